@@ -2,44 +2,536 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
 
+	authPack "user-api/internal/auth-pack"
+	"user-api/internal/gateway"
+	graphqlPack "user-api/internal/graphql-pack"
 	server "user-api/internal/grpc/user"
+	orgPack "user-api/internal/org-pack"
+	"user-api/internal/outbox"
+	"user-api/internal/reqctx"
+	scimPack "user-api/internal/scim-pack"
+	"user-api/internal/throttle"
 	userPack "user-api/internal/user-pack"
+	webhookPack "user-api/internal/webhook-pack"
+	"user-api/pkg/cache"
+	"user-api/pkg/certreload"
+	"user-api/pkg/config"
 	"user-api/pkg/db"
+	"user-api/pkg/encryption"
+	"user-api/pkg/grpcbridge"
+	"user-api/pkg/httpcache"
+	"user-api/pkg/mailer"
+	"user-api/pkg/negotiate"
+	"user-api/pkg/password"
+	"user-api/pkg/ratelimit"
+	"user-api/pkg/signedtoken"
 )
 
 func main() {
+	cfg := config.Load()
+
 	db, err := db.InitDB()
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v\n", err)
 	}
-	defer db.Close(context.Background())
+	defer db.Close()
+
+	watcher := userPack.NewUserWatcher(userPack.NewPostgresUserEventStore(db), cfg.Watch.Retention)
+	go func() {
+		if err := watcher.Run(context.Background()); err != nil {
+			log.Fatalf("failed to watch user changes: %v", err)
+		}
+	}()
+
+	webhookRepo := webhookPack.NewPostgresWebhookRepository(db)
+	webhookService := webhookPack.NewWebhookService(webhookRepo)
+	webhookHandler := webhookPack.NewWebhookHandler(webhookService)
+	dispatcher := webhookPack.NewDispatcher(webhookRepo, webhookPack.DispatcherConfig{
+		BatchSize:    cfg.Webhooks.BatchSize,
+		PollInterval: cfg.Webhooks.PollInterval,
+		Timeout:      cfg.Webhooks.Timeout,
+		MinBackoff:   cfg.Webhooks.MinBackoff,
+		MaxBackoff:   cfg.Webhooks.MaxBackoff,
+		MaxAttempts:  cfg.Webhooks.MaxAttempts,
+
+		AllowPrivateNetworks: cfg.Webhooks.AllowPrivateNetworks,
+	})
+	go dispatcher.Run(context.Background())
+
+	// Webhook deliveries are recorded idempotently, so they go first.
+	publishers := outbox.MultiPublisher{webhookPack.NewPublisher(webhookRepo)}
+	publisher, err := newPublisher(cfg.Outbox)
+	if err != nil {
+		log.Fatalf("Failed to initialize outbox publisher: %v\n", err)
+	}
+	if publisher != nil {
+		publishers = append(publishers, publisher)
+	}
+	defer publishers.Close()
+	relay := outbox.NewRelay(outbox.NewPostgresRepository(db), publishers, outbox.RelayConfig{
+		BatchSize:    cfg.Outbox.BatchSize,
+		PollInterval: cfg.Outbox.PollInterval,
+		MinBackoff:   cfg.Outbox.MinBackoff,
+		MaxBackoff:   cfg.Outbox.MaxBackoff,
+		Retention:    cfg.Outbox.Retention,
+	})
+	go relay.Run(context.Background())
+
+	hasher := password.NewHasher(password.Params{
+		Memory:      uint32(cfg.Password.Memory),
+		Iterations:  uint32(cfg.Password.Iterations),
+		Parallelism: uint8(cfg.Password.Parallelism),
+		SaltLength:  password.DefaultParams.SaltLength,
+		KeyLength:   password.DefaultParams.KeyLength,
+	})
+
+	mail, err := newMailer(cfg.Mail)
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v\n", err)
+	}
+	emailSecret := []byte(cfg.Email.TokenSecret)
+	if len(emailSecret) == 0 {
+		log.Printf("EMAIL_TOKEN_SECRET is not set, verification links will not survive a restart")
+		emailSecret = make([]byte, 32)
+		if _, err := rand.Read(emailSecret); err != nil {
+			log.Fatalf("Failed to generate email token secret: %v\n", err)
+		}
+	}
+
+	rateStore, err := newRateLimitStore(cfg.RateLimit, db)
+	if err != nil {
+		log.Fatalf("Failed to initialize rate limits: %v\n", err)
+	}
+	rateRules, err := throttle.ParseRules(cfg.RateLimit.Rules)
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMITS: %v\n", err)
+	}
+	limiter := throttle.NewLimiter(rateStore, rateRules)
+	createQuotas, err := ratelimit.ParseQuotas(cfg.RateLimit.TenantCreateQuotas)
+	if err != nil {
+		log.Fatalf("Invalid TENANT_CREATE_QUOTAS: %v\n", err)
+	}
+
+	var repo userPack.UserRepository = userPack.NewPostgresUserRepository(db)
+	userCache, err := newUserCache(cfg.UserCache)
+	if err != nil {
+		log.Fatalf("Failed to initialize user cache: %v\n", err)
+	}
+	if userCache != nil {
+		cachingRepo := userPack.NewCachingUserRepository(repo, userCache, cfg.UserCache.TTL)
+		go cachingRepo.Listen(context.Background(), db)
+		repo = cachingRepo
+	}
+	service := userPack.NewUserService(repo,
+		userPack.WithWatcher(watcher),
+		userPack.WithPasswordHasher(hasher),
+		userPack.WithEmailVerification(mail, signedtoken.NewSigner(emailSecret), userPack.EmailVerificationConfig{
+			URL: cfg.Email.VerificationURL,
+			TTL: cfg.Email.TokenTTL,
+		}),
+		userPack.WithCreateQuota(ratelimit.NewQuota(rateStore, "user creation", cfg.RateLimit.DailyCreateQuota, createQuotas)),
+	)
+	handler := userPack.NewUserHandler(service, userPack.WithHeartbeatInterval(cfg.Watch.HeartbeatInterval))
+
+	authRepo := authPack.NewPostgresAuthRepository(db)
+	keys, err := authPack.NewKeyManager(authRepo, authPack.KeyConfig{
+		Algorithm:        cfg.Tokens.SigningAlgorithm,
+		RotationInterval: cfg.Tokens.KeyRotationInterval,
+		VerifyFor:        cfg.Tokens.AccessTokenTTL,
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize signing keys: %v\n", err)
+	}
+	if err := keys.Refresh(context.Background()); err != nil {
+		log.Fatalf("Failed to load signing keys: %v\n", err)
+	}
+	go keys.Run(context.Background())
+
+	authOpts := []authPack.AuthServiceOption{
+		authPack.WithPasswordReset(mail, authPack.PasswordResetConfig{
+			URL:        cfg.PasswordReset.URL,
+			TTL:        cfg.PasswordReset.TokenTTL,
+			EmailLimit: cfg.PasswordReset.EmailLimit,
+			IPLimit:    cfg.PasswordReset.IPLimit,
+			Window:     cfg.PasswordReset.Window,
+		}),
+		authPack.WithLockout(authPack.LockoutConfig{
+			Account: authPack.LockoutPolicy{
+				Threshold:    cfg.Lockout.AccountThreshold,
+				BaseDuration: cfg.Lockout.BaseDuration,
+				MaxDuration:  cfg.Lockout.MaxDuration,
+				ResetAfter:   cfg.Lockout.ResetAfter,
+			},
+			IP: authPack.LockoutPolicy{
+				Threshold:    cfg.Lockout.IPThreshold,
+				BaseDuration: cfg.Lockout.BaseDuration,
+				MaxDuration:  cfg.Lockout.MaxDuration,
+				ResetAfter:   cfg.Lockout.ResetAfter,
+			},
+		}),
+	}
+	if cfg.MFA.EncryptionKey != "" {
+		key, err := encryption.ParseKey(cfg.MFA.EncryptionKey)
+		if err != nil {
+			log.Fatalf("Invalid MFA_ENCRYPTION_KEY: %v\n", err)
+		}
+		cipher, err := encryption.NewCipher(key)
+		if err != nil {
+			log.Fatalf("Failed to initialize MFA encryption: %v\n", err)
+		}
+		authOpts = append(authOpts, authPack.WithMFA(cipher, cfg.MFA.Issuer))
+	} else {
+		log.Printf("MFA_ENCRYPTION_KEY is not set, TOTP enrollment is disabled")
+	}
+	authService, err := authPack.NewAuthService(authRepo, service, hasher, keys, authPack.TokenConfig{
+		Issuer:          cfg.Tokens.Issuer,
+		Audience:        cfg.Tokens.Audience,
+		AccessTokenTTL:  cfg.Tokens.AccessTokenTTL,
+		RefreshTokenTTL: cfg.Tokens.RefreshTokenTTL,
+	}, authOpts...)
+	if err != nil {
+		log.Fatalf("Failed to initialize auth service: %v\n", err)
+	}
+	authHandler := authPack.NewAuthHandler(authService)
+
+	orgService := orgPack.NewOrgService(orgPack.NewPostgresOrgRepository(db))
+	orgHandler := orgPack.NewOrgHandler(orgService)
+
+	scimTokens, err := scimPack.ParseTokens(cfg.SCIM.Tokens)
+	if err != nil {
+		log.Fatalf("Invalid SCIM_TOKENS: %v\n", err)
+	}
+	if len(scimTokens) == 0 {
+		log.Printf("SCIM_TOKENS is not set, SCIM provisioning is disabled")
+	}
+	scimService := scimPack.NewScimService(service, scimPack.NewPostgresScimRepository(db))
+	scimHandler := scimPack.NewScimHandler(scimService, scimTokens)
+
+	graphqlHandler, err := graphqlPack.NewGraphQLHandler(service, orgService,
+		graphqlPack.WithLimits(cfg.GraphQL.MaxDepth, cfg.GraphQL.MaxComplexity),
+		graphqlPack.WithPersistedQueries(cfg.GraphQL.PersistedQueries),
+	)
+	if err != nil {
+		log.Fatalf("Failed to initialize GraphQL schema: %v\n", err)
+	}
+
+	certRoles, err := authPack.ParseClientCertRoles(cfg.Server.ClientCertRoles)
+	if err != nil {
+		log.Fatalf("Invalid CLIENT_CERT_ROLES: %v\n", err)
+	}
+	certAuth := authPack.NewClientCertAuth(certRoles)
+	trustedProxies, err := reqctx.ParseTrustedProxies(cfg.Server.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v\n", err)
+	}
+	metaOpts := []reqctx.Option{reqctx.WithTrustedProxies(trustedProxies)}
+	tlsConfig, err := newTLSConfig(cfg.Server)
+	if err != nil {
+		log.Fatalf("Failed to initialize TLS: %v\n", err)
+	}
+
+	// The public gRPC servers limit RPCs; REST requests are limited by
+	// route before they reach the gateway.
+	newGRPCServer := func(opts ...grpc.ServerOption) *grpc.Server {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(limiter.UnaryInterceptor),
+			grpc.ChainStreamInterceptor(limiter.StreamInterceptor),
+		)
+		return server.NewServer(service, authService, certAuth, orgService, cfg, metaOpts, opts...)
+	}
+	grpcServer := newGRPCServer()
 
-	repo := userPack.NewPostgresUserRepository(db)
-	service := userPack.NewUserService(repo)
-	handler := userPack.NewUserHandler(service)
+	// The REST gateway calls a gRPC server over a loopback listener of its
+	// own, whatever the mode of the public ones. The server takes the actor
+	// from the gateway, which proves itself with a key made up per process.
+	gatewayListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Failed to listen for the REST gateway: %v\n", err)
+	}
+	gatewayKeyBytes := make([]byte, 32)
+	if _, err := rand.Read(gatewayKeyBytes); err != nil {
+		log.Fatalf("Failed to generate the REST gateway key: %v\n", err)
+	}
+	gatewayKey := hex.EncodeToString(gatewayKeyBytes)
+	go server.NewServer(service, authService, certAuth, orgService, cfg, []reqctx.Option{reqctx.WithGatewayKey(gatewayKey)}).Serve(gatewayListener)
+	conn, err := grpc.NewClient(gatewayListener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Failed to connect the REST gateway: %v\n", err)
+	}
+	defer conn.Close()
+	gw, err := gateway.NewGateway(context.Background(), conn, gatewayKey)
+	if err != nil {
+		log.Fatalf("Failed to initialize REST gateway: %v\n", err)
+	}
+	legacyHandler := gateway.NewLegacyHandler(gw)
+
+	// Users and lists about them answer conditional requests; streams such
+	// as /users:watch must stay out of httpcache, which buffers.
+	userHTTPCache := httpcache.Middleware(cfg.HTTPCache.UserCacheControl)
+	listHTTPCache := httpcache.Middleware(cfg.HTTPCache.ListCacheControl)
+	encodings, err := negotiate.ParseEncodings(cfg.Compression.Encodings)
+	if err != nil {
+		log.Fatalf("Invalid RESPONSE_COMPRESSION: %v\n", err)
+	}
+	compress := negotiate.Compress(encodings, cfg.Compression.MinSize)
 
+	// Gin trusts X-Forwarded-For from any peer unless told otherwise; its
+	// ClientIP, which the rate limits key on, honours the same proxies as
+	// the actor headers, and none when TRUSTED_PROXIES is unset.
 	r := gin.Default()
-	r.POST("/users", handler.CreateUser)
-	r.GET("/user/:id", handler.GetUser)
-	r.PATCH("/user/:id", handler.UpdateUser)
+	var ginProxies []string
+	for _, proxy := range trustedProxies {
+		ginProxies = append(ginProxies, proxy.String())
+	}
+	if err := r.SetTrustedProxies(ginProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v\n", err)
+	}
+	r.Use(reqctx.GinMiddleware(metaOpts...), certAuth.Middleware(), authService.TenantMiddleware(), limiter.Middleware())
+	r.Any(gateway.Prefix+"/*path", gin.WrapH(gw))
+	r.GET("/openapi.json", gateway.OpenAPI)
 
-	go func() {
-		if err := r.Run(":8080"); err != nil {
-			fmt.Println("Failed to run server:", err)
+	// The users API speaks JSON, protobuf, MessagePack and CBOR, compressed
+	// as the client prefers. /users:method streams text/event-stream for
+	// :watch, which the media type check would refuse.
+	users := r.Group("", compress, negotiate.Middleware())
+	users.POST("/users", legacyHandler.CreateUser)
+	users.GET("/user/:id", userHTTPCache, legacyHandler.GetUser)
+	users.HEAD("/user/:id", userHTTPCache, legacyHandler.GetUser)
+	users.PATCH("/user/:id", legacyHandler.UpdateUser)
+	users.DELETE("/user/:id", legacyHandler.DeleteUser)
+	users.GET("/user/:id/audit", listHTTPCache, handler.ListUserAuditEvents)
+	users.HEAD("/user/:id/audit", listHTTPCache, handler.ListUserAuditEvents)
+	users.GET("/user/:id/versions", listHTTPCache, handler.ListUserVersions)
+	users.HEAD("/user/:id/versions", listHTTPCache, handler.ListUserVersions)
+	users.POST("/user/:id/versions/:version/restore", handler.RestoreUserVersion)
+	users.POST("/user/:id/email/verification", handler.SendEmailVerification)
+	users.POST("/user/:id/suspend", legacyHandler.SuspendUser)
+	users.POST("/user/:id/reactivate", legacyHandler.ReactivateUser)
+	users.POST("/user/:id/deactivate", legacyHandler.DeactivateUser)
+	r.GET("/users:method", compress, handler.CollectionMethod)
+	r.GET("/user/:id/orgs", orgHandler.ListUserOrganizations)
+
+	r.POST("/orgs", orgHandler.CreateOrganization)
+	r.GET("/orgs/:id", orgHandler.GetOrganization)
+	r.PATCH("/orgs/:id", orgHandler.UpdateOrganization)
+	r.DELETE("/orgs/:id", orgHandler.DeleteOrganization)
+	r.GET("/orgs/:id/members", orgHandler.ListMembers)
+	r.PUT("/orgs/:id/members/:userId", orgHandler.SetMember)
+	r.DELETE("/orgs/:id/members/:userId", orgHandler.RemoveMember)
+	r.POST("/orgs/:id/teams", orgHandler.CreateTeam)
+	r.GET("/orgs/:id/teams", orgHandler.ListTeams)
+	r.GET("/orgs/:id/teams/:teamId", orgHandler.GetTeam)
+	r.PATCH("/orgs/:id/teams/:teamId", orgHandler.UpdateTeam)
+	r.DELETE("/orgs/:id/teams/:teamId", orgHandler.DeleteTeam)
+	r.GET("/orgs/:id/teams/:teamId/members", orgHandler.ListTeamMembers)
+	r.PUT("/orgs/:id/teams/:teamId/members/:userId", orgHandler.SetTeamMember)
+	r.DELETE("/orgs/:id/teams/:teamId/members/:userId", orgHandler.RemoveTeamMember)
+
+	r.POST("/auth/login", authHandler.Login)
+	r.POST("/auth/login/mfa", authHandler.VerifyMFA)
+	r.POST("/auth/mfa/totp", authHandler.EnrollTOTP)
+	r.POST("/auth/mfa/totp/confirm", authHandler.ConfirmTOTP)
+	r.DELETE("/admin/users/:id/mfa", authHandler.ResetMFA)
+	r.GET("/admin/lockouts", authHandler.ListLockouts)
+	r.DELETE("/admin/users/:id/lockout", authHandler.UnlockUser)
+	r.DELETE("/admin/lockouts/ip/:ip", authHandler.UnlockIP)
+	r.POST("/auth/refresh", authHandler.Refresh)
+	r.POST("/auth/logout", authHandler.Logout)
+	r.POST("/auth/revoke", authHandler.Revoke)
+	r.POST("/auth/password-reset", authHandler.RequestPasswordReset)
+	r.POST("/auth/password-reset/confirm", authHandler.ResetPassword)
+	r.GET("/.well-known/jwks.json", authHandler.JWKS)
+
+	// Subscriptions receive the events of the tenant of the token.
+	webhooks := r.Group("/webhooks", authHandler.RequireAdmin("Only admins can manage webhooks"))
+	webhooks.POST("", webhookHandler.CreateSubscription)
+	webhooks.GET("", webhookHandler.ListSubscriptions)
+	webhooks.GET("/:id", webhookHandler.GetSubscription)
+	webhooks.PATCH("/:id", webhookHandler.UpdateSubscription)
+	webhooks.DELETE("/:id", webhookHandler.DeleteSubscription)
+	webhooks.GET("/:id/deliveries", webhookHandler.ListDeliveries)
+	webhooks.POST("/:id/deliveries/:deliveryId/replay", webhookHandler.ReplayDelivery)
+
+	r.POST(graphqlPack.Path, graphqlHandler.Serve)
+	r.GET(graphqlPack.Path, graphqlHandler.Serve)
+	r.GET(graphqlPack.Path+"/schema.graphql", graphqlHandler.Schema)
+
+	scim := r.Group(scimPack.BasePath, scimHandler.Authenticate())
+	scim.GET("/ServiceProviderConfig", scimHandler.ServiceProviderConfig)
+	scim.GET("/Schemas", scimHandler.ListSchemas)
+	scim.GET("/Schemas/:id", scimHandler.GetSchema)
+	scim.GET("/ResourceTypes", scimHandler.ListResourceTypes)
+	scim.GET("/ResourceTypes/:id", scimHandler.GetResourceType)
+	scim.POST("/Users", scimHandler.CreateUser)
+	scim.GET("/Users", scimHandler.ListUsers)
+	scim.GET("/Users/:id", scimHandler.GetUser)
+	scim.PUT("/Users/:id", scimHandler.ReplaceUser)
+	scim.PATCH("/Users/:id", scimHandler.PatchUser)
+	scim.DELETE("/Users/:id", scimHandler.DeleteUser)
+	scim.POST("/Groups", scimHandler.CreateGroup)
+	scim.GET("/Groups", scimHandler.ListGroups)
+	scim.GET("/Groups/:id", scimHandler.GetGroup)
+	scim.PUT("/Groups/:id", scimHandler.ReplaceGroup)
+	scim.PATCH("/Groups/:id", scimHandler.PatchGroup)
+	scim.DELETE("/Groups/:id", scimHandler.DeleteGroup)
+
+	if err := serve(cfg.Server, tlsConfig, grpcServer, newGRPCServer, r); err != nil {
+		log.Fatalf("Failed to run server: %v\n", err)
+	}
+}
+
+// newTLSConfig returns the TLS configuration of the public listeners, nil
+// if TLS is off. The certificates are reloaded in the background.
+func newTLSConfig(cfg config.ServerConfig) (*tls.Config, error) {
+	var clientAuth tls.ClientAuthType
+	switch cfg.TLSClientAuth {
+	case "none":
+		clientAuth = tls.NoClientCert
+	case "optional":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown TLS client auth %q", cfg.TLSClientAuth)
+	}
+	if cfg.TLSCertFile == "" {
+		if clientAuth != tls.NoClientCert {
+			return nil, fmt.Errorf("TLS_CLIENT_AUTH needs TLS_CERT_FILE and TLS_KEY_FILE")
 		}
-	}()
+		return nil, nil
+	}
+	if clientAuth != tls.NoClientCert && cfg.TLSClientCAFile == "" {
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH needs TLS_CLIENT_CA_FILE")
+	}
 
-	go func() {
-		if err := server.StartGRPCServer(service, ":50051"); err != nil {
-			log.Fatalf("failed to start gRPC server: %v", err)
+	reloader, err := certreload.New(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.Run(context.Background(), cfg.TLSReloadInterval)
+	return reloader.TLSConfig(clientAuth), nil
+}
+
+// serve runs the public listeners of cfg.Mode. REST, gRPC-Web and Connect
+// share Addr in both modes; native gRPC joins them in single mode and gets
+// a server of its own from newGRPCServer in dual mode.
+func serve(cfg config.ServerConfig, tlsConfig *tls.Config, grpcServer *grpc.Server, newGRPCServer func(...grpc.ServerOption) *grpc.Server, router http.Handler) error {
+	bridge := grpcbridge.New(grpcServer,
+		grpcbridge.WithAllowedOrigins(strings.Split(cfg.AllowedOrigins, ",")...),
+		grpcbridge.WithExposedHeaders(reqctx.RequestIDHeader),
+	)
+	handler := bridge.Handler(router)
+
+	switch cfg.Mode {
+	case "single":
+		// h2c lets gRPC clients use HTTP/2 without TLS on the port that
+		// HTTP/1.1 clients use too.
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	case "dual":
+		var opts []grpc.ServerOption
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
 		}
-		log.Printf("gRPC server is running on port %s", ":50051")
-	}()
+		publicServer := newGRPCServer(opts...)
+		go func() {
+			if err := server.StartGRPCServer(publicServer, cfg.GRPCAddr); err != nil {
+				log.Fatalf("failed to start gRPC server: %v", err)
+			}
+		}()
+	default:
+		return fmt.Errorf("unknown server mode %q", cfg.Mode)
+	}
+
+	srv := &http.Server{Addr: cfg.Addr, Handler: handler, TLSConfig: tlsConfig}
+	log.Printf("Server is running on %s in %s mode", cfg.Addr, cfg.Mode)
+	if tlsConfig != nil {
+		// The certificate comes from tlsConfig.GetCertificate.
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
 
-	select {}
+func newRateLimitStore(cfg config.RateLimitConfig, db *pgxpool.Pool) (ratelimit.Backend, error) {
+	switch cfg.Backend {
+	case "memory":
+		return ratelimit.NewMemoryStore(), nil
+	case "postgres":
+		store := ratelimit.NewPostgresStore(db)
+		go store.Run(context.Background(), time.Minute)
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit backend %q", cfg.Backend)
+	}
+}
+
+func newUserCache(cfg config.UserCacheConfig) (cache.Cache, error) {
+	switch cfg.Backend {
+	case "none":
+		return nil, nil
+	case "memory":
+		return cache.NewLRU(cfg.Size), nil
+	case "redis":
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		return cache.NewRedis(redis.NewClient(opts), "user-api:"), nil
+	default:
+		return nil, fmt.Errorf("unknown user cache %q", cfg.Backend)
+	}
+}
+
+func newMailer(cfg config.MailConfig) (mailer.Mailer, error) {
+	switch cfg.Mailer {
+	case "log":
+		return mailer.LogMailer{}, nil
+	case "file":
+		return mailer.NewFileMailer(cfg.File, cfg.From)
+	case "smtp":
+		return mailer.NewSMTPMailer(mailer.SMTPConfig{
+			Addr:     cfg.SMTPAddr,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.From,
+			Timeout:  cfg.Timeout,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", cfg.Mailer)
+	}
+}
+
+func newPublisher(cfg config.OutboxConfig) (outbox.Publisher, error) {
+	switch cfg.Publisher {
+	case "", "none":
+		return nil, nil
+	case "stdout":
+		return outbox.NewFilePublisher("-")
+	case "file":
+		return outbox.NewFilePublisher(cfg.File)
+	case "nats":
+		return outbox.NewNATSPublisher(cfg.NATSURL, cfg.NATSSubjectPrefix)
+	case "kafka":
+		return outbox.NewKafkaPublisher(cfg.KafkaBrokers, cfg.KafkaTopic), nil
+	default:
+		return nil, fmt.Errorf("unknown outbox publisher %q", cfg.Publisher)
+	}
 }
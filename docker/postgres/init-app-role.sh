@@ -0,0 +1,16 @@
+#!/bin/sh
+# Creates the role the service connects as. It is neither a superuser nor
+# BYPASSRLS and owns no tables, so the row-level security policies apply to
+# it. The tables are created by POSTGRES_USER, which runs the migrations;
+# the default privileges give the service access to each of them.
+set -e
+
+psql -v ON_ERROR_STOP=1 --username "$POSTGRES_USER" --dbname "$POSTGRES_DB" \
+	-v owner="$POSTGRES_USER" -v app_user="$APP_DB_USER" -v app_password="$APP_DB_PASSWORD" <<'EOSQL'
+CREATE ROLE :"app_user" LOGIN NOSUPERUSER NOBYPASSRLS NOCREATEDB NOCREATEROLE PASSWORD :'app_password';
+GRANT USAGE ON SCHEMA public TO :"app_user";
+ALTER DEFAULT PRIVILEGES FOR ROLE :"owner" IN SCHEMA public
+	GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO :"app_user";
+ALTER DEFAULT PRIVILEGES FOR ROLE :"owner" IN SCHEMA public
+	GRANT USAGE, SELECT ON SEQUENCES TO :"app_user";
+EOSQL
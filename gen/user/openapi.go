@@ -0,0 +1,9 @@
+package userpb
+
+import _ "embed"
+
+// OpenAPI is the OpenAPI document protoc-gen-openapiv2 generates from the
+// google.api.http annotations of user.proto.
+//
+//go:embed user.swagger.json
+var OpenAPI []byte
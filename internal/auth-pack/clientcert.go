@@ -0,0 +1,109 @@
+package authPack
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+
+	"user-api/internal/reqctx"
+)
+
+// ClientCertAuth makes the identity of a verified client certificate the
+// actor of a request, with the roles configured for that principal. The
+// X-Actor and X-Actor-Roles headers are ignored for such requests; requests
+// without a certificate use them only when a trusted proxy sent them.
+type ClientCertAuth struct {
+	roles map[string][]string
+}
+
+func NewClientCertAuth(roles map[string][]string) *ClientCertAuth {
+	return &ClientCertAuth{roles: roles}
+}
+
+// ParseClientCertRoles parses a comma separated list of principal=roles
+// pairs, the roles separated by "|".
+func ParseClientCertRoles(s string) (map[string][]string, error) {
+	roles := make(map[string][]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		principal, list, ok := strings.Cut(pair, "=")
+		if !ok || principal == "" || list == "" {
+			return nil, fmt.Errorf("client certificate role %q is not principal=roles", pair)
+		}
+		for _, role := range strings.Split(list, "|") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles[principal] = append(roles[principal], role)
+			}
+		}
+	}
+	return roles, nil
+}
+
+// CertPrincipal names the subject of a client certificate: its first URI
+// SAN (such as a SPIFFE ID), else its first DNS or email SAN, else its
+// common name.
+func CertPrincipal(cert *x509.Certificate) string {
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
+
+func (a *ClientCertAuth) withPrincipal(ctx context.Context, state *tls.ConnectionState) context.Context {
+	// Only certificates that were verified against the CA bundle count.
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ctx
+	}
+	principal := CertPrincipal(state.VerifiedChains[0][0])
+	if principal == "" {
+		return ctx
+	}
+	return reqctx.WithActor(ctx, principal, a.roles[principal])
+}
+
+// Middleware sets the actor of REST requests. It has to run after
+// reqctx.GinMiddleware.
+func (a *ClientCertAuth) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Request = ctx.Request.WithContext(a.withPrincipal(ctx.Request.Context(), ctx.Request.TLS))
+		ctx.Next()
+	}
+}
+
+func (a *ClientCertAuth) grpcPrincipal(ctx context.Context) context.Context {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ctx
+	}
+	return a.withPrincipal(ctx, &info.State)
+}
+
+// UnaryInterceptor sets the actor of unary RPCs. It has to be chained
+// after reqctx.UnaryServerInterceptor.
+func (a *ClientCertAuth) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(a.grpcPrincipal(ctx), req)
+}
+
+// StreamInterceptor sets the actor of streaming RPCs. It has to be chained
+// after reqctx.StreamServerInterceptor.
+func (a *ClientCertAuth) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &contextStream{ServerStream: ss, ctx: a.grpcPrincipal(ss.Context())})
+}
@@ -0,0 +1,453 @@
+package authPack
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+)
+
+type AuthHandler struct {
+	service *AuthService
+}
+
+func NewAuthHandler(service *AuthService) *AuthHandler {
+	return &AuthHandler{service: service}
+}
+
+func (c *AuthHandler) Login(ctx *gin.Context) {
+	var req LoginRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Email == "" || req.Password == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "email and password are required"})
+		return
+	}
+
+	result, err := c.service.Login(ctx.Request.Context(), req.Email, req.Password, ctx.ClientIP())
+	if err != nil {
+		if respondLockout(ctx, err) {
+			return
+		}
+		if errors.Is(err, ErrInvalidCredentials) {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+			return
+		}
+		if errors.Is(err, ErrAccountDisabled) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondLogin(ctx, result)
+}
+
+// VerifyMFA completes a login with the mfa_token it returned and either a
+// TOTP code or a recovery code.
+func (c *AuthHandler) VerifyMFA(ctx *gin.Context) {
+	var req MFARequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MFAToken == "" || (req.Code == "") == (req.RecoveryCode == "") {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "mfa_token and either code or recovery_code are required"})
+		return
+	}
+
+	result, err := c.service.VerifyMFA(ctx.Request.Context(), req.MFAToken, req.Code, req.RecoveryCode, ctx.ClientIP())
+	if err != nil {
+		if respondLockout(ctx, err) {
+			return
+		}
+		if errors.Is(err, ErrInvalidMFAToken) || errors.Is(err, ErrInvalidMFACode) {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, ErrAccountDisabled) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, ErrMFAUnavailable) {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondLogin(ctx, result)
+}
+
+func respondLogin(ctx *gin.Context, result *LoginResult) {
+	ctx.Header("Cache-Control", "no-store")
+	if result.MFAToken != "" {
+		ctx.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": result.MFAToken})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"user":          result.User,
+		"access_token":  result.Tokens.AccessToken,
+		"token_type":    result.Tokens.TokenType,
+		"expires_in":    result.Tokens.ExpiresIn,
+		"refresh_token": result.Tokens.RefreshToken,
+	})
+}
+
+// respondLockout answers a locked out login with 429 and a Retry-After
+// header. It returns false if err is not a LockoutError.
+func respondLockout(ctx *gin.Context, err error) bool {
+	var lockout *LockoutError
+	if !errors.As(err, &lockout) {
+		return false
+	}
+	retryAfter := int(math.Ceil(time.Until(lockout.Until).Seconds()))
+	ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+	ctx.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "locked_until": lockout.Until})
+	return true
+}
+
+func (c *AuthHandler) Refresh(ctx *gin.Context) {
+	var req RefreshRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
+		return
+	}
+
+	tokens, err := c.service.Refresh(ctx.Request.Context(), req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenInvalid) || errors.Is(err, ErrRefreshTokenReused) {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+		if errors.Is(err, ErrAccountDisabled) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, tokens)
+}
+
+// Logout ends the session of a refresh token. Like token revocation in
+// RFC 7009 it succeeds for unknown tokens too.
+func (c *AuthHandler) Logout(ctx *gin.Context) {
+	var req RefreshRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
+		return
+	}
+
+	if err := c.service.Logout(ctx.Request.Context(), req.RefreshToken); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// Revoke signs the caller out everywhere. Admins may pass user_id to do the
+// same for another user.
+func (c *AuthHandler) Revoke(ctx *gin.Context) {
+	claims, ok := c.verify(ctx)
+	if !ok {
+		return
+	}
+	userID, _ := strconv.Atoi(claims.Subject)
+
+	var req RevokeRequest
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.UserID != 0 && req.UserID != userID {
+		if !claims.HasRole(reqctx.RoleAdmin) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "Only admins can revoke tokens of other users"})
+			return
+		}
+		userID = req.UserID
+	}
+
+	revoked, err := c.service.RevokeUserTokens(ctx.Request.Context(), userID)
+	if err != nil {
+		if errors.Is(err, userPack.ErrUserNotFound) || errors.Is(err, pgx.ErrNoRows) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
+
+// RequestPasswordReset mails a reset link. The response is the same whether
+// or not the email is registered.
+func (c *AuthHandler) RequestPasswordReset(ctx *gin.Context) {
+	var req PasswordResetRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.Email == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "email is required"})
+		return
+	}
+
+	if err := c.service.RequestPasswordReset(ctx.Request.Context(), req.Email, ctx.ClientIP()); err != nil {
+		switch {
+		case errors.Is(err, ErrTooManyRequests):
+			ctx.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrPasswordResetUnavailable):
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusAccepted, gin.H{"message": "If the email is registered, a password reset link has been sent"})
+}
+
+// ResetPassword sets a new password with the token from a reset mail.
+func (c *AuthHandler) ResetPassword(ctx *gin.Context) {
+	var req PasswordResetConfirmRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.Token == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "token and password are required"})
+		return
+	}
+	if err := userPack.ValidatePassword(req.Password); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.service.ResetPassword(ctx.Request.Context(), req.Token, req.Password); err != nil {
+		if errors.Is(err, ErrResetTokenInvalid) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Password changed, all sessions have been signed out"})
+}
+
+// EnrollTOTP starts TOTP enrollment for the bearer. The response carries the
+// secret, the otpauth URI and a QR code of it; clients sending
+// "Accept: image/png" get the QR code alone.
+func (c *AuthHandler) EnrollTOTP(ctx *gin.Context) {
+	userID, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+
+	enrollment, err := c.service.EnrollTOTP(ctx.Request.Context(), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrMFAAlreadyEnabled):
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrMFAUnavailable):
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	if strings.Contains(ctx.GetHeader("Accept"), "image/png") {
+		ctx.Data(http.StatusOK, "image/png", enrollment.QRCode)
+		return
+	}
+	ctx.JSON(http.StatusOK, enrollment)
+}
+
+// ConfirmTOTP enables MFA with a first code and returns the recovery codes.
+func (c *AuthHandler) ConfirmTOTP(ctx *gin.Context) {
+	userID, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+	var req TOTPCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+		return
+	}
+
+	codes, err := c.service.ConfirmTOTP(ctx.Request.Context(), userID, req.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidMFACode):
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrMFANotEnrolled), errors.Is(err, ErrMFAAlreadyEnabled):
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrMFAUnavailable):
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// ResetMFA lets an admin remove the second factor of a user who lost it.
+func (c *AuthHandler) ResetMFA(ctx *gin.Context) {
+	if !c.requireAdmin(ctx, "Only admins can reset MFA") {
+		return
+	}
+	userID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := c.service.ResetMFA(ctx.Request.Context(), userID); err != nil {
+		switch {
+		case errors.Is(err, ErrMFANotEnrolled), errors.Is(err, userPack.ErrUserNotFound), errors.Is(err, pgx.ErrNoRows):
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// ListLockouts shows the accounts and IPs that are locked out (admin).
+func (c *AuthHandler) ListLockouts(ctx *gin.Context) {
+	if !c.requireAdmin(ctx, "Only admins can list lockouts") {
+		return
+	}
+
+	lockouts, err := c.service.ListLockouts(ctx.Request.Context())
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if lockouts == nil {
+		lockouts = []*Lockout{}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"lockouts": lockouts})
+}
+
+// UnlockUser clears the failed login counter of a user (admin).
+func (c *AuthHandler) UnlockUser(ctx *gin.Context) {
+	if !c.requireAdmin(ctx, "Only admins can unlock users") {
+		return
+	}
+	userID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := c.service.UnlockUser(ctx.Request.Context(), userID); err != nil {
+		switch {
+		case errors.Is(err, ErrNotLockedOut), errors.Is(err, userPack.ErrUserNotFound), errors.Is(err, pgx.ErrNoRows):
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// UnlockIP clears the failed login counter of a client IP (admin).
+func (c *AuthHandler) UnlockIP(ctx *gin.Context) {
+	if !c.requireAdmin(ctx, "Only admins can unlock IPs") {
+		return
+	}
+	ip := net.ParseIP(ctx.Param("ip"))
+	if ip == nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid IP address"})
+		return
+	}
+
+	if err := c.service.UnlockIP(ctx.Request.Context(), ip.String()); err != nil {
+		if errors.Is(err, ErrNotLockedOut) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// authenticate returns the user id of the bearer access token, responding
+// with 401 if there is no valid one.
+func (c *AuthHandler) authenticate(ctx *gin.Context) (int, bool) {
+	claims, ok := c.verify(ctx)
+	if !ok {
+		return 0, false
+	}
+	userID, _ := strconv.Atoi(claims.Subject)
+	return userID, true
+}
+
+// verify returns the claims of the bearer access token, responding with
+// 401 if there is no valid one.
+func (c *AuthHandler) verify(ctx *gin.Context) (*AccessClaims, bool) {
+	claims, err := c.service.VerifyAccessToken(BearerToken(ctx.GetHeader("Authorization")))
+	if err != nil {
+		ctx.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid access token"})
+		return nil, false
+	}
+	return claims, true
+}
+
+// requireAdmin lets requests through whose access token carries the admin
+// role, responding with 401 without a valid token and with 403 and denied
+// otherwise.
+func (c *AuthHandler) requireAdmin(ctx *gin.Context, denied string) bool {
+	claims, ok := c.verify(ctx)
+	if !ok {
+		return false
+	}
+	if !claims.HasRole(reqctx.RoleAdmin) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": denied})
+		return false
+	}
+	return true
+}
+
+// RequireAdmin guards routes of other packages like requireAdmin guards the
+// admin endpoints here.
+func (c *AuthHandler) RequireAdmin(denied string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !c.requireAdmin(ctx, denied) {
+			ctx.Abort()
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func (c *AuthHandler) JWKS(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(http.StatusOK, c.service.JWKS())
+}
+
+// BearerToken extracts the token from an Authorization header value, or
+// returns "" if it is not a bearer credential.
+func BearerToken(header string) string {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
@@ -0,0 +1,275 @@
+package authPack
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmRS256 = "RS256"
+)
+
+// SigningKey is a JWT signing key as stored in the database. PrivateKey is
+// PKCS #8 DER.
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey []byte
+	Created    time.Time
+}
+
+type KeyStore interface {
+	ListSigningKeys(ctx context.Context, since time.Time) ([]*SigningKey, error)
+	CreateSigningKey(ctx context.Context, key *SigningKey) error
+	DeleteSigningKeys(ctx context.Context, before time.Time) error
+}
+
+type KeyConfig struct {
+	// Algorithm of newly generated keys, AlgorithmEdDSA or AlgorithmRS256.
+	Algorithm string
+	// RotationInterval is how long a key signs tokens before it is replaced.
+	RotationInterval time.Duration
+	// VerifyFor is how long a replaced key is still published, which must
+	// cover the lifetime of the tokens it signed.
+	VerifyFor time.Duration
+}
+
+type loadedKey struct {
+	id      string
+	alg     string
+	signer  crypto.Signer
+	created time.Time
+}
+
+// KeyManager keeps the signing keys shared by all replicas in the database
+// and rotates them. The newest key signs; every key that may still have
+// valid tokens is published in the JWKS.
+type KeyManager struct {
+	store KeyStore
+	cfg   KeyConfig
+
+	mu   sync.RWMutex
+	keys []*loadedKey // oldest first
+}
+
+func NewKeyManager(store KeyStore, cfg KeyConfig) (*KeyManager, error) {
+	if cfg.Algorithm != AlgorithmEdDSA && cfg.Algorithm != AlgorithmRS256 {
+		return nil, fmt.Errorf("NewKeyManager: unsupported signing algorithm %q", cfg.Algorithm)
+	}
+	return &KeyManager{store: store, cfg: cfg}, nil
+}
+
+// Run refreshes and rotates the keys until ctx is cancelled.
+func (m *KeyManager) Run(ctx context.Context) {
+	interval := m.cfg.RotationInterval / 10
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := m.Refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("KeyManager: %v", err)
+		}
+	}
+}
+
+// Refresh reloads the keys and generates a new one when the newest is due
+// for rotation. Replicas racing to rotate each add a key, which is harmless:
+// all of them are published and the newest signs.
+func (m *KeyManager) Refresh(ctx context.Context) error {
+	now := time.Now()
+	cutoff := now.Add(-m.cfg.RotationInterval - m.cfg.VerifyFor)
+	stored, err := m.store.ListSigningKeys(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]*loadedKey, 0, len(stored)+1)
+	for _, key := range stored {
+		loaded, err := loadKey(key)
+		if err != nil {
+			log.Printf("KeyManager: skipping signing key %s: %v", key.ID, err)
+			continue
+		}
+		keys = append(keys, loaded)
+	}
+
+	if len(keys) == 0 || now.Sub(keys[len(keys)-1].created) >= m.cfg.RotationInterval {
+		key, err := generateKey(m.cfg.Algorithm)
+		if err != nil {
+			return err
+		}
+		if err := m.store.CreateSigningKey(ctx, key); err != nil {
+			return err
+		}
+		loaded, err := loadKey(key)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, loaded)
+		log.Printf("KeyManager: rotated to signing key %s (%s)", key.ID, key.Algorithm)
+	}
+
+	if err := m.store.DeleteSigningKeys(ctx, cutoff); err != nil {
+		log.Printf("KeyManager: %v", err)
+	}
+
+	m.mu.Lock()
+	m.keys = keys
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *KeyManager) current() (*loadedKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.keys) == 0 {
+		return nil, fmt.Errorf("no signing key loaded")
+	}
+	return m.keys[len(m.keys)-1], nil
+}
+
+func (m *KeyManager) find(id string) *loadedKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, key := range m.keys {
+		if key.id == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// Sign signs claims with the current key.
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	key, err := m.current()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.alg), claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.signer)
+}
+
+// Keyfunc resolves the verification key of a token by its kid header.
+func (m *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	id, _ := token.Header["kid"].(string)
+	key := m.find(id)
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key %q", id)
+	}
+	if token.Method.Alg() != key.alg {
+		return nil, fmt.Errorf("signing key %q is not an %s key", id, token.Method.Alg())
+	}
+	return key.signer.Public(), nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517, RFC 8037).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public halves of all published keys, newest first.
+func (m *KeyManager) JWKS() JWKS {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	set := JWKS{Keys: make([]JWK, 0, len(m.keys))}
+	for i := len(m.keys) - 1; i >= 0; i-- {
+		key := m.keys[i]
+		jwk := JWK{KeyID: key.id, Use: "sig", Algorithm: key.alg}
+		switch pub := key.signer.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType, jwk.Curve, jwk.X = "OKP", "Ed25519", base64.RawURLEncoding.EncodeToString(pub)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+func generateKey(alg string) (*SigningKey, error) {
+	var priv interface{}
+	var err error
+	switch alg {
+	case AlgorithmEdDSA:
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case AlgorithmRS256:
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate %s key: %w", alg, err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s key: %w", alg, err)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate key id: %w", err)
+	}
+	return &SigningKey{ID: hex.EncodeToString(id), Algorithm: alg, PrivateKey: der, Created: time.Now()}, nil
+}
+
+func loadKey(key *SigningKey) (*loadedKey, error) {
+	priv, err := x509.ParsePKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key of type %T cannot sign", priv)
+	}
+	switch signer.(type) {
+	case ed25519.PrivateKey:
+		if key.Algorithm != AlgorithmEdDSA {
+			return nil, fmt.Errorf("Ed25519 key stored as %s", key.Algorithm)
+		}
+	case *rsa.PrivateKey:
+		if key.Algorithm != AlgorithmRS256 {
+			return nil, fmt.Errorf("RSA key stored as %s", key.Algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", priv)
+	}
+	return &loadedKey{id: key.ID, alg: key.Algorithm, signer: signer, created: key.Created}, nil
+}
@@ -0,0 +1,261 @@
+package authPack
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/skip2/go-qrcode"
+
+	"user-api/pkg/totp"
+)
+
+const (
+	mfaTokenTTL       = 5 * time.Minute
+	recoveryCodeCount = 10
+	// totpSkew accepts codes from one period before and after the current
+	// one to allow for clock drift.
+	totpSkew = 1
+)
+
+var (
+	ErrMFAUnavailable   = errors.New("MFA is not configured on this server")
+	ErrInvalidMFACode   = errors.New("invalid MFA code")
+	ErrInvalidMFAToken  = errors.New("invalid or expired MFA token")
+	recoveryCodeEncoder = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// mfaAudience keeps MFA tokens from being accepted as access tokens.
+func (s *AuthService) mfaAudience() string {
+	return s.cfg.Audience + "#mfa"
+}
+
+func (s *AuthService) mfaEnabled(ctx context.Context, userID int) (bool, error) {
+	secret, err := s.repo.GetTOTPSecret(ctx, userID)
+	if errors.Is(err, ErrMFANotEnrolled) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return secret.Confirmed, nil
+}
+
+func (s *AuthService) signMFAToken(userID int) (string, error) {
+	now := time.Now()
+	token, err := s.keys.Sign(&jwt.RegisteredClaims{
+		Issuer:    s.cfg.Issuer,
+		Subject:   strconv.Itoa(userID),
+		Audience:  jwt.ClaimStrings{s.mfaAudience()},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenTTL)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign MFA token: %w", err)
+	}
+	return token, nil
+}
+
+// VerifyMFA completes a login that returned an MFAToken, with either a TOTP
+// code or an unused recovery code. Wrong codes count as failed logins of the
+// account and ip.
+func (s *AuthService) VerifyMFA(ctx context.Context, mfaToken, code, recoveryCode, ip string) (*LoginResult, error) {
+	var claims jwt.RegisteredClaims
+	_, err := jwt.ParseWithClaims(mfaToken, &claims, s.keys.Keyfunc,
+		jwt.WithValidMethods([]string{AlgorithmEdDSA, AlgorithmRS256}),
+		jwt.WithIssuer(s.cfg.Issuer),
+		jwt.WithAudience(s.mfaAudience()),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, ErrInvalidMFAToken
+	}
+
+	var email string
+	if s.lockout != nil {
+		user, err := s.users.GetUser(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		email = user.Email
+		if err := s.checkLockout(ctx, email, ip); err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.verifySecondFactor(ctx, userID, code, recoveryCode)
+	if errors.Is(err, ErrInvalidMFACode) {
+		s.loginFailed(ctx, email, ip, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.loginSucceeded(ctx, email)
+	return s.completeLogin(ctx, userID)
+}
+
+func (s *AuthService) verifySecondFactor(ctx context.Context, userID int, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		ok, err := s.repo.UseRecoveryCode(ctx, userID, hashRecoveryCode(recoveryCode))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrInvalidMFACode
+		}
+		return nil
+	}
+
+	secret, err := s.repo.GetTOTPSecret(ctx, userID)
+	if errors.Is(err, ErrMFANotEnrolled) {
+		return ErrInvalidMFAToken
+	}
+	if err != nil {
+		return err
+	}
+	if !secret.Confirmed {
+		return ErrInvalidMFAToken
+	}
+	counter, err := s.checkTOTP(secret, code)
+	if err != nil {
+		return err
+	}
+	ok, err := s.repo.UseTOTPCounter(ctx, userID, counter)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// EnrollTOTP generates a new secret for the user. It stays pending until
+// ConfirmTOTP is called with a code from it, so a user who abandons
+// enrollment is not locked out.
+func (s *AuthService) EnrollTOTP(ctx context.Context, userID int) (*TOTPEnrollment, error) {
+	if s.mfaCipher == nil {
+		return nil, ErrMFAUnavailable
+	}
+	user, err := s.users.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := s.mfaCipher.Encrypt(secret, mfaAssociatedData(userID))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SaveTOTPSecret(ctx, userID, encrypted); err != nil {
+		return nil, err
+	}
+
+	uri := totp.URI(s.mfaIssuer, user.Email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render QR code: %w", err)
+	}
+	return &TOTPEnrollment{Secret: totp.EncodeSecret(secret), URI: uri, QRCode: png}, nil
+}
+
+// ConfirmTOTP enables a pending enrollment and returns a fresh set of
+// recovery codes. Only their hashes are stored, so they cannot be shown
+// again.
+func (s *AuthService) ConfirmTOTP(ctx context.Context, userID int, code string) ([]string, error) {
+	secret, err := s.repo.GetTOTPSecret(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if secret.Confirmed {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	counter, err := s.checkTOTP(secret, code)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			return nil, err
+		}
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	if err := s.repo.ConfirmTOTP(ctx, userID, counter, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// ResetMFA removes a user's second factor so they can enroll again. It also
+// signs the user out everywhere, as the reset usually follows a lost device.
+// Users of other tenants are not found.
+func (s *AuthService) ResetMFA(ctx context.Context, userID int) error {
+	user, err := s.users.GetUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	found, err := s.repo.DeleteMFA(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrMFANotEnrolled
+	}
+	_, err = s.repo.RevokeUserRefreshTokens(ctx, user.ID)
+	return err
+}
+
+func (s *AuthService) checkTOTP(secret *TOTPSecret, code string) (int64, error) {
+	if s.mfaCipher == nil {
+		return 0, ErrMFAUnavailable
+	}
+	key, err := s.mfaCipher.Decrypt(secret.Secret, mfaAssociatedData(secret.UserID))
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrypt TOTP secret of user %d: %w", secret.UserID, err)
+	}
+	counter, ok := totp.Validate(key, strings.TrimSpace(code), time.Now(), totpSkew)
+	if !ok || counter <= secret.LastCounter {
+		return 0, ErrInvalidMFACode
+	}
+	return counter, nil
+}
+
+// mfaAssociatedData binds an encrypted secret to its user.
+func mfaAssociatedData(userID int) []byte {
+	return []byte("mfa_totp:" + strconv.Itoa(userID))
+}
+
+// newRecoveryCode returns 80 random bits formatted as XXXX-XXXX-XXXX-XXXX.
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate recovery code: %w", err)
+	}
+	code := recoveryCodeEncoder.EncodeToString(b)
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16], nil
+}
+
+// hashRecoveryCode ignores case and dashes, so codes can be typed loosely.
+// The codes carry 80 bits of entropy, which makes a plain SHA-256 enough.
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return sum[:]
+}
@@ -0,0 +1,114 @@
+package authPack
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	userPack "user-api/internal/user-pack"
+)
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// Credentials is what login needs to know about a user. It never leaves the
+// package.
+type Credentials struct {
+	UserID       int
+	PasswordHash string
+}
+
+// RefreshToken is a stored refresh token. Only the SHA-256 of the token is
+// kept. All tokens issued from one login share a FamilyID, so a replayed
+// token can revoke everything derived from the same session.
+type RefreshToken struct {
+	ID        int64
+	TokenHash []byte
+	UserID    int
+	FamilyID  string
+	TenantID  string
+	ExpiresAt time.Time
+}
+
+// TokenPair is returned by login and refresh. The JSON follows the OAuth 2.0
+// token response (RFC 6749, section 5.1).
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// AccessClaims are the claims of an access token. Subject is the user id,
+// SessionID the refresh token family the token was issued from, TenantID
+// the tenant of the user and Roles the roles the user had when the token
+// was issued.
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	SessionID string   `json:"sid,omitempty"`
+	TenantID  string   `json:"tid,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+func (c *AccessClaims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RevokeRequest struct {
+	UserID int `json:"user_id"`
+}
+
+// TOTPSecret is a user's TOTP enrollment. Secret is encrypted; the
+// enrollment only counts once it is confirmed with a first code.
+type TOTPSecret struct {
+	UserID      int
+	Secret      []byte
+	LastCounter int64
+	Confirmed   bool
+}
+
+// LoginResult is the outcome of a login step. Users with MFA get an
+// MFAToken instead of Tokens and have to complete the TOTP step with it.
+type LoginResult struct {
+	User     *userPack.User
+	Tokens   *TokenPair
+	MFAToken string
+}
+
+// TOTPEnrollment is returned once when enrollment starts. QRCode is a PNG
+// of URI.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+	QRCode []byte `json:"qr_code_png"`
+}
+
+type MFARequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
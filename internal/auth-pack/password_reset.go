@@ -0,0 +1,131 @@
+package authPack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"user-api/internal/reqctx"
+	"user-api/pkg/mailer"
+)
+
+// passwordResetMailTimeout bounds the background send of a reset mail, which
+// no longer has the request context to inherit a deadline from.
+const passwordResetMailTimeout = time.Minute
+
+var (
+	ErrPasswordResetUnavailable = errors.New("password reset is not configured on this server")
+	ErrTooManyRequests          = errors.New("too many requests, try again later")
+)
+
+type PasswordResetConfig struct {
+	// URL is the page linked from reset mails; the token is appended as the
+	// "token" query parameter.
+	URL string
+	// TTL is how long a reset link stays valid.
+	TTL time.Duration
+	// EmailLimit and IPLimit are how many resets may be requested per email
+	// address and per client IP within Window.
+	EmailLimit int
+	IPLimit    int
+	Window     time.Duration
+}
+
+// WithPasswordReset enables password reset mails sent through m.
+func WithPasswordReset(m mailer.Mailer, cfg PasswordResetConfig) AuthServiceOption {
+	return func(s *AuthService) {
+		s.mailer = m
+		s.resetCfg = cfg
+	}
+}
+
+// RequestPasswordReset mails a reset link if email belongs to a user. The
+// result does not depend on whether it does: unknown emails succeed as well,
+// and the mail is sent in the background so the response time does not tell
+// either. Requests over the per-email or per-IP limit fail with
+// ErrTooManyRequests, counted the same way for known and unknown emails.
+func (s *AuthService) RequestPasswordReset(ctx context.Context, email, ip string) error {
+	if s.mailer == nil {
+		return ErrPasswordResetUnavailable
+	}
+	email = strings.TrimSpace(email)
+
+	for _, limit := range []struct {
+		key   string
+		limit int
+	}{
+		{"password_reset:ip:" + ip, s.resetCfg.IPLimit},
+		{"password_reset:email:" + strings.ToLower(email), s.resetCfg.EmailLimit},
+	} {
+		allowed, err := s.repo.Throttle(ctx, limit.key, limit.limit, s.resetCfg.Window)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return ErrTooManyRequests
+		}
+	}
+
+	userID, err := s.repo.GetUserIDByEmail(ctx, email)
+	if errors.Is(err, ErrCredentialsNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The token is stored in the tenant of the user, which the background
+	// context has to carry over.
+	tenantID := reqctx.FromContext(ctx).Tenant()
+	go func() {
+		ctx, cancel := context.WithTimeout(reqctx.WithTenant(context.Background(), tenantID), passwordResetMailTimeout)
+		defer cancel()
+		if err := s.mailPasswordReset(ctx, userID, email); err != nil {
+			log.Printf("Failed to send password reset mail to user %d: %v", userID, err)
+		}
+	}()
+	return nil
+}
+
+func (s *AuthService) mailPasswordReset(ctx context.Context, userID int, email string) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("failed to generate reset token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expires := time.Now().Add(s.resetCfg.TTL)
+	if err := s.repo.CreatePasswordResetToken(ctx, userID, hashToken(token), expires); err != nil {
+		return err
+	}
+
+	link := s.resetCfg.URL + "?" + url.Values{"token": {token}}.Encode()
+	return s.mailer.Send(ctx, &mailer.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of the account for %s. To choose a new password, open this link:\n\n%s\n\n"+
+			"The link can be used once and expires on %s. If you did not ask for this, you can ignore this mail.\n",
+			email, link, expires.UTC().Format(time.RFC1123)),
+	})
+}
+
+// ResetPassword sets a new password with a token from a reset mail and signs
+// the user out everywhere. Access tokens already issued stay valid until
+// they expire. The password is expected to be validated by the caller.
+func (s *AuthService) ResetPassword(ctx context.Context, token, newPassword string) error {
+	hash, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	userID, err := s.repo.ResetPassword(ctx, hashToken(token), hash)
+	if err != nil {
+		return err
+	}
+	log.Printf("ResetPassword: password of user %d was reset, all sessions revoked", userID)
+	return nil
+}
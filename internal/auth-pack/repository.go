@@ -0,0 +1,659 @@
+package authPack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"user-api/internal/outbox"
+	"user-api/internal/reqctx"
+	"user-api/internal/tenant"
+	userPack "user-api/internal/user-pack"
+)
+
+var (
+	ErrCredentialsNotFound = errors.New("credentials not found")
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+	ErrMFANotEnrolled      = errors.New("MFA is not enrolled")
+	ErrMFAAlreadyEnabled   = errors.New("MFA is already enabled")
+	ErrResetTokenInvalid   = errors.New("password reset token is invalid, expired or already used")
+)
+
+// throttleRetention bounds how long throttled attempts are kept, and with it
+// the longest window Throttle can enforce.
+const throttleRetention = 24 * time.Hour
+
+type AuthRepository interface {
+	KeyStore
+	GetCredentials(ctx context.Context, email string) (*Credentials, error)
+	GetRoles(ctx context.Context, userID int) ([]string, error)
+	UpdatePasswordHash(ctx context.Context, userID int, hash string) error
+	CreateRefreshToken(ctx context.Context, token *RefreshToken) error
+	RotateRefreshToken(ctx context.Context, oldHash []byte, next *RefreshToken) error
+	RevokeRefreshTokenFamily(ctx context.Context, hash []byte) error
+	RevokeUserRefreshTokens(ctx context.Context, userID int) (int64, error)
+	GetTOTPSecret(ctx context.Context, userID int) (*TOTPSecret, error)
+	SaveTOTPSecret(ctx context.Context, userID int, secret []byte) error
+	ConfirmTOTP(ctx context.Context, userID int, counter int64, recoveryCodeHashes [][]byte) error
+	UseTOTPCounter(ctx context.Context, userID int, counter int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userID int, hash []byte) (bool, error)
+	DeleteMFA(ctx context.Context, userID int) (bool, error)
+	GetUserIDByEmail(ctx context.Context, email string) (int, error)
+	CreatePasswordResetToken(ctx context.Context, userID int, hash []byte, expiresAt time.Time) error
+	ResetPassword(ctx context.Context, tokenHash []byte, passwordHash string) (int, error)
+	Throttle(ctx context.Context, key string, limit int, window time.Duration) (bool, error)
+	LockedUntil(ctx context.Context, keys []string) (time.Time, error)
+	RecordLoginFailure(ctx context.Context, key string, userID int, ip string, policy LockoutPolicy) (*Lockout, bool, error)
+	ClearLoginFailures(ctx context.Context, key string) error
+	Unlock(ctx context.Context, key string, userID int) (bool, error)
+	ListLockouts(ctx context.Context) ([]*Lockout, error)
+}
+
+type PostgresAuthRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresAuthRepository(db *pgxpool.Pool) *PostgresAuthRepository {
+	return &PostgresAuthRepository{db: db}
+}
+
+// withTenant runs fn in a transaction scoped to the tenant of ctx. Every
+// query on users goes through it, since row-level security hides the users
+// of other tenants.
+func (r *PostgresAuthRepository) withTenant(ctx context.Context, op string, fn func(tx pgx.Tx) error) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tenant.Scope(ctx, tx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+	return nil
+}
+
+// GetCredentials returns ErrCredentialsNotFound both for unknown emails and
+// for users without a password. Emails are only unique within a tenant, so
+// the lookup is limited to the tenant of ctx even for platform admins.
+func (r *PostgresAuthRepository) GetCredentials(ctx context.Context, email string) (*Credentials, error) {
+	var c Credentials
+	err := r.withTenant(ctx, "GetCredentials", func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "SELECT id, password_hash FROM users WHERE tenant_id = $1 AND email = $2 AND password_hash IS NOT NULL",
+			reqctx.FromContext(ctx).Tenant(), email).Scan(&c.UserID, &c.PasswordHash)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrCredentialsNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("GetCredentials: failed to query credentials: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetRoles returns the roles granted to a user, which access tokens carry.
+func (r *PostgresAuthRepository) GetRoles(ctx context.Context, userID int) ([]string, error) {
+	var roles []string
+	err := r.withTenant(ctx, "GetRoles", func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "SELECT roles FROM users WHERE id = $1", userID).Scan(&roles)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return userPack.ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("GetRoles: failed to query roles of user %d: %w", userID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (r *PostgresAuthRepository) UpdatePasswordHash(ctx context.Context, userID int, hash string) error {
+	return r.withTenant(ctx, "UpdatePasswordHash", func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "UPDATE users SET password_hash = $1 WHERE id = $2", hash, userID); err != nil {
+			return fmt.Errorf("UpdatePasswordHash: failed to update password of user %d: %w", userID, err)
+		}
+		return nil
+	})
+}
+
+func (r *PostgresAuthRepository) ListSigningKeys(ctx context.Context, since time.Time) ([]*SigningKey, error) {
+	rows, err := r.db.Query(ctx, "SELECT id, algorithm, private_key, created FROM signing_keys WHERE created > $1 ORDER BY created, id", since)
+	if err != nil {
+		return nil, fmt.Errorf("ListSigningKeys: failed to query signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*SigningKey
+	for rows.Next() {
+		var key SigningKey
+		if err := rows.Scan(&key.ID, &key.Algorithm, &key.PrivateKey, &key.Created); err != nil {
+			return nil, fmt.Errorf("ListSigningKeys: failed to scan signing key: %w", err)
+		}
+		keys = append(keys, &key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ListSigningKeys: failed to read signing keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (r *PostgresAuthRepository) CreateSigningKey(ctx context.Context, key *SigningKey) error {
+	err := r.db.QueryRow(ctx, "INSERT INTO signing_keys (id, algorithm, private_key) VALUES ($1, $2, $3) RETURNING created",
+		key.ID, key.Algorithm, key.PrivateKey).Scan(&key.Created)
+	if err != nil {
+		return fmt.Errorf("CreateSigningKey: failed to insert signing key %s: %w", key.ID, err)
+	}
+	return nil
+}
+
+func (r *PostgresAuthRepository) DeleteSigningKeys(ctx context.Context, before time.Time) error {
+	if _, err := r.db.Exec(ctx, "DELETE FROM signing_keys WHERE created <= $1", before); err != nil {
+		return fmt.Errorf("DeleteSigningKeys: failed to delete retired signing keys: %w", err)
+	}
+	return nil
+}
+
+func (r *PostgresAuthRepository) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	err := r.db.QueryRow(ctx, "INSERT INTO refresh_tokens (token_hash, user_id, family_id, tenant_id, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		token.TokenHash, token.UserID, token.FamilyID, token.TenantID, token.ExpiresAt).Scan(&token.ID)
+	if err != nil {
+		return fmt.Errorf("CreateRefreshToken: failed to insert refresh token for user %d: %w", token.UserID, err)
+	}
+	return nil
+}
+
+// RotateRefreshToken marks the token with oldHash as used and stores next in
+// its family, filling in next.UserID, next.FamilyID and next.TenantID. Presenting a token
+// that was already used revokes the whole family and returns
+// ErrRefreshTokenReused; the revocation is committed even so.
+func (r *PostgresAuthRepository) RotateRefreshToken(ctx context.Context, oldHash []byte, next *RefreshToken) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("RotateRefreshToken: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var id int64
+	var expiresAt time.Time
+	var usedAt, revokedAt *time.Time
+	err = tx.QueryRow(ctx, "SELECT id, user_id, family_id, tenant_id, expires_at, used_at, revoked_at FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE", oldHash).
+		Scan(&id, &next.UserID, &next.FamilyID, &next.TenantID, &expiresAt, &usedAt, &revokedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return fmt.Errorf("RotateRefreshToken: failed to query refresh token: %w", err)
+	}
+
+	switch {
+	case usedAt != nil:
+		if _, err := tx.Exec(ctx, "UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL", next.FamilyID); err != nil {
+			return fmt.Errorf("RotateRefreshToken: failed to revoke token family %s: %w", next.FamilyID, err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("RotateRefreshToken: failed to commit transaction: %w", err)
+		}
+		return ErrRefreshTokenReused
+	case revokedAt != nil, !expiresAt.After(time.Now()):
+		return ErrRefreshTokenInvalid
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE refresh_tokens SET used_at = now() WHERE id = $1", id); err != nil {
+		return fmt.Errorf("RotateRefreshToken: failed to mark refresh token %d used: %w", id, err)
+	}
+	err = tx.QueryRow(ctx, "INSERT INTO refresh_tokens (token_hash, user_id, family_id, tenant_id, expires_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		next.TokenHash, next.UserID, next.FamilyID, next.TenantID, next.ExpiresAt).Scan(&next.ID)
+	if err != nil {
+		return fmt.Errorf("RotateRefreshToken: failed to insert refresh token: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("RotateRefreshToken: failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// RevokeRefreshTokenFamily revokes the session the token belongs to. Unknown
+// tokens are ignored.
+func (r *PostgresAuthRepository) RevokeRefreshTokenFamily(ctx context.Context, hash []byte) error {
+	_, err := r.db.Exec(ctx, `
+		UPDATE refresh_tokens SET revoked_at = now()
+		WHERE revoked_at IS NULL AND family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1)`, hash)
+	if err != nil {
+		return fmt.Errorf("RevokeRefreshTokenFamily: failed to revoke refresh tokens: %w", err)
+	}
+	return nil
+}
+
+func (r *PostgresAuthRepository) RevokeUserRefreshTokens(ctx context.Context, userID int) (int64, error) {
+	tag, err := r.db.Exec(ctx, "UPDATE refresh_tokens SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		return 0, fmt.Errorf("RevokeUserRefreshTokens: failed to revoke refresh tokens of user %d: %w", userID, err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (r *PostgresAuthRepository) GetTOTPSecret(ctx context.Context, userID int) (*TOTPSecret, error) {
+	secret := TOTPSecret{UserID: userID}
+	err := r.db.QueryRow(ctx, "SELECT secret, last_counter, confirmed_at IS NOT NULL FROM mfa_totp WHERE user_id = $1", userID).
+		Scan(&secret.Secret, &secret.LastCounter, &secret.Confirmed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMFANotEnrolled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetTOTPSecret: failed to query TOTP secret of user %d: %w", userID, err)
+	}
+	return &secret, nil
+}
+
+// SaveTOTPSecret starts or restarts an enrollment. It returns
+// ErrMFAAlreadyEnabled if the user has a confirmed secret.
+func (r *PostgresAuthRepository) SaveTOTPSecret(ctx context.Context, userID int, secret []byte) error {
+	tag, err := r.db.Exec(ctx, `
+		INSERT INTO mfa_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_counter = 0, created = now()
+		WHERE mfa_totp.confirmed_at IS NULL`, userID, secret)
+	if err != nil {
+		return fmt.Errorf("SaveTOTPSecret: failed to save TOTP secret of user %d: %w", userID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrMFAAlreadyEnabled
+	}
+	return nil
+}
+
+// ConfirmTOTP enables a pending enrollment and replaces the user's recovery
+// codes.
+func (r *PostgresAuthRepository) ConfirmTOTP(ctx context.Context, userID int, counter int64, recoveryCodeHashes [][]byte) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("ConfirmTOTP: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "UPDATE mfa_totp SET confirmed_at = now(), last_counter = $2 WHERE user_id = $1 AND confirmed_at IS NULL AND last_counter < $2", userID, counter)
+	if err != nil {
+		return fmt.Errorf("ConfirmTOTP: failed to confirm TOTP of user %d: %w", userID, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrMFANotEnrolled
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("ConfirmTOTP: failed to delete recovery codes of user %d: %w", userID, err)
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.Exec(ctx, "INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, hash); err != nil {
+			return fmt.Errorf("ConfirmTOTP: failed to insert recovery code of user %d: %w", userID, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("ConfirmTOTP: failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// UseTOTPCounter records counter as the last accepted time step. It returns
+// false if that step or a later one was already used.
+func (r *PostgresAuthRepository) UseTOTPCounter(ctx context.Context, userID int, counter int64) (bool, error) {
+	tag, err := r.db.Exec(ctx, "UPDATE mfa_totp SET last_counter = $2 WHERE user_id = $1 AND confirmed_at IS NOT NULL AND last_counter < $2", userID, counter)
+	if err != nil {
+		return false, fmt.Errorf("UseTOTPCounter: failed to update TOTP counter of user %d: %w", userID, err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// UseRecoveryCode burns an unused recovery code. It returns false if there
+// is none with that hash.
+func (r *PostgresAuthRepository) UseRecoveryCode(ctx context.Context, userID int, hash []byte) (bool, error) {
+	tag, err := r.db.Exec(ctx, "UPDATE mfa_recovery_codes SET used_at = now() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL", userID, hash)
+	if err != nil {
+		return false, fmt.Errorf("UseRecoveryCode: failed to use recovery code of user %d: %w", userID, err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// DeleteMFA removes the TOTP secret and recovery codes of a user. It returns
+// false if the user had neither.
+func (r *PostgresAuthRepository) DeleteMFA(ctx context.Context, userID int) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("DeleteMFA: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	totp, err := tx.Exec(ctx, "DELETE FROM mfa_totp WHERE user_id = $1", userID)
+	if err != nil {
+		return false, fmt.Errorf("DeleteMFA: failed to delete TOTP secret of user %d: %w", userID, err)
+	}
+	codes, err := tx.Exec(ctx, "DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return false, fmt.Errorf("DeleteMFA: failed to delete recovery codes of user %d: %w", userID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("DeleteMFA: failed to commit transaction: %w", err)
+	}
+	return totp.RowsAffected()+codes.RowsAffected() > 0, nil
+}
+
+// GetUserIDByEmail returns ErrCredentialsNotFound for unknown emails. Unlike
+// GetCredentials it also finds users without a password.
+func (r *PostgresAuthRepository) GetUserIDByEmail(ctx context.Context, email string) (int, error) {
+	var id int
+	err := r.withTenant(ctx, "GetUserIDByEmail", func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "SELECT id FROM users WHERE tenant_id = $1 AND email = $2", reqctx.FromContext(ctx).Tenant(), email).Scan(&id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrCredentialsNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("GetUserIDByEmail: failed to query user: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// CreatePasswordResetToken stores a reset token and drops the user's older
+// ones, so only the most recent mail can be used. The token remembers the
+// tenant of ctx, so it can be redeemed without one.
+func (r *PostgresAuthRepository) CreatePasswordResetToken(ctx context.Context, userID int, hash []byte, expiresAt time.Time) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("CreatePasswordResetToken: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM password_reset_tokens WHERE user_id = $1 OR expires_at < now()", userID); err != nil {
+		return fmt.Errorf("CreatePasswordResetToken: failed to delete old reset tokens of user %d: %w", userID, err)
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO password_reset_tokens (token_hash, user_id, tenant_id, expires_at) VALUES ($1, $2, $3, $4)",
+		hash, userID, reqctx.FromContext(ctx).Tenant(), expiresAt); err != nil {
+		return fmt.Errorf("CreatePasswordResetToken: failed to insert reset token for user %d: %w", userID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("CreatePasswordResetToken: failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// ResetPassword redeems a reset token, sets the new password hash and
+// revokes every refresh token of the user in one transaction. It returns the
+// user id, or ErrResetTokenInvalid if the token is unknown, expired or used.
+func (r *PostgresAuthRepository) ResetPassword(ctx context.Context, tokenHash []byte, passwordHash string) (int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ResetPassword: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int
+	var tenantID string
+	err = tx.QueryRow(ctx, `
+		UPDATE password_reset_tokens SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id, tenant_id`, tokenHash).Scan(&userID, &tenantID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrResetTokenInvalid
+	}
+	if err != nil {
+		return 0, fmt.Errorf("ResetPassword: failed to redeem reset token: %w", err)
+	}
+	if err := tenant.Scope(reqctx.WithTenant(ctx, tenantID), tx); err != nil {
+		return 0, fmt.Errorf("ResetPassword: %w", err)
+	}
+
+	// Row-level security hides users of other tenants instead of failing,
+	// so the update has to be checked for the user it was meant for.
+	tag, err := tx.Exec(ctx, "UPDATE users SET password_hash = $1 WHERE id = $2", passwordHash, userID)
+	if err != nil {
+		return 0, fmt.Errorf("ResetPassword: failed to update password of user %d: %w", userID, err)
+	}
+	if tag.RowsAffected() != 1 {
+		return 0, fmt.Errorf("ResetPassword: %w: user %d in tenant %s", userPack.ErrUserNotFound, userID, tenantID)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM password_reset_tokens WHERE user_id = $1 AND used_at IS NULL", userID); err != nil {
+		return 0, fmt.Errorf("ResetPassword: failed to delete reset tokens of user %d: %w", userID, err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE refresh_tokens SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL", userID); err != nil {
+		return 0, fmt.Errorf("ResetPassword: failed to revoke refresh tokens of user %d: %w", userID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("ResetPassword: failed to commit transaction: %w", err)
+	}
+	return userID, nil
+}
+
+// Throttle records an attempt under key and reports whether it is within
+// limit attempts per window. Rejected attempts are not recorded, so callers
+// get through again once the window has passed. Attempts for one key are
+// serialized with an advisory lock; windows longer than throttleRetention
+// are cut short.
+func (r *PostgresAuthRepository) Throttle(ctx context.Context, key string, limit int, window time.Duration) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("Throttle: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", key); err != nil {
+		return false, fmt.Errorf("Throttle: failed to lock %s: %w", key, err)
+	}
+	now := time.Now()
+	if _, err := tx.Exec(ctx, "DELETE FROM auth_throttle WHERE created < $1", now.Add(-throttleRetention)); err != nil {
+		return false, fmt.Errorf("Throttle: failed to purge old attempts: %w", err)
+	}
+	var attempts int
+	if err := tx.QueryRow(ctx, "SELECT count(*) FROM auth_throttle WHERE key = $1 AND created > $2", key, now.Add(-window)).Scan(&attempts); err != nil {
+		return false, fmt.Errorf("Throttle: failed to count attempts for %s: %w", key, err)
+	}
+	allowed := attempts < limit
+	if allowed {
+		if _, err := tx.Exec(ctx, "INSERT INTO auth_throttle (key, created) VALUES ($1, $2)", key, now); err != nil {
+			return false, fmt.Errorf("Throttle: failed to record attempt for %s: %w", key, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("Throttle: failed to commit transaction: %w", err)
+	}
+	return allowed, nil
+}
+
+// LockedUntil returns the latest lockout end of keys, or the zero time if
+// none of them is locked.
+func (r *PostgresAuthRepository) LockedUntil(ctx context.Context, keys []string) (time.Time, error) {
+	var until *time.Time
+	err := r.db.QueryRow(ctx, "SELECT max(locked_until) FROM login_failures WHERE key = ANY($1) AND locked_until > now()", keys).Scan(&until)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("LockedUntil: failed to query lockouts: %w", err)
+	}
+	if until == nil {
+		return time.Time{}, nil
+	}
+	return *until, nil
+}
+
+// RecordLoginFailure counts a failed login under key and locks the key out
+// once policy.Threshold is reached. It reports whether this failure started
+// a lockout; the lockout is logged as a security event in the same
+// transaction. userID is the account the key belongs to, if known.
+func (r *PostgresAuthRepository) RecordLoginFailure(ctx context.Context, key string, userID int, ip string, policy LockoutPolicy) (*Lockout, bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("RecordLoginFailure: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	// Only counters of the same kind share policy.ResetAfter.
+	_, err = tx.Exec(ctx, `
+		DELETE FROM login_failures
+		WHERE split_part(key, ':', 1) = split_part($1, ':', 1) AND last_failure < $2 AND (locked_until IS NULL OR locked_until < $3)`,
+		key, now.Add(-policy.ResetAfter), now)
+	if err != nil {
+		return nil, false, fmt.Errorf("RecordLoginFailure: failed to purge stale counters: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO login_failures (key, tenant_id) VALUES ($1, $2) ON CONFLICT DO NOTHING", key, lockoutTenant(ctx, key)); err != nil {
+		return nil, false, fmt.Errorf("RecordLoginFailure: failed to create counter for %s: %w", key, err)
+	}
+	lockout := Lockout{Key: key}
+	err = tx.QueryRow(ctx, "SELECT failures, lockouts, last_failure, locked_until FROM login_failures WHERE key = $1 FOR UPDATE", key).
+		Scan(&lockout.Failures, &lockout.Lockouts, &lockout.LastFailure, &lockout.LockedUntil)
+	if err != nil {
+		return nil, false, fmt.Errorf("RecordLoginFailure: failed to query counter for %s: %w", key, err)
+	}
+
+	if lockout.LastFailure.Before(now.Add(-policy.ResetAfter)) {
+		lockout.Failures, lockout.Lockouts = 0, 0
+	}
+	lockout.Failures++
+	lockout.LastFailure = now
+	locked := lockout.Failures >= policy.Threshold
+	if locked {
+		until := now.Add(policy.duration(lockout.Lockouts))
+		lockout.LockedUntil = &until
+		lockout.Lockouts++
+		lockout.Failures = 0
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE login_failures SET failures = $2, lockouts = $3, last_failure = $4, locked_until = $5 WHERE key = $1",
+		key, lockout.Failures, lockout.Lockouts, lockout.LastFailure, lockout.LockedUntil)
+	if err != nil {
+		return nil, false, fmt.Errorf("RecordLoginFailure: failed to update counter for %s: %w", key, err)
+	}
+	if locked {
+		err := insertSecurityEvent(ctx, tx, outbox.EventSecurityLockout, &SecurityEvent{
+			Type:    SecurityEventLockout,
+			Subject: key,
+			UserID:  userID,
+			Details: map[string]interface{}{"ip": ip, "lockouts": lockout.Lockouts, "locked_until": lockout.LockedUntil},
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, false, fmt.Errorf("RecordLoginFailure: failed to commit transaction: %w", err)
+	}
+	return &lockout, locked, nil
+}
+
+func (r *PostgresAuthRepository) ClearLoginFailures(ctx context.Context, key string) error {
+	if _, err := r.db.Exec(ctx, "DELETE FROM login_failures WHERE key = $1", key); err != nil {
+		return fmt.Errorf("ClearLoginFailures: failed to delete counter for %s: %w", key, err)
+	}
+	return nil
+}
+
+// Unlock deletes the counter of key and logs the unlock as a security
+// event. It returns false if there was no counter.
+func (r *PostgresAuthRepository) Unlock(ctx context.Context, key string, userID int) (bool, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("Unlock: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var lockedUntil *time.Time
+	err = tx.QueryRow(ctx, "DELETE FROM login_failures WHERE key = $1 RETURNING locked_until", key).Scan(&lockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Unlock: failed to delete counter for %s: %w", key, err)
+	}
+	err = insertSecurityEvent(ctx, tx, outbox.EventSecurityUnlock, &SecurityEvent{
+		Type:    SecurityEventUnlock,
+		Subject: key,
+		UserID:  userID,
+		Details: map[string]interface{}{"locked_until": lockedUntil},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("Unlock: failed to commit transaction: %w", err)
+	}
+	return true, nil
+}
+
+// lockoutTenant is the tenant an account counter is listed in. IP counters
+// are shared by all tenants and have none.
+func lockoutTenant(ctx context.Context, key string) *string {
+	if !strings.HasPrefix(key, accountLockoutPrefix) {
+		return nil
+	}
+	tenantID := reqctx.FromContext(ctx).Tenant()
+	return &tenantID
+}
+
+// ListLockouts returns the lockouts of the tenant of ctx and of IPs, or of
+// every tenant for platform admins.
+func (r *PostgresAuthRepository) ListLockouts(ctx context.Context) ([]*Lockout, error) {
+	meta := reqctx.FromContext(ctx)
+	rows, err := r.db.Query(ctx, `
+		SELECT key, failures, lockouts, last_failure, locked_until FROM login_failures
+		WHERE locked_until > now() AND (tenant_id IS NULL OR tenant_id = $1 OR $2)
+		ORDER BY locked_until DESC`, meta.Tenant(), meta.IsPlatformAdmin())
+	if err != nil {
+		return nil, fmt.Errorf("ListLockouts: failed to query lockouts: %w", err)
+	}
+	defer rows.Close()
+
+	var lockouts []*Lockout
+	for rows.Next() {
+		var lockout Lockout
+		if err := rows.Scan(&lockout.Key, &lockout.Failures, &lockout.Lockouts, &lockout.LastFailure, &lockout.LockedUntil); err != nil {
+			return nil, fmt.Errorf("ListLockouts: failed to scan lockout: %w", err)
+		}
+		lockouts = append(lockouts, &lockout)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ListLockouts: failed to read lockouts: %w", err)
+	}
+	return lockouts, nil
+}
+
+// insertSecurityEvent appends event to the security log and publishes it
+// through the outbox as part of tx. Actor and request come from ctx.
+func insertSecurityEvent(ctx context.Context, tx pgx.Tx, outboxType string, event *SecurityEvent) error {
+	meta := reqctx.FromContext(ctx)
+	event.Actor, event.RequestID, event.Source = meta.Actor, meta.RequestID, meta.Source
+	if tenantID := lockoutTenant(ctx, event.Subject); tenantID != nil {
+		event.TenantID = *tenantID
+	}
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return fmt.Errorf("insertSecurityEvent: failed to encode details: %w", err)
+	}
+	var userID *int
+	if event.UserID != 0 {
+		userID = &event.UserID
+	}
+	_, err = tx.Exec(ctx, "INSERT INTO security_events (event_type, subject, user_id, actor, request_id, source, details) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		event.Type, event.Subject, userID, event.Actor, event.RequestID, event.Source, details)
+	if err != nil {
+		return fmt.Errorf("insertSecurityEvent: failed to insert %s event for %s: %w", event.Type, event.Subject, err)
+	}
+	return outbox.Enqueue(ctx, tx, outboxType, event.UserID, event)
+}
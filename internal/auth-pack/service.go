@@ -0,0 +1,294 @@
+package authPack
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/encryption"
+	"user-api/pkg/mailer"
+	"user-api/pkg/password"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrInvalidAccessToken = errors.New("invalid access token")
+	ErrAccountDisabled    = errors.New("account is suspended or deactivated")
+)
+
+type TokenConfig struct {
+	Issuer          string
+	Audience        string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+}
+
+type AuthService struct {
+	repo   AuthRepository
+	users  *userPack.UserService
+	hasher *password.Hasher
+	keys   *KeyManager
+	cfg    TokenConfig
+	// mfaCipher encrypts TOTP secrets; enrollment is unavailable without it.
+	mfaCipher *encryption.Cipher
+	mfaIssuer string
+	// mailer sends password reset links; resets are unavailable without it.
+	mailer   mailer.Mailer
+	resetCfg PasswordResetConfig
+	// lockout is nil when failed logins are not counted.
+	lockout *LockoutConfig
+	// dummyHash is verified against when the email is unknown, so the
+	// response time does not reveal which emails are registered.
+	dummyHash string
+}
+
+type AuthServiceOption func(*AuthService)
+
+// WithMFA enables TOTP enrollment. Secrets are encrypted with cipher and
+// issuer labels the account in authenticator apps.
+func WithMFA(cipher *encryption.Cipher, issuer string) AuthServiceOption {
+	return func(s *AuthService) {
+		s.mfaCipher = cipher
+		s.mfaIssuer = issuer
+	}
+}
+
+func NewAuthService(repo AuthRepository, users *userPack.UserService, hasher *password.Hasher, keys *KeyManager, cfg TokenConfig, opts ...AuthServiceOption) (*AuthService, error) {
+	dummyHash, err := hasher.Hash("not a real password")
+	if err != nil {
+		return nil, fmt.Errorf("NewAuthService: %w", err)
+	}
+	s := &AuthService{repo: repo, users: users, hasher: hasher, keys: keys, cfg: cfg, dummyHash: dummyHash}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Login verifies an email and password. Users without MFA get a new token
+// pair, which starts a new refresh token family; users with MFA get an
+// MFAToken for VerifyMFA. Hashes made with outdated parameters are upgraded
+// on success. With WithLockout, failures are counted per email and per ip
+// and a locked out login fails with a LockoutError before the password is
+// checked.
+func (s *AuthService) Login(ctx context.Context, email, pw, ip string) (*LoginResult, error) {
+	if err := s.checkLockout(ctx, email, ip); err != nil {
+		return nil, err
+	}
+
+	creds, err := s.repo.GetCredentials(ctx, email)
+	if errors.Is(err, ErrCredentialsNotFound) {
+		s.hasher.Verify(pw, s.dummyHash)
+		s.loginFailed(ctx, email, ip, 0)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, needsRehash, err := s.hasher.Verify(pw, creds.PasswordHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify password of user %d: %w", creds.UserID, err)
+	}
+	if !ok {
+		s.loginFailed(ctx, email, ip, creds.UserID)
+		return nil, ErrInvalidCredentials
+	}
+
+	if needsRehash {
+		if hash, err := s.hasher.Hash(pw); err == nil {
+			if err := s.repo.UpdatePasswordHash(ctx, creds.UserID, hash); err != nil {
+				log.Printf("Login: failed to upgrade password hash of user %d: %v", creds.UserID, err)
+			}
+		}
+	}
+
+	enabled, err := s.mfaEnabled(ctx, creds.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		mfaToken, err := s.signMFAToken(creds.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return &LoginResult{MFAToken: mfaToken}, nil
+	}
+	s.loginSucceeded(ctx, email)
+	return s.completeLogin(ctx, creds.UserID)
+}
+
+// completeLogin issues the tokens of a login that passed every check. It
+// is the last point where a suspended or deactivated user is turned away.
+func (s *AuthService) completeLogin(ctx context.Context, userID int) (*LoginResult, error) {
+	user, err := s.users.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.Status.CanLogIn() {
+		return nil, ErrAccountDisabled
+	}
+	tokens, err := s.issueTokens(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginResult{User: user, Tokens: tokens}, nil
+}
+
+func (s *AuthService) issueTokens(ctx context.Context, user *userPack.User) (*TokenPair, error) {
+	family := make([]byte, 16)
+	if _, err := rand.Read(family); err != nil {
+		return nil, fmt.Errorf("failed to generate token family: %w", err)
+	}
+	refresh, token, err := s.newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	token.UserID, token.FamilyID, token.TenantID = user.ID, hex.EncodeToString(family), user.TenantID
+	roles, err := s.repo.GetRoles(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.CreateRefreshToken(ctx, token); err != nil {
+		return nil, err
+	}
+	return s.tokenPair(token, refresh, roles)
+}
+
+// Refresh exchanges a refresh token for a new pair. Each refresh token is
+// single use; presenting one twice revokes its whole family, since either
+// the client or an attacker holds a stolen copy. The session of a user who
+// was suspended or deactivated since is revoked instead.
+func (s *AuthService) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	refresh, next, err := s.newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	err = s.repo.RotateRefreshToken(ctx, hashToken(refreshToken), next)
+	if errors.Is(err, ErrRefreshTokenReused) {
+		log.Printf("Refresh: refresh token reuse detected, revoked token family %s of user %d", next.FamilyID, next.UserID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The refresh request carries no tenant; the session keeps the one it
+	// was started in.
+	ctx = reqctx.WithTenant(ctx, next.TenantID)
+	user, err := s.users.GetUser(ctx, next.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.Status.CanLogIn() {
+		if err := s.repo.RevokeRefreshTokenFamily(ctx, hashToken(refresh)); err != nil {
+			return nil, err
+		}
+		return nil, ErrAccountDisabled
+	}
+	// Roles are looked up again, so revoking one takes effect by the next
+	// refresh.
+	roles, err := s.repo.GetRoles(ctx, next.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return s.tokenPair(next, refresh, roles)
+}
+
+// Logout revokes the refresh token family of refreshToken, ending that
+// session. Access tokens already issued stay valid until they expire.
+func (s *AuthService) Logout(ctx context.Context, refreshToken string) error {
+	return s.repo.RevokeRefreshTokenFamily(ctx, hashToken(refreshToken))
+}
+
+// RevokeUserTokens revokes all refresh tokens of a user, signing them out
+// everywhere. It returns the number of tokens revoked. Users of other
+// tenants are not found.
+func (s *AuthService) RevokeUserTokens(ctx context.Context, userID int) (int64, error) {
+	user, err := s.users.GetUser(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	return s.repo.RevokeUserRefreshTokens(ctx, user.ID)
+}
+
+// VerifyAccessToken checks the signature, issuer, audience and expiry of an
+// access token and returns its claims.
+func (s *AuthService) VerifyAccessToken(token string) (*AccessClaims, error) {
+	var claims AccessClaims
+	_, err := jwt.ParseWithClaims(token, &claims, s.keys.Keyfunc,
+		jwt.WithValidMethods([]string{AlgorithmEdDSA, AlgorithmRS256}),
+		jwt.WithIssuer(s.cfg.Issuer),
+		jwt.WithAudience(s.cfg.Audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAccessToken, err)
+	}
+	if _, err := strconv.Atoi(claims.Subject); err != nil {
+		return nil, fmt.Errorf("%w: subject is not a user id", ErrInvalidAccessToken)
+	}
+	return &claims, nil
+}
+
+// JWKS returns the public keys access tokens can be verified with.
+func (s *AuthService) JWKS() JWKS {
+	return s.keys.JWKS()
+}
+
+func (s *AuthService) newRefreshToken() (string, *RefreshToken, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	refresh := base64.RawURLEncoding.EncodeToString(b)
+	return refresh, &RefreshToken{TokenHash: hashToken(refresh), ExpiresAt: time.Now().Add(s.cfg.RefreshTokenTTL)}, nil
+}
+
+func (s *AuthService) tokenPair(token *RefreshToken, refresh string, roles []string) (*TokenPair, error) {
+	now := time.Now()
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, fmt.Errorf("failed to generate token id: %w", err)
+	}
+	access, err := s.keys.Sign(&AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.cfg.Issuer,
+			Subject:   strconv.Itoa(token.UserID),
+			Audience:  jwt.ClaimStrings{s.cfg.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.cfg.AccessTokenTTL)),
+			ID:        hex.EncodeToString(jti),
+		},
+		SessionID: token.FamilyID,
+		TenantID:  token.TenantID,
+		Roles:     roles,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign access token: %w", err)
+	}
+	return &TokenPair{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.cfg.AccessTokenTTL / time.Second),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// hashToken is the lookup key of a refresh token. The tokens are random, so
+// a fast unsalted hash is enough.
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
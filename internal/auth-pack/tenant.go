@@ -0,0 +1,106 @@
+package authPack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"user-api/internal/reqctx"
+)
+
+var ErrTenantMismatch = errors.New("tenant does not match the access token")
+
+// resolveTenant settles the tenant a request acts for. A valid access token
+// names the tenant of its user, which wins over the X-Tenant-ID header; a
+// header naming another tenant is refused unless the caller is a platform
+// admin. Without a valid token the header is used as is, and requests
+// without either act for reqctx.DefaultTenant.
+//
+// The user of a valid token becomes the verified actor of the request,
+// with the roles of the token, unless a client certificate named one.
+func (s *AuthService) resolveTenant(ctx context.Context, authorization string) (context.Context, error) {
+	token := BearerToken(authorization)
+	if token == "" {
+		return ctx, nil
+	}
+	claims, err := s.VerifyAccessToken(token)
+	if err != nil {
+		// Rejecting bad tokens is up to the endpoints that need one.
+		return ctx, nil
+	}
+
+	tenantID := claims.TenantID
+	if tenantID == "" {
+		tenantID = reqctx.DefaultTenant
+	}
+	if !reqctx.FromContext(ctx).Verified {
+		ctx = reqctx.WithActor(ctx, reqctx.UserActorPrefix+claims.Subject, claims.Roles)
+	}
+	meta := reqctx.FromContext(ctx)
+	switch {
+	case meta.TenantID == "" || meta.TenantID == tenantID:
+		return reqctx.WithTenant(ctx, tenantID), nil
+	case meta.IsPlatformAdmin():
+		return ctx, nil
+	default:
+		return nil, fmt.Errorf("%w: header names %s, token %s", ErrTenantMismatch, meta.TenantID, tenantID)
+	}
+}
+
+// TenantMiddleware resolves the tenant of REST requests. It has to run
+// after reqctx.GinMiddleware.
+func (s *AuthService) TenantMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		resolved, err := s.resolveTenant(ctx.Request.Context(), ctx.GetHeader("Authorization"))
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Request = ctx.Request.WithContext(resolved)
+		ctx.Next()
+	}
+}
+
+func (s *AuthService) grpcTenant(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var authorization string
+	if values := md.Get("authorization"); len(values) > 0 {
+		authorization = values[0]
+	}
+	return s.resolveTenant(ctx, authorization)
+}
+
+// TenantUnaryInterceptor resolves the tenant of unary RPCs. It has to be
+// chained after reqctx.UnaryServerInterceptor.
+func (s *AuthService) TenantUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resolved, err := s.grpcTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(resolved, req)
+}
+
+// TenantStreamInterceptor resolves the tenant of streaming RPCs. It has to
+// be chained after reqctx.StreamServerInterceptor.
+func (s *AuthService) TenantStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	resolved, err := s.grpcTenant(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: ss, ctx: resolved})
+}
+
+// contextStream is a server stream with a context the interceptors resolved.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	userpb "user-api/gen/user"
+	"user-api/internal/reqctx"
+	"user-api/internal/throttle"
+)
+
+// Prefix is where the gateway serves the REST mapping of the gRPC service.
+const Prefix = "/v1"
+
+// forwardedHeaders are passed to the gRPC server as metadata, where
+// reqctx reads them like it does for direct gRPC clients. The actor is
+// passed by requestMetadata instead.
+var forwardedHeaders = map[string]bool{
+	reqctx.RequestIDHeader: true,
+	reqctx.TenantHeader:    true,
+	throttle.APIKeyHeader:  true,
+}
+
+// gatewayHeaders are the metadata the gateway vouches for with its key.
+// Clients cannot send them, not even as Grpc-Metadata- headers.
+var gatewayHeaders = map[string]bool{
+	reqctx.ActorHeader:         true,
+	reqctx.ActorRolesHeader:    true,
+	reqctx.ActorVerifiedHeader: true,
+	reqctx.GatewayKeyHeader:    true,
+	reqctx.ClientIPHeader:      true,
+}
+
+// NewGateway returns a handler translating REST requests into calls of the
+// UserService on conn, so REST and gRPC share one implementation. key
+// proves to the gRPC server that the actor metadata comes from the gateway;
+// the server has to be set up with reqctx.WithGatewayKey(key).
+func NewGateway(ctx context.Context, conn *grpc.ClientConn, key string) (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions:   protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true},
+			UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+		}),
+		runtime.WithIncomingHeaderMatcher(incomingHeader),
+		runtime.WithOutgoingHeaderMatcher(outgoingHeader),
+		runtime.WithMetadata(requestMetadata(key)),
+		runtime.WithErrorHandler(errorHandler),
+	)
+	if err := userpb.RegisterUserServiceHandler(ctx, mux, conn); err != nil {
+		return nil, err
+	}
+	return mux, nil
+}
+
+func incomingHeader(key string) (string, bool) {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	if gatewayHeaders[strings.TrimPrefix(key, runtime.MetadataHeaderPrefix)] {
+		return "", false
+	}
+	if forwardedHeaders[key] {
+		return key, true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// outgoingHeader drops the request id the gRPC server echoes; the REST
+// middleware has set X-Request-ID already.
+func outgoingHeader(key string) (string, bool) {
+	if textproto.CanonicalMIMEHeaderKey(key) == reqctx.RequestIDHeader {
+		return "", false
+	}
+	return runtime.MetadataHeaderPrefix + key, true
+}
+
+// requestMetadata forwards the actor the REST middleware settled on, which
+// may come from a client certificate the gRPC server never sees, the
+// client address gin settled on behind the trusted proxies, and the request
+// id it generated when the client sent none, so both sides log the same
+// one.
+func requestMetadata(key string) func(context.Context, *http.Request) metadata.MD {
+	return func(ctx context.Context, r *http.Request) metadata.MD {
+		meta := reqctx.FromContext(r.Context())
+		md := metadata.Pairs(reqctx.GatewayKeyHeader, key)
+		if meta.Actor != "" {
+			md.Set(reqctx.ActorHeader, meta.Actor)
+		}
+		if len(meta.Roles) > 0 {
+			md.Set(reqctx.ActorRolesHeader, strings.Join(meta.Roles, ","))
+		}
+		if meta.Verified {
+			md.Set(reqctx.ActorVerifiedHeader, "true")
+		}
+		if meta.ClientIP != "" {
+			md.Set(reqctx.ClientIPHeader, meta.ClientIP)
+		}
+		if r.Header.Get(reqctx.RequestIDHeader) == "" && meta.RequestID != "" {
+			md.Set(reqctx.RequestIDHeader, meta.RequestID)
+		}
+		return md
+	}
+}
+
+// errorHandler answers like runtime.DefaultHTTPErrorHandler, except that
+// FailedPrecondition is a 409 as in the REST handlers: it is what the
+// service returns for conflicts with the current state of a resource. The
+// retry delay of throttled calls becomes a Retry-After header.
+func errorHandler(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	var httpErr *runtime.HTTPStatusError
+	if !errors.As(err, &httpErr) && status.Code(err) == codes.FailedPrecondition {
+		err = &runtime.HTTPStatusError{HTTPStatus: http.StatusConflict, Err: err}
+	}
+	if retryAfter, ok := throttle.RetryAfter(err); ok {
+		throttle.SetRetryAfter(w.Header(), retryAfter)
+	}
+	runtime.DefaultHTTPErrorHandler(ctx, mux, m, w, r, err)
+}
+
+// OpenAPI serves the OpenAPI document generated from the proto annotations.
+func OpenAPI(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "application/json", userpb.OpenAPI)
+}
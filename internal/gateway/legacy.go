@@ -0,0 +1,240 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	userpb "user-api/gen/user"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/httpcache"
+	"user-api/pkg/negotiate"
+)
+
+// LegacyHandler keeps the routes of the original REST API (POST /users,
+// /user/:id) working on top of the gateway. Requests are rewritten to their
+// /v1 route and the answers reshaped to what those routes always returned:
+// bare users with lowercase statuses, 201 on create, 204 on delete and
+// errors as {"error": message}. Bodies may be in any format negotiate
+// supports; the gateway only ever sees JSON.
+type LegacyHandler struct {
+	gateway http.Handler
+}
+
+func NewLegacyHandler(gateway http.Handler) *LegacyHandler {
+	return &LegacyHandler{gateway: gateway}
+}
+
+func (c *LegacyHandler) CreateUser(ctx *gin.Context) {
+	body, ok := jsonBody(ctx, &userPack.User{})
+	if !ok {
+		return
+	}
+	// The password used to be a field of the user; CreateUserRequest has
+	// it next to the user.
+	var user struct {
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(body, &user); err != nil {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req, _ := json.Marshal(map[string]interface{}{"user": json.RawMessage(body), "password": user.Password})
+
+	resp := c.forward(ctx, http.MethodPost, Prefix+"/users", req)
+	if resp.failed(ctx) {
+		return
+	}
+	c.respondUser(ctx, http.StatusCreated, resp)
+}
+
+func (c *LegacyHandler) GetUser(ctx *gin.Context) {
+	id, ok := userID(ctx)
+	if !ok {
+		return
+	}
+	resp := c.forward(ctx, http.MethodGet, Prefix+"/users/"+id, nil)
+	if resp.failed(ctx) {
+		return
+	}
+	c.respondUser(ctx, http.StatusOK, resp)
+}
+
+func (c *LegacyHandler) UpdateUser(ctx *gin.Context) {
+	id, ok := userID(ctx)
+	if !ok {
+		return
+	}
+	body, ok := jsonBody(ctx, &userPack.User{})
+	if !ok {
+		return
+	}
+	resp := c.forward(ctx, http.MethodPatch, Prefix+"/users/"+id, body)
+	if resp.failed(ctx) {
+		return
+	}
+
+	var out map[string]interface{}
+	if err := json.Unmarshal(resp.body.Bytes(), &out); err != nil {
+		negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if out["pending_email"] == "" {
+		delete(out, "pending_email")
+	}
+	negotiate.Render(ctx, http.StatusOK, out)
+}
+
+func (c *LegacyHandler) DeleteUser(ctx *gin.Context) {
+	id, ok := userID(ctx)
+	if !ok {
+		return
+	}
+	resp := c.forward(ctx, http.MethodDelete, Prefix+"/users/"+id, nil)
+	if resp.failed(ctx) {
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// SuspendUser, ReactivateUser and DeactivateUser forward to the :suspend,
+// :reactivate and :deactivate methods; the body with the reason is the same.
+func (c *LegacyHandler) SuspendUser(ctx *gin.Context) {
+	c.changeStatus(ctx, "suspend")
+}
+
+func (c *LegacyHandler) ReactivateUser(ctx *gin.Context) {
+	c.changeStatus(ctx, "reactivate")
+}
+
+func (c *LegacyHandler) DeactivateUser(ctx *gin.Context) {
+	c.changeStatus(ctx, "deactivate")
+}
+
+func (c *LegacyHandler) changeStatus(ctx *gin.Context, verb string) {
+	id, ok := userID(ctx)
+	if !ok {
+		return
+	}
+	body, ok := jsonBody(ctx, &userPack.StatusChangeRequest{})
+	if !ok {
+		return
+	}
+	resp := c.forward(ctx, http.MethodPost, fmt.Sprintf("%s/users/%s:%s", Prefix, id, verb), body)
+	if resp.failed(ctx) {
+		return
+	}
+	c.respondUser(ctx, http.StatusOK, resp)
+}
+
+// respondUser unwraps the user of a gateway response and writes it the
+// way userPack.User is encoded.
+func (c *LegacyHandler) respondUser(ctx *gin.Context, status int, resp *response) {
+	var out userpb.GetUserResponse
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(resp.body.Bytes(), &out); err != nil || out.User == nil {
+		negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": "unexpected response from the gateway"})
+		return
+	}
+	user := userPack.UserFromProto(out.User)
+	httpcache.SetLastModified(ctx.Writer.Header(), user.Updated)
+	negotiate.Render(ctx, status, user)
+}
+
+// jsonBody returns the body of the request as JSON for the gateway. Bodies
+// in other formats are decoded into v and encoded again.
+func jsonBody(ctx *gin.Context, v interface{}) ([]byte, bool) {
+	if ct := ctx.ContentType(); ct == "" || ct == binding.MIMEJSON {
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return nil, false
+		}
+		return body, true
+	}
+	if !negotiate.Bind(ctx, v) {
+		return nil, false
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return body, true
+}
+
+func userID(ctx *gin.Context) (string, bool) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return "", false
+	}
+	return strconv.Itoa(id), true
+}
+
+// forward runs the request through the gateway as method path and buffers
+// the answer for reshaping. Headers and the query string are kept.
+func (c *LegacyHandler) forward(ctx *gin.Context, method, path string, body []byte) *response {
+	req := ctx.Request.Clone(ctx.Request.Context())
+	req.Method = method
+	req.URL.Path, req.URL.RawPath = path, ""
+	req.RequestURI = ""
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp := &response{header: make(http.Header), status: http.StatusOK}
+	c.gateway.ServeHTTP(resp, req)
+	return resp
+}
+
+// response is an http.ResponseWriter keeping what the gateway wrote.
+type response struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *response) Header() http.Header {
+	return r.header
+}
+
+func (r *response) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *response) Write(p []byte) (int, error) {
+	return r.body.Write(p)
+}
+
+// failed writes the error of an unsuccessful response in the legacy shape
+// and reports whether there was one.
+func (r *response) failed(ctx *gin.Context) bool {
+	if r.status < http.StatusBadRequest {
+		return false
+	}
+	var s struct {
+		Code    codes.Code `json:"code"`
+		Message string     `json:"message"`
+	}
+	if err := json.Unmarshal(r.body.Bytes(), &s); err != nil {
+		s.Message = http.StatusText(r.status)
+	}
+	if s.Code == codes.NotFound {
+		s.Message = "User not found"
+	}
+	if retryAfter := r.header.Get("Retry-After"); retryAfter != "" {
+		ctx.Header("Retry-After", retryAfter)
+	}
+	negotiate.Render(ctx, r.status, gin.H{"error": s.Message})
+	return true
+}
@@ -0,0 +1,72 @@
+package graphqlPack
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+
+	orgPack "user-api/internal/org-pack"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/ratelimit"
+)
+
+// Error codes in the extensions of GraphQL errors.
+const (
+	CodeBadUserInput          = "BAD_USER_INPUT"
+	CodeNotFound              = "NOT_FOUND"
+	CodeConflict              = "CONFLICT"
+	CodeGone                  = "GONE"
+	CodeUnauthenticated       = "UNAUTHENTICATED"
+	CodeForbidden             = "FORBIDDEN"
+	CodeUnavailable           = "UNAVAILABLE"
+	CodeQuotaExceeded         = "QUOTA_EXCEEDED"
+	CodeInternal              = "INTERNAL_SERVER_ERROR"
+	CodePersistedQueryMissing = "PERSISTED_QUERY_NOT_FOUND"
+)
+
+// Error is a resolver error with a code for clients.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.Code}
+}
+
+func badUserInput(format string, args ...interface{}) *Error {
+	return &Error{Code: CodeBadUserInput, Message: fmt.Sprintf(format, args...)}
+}
+
+func forbidden(message string) *Error {
+	return &Error{Code: CodeForbidden, Message: message}
+}
+
+// serviceError gives errors of the user service the code of the HTTP
+// status the REST handlers answer them with.
+func serviceError(err error) error {
+	var quota *ratelimit.QuotaError
+	switch {
+	case errors.As(err, &quota):
+		return &Error{Code: CodeQuotaExceeded, Message: err.Error()}
+	case errors.Is(err, userPack.ErrUserNotFound), errors.Is(err, pgx.ErrNoRows):
+		return &Error{Code: CodeNotFound, Message: userPack.ErrUserNotFound.Error()}
+	case errors.Is(err, userPack.ErrResumeTokenExpired):
+		return &Error{Code: CodeGone, Message: err.Error()}
+	case errors.Is(err, userPack.ErrStatusReasonRequired), errors.Is(err, userPack.ErrInvalidResumeToken):
+		return &Error{Code: CodeBadUserInput, Message: err.Error()}
+	case errors.Is(err, userPack.ErrEmailTaken), errors.Is(err, userPack.ErrInvalidStatusTransition):
+		return &Error{Code: CodeConflict, Message: err.Error()}
+	case errors.Is(err, orgPack.ErrNotAuthenticated):
+		return &Error{Code: CodeUnauthenticated, Message: err.Error()}
+	case errors.Is(err, userPack.ErrWatchUnavailable):
+		return &Error{Code: CodeUnavailable, Message: err.Error()}
+	default:
+		return &Error{Code: CodeInternal, Message: err.Error()}
+	}
+}
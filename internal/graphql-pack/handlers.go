@@ -0,0 +1,212 @@
+package graphqlPack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	orgPack "user-api/internal/org-pack"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/graphql"
+)
+
+// Path is where the GraphQL endpoint is served. Subscriptions use the same
+// path over WebSocket.
+const Path = "/graphql"
+
+type GraphQLHandler struct {
+	schema    *graphql.Schema
+	resolver  *resolver
+	limits    graphql.Limits
+	persisted *persistedQueries
+}
+
+type GraphQLHandlerOption func(*GraphQLHandler)
+
+// WithLimits rejects queries nested deeper than maxDepth or with a
+// complexity above maxComplexity before they run. Zero means no limit.
+func WithLimits(maxDepth, maxComplexity int) GraphQLHandlerOption {
+	return func(h *GraphQLHandler) {
+		h.limits.MaxDepth, h.limits.MaxComplexity = maxDepth, maxComplexity
+	}
+}
+
+// WithPersistedQueries enables automatic persisted queries, keeping up to
+// size of them in memory.
+func WithPersistedQueries(size int) GraphQLHandlerOption {
+	return func(h *GraphQLHandler) {
+		h.persisted = newPersistedQueries(size)
+	}
+}
+
+func NewGraphQLHandler(users *userPack.UserService, orgs *orgPack.OrgService, opts ...GraphQLHandlerOption) (*GraphQLHandler, error) {
+	r := &resolver{users: users, orgs: orgs}
+	schema, err := newSchema(r)
+	if err != nil {
+		return nil, err
+	}
+	h := &GraphQLHandler{schema: schema, resolver: r}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h, nil
+}
+
+// Params is a GraphQL request as sent in a POST body, in the query string
+// of a GET or in the payload of a WebSocket subscribe message.
+type Params struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	Extensions    Extensions             `json:"extensions"`
+}
+
+type Extensions struct {
+	PersistedQuery *PersistedQuery `json:"persistedQuery,omitempty"`
+}
+
+// PersistedQuery refers to a query by the SHA-256 of its text, following
+// the automatic persisted queries protocol: clients send the hash alone
+// and only add the query when the server answers PersistedQueryNotFound.
+type PersistedQuery struct {
+	Version    int    `json:"version"`
+	Sha256Hash string `json:"sha256Hash"`
+}
+
+// Serve answers queries and mutations sent by POST or GET (queries only)
+// and upgrades WebSocket requests to the graphql-transport-ws protocol.
+func (c *GraphQLHandler) Serve(ctx *gin.Context) {
+	if strings.EqualFold(ctx.GetHeader("Upgrade"), "websocket") {
+		c.serveWebSocket(ctx)
+		return
+	}
+
+	var params Params
+	switch ctx.Request.Method {
+	case http.MethodGet:
+		params.Query = ctx.Query("query")
+		params.OperationName = ctx.Query("operationName")
+		if v := ctx.Query("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &params.Variables); err != nil {
+				respondError(ctx, http.StatusBadRequest, "variables must be a JSON object")
+				return
+			}
+		}
+		if v := ctx.Query("extensions"); v != "" {
+			if err := json.Unmarshal([]byte(v), &params.Extensions); err != nil {
+				respondError(ctx, http.StatusBadRequest, "extensions must be a JSON object")
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := ctx.ShouldBindJSON(&params); err != nil {
+			respondError(ctx, http.StatusBadRequest, err.Error())
+			return
+		}
+	default:
+		ctx.Header("Allow", "GET, POST")
+		respondError(ctx, http.StatusMethodNotAllowed, "GraphQL requests must use GET or POST")
+		return
+	}
+	if params.Query == "" && params.Extensions.PersistedQuery == nil {
+		respondError(ctx, http.StatusBadRequest, "Must provide query string.")
+		return
+	}
+
+	req, gqlErr := c.request(&params)
+	if gqlErr != nil {
+		ctx.JSON(http.StatusOK, &graphql.Result{Errors: []*graphql.Error{gqlErr}})
+		return
+	}
+	op, err := req.Operation()
+	if err != nil {
+		ctx.JSON(http.StatusOK, &graphql.Result{Errors: []*graphql.Error{err.(*graphql.Error)}})
+		return
+	}
+	switch {
+	case op == graphql.OperationSubscription:
+		respondError(ctx, http.StatusBadRequest, "Subscriptions are only served over WebSocket")
+		return
+	case op == graphql.OperationMutation && ctx.Request.Method == http.MethodGet:
+		// GET must stay safe, or a link could change data.
+		ctx.Header("Allow", "POST")
+		respondError(ctx, http.StatusMethodNotAllowed, "Mutations must be sent with POST")
+		return
+	}
+
+	ctx.JSON(http.StatusOK, graphql.Execute(ctx.Request.Context(), req))
+}
+
+// Schema returns the schema in the schema definition language.
+func (c *GraphQLHandler) Schema(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(c.schema.SDL()+"\n"))
+}
+
+// request parses params, or looks its document up among the persisted
+// queries.
+func (c *GraphQLHandler) request(params *Params) (*graphql.Request, *graphql.Error) {
+	document, gqlErr := c.document(params)
+	if gqlErr != nil {
+		return nil, gqlErr
+	}
+	return &graphql.Request{
+		Schema:           c.schema,
+		Document:         document,
+		OperationName:    params.OperationName,
+		Variables:        params.Variables,
+		Limits:           c.limits,
+		ExecutionContext: c.resolver.withLoaders,
+	}, nil
+}
+
+func (c *GraphQLHandler) document(params *Params) (*graphql.Document, *graphql.Error) {
+	pq := params.Extensions.PersistedQuery
+	if pq == nil {
+		return parse(params.Query)
+	}
+	if c.persisted == nil {
+		return nil, &graphql.Error{Message: "PersistedQueryNotSupported", Extensions: map[string]interface{}{"code": "PERSISTED_QUERY_NOT_SUPPORTED"}}
+	}
+
+	hash := strings.ToLower(pq.Sha256Hash)
+	if params.Query == "" {
+		document, ok := c.persisted.get(hash)
+		if !ok {
+			return nil, &graphql.Error{Message: "PersistedQueryNotFound", Extensions: map[string]interface{}{"code": CodePersistedQueryMissing}}
+		}
+		return document, nil
+	}
+	sum := sha256.Sum256([]byte(params.Query))
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, &graphql.Error{Message: "provided sha does not match query", Extensions: map[string]interface{}{"code": CodeBadUserInput}}
+	}
+	document, gqlErr := parse(params.Query)
+	if gqlErr != nil {
+		return nil, gqlErr
+	}
+	c.persisted.put(hash, document)
+	return document, nil
+}
+
+func parse(query string) (*graphql.Document, *graphql.Error) {
+	document, err := graphql.Parse(query)
+	if err != nil {
+		gqlErr, ok := err.(*graphql.Error)
+		if !ok {
+			gqlErr = &graphql.Error{Message: err.Error()}
+		}
+		gqlErr.Extensions = map[string]interface{}{"code": "GRAPHQL_PARSE_FAILED"}
+		return nil, gqlErr
+	}
+	return document, nil
+}
+
+// respondError answers requests that are not GraphQL requests at all in the
+// shape of a GraphQL response, so clients handle them the same way.
+func respondError(ctx *gin.Context, status int, message string) {
+	ctx.JSON(status, &graphql.Result{Errors: []*graphql.Error{{Message: message}}})
+}
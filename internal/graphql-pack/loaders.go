@@ -0,0 +1,56 @@
+package graphqlPack
+
+import (
+	"context"
+
+	orgPack "user-api/internal/org-pack"
+	"user-api/pkg/graphql"
+)
+
+type loadersKey struct{}
+
+// loaders batch the lookups of one execution: the users and memberships
+// asked for by sibling fields are fetched with one query each.
+type loaders struct {
+	users       *graphql.Loader
+	memberships *graphql.Loader
+}
+
+func (r *resolver) withLoaders(ctx context.Context) context.Context {
+	return context.WithValue(ctx, loadersKey{}, &loaders{
+		users:       graphql.NewLoader(r.batchUsers),
+		memberships: graphql.NewLoader(r.batchMemberships),
+	})
+}
+
+func loadersFrom(ctx context.Context) *loaders {
+	return ctx.Value(loadersKey{}).(*loaders)
+}
+
+func (r *resolver) batchUsers(ctx context.Context, ids []int) (map[int]interface{}, error) {
+	users, _, err := r.users.BatchGetUsers(ctx, ids)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	out := make(map[int]interface{}, len(users))
+	for _, user := range users {
+		out[user.ID] = user
+	}
+	return out, nil
+}
+
+func (r *resolver) batchMemberships(ctx context.Context, userIDs []int) (map[int]interface{}, error) {
+	memberships, err := r.orgs.BatchListUserOrganizations(ctx, userIDs)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+	out := make(map[int]interface{}, len(userIDs))
+	for _, id := range userIDs {
+		if memberships[id] == nil {
+			out[id] = []*orgPack.Membership{}
+			continue
+		}
+		out[id] = memberships[id]
+	}
+	return out, nil
+}
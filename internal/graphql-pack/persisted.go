@@ -0,0 +1,54 @@
+package graphqlPack
+
+import (
+	"container/list"
+	"sync"
+
+	"user-api/pkg/graphql"
+)
+
+// persistedQueries keeps the parsed documents of persisted queries by the
+// hex SHA-256 of their text, evicting the least recently used ones once it
+// holds size queries.
+type persistedQueries struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type persistedQuery struct {
+	hash     string
+	document *graphql.Document
+}
+
+func newPersistedQueries(size int) *persistedQueries {
+	return &persistedQueries{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (q *persistedQueries) get(hash string) (*graphql.Document, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.entries[hash]
+	if !ok {
+		return nil, false
+	}
+	q.order.MoveToFront(e)
+	return e.Value.(*persistedQuery).document, true
+}
+
+func (q *persistedQueries) put(hash string, document *graphql.Document) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e, ok := q.entries[hash]; ok {
+		q.order.MoveToFront(e)
+		return
+	}
+	q.entries[hash] = q.order.PushFront(&persistedQuery{hash: hash, document: document})
+	for q.order.Len() > q.size {
+		oldest := q.order.Back()
+		q.order.Remove(oldest)
+		delete(q.entries, oldest.Value.(*persistedQuery).hash)
+	}
+}
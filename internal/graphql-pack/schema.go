@@ -0,0 +1,404 @@
+package graphqlPack
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	orgPack "user-api/internal/org-pack"
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/graphql"
+)
+
+// DateTime is a timestamp in RFC 3339 format.
+var DateTime = &graphql.Scalar{
+	Name:        "DateTime",
+	Description: "A timestamp in RFC 3339 format.",
+	Serialize: func(v interface{}) (interface{}, error) {
+		t, ok := v.(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("DateTime cannot represent %v", v)
+		}
+		return t.UTC().Format(time.RFC3339Nano), nil
+	},
+	ParseValue: parseDateTime,
+	ParseLiteral: func(v graphql.Value) (interface{}, error) {
+		return parseDateTime(v)
+	},
+}
+
+func parseDateTime(v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("DateTime cannot represent %v", v)
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, fmt.Errorf("DateTime cannot represent %q, expected RFC 3339", s)
+	}
+	return t, nil
+}
+
+var userStatusEnum = &graphql.Enum{
+	Name: "UserStatus",
+	Values: []*graphql.EnumValueDefinition{
+		{Name: "PENDING", Value: userPack.StatusPending},
+		{Name: "ACTIVE", Value: userPack.StatusActive},
+		{Name: "SUSPENDED", Value: userPack.StatusSuspended},
+		{Name: "DEACTIVATED", Value: userPack.StatusDeactivated},
+	},
+}
+
+var orgRoleEnum = &graphql.Enum{
+	Name: "OrgRole",
+	Values: []*graphql.EnumValueDefinition{
+		{Name: "OWNER", Value: orgPack.RoleOwner},
+		{Name: "ADMIN", Value: orgPack.RoleAdmin},
+		{Name: "MEMBER", Value: orgPack.RoleMember},
+	},
+}
+
+var userEventTypeEnum = &graphql.Enum{
+	Name: "UserEventType",
+	Values: []*graphql.EnumValueDefinition{
+		{Name: "CREATED", Value: userPack.UserEventCreated},
+		{Name: "UPDATED", Value: userPack.UserEventUpdated},
+		{Name: "DELETED", Value: userPack.UserEventDeleted},
+	},
+}
+
+var organizationType = &graphql.Object{
+	Name: "Organization",
+	Fields: []*graphql.FieldDefinition{
+		{Name: "id", Type: graphql.NewNonNull(graphql.ID), Resolve: orgField(func(o *orgPack.Organization) interface{} { return o.ID })},
+		{Name: "name", Type: graphql.NewNonNull(graphql.String), Resolve: orgField(func(o *orgPack.Organization) interface{} { return o.Name })},
+		{Name: "slug", Type: graphql.NewNonNull(graphql.String), Resolve: orgField(func(o *orgPack.Organization) interface{} { return o.Slug })},
+		{Name: "created", Type: graphql.NewNonNull(DateTime), Resolve: orgField(func(o *orgPack.Organization) interface{} { return o.Created })},
+	},
+}
+
+var membershipType = &graphql.Object{
+	Name:        "Membership",
+	Description: "An organization together with the role the user has in it.",
+	Fields: []*graphql.FieldDefinition{
+		{Name: "organization", Type: graphql.NewNonNull(organizationType), Resolve: membershipField(func(m *orgPack.Membership) interface{} { return &m.Organization })},
+		{Name: "role", Type: graphql.NewNonNull(orgRoleEnum), Resolve: membershipField(func(m *orgPack.Membership) interface{} { return m.Role })},
+		{Name: "joined", Type: graphql.NewNonNull(DateTime), Resolve: membershipField(func(m *orgPack.Membership) interface{} { return m.Joined })},
+	},
+}
+
+func orgField(get func(*orgPack.Organization) interface{}) graphql.ResolveFunc {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return get(p.Source.(*orgPack.Organization)), nil
+	}
+}
+
+func membershipField(get func(*orgPack.Membership) interface{}) graphql.ResolveFunc {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return get(p.Source.(*orgPack.Membership)), nil
+	}
+}
+
+func userField(get func(*userPack.User) interface{}) graphql.ResolveFunc {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return get(p.Source.(*userPack.User)), nil
+	}
+}
+
+// optional turns the zero value of a string into null.
+func optional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func parseID(v interface{}) (int, error) {
+	id, err := strconv.Atoi(v.(string))
+	if err != nil {
+		return 0, badUserInput("invalid user ID %q", v)
+	}
+	return id, nil
+}
+
+type resolver struct {
+	users *userPack.UserService
+	orgs  *orgPack.OrgService
+}
+
+// newSchema builds the GraphQL schema over the user service. Users and
+// their organizations are loaded through the loaders of withLoaders, so a
+// query asking for many users and their organizations costs two queries.
+func newSchema(r *resolver) (*graphql.Schema, error) {
+	userType := &graphql.Object{
+		Name: "User",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "id", Type: graphql.NewNonNull(graphql.ID), Resolve: userField(func(u *userPack.User) interface{} { return u.ID })},
+			{Name: "firstname", Type: graphql.NewNonNull(graphql.String), Resolve: userField(func(u *userPack.User) interface{} { return u.Firstname })},
+			{Name: "lastname", Type: graphql.NewNonNull(graphql.String), Resolve: userField(func(u *userPack.User) interface{} { return u.Lastname })},
+			{Name: "email", Type: graphql.NewNonNull(graphql.String), Resolve: userField(func(u *userPack.User) interface{} { return u.Email })},
+			{Name: "age", Type: graphql.NewNonNull(graphql.Int), Resolve: userField(func(u *userPack.User) interface{} { return u.Age })},
+			{Name: "created", Type: graphql.NewNonNull(DateTime), Resolve: userField(func(u *userPack.User) interface{} { return u.Created })},
+			{Name: "updated", Type: graphql.NewNonNull(DateTime), Resolve: userField(func(u *userPack.User) interface{} { return u.Updated })},
+			{Name: "emailVerified", Type: graphql.NewNonNull(graphql.Boolean), Resolve: userField(func(u *userPack.User) interface{} { return u.EmailVerified })},
+			{
+				Name:        "pendingEmail",
+				Description: "The new email of the user until it is verified.",
+				Type:        graphql.String,
+				Resolve:     userField(func(u *userPack.User) interface{} { return optional(u.PendingEmail) }),
+			},
+			{Name: "status", Type: userStatusEnum, Resolve: userField(func(u *userPack.User) interface{} {
+				if u.Status == "" {
+					return nil
+				}
+				return u.Status
+			})},
+			{Name: "statusReason", Type: graphql.String, Resolve: userField(func(u *userPack.User) interface{} { return optional(u.StatusReason) })},
+			{
+				Name:        "organizations",
+				Description: "The organizations the user is a member of, with their role.",
+				Type:        graphql.NonNullList(membershipType),
+				Resolve:     r.organizations,
+			},
+		},
+	}
+
+	userEventType := &graphql.Object{
+		Name: "UserEvent",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "type", Type: graphql.NewNonNull(userEventTypeEnum), Resolve: eventField(func(e *userPack.UserEvent) interface{} { return e.Type })},
+			{
+				Name:        "user",
+				Description: "The user after the change, or before it for deletes.",
+				Type:        graphql.NewNonNull(userType),
+				Resolve:     eventField(func(e *userPack.UserEvent) interface{} { return e.User }),
+			},
+			{Name: "occurred", Type: graphql.NewNonNull(DateTime), Resolve: eventField(func(e *userPack.UserEvent) interface{} { return e.Occurred })},
+			{
+				Name:        "resumeToken",
+				Description: "Pass it to userChanged to continue the feed after this event.",
+				Type:        graphql.NewNonNull(graphql.String),
+				Resolve:     eventField(func(e *userPack.UserEvent) interface{} { return e.ResumeToken() }),
+			},
+		},
+	}
+
+	createUserInput := &graphql.InputObject{
+		Name: "CreateUserInput",
+		Fields: []*graphql.ArgumentDefinition{
+			{Name: "firstname", Type: graphql.NewNonNull(graphql.String)},
+			{Name: "lastname", Type: graphql.NewNonNull(graphql.String)},
+			{Name: "email", Type: graphql.NewNonNull(graphql.String)},
+			{Name: "age", Type: graphql.Int},
+			{Name: "password", Type: graphql.String},
+		},
+	}
+	updateUserInput := &graphql.InputObject{
+		Name:        "UpdateUserInput",
+		Description: "The fields to change; the others are kept. A new email waits for verification in pendingEmail.",
+		Fields: []*graphql.ArgumentDefinition{
+			{Name: "firstname", Type: graphql.String},
+			{Name: "lastname", Type: graphql.String},
+			{Name: "email", Type: graphql.String},
+			{Name: "age", Type: graphql.Int},
+		},
+	}
+	idArg := &graphql.ArgumentDefinition{Name: "id", Type: graphql.NewNonNull(graphql.ID)}
+	reasonArg := &graphql.ArgumentDefinition{Name: "reason", Type: graphql.NewNonNull(graphql.String)}
+
+	query := &graphql.Object{
+		Name: "Query",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "user", Type: userType, Args: []*graphql.ArgumentDefinition{idArg}, Resolve: r.user},
+			{
+				Name:        "users",
+				Description: "The users with the given ids, null for the ones that do not exist.",
+				Type:        graphql.NewNonNull(graphql.NewList(userType)),
+				Args:        []*graphql.ArgumentDefinition{{Name: "ids", Type: graphql.NonNullList(graphql.ID)}},
+				Resolve:     r.usersByID,
+				Complexity: func(child int, args map[string]interface{}) int {
+					return 1 + child*len(args["ids"].([]interface{}))
+				},
+			},
+		},
+	}
+	mutation := &graphql.Object{
+		Name: "Mutation",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "createUser", Type: graphql.NewNonNull(userType), Args: []*graphql.ArgumentDefinition{{Name: "input", Type: graphql.NewNonNull(createUserInput)}}, Resolve: r.createUser},
+			{Name: "updateUser", Type: graphql.NewNonNull(userType), Args: []*graphql.ArgumentDefinition{idArg, {Name: "input", Type: graphql.NewNonNull(updateUserInput)}}, Resolve: r.updateUser},
+			{Name: "deleteUser", Type: graphql.NewNonNull(graphql.ID), Args: []*graphql.ArgumentDefinition{idArg}, Resolve: r.deleteUser},
+			{Name: "suspendUser", Description: "Admins only.", Type: graphql.NewNonNull(userType), Args: []*graphql.ArgumentDefinition{idArg, reasonArg}, Resolve: r.changeStatus(r.users.SuspendUser)},
+			{Name: "reactivateUser", Description: "Admins only.", Type: graphql.NewNonNull(userType), Args: []*graphql.ArgumentDefinition{idArg, reasonArg}, Resolve: r.changeStatus(r.users.ReactivateUser)},
+			{Name: "deactivateUser", Description: "Admins only.", Type: graphql.NewNonNull(userType), Args: []*graphql.ArgumentDefinition{idArg, reasonArg}, Resolve: r.changeStatus(r.users.DeactivateUser)},
+		},
+	}
+	subscription := &graphql.Object{
+		Name: "Subscription",
+		Fields: []*graphql.FieldDefinition{
+			{
+				Name:        "userChanged",
+				Description: "Streams user changes, starting after resumeToken if given.",
+				Type:        graphql.NewNonNull(userEventType),
+				Args:        []*graphql.ArgumentDefinition{{Name: "resumeToken", Type: graphql.String}},
+				Subscribe:   r.userChanged,
+			},
+		},
+	}
+	return graphql.NewSchema(query, mutation, subscription)
+}
+
+func eventField(get func(*userPack.UserEvent) interface{}) graphql.ResolveFunc {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		return get(p.Source.(*userPack.UserEvent)), nil
+	}
+}
+
+func (r *resolver) user(p graphql.ResolveParams) (interface{}, error) {
+	id, err := parseID(p.Args["id"])
+	if err != nil {
+		return nil, err
+	}
+	return loadersFrom(p.Context).users.Load(p.Context, id), nil
+}
+
+func (r *resolver) usersByID(p graphql.ResolveParams) (interface{}, error) {
+	loaders := loadersFrom(p.Context)
+	var thunks []graphql.Thunk
+	for _, v := range p.Args["ids"].([]interface{}) {
+		id, err := parseID(v)
+		if err != nil {
+			return nil, err
+		}
+		thunks = append(thunks, loaders.users.Load(p.Context, id))
+	}
+	return graphql.Thunk(func() (interface{}, error) {
+		users := make([]interface{}, len(thunks))
+		for i, thunk := range thunks {
+			user, err := thunk()
+			if err != nil {
+				return nil, err
+			}
+			users[i] = user
+		}
+		return users, nil
+	}), nil
+}
+
+func (r *resolver) organizations(p graphql.ResolveParams) (interface{}, error) {
+	user := p.Source.(*userPack.User)
+	return loadersFrom(p.Context).memberships.Load(p.Context, user.ID), nil
+}
+
+func (r *resolver) createUser(p graphql.ResolveParams) (interface{}, error) {
+	input := p.Args["input"].(map[string]interface{})
+	user := &userPack.User{
+		Firstname: input["firstname"].(string),
+		Lastname:  input["lastname"].(string),
+		Email:     input["email"].(string),
+	}
+	if age, ok := input["age"].(int); ok {
+		if age < 0 {
+			return nil, badUserInput("age must not be negative")
+		}
+		user.Age = uint(age)
+	}
+	if password, ok := input["password"].(string); ok {
+		user.Password = password
+	}
+	if err := userPack.ValidateUser(user); err != nil {
+		return nil, badUserInput("%v", err)
+	}
+
+	if err := r.users.CreateUser(p.Context, user); err != nil {
+		return nil, serviceError(err)
+	}
+	return user, nil
+}
+
+func (r *resolver) updateUser(p graphql.ResolveParams) (interface{}, error) {
+	id, err := parseID(p.Args["id"])
+	if err != nil {
+		return nil, err
+	}
+	user, err := r.users.GetUser(p.Context, id)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+
+	input := p.Args["input"].(map[string]interface{})
+	if v, ok := input["firstname"].(string); ok {
+		user.Firstname = v
+	}
+	if v, ok := input["lastname"].(string); ok {
+		user.Lastname = v
+	}
+	if v, ok := input["email"].(string); ok {
+		user.Email = v
+	}
+	if v, ok := input["age"].(int); ok {
+		if v < 0 {
+			return nil, badUserInput("age must not be negative")
+		}
+		user.Age = uint(v)
+	}
+	if err := userPack.ValidateUser(user); err != nil {
+		return nil, badUserInput("%v", err)
+	}
+
+	if err := r.users.UpdateUser(p.Context, id, user); err != nil {
+		return nil, serviceError(err)
+	}
+	return user, nil
+}
+
+func (r *resolver) deleteUser(p graphql.ResolveParams) (interface{}, error) {
+	id, err := parseID(p.Args["id"])
+	if err != nil {
+		return nil, err
+	}
+	if err := r.users.DeleteUser(p.Context, id); err != nil {
+		return nil, serviceError(err)
+	}
+	return id, nil
+}
+
+func (r *resolver) changeStatus(change func(ctx context.Context, id int, reason string) (*userPack.User, error)) graphql.ResolveFunc {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		if !reqctx.FromContext(p.Context).IsAdmin() {
+			return nil, forbidden("only admins can change the status of users")
+		}
+		id, err := parseID(p.Args["id"])
+		if err != nil {
+			return nil, err
+		}
+		user, err := change(p.Context, id, p.Args["reason"].(string))
+		if err != nil {
+			return nil, serviceError(err)
+		}
+		return user, nil
+	}
+}
+
+func (r *resolver) userChanged(p graphql.ResolveParams) (<-chan interface{}, error) {
+	resumeToken, _ := p.Args["resumeToken"].(string)
+	events, err := r.users.WatchUsers(p.Context, resumeToken)
+	if err != nil {
+		return nil, serviceError(err)
+	}
+
+	out := make(chan interface{})
+	go func() {
+		defer close(out)
+		for event := range events {
+			select {
+			case out <- event:
+			case <-p.Context.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,186 @@
+package graphqlPack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+
+	"user-api/pkg/graphql"
+)
+
+// Subprotocol is the GraphQL over WebSocket protocol spoken on Path, see
+// https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md.
+const Subprotocol = "graphql-transport-ws"
+
+// connectionInitTimeout is how long a client has to send connection_init.
+const connectionInitTimeout = 10 * time.Second
+
+// Message types of the graphql-transport-ws protocol.
+const (
+	messageConnectionInit = "connection_init"
+	messageConnectionAck  = "connection_ack"
+	messagePing           = "ping"
+	messagePong           = "pong"
+	messageSubscribe      = "subscribe"
+	messageNext           = "next"
+	messageError          = "error"
+	messageComplete       = "complete"
+)
+
+type message struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func (c *GraphQLHandler) serveWebSocket(ctx *gin.Context) {
+	server := websocket.Server{
+		// Requests are authenticated by their headers like any other, so
+		// there is no Origin to check; the subprotocol must be ours.
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			for _, protocol := range config.Protocol {
+				if protocol == Subprotocol {
+					config.Protocol = []string{Subprotocol}
+					return nil
+				}
+			}
+			return fmt.Errorf("unsupported subprotocol, expected %s", Subprotocol)
+		},
+		Handler: c.serveConn,
+	}
+	server.ServeHTTP(ctx.Writer, ctx.Request)
+}
+
+// wsConn is one WebSocket connection with its running operations.
+type wsConn struct {
+	handler *GraphQLHandler
+	ws      *websocket.Conn
+
+	writeMu sync.Mutex
+
+	mu         sync.Mutex
+	operations map[string]context.CancelFunc
+}
+
+func (c *GraphQLHandler) serveConn(ws *websocket.Conn) {
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+	conn := &wsConn{handler: c, ws: ws, operations: make(map[string]context.CancelFunc)}
+	defer ws.Close()
+
+	ws.SetReadDeadline(time.Now().Add(connectionInitTimeout))
+	acknowledged := false
+	for {
+		var msg message
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case messageConnectionInit:
+			if acknowledged {
+				return
+			}
+			acknowledged = true
+			ws.SetReadDeadline(time.Time{})
+			conn.send(&message{Type: messageConnectionAck})
+		case messagePing:
+			conn.send(&message{Type: messagePong})
+		case messagePong:
+		case messageSubscribe:
+			if !acknowledged || msg.ID == "" {
+				return
+			}
+			var params Params
+			if err := json.Unmarshal(msg.Payload, &params); err != nil {
+				return
+			}
+			if !conn.start(ctx, msg.ID, &params) {
+				// Reusing the id of a running operation is a protocol error.
+				return
+			}
+		case messageComplete:
+			conn.stop(msg.ID)
+		default:
+			return
+		}
+	}
+}
+
+func (conn *wsConn) send(msg *message) {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	// A failed write shows up as a failed read in serveConn.
+	websocket.JSON.Send(conn.ws, msg)
+}
+
+func (conn *wsConn) sendPayload(id, typ string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		data, _ = json.Marshal([]*graphql.Error{{Message: err.Error()}})
+		typ = messageError
+	}
+	conn.send(&message{ID: id, Type: typ, Payload: data})
+}
+
+// start runs an operation in the background. Queries and mutations send
+// one result, subscriptions one per event, and both end with complete.
+func (conn *wsConn) start(ctx context.Context, id string, params *Params) bool {
+	conn.mu.Lock()
+	if _, ok := conn.operations[id]; ok {
+		conn.mu.Unlock()
+		return false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	conn.operations[id] = cancel
+	conn.mu.Unlock()
+
+	go func() {
+		defer conn.stop(id)
+
+		req, gqlErr := conn.handler.request(params)
+		if gqlErr != nil {
+			conn.sendPayload(id, messageError, []*graphql.Error{gqlErr})
+			return
+		}
+		op, err := req.Operation()
+		if err != nil {
+			conn.sendPayload(id, messageError, []*graphql.Error{err.(*graphql.Error)})
+			return
+		}
+		if op != graphql.OperationSubscription {
+			conn.sendPayload(id, messageNext, graphql.Execute(ctx, req))
+			conn.send(&message{ID: id, Type: messageComplete})
+			return
+		}
+
+		results, failed := graphql.Subscribe(ctx, req)
+		if failed != nil {
+			conn.sendPayload(id, messageError, failed.Errors)
+			return
+		}
+		for result := range results {
+			conn.sendPayload(id, messageNext, result)
+		}
+		// Only tell the client if the feed ended on our side.
+		if ctx.Err() == nil {
+			conn.send(&message{ID: id, Type: messageComplete})
+		}
+	}()
+	return true
+}
+
+func (conn *wsConn) stop(id string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if cancel, ok := conn.operations[id]; ok {
+		cancel()
+		delete(conn.operations, id)
+	}
+}
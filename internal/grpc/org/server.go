@@ -0,0 +1,289 @@
+package orgGrpc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	orgpb "user-api/gen/org"
+	orgPack "user-api/internal/org-pack"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+type grpcServer struct {
+	orgpb.UnimplementedOrganizationServiceServer
+	orgService *orgPack.OrgService
+}
+
+func NewGRPCServer(orgService *orgPack.OrgService) *grpcServer {
+	return &grpcServer{orgService: orgService}
+}
+
+func (s *grpcServer) CreateOrganization(ctx context.Context, req *orgpb.CreateOrganizationRequest) (*orgpb.OrganizationResponse, error) {
+	if req.Organization == nil {
+		return nil, fmt.Errorf("organization data is nil")
+	}
+	org := &orgPack.Organization{Name: req.Organization.Name, Slug: req.Organization.Slug}
+	if err := orgPack.ValidateOrganization(org); err != nil {
+		return nil, fmt.Errorf("invalid organization: %w", err)
+	}
+	if req.OwnerId <= 0 {
+		return nil, fmt.Errorf("owner_id is required")
+	}
+
+	if err := s.orgService.CreateOrganization(ctx, org, int(req.OwnerId)); err != nil {
+		return nil, fmt.Errorf("failed to create organization: %w", err)
+	}
+
+	return &orgpb.OrganizationResponse{Organization: convertOrganization(org)}, nil
+}
+
+func (s *grpcServer) GetOrganization(ctx context.Context, req *orgpb.GetOrganizationRequest) (*orgpb.OrganizationResponse, error) {
+	org, err := s.orgService.GetOrganization(ctx, int(req.Id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get organization: %w", err)
+	}
+
+	return &orgpb.OrganizationResponse{Organization: convertOrganization(org)}, nil
+}
+
+// UpdateOrganization replaces the name and slug of the organization.
+func (s *grpcServer) UpdateOrganization(ctx context.Context, req *orgpb.UpdateOrganizationRequest) (*orgpb.OrganizationResponse, error) {
+	if req.Organization == nil {
+		return nil, fmt.Errorf("organization data is nil")
+	}
+
+	org, err := s.orgService.UpdateOrganization(ctx, int(req.Organization.Id), func(org *orgPack.Organization) error {
+		org.Name, org.Slug = req.Organization.Name, req.Organization.Slug
+		return orgPack.ValidateOrganization(org)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update organization: %w", err)
+	}
+
+	return &orgpb.OrganizationResponse{Organization: convertOrganization(org)}, nil
+}
+
+func (s *grpcServer) DeleteOrganization(ctx context.Context, req *orgpb.DeleteOrganizationRequest) (*orgpb.DeleteResponse, error) {
+	if err := s.orgService.DeleteOrganization(ctx, int(req.Id)); err != nil {
+		return nil, fmt.Errorf("failed to delete organization: %w", err)
+	}
+
+	return &orgpb.DeleteResponse{Message: "Organization deleted successfully"}, nil
+}
+
+func (s *grpcServer) ListMembers(ctx context.Context, req *orgpb.ListMembersRequest) (*orgpb.ListMembersResponse, error) {
+	limit, offset, err := pagination(req.Limit, req.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := s.orgService.ListMembers(ctx, int(req.OrgId), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members: %w", err)
+	}
+
+	return &orgpb.ListMembersResponse{Members: convertMembers(members)}, nil
+}
+
+func (s *grpcServer) ListUserOrganizations(ctx context.Context, req *orgpb.ListUserOrganizationsRequest) (*orgpb.ListUserOrganizationsResponse, error) {
+	limit, offset, err := pagination(req.Limit, req.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships, err := s.orgService.ListUserOrganizations(ctx, int(req.UserId), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list organizations: %w", err)
+	}
+
+	resp := &orgpb.ListUserOrganizationsResponse{}
+	for _, m := range memberships {
+		resp.Organizations = append(resp.Organizations, &orgpb.Membership{
+			Organization: convertOrganization(&m.Organization),
+			Role:         m.Role,
+			Joined:       m.Joined.Format(time.RFC3339),
+		})
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) SetMember(ctx context.Context, req *orgpb.SetMemberRequest) (*orgpb.MemberResponse, error) {
+	if err := orgPack.ValidateRole(req.Role); err != nil {
+		return nil, err
+	}
+
+	member, err := s.orgService.SetMember(ctx, int(req.OrgId), int(req.UserId), req.Role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set member: %w", err)
+	}
+
+	return &orgpb.MemberResponse{Member: convertMember(member)}, nil
+}
+
+func (s *grpcServer) RemoveMember(ctx context.Context, req *orgpb.RemoveMemberRequest) (*orgpb.DeleteResponse, error) {
+	if err := s.orgService.RemoveMember(ctx, int(req.OrgId), int(req.UserId)); err != nil {
+		return nil, fmt.Errorf("failed to remove member: %w", err)
+	}
+
+	return &orgpb.DeleteResponse{Message: "Member removed successfully"}, nil
+}
+
+func (s *grpcServer) CreateTeam(ctx context.Context, req *orgpb.CreateTeamRequest) (*orgpb.TeamResponse, error) {
+	if req.Team == nil {
+		return nil, fmt.Errorf("team data is nil")
+	}
+	team := &orgPack.Team{OrgID: int(req.Team.OrgId), Name: req.Team.Name, Description: req.Team.Description}
+	if err := orgPack.ValidateTeam(team); err != nil {
+		return nil, fmt.Errorf("invalid team: %w", err)
+	}
+
+	if err := s.orgService.CreateTeam(ctx, team); err != nil {
+		return nil, fmt.Errorf("failed to create team: %w", err)
+	}
+
+	return &orgpb.TeamResponse{Team: convertTeam(team)}, nil
+}
+
+func (s *grpcServer) GetTeam(ctx context.Context, req *orgpb.GetTeamRequest) (*orgpb.TeamResponse, error) {
+	team, err := s.orgService.GetTeam(ctx, int(req.OrgId), int(req.Id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get team: %w", err)
+	}
+
+	return &orgpb.TeamResponse{Team: convertTeam(team)}, nil
+}
+
+func (s *grpcServer) ListTeams(ctx context.Context, req *orgpb.ListTeamsRequest) (*orgpb.ListTeamsResponse, error) {
+	limit, offset, err := pagination(req.Limit, req.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	teams, err := s.orgService.ListTeams(ctx, int(req.OrgId), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list teams: %w", err)
+	}
+
+	resp := &orgpb.ListTeamsResponse{}
+	for _, team := range teams {
+		resp.Teams = append(resp.Teams, convertTeam(team))
+	}
+	return resp, nil
+}
+
+// UpdateTeam replaces the name and description of the team.
+func (s *grpcServer) UpdateTeam(ctx context.Context, req *orgpb.UpdateTeamRequest) (*orgpb.TeamResponse, error) {
+	if req.Team == nil {
+		return nil, fmt.Errorf("team data is nil")
+	}
+
+	team, err := s.orgService.UpdateTeam(ctx, int(req.Team.OrgId), int(req.Team.Id), func(team *orgPack.Team) error {
+		team.Name, team.Description = req.Team.Name, req.Team.Description
+		return orgPack.ValidateTeam(team)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update team: %w", err)
+	}
+
+	return &orgpb.TeamResponse{Team: convertTeam(team)}, nil
+}
+
+func (s *grpcServer) DeleteTeam(ctx context.Context, req *orgpb.DeleteTeamRequest) (*orgpb.DeleteResponse, error) {
+	if err := s.orgService.DeleteTeam(ctx, int(req.OrgId), int(req.Id)); err != nil {
+		return nil, fmt.Errorf("failed to delete team: %w", err)
+	}
+
+	return &orgpb.DeleteResponse{Message: "Team deleted successfully"}, nil
+}
+
+func (s *grpcServer) ListTeamMembers(ctx context.Context, req *orgpb.ListTeamMembersRequest) (*orgpb.ListMembersResponse, error) {
+	limit, offset, err := pagination(req.Limit, req.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := s.orgService.ListTeamMembers(ctx, int(req.OrgId), int(req.TeamId), limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list team members: %w", err)
+	}
+
+	return &orgpb.ListMembersResponse{Members: convertMembers(members)}, nil
+}
+
+func (s *grpcServer) SetTeamMember(ctx context.Context, req *orgpb.SetTeamMemberRequest) (*orgpb.MemberResponse, error) {
+	if err := orgPack.ValidateTeamRole(req.Role); err != nil {
+		return nil, err
+	}
+
+	member, err := s.orgService.SetTeamMember(ctx, int(req.OrgId), int(req.TeamId), int(req.UserId), req.Role)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set team member: %w", err)
+	}
+
+	return &orgpb.MemberResponse{Member: convertMember(member)}, nil
+}
+
+func (s *grpcServer) RemoveTeamMember(ctx context.Context, req *orgpb.RemoveTeamMemberRequest) (*orgpb.DeleteResponse, error) {
+	if err := s.orgService.RemoveTeamMember(ctx, int(req.OrgId), int(req.TeamId), int(req.UserId)); err != nil {
+		return nil, fmt.Errorf("failed to remove team member: %w", err)
+	}
+
+	return &orgpb.DeleteResponse{Message: "Team member removed successfully"}, nil
+}
+
+// pagination defaults an unset limit to defaultPageSize.
+func pagination(limit, offset int32) (int, int, error) {
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	if limit < 1 || limit > maxPageSize {
+		return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+	if offset < 0 {
+		return 0, 0, fmt.Errorf("offset must not be negative")
+	}
+	return int(limit), int(offset), nil
+}
+
+func convertOrganization(org *orgPack.Organization) *orgpb.Organization {
+	return &orgpb.Organization{
+		Id:      int32(org.ID),
+		Name:    org.Name,
+		Slug:    org.Slug,
+		Created: org.Created.Format(time.RFC3339),
+	}
+}
+
+func convertTeam(team *orgPack.Team) *orgpb.Team {
+	return &orgpb.Team{
+		Id:          int32(team.ID),
+		OrgId:       int32(team.OrgID),
+		Name:        team.Name,
+		Description: team.Description,
+		Created:     team.Created.Format(time.RFC3339),
+	}
+}
+
+func convertMember(member *orgPack.Member) *orgpb.Member {
+	return &orgpb.Member{
+		UserId:    int32(member.UserID),
+		Firstname: member.Firstname,
+		Lastname:  member.Lastname,
+		Email:     member.Email,
+		Role:      member.Role,
+		Joined:    member.Joined.Format(time.RFC3339),
+	}
+}
+
+func convertMembers(members []*orgPack.Member) []*orgpb.Member {
+	var out []*orgpb.Member
+	for _, member := range members {
+		out = append(out, convertMember(member))
+	}
+	return out
+}
@@ -0,0 +1,80 @@
+package userGrpc
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	authPack "user-api/internal/auth-pack"
+	orgPack "user-api/internal/org-pack"
+	"user-api/internal/throttle"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/ratelimit"
+)
+
+// errorCodes maps the errors of the services to gRPC codes. The gateway
+// turns the codes into the HTTP statuses the REST handlers answer with.
+var errorCodes = []struct {
+	code codes.Code
+	errs []error
+}{
+	{codes.NotFound, []error{userPack.ErrUserNotFound, pgx.ErrNoRows, userPack.ErrVersionNotFound, authPack.ErrNotLockedOut,
+		orgPack.ErrOrganizationNotFound, orgPack.ErrTeamNotFound, orgPack.ErrMemberNotFound}},
+	{codes.AlreadyExists, []error{userPack.ErrEmailTaken, orgPack.ErrSlugTaken, orgPack.ErrTeamNameTaken, authPack.ErrMFAAlreadyEnabled}},
+	{codes.FailedPrecondition, []error{userPack.ErrInvalidStatusTransition, userPack.ErrEmailAlreadyVerified,
+		orgPack.ErrLastOwner, orgPack.ErrNotOrgMember, authPack.ErrMFANotEnrolled}},
+	// Expired resume tokens are invalid ones too, so they come first.
+	{codes.OutOfRange, []error{userPack.ErrResumeTokenExpired}},
+	{codes.InvalidArgument, []error{userPack.ErrStatusReasonRequired, userPack.ErrInvalidStatus, userPack.ErrInvalidResumeToken,
+		userPack.ErrInvalidEmailToken, userPack.ErrInvalidSearchQuery, authPack.ErrResetTokenInvalid}},
+	{codes.Unauthenticated, []error{authPack.ErrInvalidCredentials, authPack.ErrInvalidAccessToken, authPack.ErrRefreshTokenInvalid,
+		authPack.ErrRefreshTokenReused, authPack.ErrInvalidMFAToken, authPack.ErrInvalidMFACode, orgPack.ErrNotAuthenticated}},
+	{codes.PermissionDenied, []error{authPack.ErrTenantMismatch, authPack.ErrAccountDisabled,
+		orgPack.ErrNotOrgAdmin, orgPack.ErrNotOrgOwner, orgPack.ErrOwnerNotCaller}},
+	{codes.ResourceExhausted, []error{authPack.ErrTooManyRequests}},
+	{codes.Unavailable, []error{userPack.ErrWatchUnavailable, userPack.ErrEmailVerificationMissing,
+		authPack.ErrMFAUnavailable, authPack.ErrPasswordResetUnavailable}},
+}
+
+// statusError gives err the code of the service error it wraps. Errors
+// that already have a status keep it; anything else stays Unknown.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var lockout *authPack.LockoutError
+	if errors.As(err, &lockout) {
+		return throttle.ResourceExhausted(err.Error(), time.Until(lockout.Until))
+	}
+	var quota *ratelimit.QuotaError
+	if errors.As(err, &quota) {
+		return throttle.ResourceExhausted(err.Error(), time.Until(quota.Reset))
+	}
+	for _, c := range errorCodes {
+		for _, target := range c.errs {
+			if errors.Is(err, target) {
+				return status.Error(c.code, err.Error())
+			}
+		}
+	}
+	return err
+}
+
+// ErrorUnaryInterceptor and ErrorStreamInterceptor set the status of the
+// errors returned by the handlers and the interceptors chained after them.
+func ErrorUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	return resp, statusError(err)
+}
+
+func ErrorStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return statusError(handler(srv, ss))
+}
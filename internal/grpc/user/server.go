@@ -2,106 +2,620 @@ package userGrpc
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sort"
+	"strconv"
 	"time"
 
+	orgpb "user-api/gen/org"
 	userpb "user-api/gen/user"
+	authPack "user-api/internal/auth-pack"
+	orgGrpc "user-api/internal/grpc/org"
+	orgPack "user-api/internal/org-pack"
+	"user-api/internal/reqctx"
 	userPack "user-api/internal/user-pack"
+	"user-api/pkg/config"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type grpcServer struct {
 	userpb.UnimplementedUserServiceServer
-	userService *userPack.UserService
+	userService       *userPack.UserService
+	authService       *authPack.AuthService
+	batchChunkSize    int
+	heartbeatInterval time.Duration
 }
 
-func NewGRPCServer(userService *userPack.UserService) *grpcServer {
+func NewGRPCServer(userService *userPack.UserService, authService *authPack.AuthService, cfg config.Config) *grpcServer {
 	return &grpcServer{
 		UnimplementedUserServiceServer: userpb.UnimplementedUserServiceServer{},
-		userService:                    userService}
+		userService:                    userService,
+		authService:                    authService,
+		batchChunkSize:                 cfg.GRPC.BatchChunkSize,
+		heartbeatInterval:              cfg.Watch.HeartbeatInterval}
 }
 
 func (s *grpcServer) CreateUser(ctx context.Context, req *userpb.CreateUserRequest) (*userpb.CreateUserResponse, error) {
-	log.Printf("Received CreateUser request: %+v", req)
-
-	if req.User == nil {
-		return nil, fmt.Errorf("user data is nil")
-	}
+	log.Printf("Received CreateUser request: %+v", req.User)
 
 	user, err := convertProtoUserToUser(req.User)
-	log.Printf("Converted user: %+v", user)
 	if err != nil {
-		return nil, fmt.Errorf("failed to convert proto user to user: %w", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	user.Password = req.Password
 
 	if err := userPack.ValidateUser(user); err != nil {
-		return nil, fmt.Errorf("invalid user: %w", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	if err := s.userService.CreateUser(ctx, user); err != nil {
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	return &userpb.CreateUserResponse{User: req.User}, nil
+	return &userpb.CreateUserResponse{User: user.ToProto()}, nil
 }
 
 func (s *grpcServer) GetUser(ctx context.Context, req *userpb.GetUserRequest) (*userpb.GetUserResponse, error) {
-	user, err := s.userService.GetUser(ctx, int(req.Id))
-	if err != nil {
-		return nil, fmt.Errorf("user not found: %w", err)
+	var user *userPack.User
+	var err error
+	if req.AsOf != "" {
+		asOf, perr := time.Parse(time.RFC3339, req.AsOf)
+		if perr != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid as_of timestamp, expected RFC 3339")
+		}
+		user, err = s.userService.GetUserAsOf(ctx, int(req.Id), asOf)
+	} else {
+		user, err = s.userService.GetUser(ctx, int(req.Id))
 	}
-
-	protoUser := &userpb.User{
-		Id:        int32(user.ID),
-		Firstname: user.Firstname,
-		Lastname:  user.Lastname,
-		Email:     user.Email,
-		Age:       uint32(user.Age),
-		Created:   user.Created.Format(time.RFC3339),
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
 	}
 
-	return &userpb.GetUserResponse{User: protoUser}, nil
+	return &userpb.GetUserResponse{User: user.ToProto()}, nil
 }
 
 func (s *grpcServer) UpdateUser(ctx context.Context, req *userpb.UpdateUserRequest) (*userpb.UpdateUserResponse, error) {
 	user, err := convertProtoUserToUser(req.User)
-
 	if err != nil {
-		return nil, fmt.Errorf("failed to convert proto user to user: %w", err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := userPack.ValidateUser(user); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 	if err := s.userService.UpdateUser(ctx, int(req.Id), user); err != nil {
 		return nil, fmt.Errorf("failed to update user: %w", err)
 	}
 
+	if user.PendingEmail != "" {
+		return &userpb.UpdateUserResponse{
+			Message:      "User updated, the new email is pending verification",
+			PendingEmail: user.PendingEmail,
+		}, nil
+	}
 	return &userpb.UpdateUserResponse{Message: "User updated"}, nil
 }
 
-func StartGRPCServer(userService *userPack.UserService, port string) error {
+func (s *grpcServer) DeleteUser(ctx context.Context, req *userpb.DeleteUserRequest) (*userpb.DeleteUserResponse, error) {
+	if err := s.userService.DeleteUser(ctx, int(req.Id)); err != nil {
+		return nil, fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return &userpb.DeleteUserResponse{Message: "User deleted"}, nil
+}
+
+func (s *grpcServer) BatchGetUsers(ctx context.Context, req *userpb.BatchGetUsersRequest) (*userpb.BatchGetUsersResponse, error) {
+	ids := make([]int, len(req.Ids))
+	for i, id := range req.Ids {
+		ids[i] = int(id)
+	}
+
+	users, missing, err := s.userService.BatchGetUsers(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+
+	resp := &userpb.BatchGetUsersResponse{}
+	for _, user := range users {
+		resp.Users = append(resp.Users, user.ToProto())
+	}
+	for _, id := range missing {
+		resp.MissingIds = append(resp.MissingIds, int32(id))
+	}
+	return resp, nil
+}
+
+// BatchCreateUsers reads users from the stream and commits them in chunks of
+// batchChunkSize. Each received user gets a result with its position in the
+// stream, so the client can tell which ones were rejected and why.
+func (s *grpcServer) BatchCreateUsers(stream userpb.UserService_BatchCreateUsersServer) error {
+	resp := &userpb.BatchCreateUsersResponse{}
+	fail := func(index int32, err error) {
+		resp.Results = append(resp.Results, &userpb.BatchCreateUserResult{Index: index, Error: err.Error()})
+		resp.Failed++
+	}
+
+	var chunk []*userPack.User
+	var chunkIndexes []int32
+	flush := func() {
+		if len(chunk) == 0 {
+			return
+		}
+		errs, err := s.userService.CreateUsers(stream.Context(), chunk)
+		for i, user := range chunk {
+			switch {
+			case err != nil:
+				fail(chunkIndexes[i], fmt.Errorf("failed to create user: %w", err))
+			case errs[i] != nil:
+				fail(chunkIndexes[i], fmt.Errorf("failed to create user: %w", errs[i]))
+			default:
+				resp.Results = append(resp.Results, &userpb.BatchCreateUserResult{
+					Index: chunkIndexes[i],
+					User:  user.ToProto(),
+					Ok:    true,
+				})
+				resp.Created++
+			}
+		}
+		chunk, chunkIndexes = nil, nil
+	}
+
+	for index := int32(0); ; index++ {
+		protoUser, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to receive user: %w", err)
+		}
+
+		user, err := convertProtoUserToUser(protoUser)
+		if err != nil {
+			fail(index, fmt.Errorf("failed to convert proto user to user: %w", err))
+			continue
+		}
+		if err := userPack.ValidateUser(user); err != nil {
+			fail(index, fmt.Errorf("invalid user: %w", err))
+			continue
+		}
+
+		chunk = append(chunk, user)
+		chunkIndexes = append(chunkIndexes, index)
+		if len(chunk) >= s.batchChunkSize {
+			flush()
+		}
+	}
+	flush()
+
+	sort.Slice(resp.Results, func(i, j int) bool { return resp.Results[i].Index < resp.Results[j].Index })
+	return stream.SendAndClose(resp)
+}
+
+// WatchUsers streams user changes after req.ResumeToken, sending a heartbeat
+// whenever the feed has been idle for heartbeatInterval.
+func (s *grpcServer) WatchUsers(req *userpb.WatchUsersRequest, stream userpb.UserService_WatchUsersServer) error {
+	events, err := s.userService.WatchUsers(stream.Context(), req.ResumeToken)
+	if err != nil {
+		return fmt.Errorf("failed to watch users: %w", err)
+	}
+
+	heartbeat := time.NewTicker(s.heartbeatInterval)
+	defer heartbeat.Stop()
+
+	resumeToken := req.ResumeToken
+	for {
+		var msg *userpb.UserEvent
+		select {
+		case event, ok := <-events:
+			if !ok {
+				if stream.Context().Err() != nil {
+					return nil
+				}
+				return fmt.Errorf("change feed interrupted, resume from token %q", resumeToken)
+			}
+			resumeToken = event.ResumeToken()
+			msg = &userpb.UserEvent{
+				Type:        event.Type,
+				User:        event.User.ToProto(),
+				ResumeToken: resumeToken,
+				Occurred:    event.Occurred.Format(time.RFC3339),
+			}
+		case now := <-heartbeat.C:
+			msg = &userpb.UserEvent{Type: "heartbeat", ResumeToken: resumeToken, Occurred: now.Format(time.RFC3339)}
+		case <-stream.Context().Done():
+			return nil
+		}
+
+		if err := stream.Send(msg); err != nil {
+			return fmt.Errorf("failed to send event: %w", err)
+		}
+	}
+}
+
+func (s *grpcServer) ListUserAuditEvents(ctx context.Context, req *userpb.ListUserAuditEventsRequest) (*userpb.ListUserAuditEventsResponse, error) {
+	limit := int(req.Limit)
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	if req.Offset < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid offset")
+	}
+
+	events, err := s.userService.ListUserAuditEvents(ctx, int(req.UserId), limit, int(req.Offset))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list audit events: %w", err)
+	}
+
+	resp := &userpb.ListUserAuditEventsResponse{}
+	for _, event := range events {
+		protoEvent := &userpb.AuditEvent{
+			Id:        event.ID,
+			UserId:    int32(event.UserID),
+			Action:    event.Action,
+			Actor:     event.Actor,
+			RequestId: event.RequestID,
+			Source:    event.Source,
+			Created:   event.Created.Format(time.RFC3339),
+		}
+		fields := make([]string, 0, len(event.Changes))
+		for field := range event.Changes {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			change := event.Changes[field]
+			protoEvent.Changes = append(protoEvent.Changes, &userpb.FieldChange{
+				Field:  field,
+				Before: encodeAuditValue(change.Before),
+				After:  encodeAuditValue(change.After),
+			})
+		}
+		resp.Events = append(resp.Events, protoEvent)
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) ListUserVersions(ctx context.Context, req *userpb.ListUserVersionsRequest) (*userpb.ListUserVersionsResponse, error) {
+	versions, err := s.userService.ListUserVersions(ctx, int(req.UserId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list user versions: %w", err)
+	}
+
+	resp := &userpb.ListUserVersionsResponse{}
+	for _, v := range versions {
+		protoVersion := &userpb.UserVersion{
+			Version:   int32(v.Version),
+			User:      v.User.ToProto(),
+			ValidFrom: v.ValidFrom.Format(time.RFC3339),
+		}
+		if v.ValidTo != nil {
+			protoVersion.ValidTo = v.ValidTo.Format(time.RFC3339)
+		}
+		resp.Versions = append(resp.Versions, protoVersion)
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) RestoreUserVersion(ctx context.Context, req *userpb.RestoreUserVersionRequest) (*userpb.RestoreUserVersionResponse, error) {
+	user, err := s.userService.RestoreUserVersion(ctx, int(req.UserId), int(req.Version))
+	if err != nil {
+		return nil, fmt.Errorf("failed to restore user version: %w", err)
+	}
+
+	return &userpb.RestoreUserVersionResponse{User: user.ToProto()}, nil
+}
+
+func (s *grpcServer) SearchUsers(ctx context.Context, req *userpb.SearchUsersRequest) (*userpb.SearchUsersResponse, error) {
+	if req.Limit < 0 || req.Limit > userPack.MaxSearchResults {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must be at most %d", userPack.MaxSearchResults)
+	}
+
+	results, err := s.userService.SearchUsers(ctx, req.Query, req.Prefix, int(req.Limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+
+	resp := &userpb.SearchUsersResponse{}
+	for _, result := range results {
+		resp.Results = append(resp.Results, &userpb.SearchResult{
+			User:       result.User.ToProto(),
+			Rank:       result.Rank,
+			Highlights: result.Highlights,
+		})
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) Login(ctx context.Context, req *userpb.LoginRequest) (*userpb.LoginResponse, error) {
+	if req.Email == "" || req.Password == "" {
+		return nil, status.Error(codes.InvalidArgument, "email and password are required")
+	}
+
+	result, err := s.authService.Login(ctx, req.Email, req.Password, reqctx.PeerIP(ctx))
+	if err != nil {
+		return nil, loginError("login failed", err)
+	}
+
+	return convertLoginResult(result), nil
+}
+
+func (s *grpcServer) VerifyMFA(ctx context.Context, req *userpb.VerifyMFARequest) (*userpb.LoginResponse, error) {
+	if req.MfaToken == "" || (req.Code == "") == (req.RecoveryCode == "") {
+		return nil, status.Error(codes.InvalidArgument, "mfa_token and either code or recovery_code are required")
+	}
+
+	result, err := s.authService.VerifyMFA(ctx, req.MfaToken, req.Code, req.RecoveryCode, reqctx.PeerIP(ctx))
+	if err != nil {
+		return nil, loginError("MFA verification failed", err)
+	}
+
+	return convertLoginResult(result), nil
+}
+
+func (s *grpcServer) VerifyEmail(ctx context.Context, req *userpb.VerifyEmailRequest) (*userpb.VerifyEmailResponse, error) {
+	if req.Token == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is required")
+	}
+
+	user, err := s.userService.VerifyEmail(ctx, req.Token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify email: %w", err)
+	}
+
+	return &userpb.VerifyEmailResponse{User: user.ToProto()}, nil
+}
+
+func convertLoginResult(result *authPack.LoginResult) *userpb.LoginResponse {
+	if result.MFAToken != "" {
+		return &userpb.LoginResponse{MfaToken: result.MFAToken}
+	}
+	return &userpb.LoginResponse{User: result.User.ToProto(), Tokens: convertTokenPair(result.Tokens)}
+}
+
+func (s *grpcServer) RefreshToken(ctx context.Context, req *userpb.RefreshTokenRequest) (*userpb.RefreshTokenResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, status.Error(codes.InvalidArgument, "refresh_token is required")
+	}
+
+	tokens, err := s.authService.Refresh(ctx, req.RefreshToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh token: %w", err)
+	}
+
+	return &userpb.RefreshTokenResponse{Tokens: convertTokenPair(tokens)}, nil
+}
+
+func (s *grpcServer) Logout(ctx context.Context, req *userpb.LogoutRequest) (*userpb.LogoutResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, status.Error(codes.InvalidArgument, "refresh_token is required")
+	}
+
+	if err := s.authService.Logout(ctx, req.RefreshToken); err != nil {
+		return nil, fmt.Errorf("failed to log out: %w", err)
+	}
+
+	return &userpb.LogoutResponse{Message: "Logged out"}, nil
+}
+
+// accessClaims verifies the bearer access token of an RPC.
+func (s *grpcServer) accessClaims(ctx context.Context) (*authPack.AccessClaims, error) {
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+	return s.authService.VerifyAccessToken(authPack.BearerToken(authorization))
+}
+
+// requireAdmin fails RPCs whose access token does not carry the admin role.
+func (s *grpcServer) requireAdmin(ctx context.Context, denied string) error {
+	claims, err := s.accessClaims(ctx)
+	if err != nil {
+		return err
+	}
+	if !claims.HasRole(reqctx.RoleAdmin) {
+		return status.Error(codes.PermissionDenied, denied)
+	}
+	return nil
+}
+
+func (s *grpcServer) RevokeTokens(ctx context.Context, req *userpb.RevokeTokensRequest) (*userpb.RevokeTokensResponse, error) {
+	claims, err := s.accessClaims(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userID, _ := strconv.Atoi(claims.Subject)
+	if req.UserId != 0 && int(req.UserId) != userID {
+		if !claims.HasRole(reqctx.RoleAdmin) {
+			return nil, status.Error(codes.PermissionDenied, "only admins can revoke tokens of other users")
+		}
+		userID = int(req.UserId)
+	}
+
+	revoked, err := s.authService.RevokeUserTokens(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	return &userpb.RevokeTokensResponse{Revoked: revoked}, nil
+}
+
+func (s *grpcServer) RequestPasswordReset(ctx context.Context, req *userpb.RequestPasswordResetRequest) (*userpb.RequestPasswordResetResponse, error) {
+	if req.Email == "" {
+		return nil, status.Error(codes.InvalidArgument, "email is required")
+	}
+
+	if err := s.authService.RequestPasswordReset(ctx, req.Email, reqctx.PeerIP(ctx)); err != nil {
+		return nil, fmt.Errorf("failed to request password reset: %w", err)
+	}
+
+	return &userpb.RequestPasswordResetResponse{Message: "If the email is registered, a password reset link has been sent"}, nil
+}
+
+func (s *grpcServer) ResetPassword(ctx context.Context, req *userpb.ResetPasswordRequest) (*userpb.ResetPasswordResponse, error) {
+	if req.Token == "" {
+		return nil, status.Error(codes.InvalidArgument, "token and password are required")
+	}
+	if err := userPack.ValidatePassword(req.Password); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := s.authService.ResetPassword(ctx, req.Token, req.Password); err != nil {
+		return nil, fmt.Errorf("failed to reset password: %w", err)
+	}
+
+	return &userpb.ResetPasswordResponse{Message: "Password changed, all sessions have been signed out"}, nil
+}
+
+func (s *grpcServer) ListLockouts(ctx context.Context, req *userpb.ListLockoutsRequest) (*userpb.ListLockoutsResponse, error) {
+	if err := s.requireAdmin(ctx, "only admins can list lockouts"); err != nil {
+		return nil, err
+	}
+
+	lockouts, err := s.authService.ListLockouts(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &userpb.ListLockoutsResponse{}
+	for _, lockout := range lockouts {
+		pb := &userpb.Lockout{
+			Key:         lockout.Key,
+			Failures:    int32(lockout.Failures),
+			Lockouts:    int32(lockout.Lockouts),
+			LastFailure: lockout.LastFailure.Format(time.RFC3339),
+		}
+		if lockout.LockedUntil != nil {
+			pb.LockedUntil = lockout.LockedUntil.Format(time.RFC3339)
+		}
+		resp.Lockouts = append(resp.Lockouts, pb)
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) UnlockUser(ctx context.Context, req *userpb.UnlockUserRequest) (*userpb.UnlockResponse, error) {
+	if err := s.requireAdmin(ctx, "only admins can unlock users"); err != nil {
+		return nil, err
+	}
+
+	if err := s.authService.UnlockUser(ctx, int(req.UserId)); err != nil {
+		return nil, fmt.Errorf("failed to unlock user: %w", err)
+	}
+
+	return &userpb.UnlockResponse{Message: "User unlocked"}, nil
+}
+
+func (s *grpcServer) UnlockIP(ctx context.Context, req *userpb.UnlockIPRequest) (*userpb.UnlockResponse, error) {
+	if err := s.requireAdmin(ctx, "only admins can unlock IPs"); err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(req.Ip)
+	if ip == nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid IP address")
+	}
+
+	if err := s.authService.UnlockIP(ctx, ip.String()); err != nil {
+		return nil, fmt.Errorf("failed to unlock IP: %w", err)
+	}
+
+	return &userpb.UnlockResponse{Message: "IP unlocked"}, nil
+}
+
+func (s *grpcServer) SuspendUser(ctx context.Context, req *userpb.SuspendUserRequest) (*userpb.UserStatusResponse, error) {
+	return s.changeStatus(ctx, "suspend", s.userService.SuspendUser, req.Id, req.Reason)
+}
+
+func (s *grpcServer) ReactivateUser(ctx context.Context, req *userpb.ReactivateUserRequest) (*userpb.UserStatusResponse, error) {
+	return s.changeStatus(ctx, "reactivate", s.userService.ReactivateUser, req.Id, req.Reason)
+}
+
+func (s *grpcServer) DeactivateUser(ctx context.Context, req *userpb.DeactivateUserRequest) (*userpb.UserStatusResponse, error) {
+	return s.changeStatus(ctx, "deactivate", s.userService.DeactivateUser, req.Id, req.Reason)
+}
+
+func (s *grpcServer) changeStatus(ctx context.Context, verb string, change func(context.Context, int, string) (*userPack.User, error), id int32, reason string) (*userpb.UserStatusResponse, error) {
+	if !reqctx.FromContext(ctx).IsAdmin() {
+		return nil, status.Errorf(codes.PermissionDenied, "only admins can %s users", verb)
+	}
+
+	user, err := change(ctx, int(id), reason)
+	if err != nil {
+		return nil, fmt.Errorf("failed to %s user: %w", verb, err)
+	}
+
+	return &userpb.UserStatusResponse{User: user.ToProto()}, nil
+}
+
+// loginError adds when a lockout ends, which REST clients get from the
+// Retry-After header.
+func loginError(msg string, err error) error {
+	var lockout *authPack.LockoutError
+	if errors.As(err, &lockout) {
+		return fmt.Errorf("%s: %w, locked until %s", msg, err, lockout.Until.Format(time.RFC3339))
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+func convertTokenPair(tokens *authPack.TokenPair) *userpb.TokenPair {
+	return &userpb.TokenPair{
+		AccessToken:  tokens.AccessToken,
+		TokenType:    tokens.TokenType,
+		ExpiresIn:    int32(tokens.ExpiresIn),
+		RefreshToken: tokens.RefreshToken,
+	}
+}
+
+func encodeAuditValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// NewServer returns the gRPC server with the user and organization services.
+// It is served on a port of its own by StartGRPCServer, or next to the REST
+// API through grpcbridge. metaOpts say whom actor metadata is taken from;
+// opts can add transport credentials.
+func NewServer(userService *userPack.UserService, authService *authPack.AuthService, certAuth *authPack.ClientCertAuth, orgService *orgPack.OrgService, cfg config.Config, metaOpts []reqctx.Option, opts ...grpc.ServerOption) *grpc.Server {
+	grpcServer := grpc.NewServer(append([]grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(ErrorUnaryInterceptor, reqctx.UnaryServerInterceptor(metaOpts...), certAuth.UnaryInterceptor, authService.TenantUnaryInterceptor),
+		grpc.ChainStreamInterceptor(ErrorStreamInterceptor, reqctx.StreamServerInterceptor(metaOpts...), certAuth.StreamInterceptor, authService.TenantStreamInterceptor),
+	}, opts...)...)
+	userpb.RegisterUserServiceServer(grpcServer, NewGRPCServer(userService, authService, cfg))
+	orgpb.RegisterOrganizationServiceServer(grpcServer, orgGrpc.NewGRPCServer(orgService))
+	return grpcServer
+}
+
+func StartGRPCServer(grpcServer *grpc.Server, port string) error {
 	listener, err := net.Listen("tcp", port)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
 
-	grpcServer := grpc.NewServer()
-	userpb.RegisterUserServiceServer(grpcServer, NewGRPCServer(userService))
-
+	log.Printf("gRPC server is running on port %s", port)
 	if err := grpcServer.Serve(listener); err != nil {
 		return fmt.Errorf("failed to serve: %w", err)
 	}
-	log.Printf("gRPC server is running on port %s", port)
 	return nil
 }
 
 func convertProtoUserToUser(protoUser *userpb.User) (*userPack.User, error) {
 	if protoUser == nil {
-		return nil, fmt.Errorf("protoUser is nil")
-	}
-
-	if protoUser.Firstname == "" || protoUser.Lastname == "" || protoUser.Email == "" {
-		return nil, fmt.Errorf("firstname, lastname, and email are required")
+		return nil, status.Error(codes.InvalidArgument, "user is required")
 	}
 
 	return &userPack.User{
@@ -0,0 +1,75 @@
+package orgPack
+
+import (
+	"context"
+	"errors"
+
+	"user-api/internal/reqctx"
+)
+
+var (
+	ErrNotAuthenticated = errors.New("organizations require an authenticated caller")
+	ErrNotOrgAdmin      = errors.New("only owners and admins of the organization can change it")
+	ErrNotOrgOwner      = errors.New("only owners of the organization can grant or take away ownership")
+	ErrOwnerNotCaller   = errors.New("only platform admins can create organizations for other users")
+)
+
+// authenticated returns ErrNotAuthenticated unless the actor of ctx came
+// from an access token or a client certificate.
+func authenticated(ctx context.Context) error {
+	if !reqctx.FromContext(ctx).Verified {
+		return ErrNotAuthenticated
+	}
+	return nil
+}
+
+// callerRole returns the role of the caller in orgID, which must be owner
+// or admin. Platform admins act as owners of every organization.
+func (s *OrgService) callerRole(ctx context.Context, orgID int) (string, error) {
+	meta := reqctx.FromContext(ctx)
+	if !meta.Verified {
+		return "", ErrNotAuthenticated
+	}
+	if meta.IsPlatformAdmin() {
+		if _, err := s.repo.GetOrganization(ctx, orgID); err != nil {
+			return "", err
+		}
+		return RoleOwner, nil
+	}
+	userID, ok := meta.UserID()
+	if !ok {
+		return "", ErrNotOrgAdmin
+	}
+	role, err := s.repo.MemberRole(ctx, orgID, userID)
+	if errors.Is(err, ErrMemberNotFound) {
+		return "", ErrNotOrgAdmin
+	}
+	if err != nil {
+		return "", err
+	}
+	if role != RoleOwner && role != RoleAdmin {
+		return "", ErrNotOrgAdmin
+	}
+	return role, nil
+}
+
+// authorizeMemberChange checks that the caller may give userID role, or
+// remove them if role is empty. Ownership only changes hands through an
+// owner: admins can neither make owners nor demote or remove them.
+func (s *OrgService) authorizeMemberChange(ctx context.Context, orgID, userID int, role string) error {
+	callerRole, err := s.callerRole(ctx, orgID)
+	if err != nil || callerRole == RoleOwner {
+		return err
+	}
+	if role == RoleOwner {
+		return ErrNotOrgOwner
+	}
+	current, err := s.repo.MemberRole(ctx, orgID, userID)
+	if err != nil && !errors.Is(err, ErrMemberNotFound) {
+		return err
+	}
+	if current == RoleOwner {
+		return ErrNotOrgOwner
+	}
+	return nil
+}
@@ -0,0 +1,418 @@
+package orgPack
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	userPack "user-api/internal/user-pack"
+)
+
+type OrgHandler struct {
+	service *OrgService
+}
+
+func NewOrgHandler(service *OrgService) *OrgHandler {
+	return &OrgHandler{service: service}
+}
+
+// CreateOrganization creates an organization with owner_id as its owner.
+func (c *OrgHandler) CreateOrganization(ctx *gin.Context) {
+	var req CreateOrganizationRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	org := Organization{Name: req.Name, Slug: req.Slug}
+	if err := ValidateOrganization(&org); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.OwnerID <= 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "owner_id is required"})
+		return
+	}
+
+	if err := c.service.CreateOrganization(ctx.Request.Context(), &org, req.OwnerID); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, org)
+}
+
+func (c *OrgHandler) GetOrganization(ctx *gin.Context) {
+	id, ok := pathID(ctx, "id", "Invalid organization ID")
+	if !ok {
+		return
+	}
+
+	org, err := c.service.GetOrganization(ctx.Request.Context(), id)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, org)
+}
+
+// UpdateOrganization patches the name and slug present in the body.
+func (c *OrgHandler) UpdateOrganization(ctx *gin.Context) {
+	id, ok := pathID(ctx, "id", "Invalid organization ID")
+	if !ok {
+		return
+	}
+
+	var invalid error
+	org, err := c.service.UpdateOrganization(ctx.Request.Context(), id, func(org *Organization) error {
+		if err := ctx.ShouldBindJSON(org); err != nil {
+			invalid = err
+			return err
+		}
+		if err := ValidateOrganization(org); err != nil {
+			invalid = err
+			return err
+		}
+		return nil
+	})
+	if invalid != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": invalid.Error()})
+		return
+	}
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, org)
+}
+
+// DeleteOrganization deletes an organization with its teams and
+// memberships. The users themselves are kept.
+func (c *OrgHandler) DeleteOrganization(ctx *gin.Context) {
+	id, ok := pathID(ctx, "id", "Invalid organization ID")
+	if !ok {
+		return
+	}
+
+	if err := c.service.DeleteOrganization(ctx.Request.Context(), id); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *OrgHandler) ListMembers(ctx *gin.Context) {
+	id, ok := pathID(ctx, "id", "Invalid organization ID")
+	if !ok {
+		return
+	}
+	limit, offset, ok := pagination(ctx)
+	if !ok {
+		return
+	}
+
+	members, err := c.service.ListMembers(ctx.Request.Context(), id, limit, offset)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// ListUserOrganizations lists the organizations of the user in the path.
+func (c *OrgHandler) ListUserOrganizations(ctx *gin.Context) {
+	id, ok := pathID(ctx, "id", "Invalid user ID")
+	if !ok {
+		return
+	}
+	limit, offset, ok := pagination(ctx)
+	if !ok {
+		return
+	}
+
+	memberships, err := c.service.ListUserOrganizations(ctx.Request.Context(), id, limit, offset)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"organizations": memberships})
+}
+
+// SetMember adds the user to the organization with the role in the body,
+// or changes the role of a member.
+func (c *OrgHandler) SetMember(ctx *gin.Context) {
+	id, ok := pathID(ctx, "id", "Invalid organization ID")
+	if !ok {
+		return
+	}
+	userID, ok := pathID(ctx, "userId", "Invalid user ID")
+	if !ok {
+		return
+	}
+	var req RoleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ValidateRole(req.Role); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	member, err := c.service.SetMember(ctx.Request.Context(), id, userID, req.Role)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, member)
+}
+
+func (c *OrgHandler) RemoveMember(ctx *gin.Context) {
+	id, ok := pathID(ctx, "id", "Invalid organization ID")
+	if !ok {
+		return
+	}
+	userID, ok := pathID(ctx, "userId", "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	if err := c.service.RemoveMember(ctx.Request.Context(), id, userID); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *OrgHandler) CreateTeam(ctx *gin.Context) {
+	id, ok := pathID(ctx, "id", "Invalid organization ID")
+	if !ok {
+		return
+	}
+	var team Team
+	if err := ctx.ShouldBindJSON(&team); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	team.OrgID = id
+	if err := ValidateTeam(&team); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.service.CreateTeam(ctx.Request.Context(), &team); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, team)
+}
+
+func (c *OrgHandler) ListTeams(ctx *gin.Context) {
+	id, ok := pathID(ctx, "id", "Invalid organization ID")
+	if !ok {
+		return
+	}
+	limit, offset, ok := pagination(ctx)
+	if !ok {
+		return
+	}
+
+	teams, err := c.service.ListTeams(ctx.Request.Context(), id, limit, offset)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"teams": teams})
+}
+
+func (c *OrgHandler) GetTeam(ctx *gin.Context) {
+	id, teamID, ok := teamPath(ctx)
+	if !ok {
+		return
+	}
+
+	team, err := c.service.GetTeam(ctx.Request.Context(), id, teamID)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, team)
+}
+
+func (c *OrgHandler) UpdateTeam(ctx *gin.Context) {
+	id, teamID, ok := teamPath(ctx)
+	if !ok {
+		return
+	}
+
+	var invalid error
+	team, err := c.service.UpdateTeam(ctx.Request.Context(), id, teamID, func(team *Team) error {
+		if err := ctx.ShouldBindJSON(team); err != nil {
+			invalid = err
+			return err
+		}
+		if err := ValidateTeam(team); err != nil {
+			invalid = err
+			return err
+		}
+		return nil
+	})
+	if invalid != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": invalid.Error()})
+		return
+	}
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, team)
+}
+
+func (c *OrgHandler) DeleteTeam(ctx *gin.Context) {
+	id, teamID, ok := teamPath(ctx)
+	if !ok {
+		return
+	}
+
+	if err := c.service.DeleteTeam(ctx.Request.Context(), id, teamID); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *OrgHandler) ListTeamMembers(ctx *gin.Context) {
+	id, teamID, ok := teamPath(ctx)
+	if !ok {
+		return
+	}
+	limit, offset, ok := pagination(ctx)
+	if !ok {
+		return
+	}
+
+	members, err := c.service.ListTeamMembers(ctx.Request.Context(), id, teamID, limit, offset)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+func (c *OrgHandler) SetTeamMember(ctx *gin.Context) {
+	id, teamID, ok := teamPath(ctx)
+	if !ok {
+		return
+	}
+	userID, ok := pathID(ctx, "userId", "Invalid user ID")
+	if !ok {
+		return
+	}
+	var req RoleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ValidateTeamRole(req.Role); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	member, err := c.service.SetTeamMember(ctx.Request.Context(), id, teamID, userID, req.Role)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, member)
+}
+
+func (c *OrgHandler) RemoveTeamMember(ctx *gin.Context) {
+	id, teamID, ok := teamPath(ctx)
+	if !ok {
+		return
+	}
+	userID, ok := pathID(ctx, "userId", "Invalid user ID")
+	if !ok {
+		return
+	}
+
+	if err := c.service.RemoveTeamMember(ctx.Request.Context(), id, teamID, userID); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func pathID(ctx *gin.Context, param, msg string) (int, bool) {
+	id, err := strconv.Atoi(ctx.Param(param))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return 0, false
+	}
+	return id, true
+}
+
+func teamPath(ctx *gin.Context) (int, int, bool) {
+	id, ok := pathID(ctx, "id", "Invalid organization ID")
+	if !ok {
+		return 0, 0, false
+	}
+	teamID, ok := pathID(ctx, "teamId", "Invalid team ID")
+	if !ok {
+		return 0, 0, false
+	}
+	return id, teamID, true
+}
+
+func pagination(ctx *gin.Context) (int, int, bool) {
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return 0, 0, false
+	}
+	offset, err := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
+
+func respondError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrOrganizationNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+	case errors.Is(err, ErrTeamNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Team not found"})
+	case errors.Is(err, ErrMemberNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Membership not found"})
+	case errors.Is(err, userPack.ErrUserNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, ErrSlugTaken), errors.Is(err, ErrTeamNameTaken), errors.Is(err, ErrLastOwner):
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNotAuthenticated):
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNotOrgAdmin), errors.Is(err, ErrNotOrgOwner), errors.Is(err, ErrOwnerNotCaller):
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, ErrNotOrgMember):
+		ctx.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,58 @@
+package orgPack
+
+import "time"
+
+// Organization roles. Every organization keeps at least one owner.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Team roles. Team members must be members of the organization.
+const (
+	TeamRoleMaintainer = "maintainer"
+	TeamRoleMember     = "member"
+)
+
+type Organization struct {
+	ID      int       `json:"id"`
+	Name    string    `json:"name"`
+	Slug    string    `json:"slug"`
+	Created time.Time `json:"created"`
+}
+
+type Team struct {
+	ID          int       `json:"id"`
+	OrgID       int       `json:"org_id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Created     time.Time `json:"created"`
+}
+
+// Member is a user with their role in an organization or a team.
+type Member struct {
+	UserID    int       `json:"user_id"`
+	Firstname string    `json:"firstname"`
+	Lastname  string    `json:"lastname"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	Joined    time.Time `json:"joined"`
+}
+
+// Membership is an organization together with the role a user has in it.
+type Membership struct {
+	Organization Organization `json:"organization"`
+	Role         string       `json:"role"`
+	Joined       time.Time    `json:"joined"`
+}
+
+type CreateOrganizationRequest struct {
+	Name    string `json:"name"`
+	Slug    string `json:"slug"`
+	OwnerID int    `json:"owner_id"`
+}
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
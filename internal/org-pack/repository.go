@@ -0,0 +1,605 @@
+package orgPack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"user-api/internal/reqctx"
+	"user-api/internal/tenant"
+	userPack "user-api/internal/user-pack"
+)
+
+var (
+	ErrOrganizationNotFound = errors.New("organization not found")
+	ErrTeamNotFound         = errors.New("team not found")
+	ErrMemberNotFound       = errors.New("membership not found")
+	ErrSlugTaken            = errors.New("slug is already taken")
+	ErrTeamNameTaken        = errors.New("a team with this name already exists in the organization")
+	ErrNotOrgMember         = errors.New("user is not a member of the organization")
+	ErrLastOwner            = errors.New("an organization must keep at least one owner")
+)
+
+type OrgRepository interface {
+	// CreateOrganization stores org with ownerID as its first owner.
+	CreateOrganization(ctx context.Context, org *Organization, ownerID int) error
+	GetOrganization(ctx context.Context, id int) (*Organization, error)
+	UpdateOrganization(ctx context.Context, id int, org *Organization) error
+	// DeleteOrganization removes the organization with its teams and
+	// memberships.
+	DeleteOrganization(ctx context.Context, id int) error
+
+	ListMembers(ctx context.Context, orgID int, limit, offset int) ([]*Member, error)
+	ListUserMemberships(ctx context.Context, userID int, limit, offset int) ([]*Membership, error)
+	// BatchListUserMemberships returns the memberships of several users at
+	// once, keyed by user id. Unknown users have no memberships.
+	BatchListUserMemberships(ctx context.Context, userIDs []int) (map[int][]*Membership, error)
+	// MemberRole returns the role of userID in orgID, ErrMemberNotFound if
+	// the user is not a member.
+	MemberRole(ctx context.Context, orgID, userID int) (string, error)
+	// SetMember adds a user to an organization or changes their role. It
+	// returns ErrLastOwner instead of demoting the only owner.
+	SetMember(ctx context.Context, orgID, userID int, role string) (*Member, error)
+	// RemoveMember removes a user from an organization and its teams. It
+	// returns ErrLastOwner instead of removing the only owner.
+	RemoveMember(ctx context.Context, orgID, userID int) error
+
+	CreateTeam(ctx context.Context, team *Team) error
+	GetTeam(ctx context.Context, orgID, id int) (*Team, error)
+	ListTeams(ctx context.Context, orgID int, limit, offset int) ([]*Team, error)
+	UpdateTeam(ctx context.Context, orgID, id int, team *Team) error
+	DeleteTeam(ctx context.Context, orgID, id int) error
+
+	ListTeamMembers(ctx context.Context, orgID, teamID int, limit, offset int) ([]*Member, error)
+	SetTeamMember(ctx context.Context, orgID, teamID, userID int, role string) (*Member, error)
+	RemoveTeamMember(ctx context.Context, orgID, teamID, userID int) error
+}
+
+// PostgresOrgRepository leaves the cascades to the schema: deleting an
+// organization deletes its teams and memberships, deleting a user deletes
+// their memberships, and leaving an organization ends the team memberships
+// in it. If that takes away the last owner, a trigger promotes the oldest
+// admin, or else the oldest member; an organization without members is
+// deleted.
+//
+// Organizations and teams belong to a tenant and are only visible in
+// transactions scoped to it. Memberships are reached through them, so every
+// change of one first finds its organization or team, and the user, in the
+// scoped transaction: foreign keys are checked without the policies.
+type PostgresOrgRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresOrgRepository(db *pgxpool.Pool) *PostgresOrgRepository {
+	return &PostgresOrgRepository{db: db}
+}
+
+func (r *PostgresOrgRepository) withTx(ctx context.Context, op string, fn func(tx pgx.Tx) error) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tenant.Scope(ctx, tx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+	return nil
+}
+
+// constraintError maps unique and foreign key violations to the errors of
+// this package by constraint name. It returns nil for other errors.
+func constraintError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return nil
+	}
+	switch pgErr.ConstraintName {
+	case "organizations_slug_key", "organizations_tenant_slug_key":
+		return ErrSlugTaken
+	case "teams_org_id_name_key":
+		return ErrTeamNameTaken
+	case "organization_members_user_id_fkey":
+		return userPack.ErrUserNotFound
+	case "organization_members_org_id_fkey", "teams_org_id_fkey":
+		return ErrOrganizationNotFound
+	case "team_members_team_fkey":
+		return ErrTeamNotFound
+	case "team_members_member_fkey":
+		return ErrNotOrgMember
+	}
+	return nil
+}
+
+func (r *PostgresOrgRepository) CreateOrganization(ctx context.Context, org *Organization, ownerID int) error {
+	return r.withTx(ctx, "CreateOrganization", func(tx pgx.Tx) error {
+		if err := findUser(ctx, tx, "CreateOrganization", ownerID); err != nil {
+			return err
+		}
+		err := tx.QueryRow(ctx, "INSERT INTO organizations (name, slug, created, tenant_id) VALUES ($1, $2, $3, $4) RETURNING id",
+			org.Name, org.Slug, org.Created, reqctx.FromContext(ctx).Tenant()).Scan(&org.ID)
+		if cerr := constraintError(err); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("CreateOrganization: failed to insert organization: %w", err)
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO organization_members (org_id, user_id, role) VALUES ($1, $2, $3)", org.ID, ownerID, RoleOwner)
+		if cerr := constraintError(err); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("CreateOrganization: failed to add owner %d: %w", ownerID, err)
+		}
+		return nil
+	})
+}
+
+func (r *PostgresOrgRepository) GetOrganization(ctx context.Context, id int) (*Organization, error) {
+	var org Organization
+	err := r.withTx(ctx, "GetOrganization", func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "SELECT id, name, slug, created FROM organizations WHERE id = $1", id).
+			Scan(&org.ID, &org.Name, &org.Slug, &org.Created)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrOrganizationNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("GetOrganization: failed to query organization with id %d: %w", id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+func (r *PostgresOrgRepository) UpdateOrganization(ctx context.Context, id int, org *Organization) error {
+	return r.withTx(ctx, "UpdateOrganization", func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "UPDATE organizations SET name = $1, slug = $2 WHERE id = $3", org.Name, org.Slug, id)
+		if cerr := constraintError(err); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("UpdateOrganization: failed to update organization with id %d: %w", id, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrOrganizationNotFound
+		}
+		return nil
+	})
+}
+
+func (r *PostgresOrgRepository) DeleteOrganization(ctx context.Context, id int) error {
+	return r.withTx(ctx, "DeleteOrganization", func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "DELETE FROM organizations WHERE id = $1", id)
+		if err != nil {
+			return fmt.Errorf("DeleteOrganization: failed to delete organization with id %d: %w", id, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrOrganizationNotFound
+		}
+		return nil
+	})
+}
+
+func (r *PostgresOrgRepository) ListMembers(ctx context.Context, orgID int, limit, offset int) ([]*Member, error) {
+	var members []*Member
+	err := r.withTx(ctx, "ListMembers", func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			SELECT u.id, u.firstname, u.lastname, u.email, m.role, m.created
+			FROM organization_members m JOIN users u ON u.id = m.user_id
+			WHERE m.org_id = $1 ORDER BY u.id LIMIT $2 OFFSET $3`, orgID, limit, offset)
+		if err != nil {
+			return fmt.Errorf("ListMembers: failed to query members of organization %d: %w", orgID, err)
+		}
+		members, err = scanMembers(rows, "ListMembers")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (r *PostgresOrgRepository) ListUserMemberships(ctx context.Context, userID int, limit, offset int) ([]*Membership, error) {
+	var memberships []*Membership
+	err := r.withTx(ctx, "ListUserMemberships", func(tx pgx.Tx) error {
+		if err := findUser(ctx, tx, "ListUserMemberships", userID); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(ctx, `
+			SELECT o.id, o.name, o.slug, o.created, m.role, m.created
+			FROM organization_members m JOIN organizations o ON o.id = m.org_id
+			WHERE m.user_id = $1 ORDER BY o.id LIMIT $2 OFFSET $3`, userID, limit, offset)
+		if err != nil {
+			return fmt.Errorf("ListUserMemberships: failed to query organizations of user %d: %w", userID, err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var m Membership
+			if err := rows.Scan(&m.Organization.ID, &m.Organization.Name, &m.Organization.Slug, &m.Organization.Created, &m.Role, &m.Joined); err != nil {
+				return fmt.Errorf("ListUserMemberships: failed to scan membership: %w", err)
+			}
+			memberships = append(memberships, &m)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("ListUserMemberships: failed to read memberships: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+func (r *PostgresOrgRepository) BatchListUserMemberships(ctx context.Context, userIDs []int) (map[int][]*Membership, error) {
+	memberships := make(map[int][]*Membership)
+	err := r.withTx(ctx, "BatchListUserMemberships", func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			SELECT m.user_id, o.id, o.name, o.slug, o.created, m.role, m.created
+			FROM organization_members m JOIN organizations o ON o.id = m.org_id
+			WHERE m.user_id = ANY($1) ORDER BY m.user_id, o.id`, userIDs)
+		if err != nil {
+			return fmt.Errorf("BatchListUserMemberships: failed to query organizations of users: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var userID int
+			var m Membership
+			if err := rows.Scan(&userID, &m.Organization.ID, &m.Organization.Name, &m.Organization.Slug, &m.Organization.Created, &m.Role, &m.Joined); err != nil {
+				return fmt.Errorf("BatchListUserMemberships: failed to scan membership: %w", err)
+			}
+			memberships[userID] = append(memberships[userID], &m)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("BatchListUserMemberships: failed to read memberships: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+func (r *PostgresOrgRepository) MemberRole(ctx context.Context, orgID, userID int) (string, error) {
+	var role *string
+	err := r.withTx(ctx, "MemberRole", func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, `
+			SELECT m.role FROM organizations o
+			LEFT JOIN organization_members m ON m.org_id = o.id AND m.user_id = $2
+			WHERE o.id = $1`, orgID, userID).Scan(&role)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrOrganizationNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("MemberRole: failed to query role of user %d in organization %d: %w", userID, orgID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if role == nil {
+		return "", ErrMemberNotFound
+	}
+	return *role, nil
+}
+
+// findUser returns userPack.ErrUserNotFound unless userID is a user of the
+// tenant of tx.
+func findUser(ctx context.Context, tx pgx.Tx, op string, userID int) error {
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists); err != nil {
+		return fmt.Errorf("%s: failed to query user with id %d: %w", op, userID, err)
+	}
+	if !exists {
+		return userPack.ErrUserNotFound
+	}
+	return nil
+}
+
+// findTeam returns ErrTeamNotFound unless the team is in the tenant of tx.
+func findTeam(ctx context.Context, tx pgx.Tx, op string, orgID, teamID int) error {
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM teams WHERE org_id = $1 AND id = $2)", orgID, teamID).Scan(&exists); err != nil {
+		return fmt.Errorf("%s: failed to query team with id %d: %w", op, teamID, err)
+	}
+	if !exists {
+		return ErrTeamNotFound
+	}
+	return nil
+}
+
+// lockOrganization serialises membership changes of an organization, so
+// two concurrent demotions cannot both see another owner.
+func lockOrganization(ctx context.Context, tx pgx.Tx, op string, orgID int) error {
+	var id int
+	err := tx.QueryRow(ctx, "SELECT id FROM organizations WHERE id = $1 FOR UPDATE", orgID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrOrganizationNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("%s: failed to lock organization %d: %w", op, orgID, err)
+	}
+	return nil
+}
+
+// isLastOwner reports whether userID is the only owner of orgID.
+func isLastOwner(ctx context.Context, tx pgx.Tx, op string, orgID, userID int) (bool, error) {
+	var last bool
+	err := tx.QueryRow(ctx, `
+		SELECT COALESCE(bool_and(user_id = $2), false)
+		FROM organization_members WHERE org_id = $1 AND role = 'owner'`, orgID, userID).Scan(&last)
+	if err != nil {
+		return false, fmt.Errorf("%s: failed to query owners of organization %d: %w", op, orgID, err)
+	}
+	return last, nil
+}
+
+func (r *PostgresOrgRepository) SetMember(ctx context.Context, orgID, userID int, role string) (*Member, error) {
+	var member *Member
+	err := r.withTx(ctx, "SetMember", func(tx pgx.Tx) error {
+		if err := lockOrganization(ctx, tx, "SetMember", orgID); err != nil {
+			return err
+		}
+		if err := findUser(ctx, tx, "SetMember", userID); err != nil {
+			return err
+		}
+		if role != RoleOwner {
+			last, err := isLastOwner(ctx, tx, "SetMember", orgID, userID)
+			if err != nil {
+				return err
+			}
+			if last {
+				return ErrLastOwner
+			}
+		}
+
+		_, err := tx.Exec(ctx, `
+			INSERT INTO organization_members (org_id, user_id, role) VALUES ($1, $2, $3)
+			ON CONFLICT (org_id, user_id) DO UPDATE SET role = EXCLUDED.role`, orgID, userID, role)
+		if cerr := constraintError(err); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("SetMember: failed to set role of user %d in organization %d: %w", userID, orgID, err)
+		}
+		member, err = getMember(ctx, tx, "SetMember", `
+			SELECT u.id, u.firstname, u.lastname, u.email, m.role, m.created
+			FROM organization_members m JOIN users u ON u.id = m.user_id
+			WHERE m.org_id = $1 AND m.user_id = $2`, orgID, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+func (r *PostgresOrgRepository) RemoveMember(ctx context.Context, orgID, userID int) error {
+	return r.withTx(ctx, "RemoveMember", func(tx pgx.Tx) error {
+		if err := lockOrganization(ctx, tx, "RemoveMember", orgID); err != nil {
+			return err
+		}
+		last, err := isLastOwner(ctx, tx, "RemoveMember", orgID, userID)
+		if err != nil {
+			return err
+		}
+		if last {
+			return ErrLastOwner
+		}
+
+		tag, err := tx.Exec(ctx, "DELETE FROM organization_members WHERE org_id = $1 AND user_id = $2", orgID, userID)
+		if err != nil {
+			return fmt.Errorf("RemoveMember: failed to remove user %d from organization %d: %w", userID, orgID, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrMemberNotFound
+		}
+		return nil
+	})
+}
+
+func (r *PostgresOrgRepository) CreateTeam(ctx context.Context, team *Team) error {
+	return r.withTx(ctx, "CreateTeam", func(tx pgx.Tx) error {
+		// The team takes the tenant of its organization, which has to be
+		// visible.
+		err := tx.QueryRow(ctx, `
+			INSERT INTO teams (org_id, name, description, created, tenant_id)
+			SELECT id, $2, $3, $4, tenant_id FROM organizations WHERE id = $1
+			RETURNING id`, team.OrgID, team.Name, team.Description, team.Created).Scan(&team.ID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrOrganizationNotFound
+		}
+		if cerr := constraintError(err); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("CreateTeam: failed to insert team: %w", err)
+		}
+		return nil
+	})
+}
+
+func (r *PostgresOrgRepository) GetTeam(ctx context.Context, orgID, id int) (*Team, error) {
+	var team Team
+	err := r.withTx(ctx, "GetTeam", func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "SELECT id, org_id, name, description, created FROM teams WHERE org_id = $1 AND id = $2", orgID, id).
+			Scan(&team.ID, &team.OrgID, &team.Name, &team.Description, &team.Created)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrTeamNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("GetTeam: failed to query team with id %d: %w", id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &team, nil
+}
+
+func (r *PostgresOrgRepository) ListTeams(ctx context.Context, orgID int, limit, offset int) ([]*Team, error) {
+	var teams []*Team
+	err := r.withTx(ctx, "ListTeams", func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT id, org_id, name, description, created FROM teams WHERE org_id = $1 ORDER BY id LIMIT $2 OFFSET $3",
+			orgID, limit, offset)
+		if err != nil {
+			return fmt.Errorf("ListTeams: failed to query teams of organization %d: %w", orgID, err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var team Team
+			if err := rows.Scan(&team.ID, &team.OrgID, &team.Name, &team.Description, &team.Created); err != nil {
+				return fmt.Errorf("ListTeams: failed to scan team: %w", err)
+			}
+			teams = append(teams, &team)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("ListTeams: failed to read teams: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return teams, nil
+}
+
+func (r *PostgresOrgRepository) UpdateTeam(ctx context.Context, orgID, id int, team *Team) error {
+	return r.withTx(ctx, "UpdateTeam", func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "UPDATE teams SET name = $1, description = $2 WHERE org_id = $3 AND id = $4",
+			team.Name, team.Description, orgID, id)
+		if cerr := constraintError(err); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("UpdateTeam: failed to update team with id %d: %w", id, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrTeamNotFound
+		}
+		return nil
+	})
+}
+
+func (r *PostgresOrgRepository) DeleteTeam(ctx context.Context, orgID, id int) error {
+	return r.withTx(ctx, "DeleteTeam", func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "DELETE FROM teams WHERE org_id = $1 AND id = $2", orgID, id)
+		if err != nil {
+			return fmt.Errorf("DeleteTeam: failed to delete team with id %d: %w", id, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrTeamNotFound
+		}
+		return nil
+	})
+}
+
+func (r *PostgresOrgRepository) ListTeamMembers(ctx context.Context, orgID, teamID int, limit, offset int) ([]*Member, error) {
+	var members []*Member
+	err := r.withTx(ctx, "ListTeamMembers", func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			SELECT u.id, u.firstname, u.lastname, u.email, m.role, m.created
+			FROM team_members m JOIN users u ON u.id = m.user_id
+			WHERE m.org_id = $1 AND m.team_id = $2 ORDER BY u.id LIMIT $3 OFFSET $4`, orgID, teamID, limit, offset)
+		if err != nil {
+			return fmt.Errorf("ListTeamMembers: failed to query members of team %d: %w", teamID, err)
+		}
+		members, err = scanMembers(rows, "ListTeamMembers")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (r *PostgresOrgRepository) SetTeamMember(ctx context.Context, orgID, teamID, userID int, role string) (*Member, error) {
+	var member *Member
+	err := r.withTx(ctx, "SetTeamMember", func(tx pgx.Tx) error {
+		if err := findTeam(ctx, tx, "SetTeamMember", orgID, teamID); err != nil {
+			return err
+		}
+		if err := findUser(ctx, tx, "SetTeamMember", userID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `
+			INSERT INTO team_members (team_id, org_id, user_id, role) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (team_id, user_id) DO UPDATE SET role = EXCLUDED.role`, teamID, orgID, userID, role)
+		if cerr := constraintError(err); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("SetTeamMember: failed to set role of user %d in team %d: %w", userID, teamID, err)
+		}
+		member, err = getMember(ctx, tx, "SetTeamMember", `
+			SELECT u.id, u.firstname, u.lastname, u.email, m.role, m.created
+			FROM team_members m JOIN users u ON u.id = m.user_id
+			WHERE m.team_id = $1 AND m.user_id = $2`, teamID, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+func (r *PostgresOrgRepository) RemoveTeamMember(ctx context.Context, orgID, teamID, userID int) error {
+	return r.withTx(ctx, "RemoveTeamMember", func(tx pgx.Tx) error {
+		if err := findTeam(ctx, tx, "RemoveTeamMember", orgID, teamID); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, "DELETE FROM team_members WHERE org_id = $1 AND team_id = $2 AND user_id = $3", orgID, teamID, userID)
+		if err != nil {
+			return fmt.Errorf("RemoveTeamMember: failed to remove user %d from team %d: %w", userID, teamID, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrMemberNotFound
+		}
+		return nil
+	})
+}
+
+func getMember(ctx context.Context, tx pgx.Tx, op, query string, args ...interface{}) (*Member, error) {
+	var m Member
+	if err := tx.QueryRow(ctx, query, args...).Scan(&m.UserID, &m.Firstname, &m.Lastname, &m.Email, &m.Role, &m.Joined); err != nil {
+		return nil, fmt.Errorf("%s: failed to query membership: %w", op, err)
+	}
+	return &m, nil
+}
+
+func scanMembers(rows pgx.Rows, op string) ([]*Member, error) {
+	defer rows.Close()
+
+	var members []*Member
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.UserID, &m.Firstname, &m.Lastname, &m.Email, &m.Role, &m.Joined); err != nil {
+			return nil, fmt.Errorf("%s: failed to scan member: %w", op, err)
+		}
+		members = append(members, &m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: failed to read members: %w", op, err)
+	}
+	return members, nil
+}
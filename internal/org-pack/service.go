@@ -0,0 +1,195 @@
+package orgPack
+
+import (
+	"context"
+	"time"
+
+	"user-api/internal/reqctx"
+)
+
+// OrgService lets authenticated callers read the organizations of their
+// tenant. Changing one takes an owner or admin of it, or a platform admin.
+type OrgService struct {
+	repo OrgRepository
+}
+
+func NewOrgService(repo OrgRepository) *OrgService {
+	return &OrgService{repo: repo}
+}
+
+// CreateOrganization stores org and makes ownerID its owner, so no
+// organization starts out without one. Callers create organizations for
+// themselves; only platform admins may name another owner.
+func (s *OrgService) CreateOrganization(ctx context.Context, org *Organization, ownerID int) error {
+	meta := reqctx.FromContext(ctx)
+	if !meta.Verified {
+		return ErrNotAuthenticated
+	}
+	if userID, ok := meta.UserID(); !meta.IsPlatformAdmin() && (!ok || userID != ownerID) {
+		return ErrOwnerNotCaller
+	}
+	org.Created = time.Now()
+	return s.repo.CreateOrganization(ctx, org, ownerID)
+}
+
+func (s *OrgService) GetOrganization(ctx context.Context, id int) (*Organization, error) {
+	if err := authenticated(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.GetOrganization(ctx, id)
+}
+
+// UpdateOrganization applies update to the stored organization. update is
+// called with the current record so callers can patch it in place.
+func (s *OrgService) UpdateOrganization(ctx context.Context, id int, update func(*Organization) error) (*Organization, error) {
+	if _, err := s.callerRole(ctx, id); err != nil {
+		return nil, err
+	}
+	org, err := s.repo.GetOrganization(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(org); err != nil {
+		return nil, err
+	}
+	org.ID = id
+	if err := s.repo.UpdateOrganization(ctx, id, org); err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// DeleteOrganization takes an owner: admins cannot remove the owners along
+// with the organization.
+func (s *OrgService) DeleteOrganization(ctx context.Context, id int) error {
+	role, err := s.callerRole(ctx, id)
+	if err != nil {
+		return err
+	}
+	if role != RoleOwner {
+		return ErrNotOrgOwner
+	}
+	return s.repo.DeleteOrganization(ctx, id)
+}
+
+func (s *OrgService) ListMembers(ctx context.Context, orgID int, limit, offset int) ([]*Member, error) {
+	if err := authenticated(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := s.repo.GetOrganization(ctx, orgID); err != nil {
+		return nil, err
+	}
+	return s.repo.ListMembers(ctx, orgID, limit, offset)
+}
+
+// ListUserOrganizations returns the organizations a user belongs to, with
+// their role in each.
+func (s *OrgService) ListUserOrganizations(ctx context.Context, userID int, limit, offset int) ([]*Membership, error) {
+	if err := authenticated(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.ListUserMemberships(ctx, userID, limit, offset)
+}
+
+// BatchListUserOrganizations returns the memberships of several users in
+// one query, keyed by user id.
+func (s *OrgService) BatchListUserOrganizations(ctx context.Context, userIDs []int) (map[int][]*Membership, error) {
+	if err := authenticated(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.BatchListUserMemberships(ctx, userIDs)
+}
+
+func (s *OrgService) SetMember(ctx context.Context, orgID, userID int, role string) (*Member, error) {
+	if err := s.authorizeMemberChange(ctx, orgID, userID, role); err != nil {
+		return nil, err
+	}
+	return s.repo.SetMember(ctx, orgID, userID, role)
+}
+
+// RemoveMember removes a user from an organization, which also removes them
+// from its teams.
+func (s *OrgService) RemoveMember(ctx context.Context, orgID, userID int) error {
+	if err := s.authorizeMemberChange(ctx, orgID, userID, ""); err != nil {
+		return err
+	}
+	return s.repo.RemoveMember(ctx, orgID, userID)
+}
+
+func (s *OrgService) CreateTeam(ctx context.Context, team *Team) error {
+	if _, err := s.callerRole(ctx, team.OrgID); err != nil {
+		return err
+	}
+	team.Created = time.Now()
+	return s.repo.CreateTeam(ctx, team)
+}
+
+func (s *OrgService) GetTeam(ctx context.Context, orgID, id int) (*Team, error) {
+	if err := authenticated(ctx); err != nil {
+		return nil, err
+	}
+	return s.repo.GetTeam(ctx, orgID, id)
+}
+
+func (s *OrgService) ListTeams(ctx context.Context, orgID int, limit, offset int) ([]*Team, error) {
+	if err := authenticated(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := s.repo.GetOrganization(ctx, orgID); err != nil {
+		return nil, err
+	}
+	return s.repo.ListTeams(ctx, orgID, limit, offset)
+}
+
+// UpdateTeam applies update to the stored team. The team cannot move to
+// another organization.
+func (s *OrgService) UpdateTeam(ctx context.Context, orgID, id int, update func(*Team) error) (*Team, error) {
+	if _, err := s.callerRole(ctx, orgID); err != nil {
+		return nil, err
+	}
+	team, err := s.repo.GetTeam(ctx, orgID, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(team); err != nil {
+		return nil, err
+	}
+	team.ID, team.OrgID = id, orgID
+	if err := s.repo.UpdateTeam(ctx, orgID, id, team); err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+func (s *OrgService) DeleteTeam(ctx context.Context, orgID, id int) error {
+	if _, err := s.callerRole(ctx, orgID); err != nil {
+		return err
+	}
+	return s.repo.DeleteTeam(ctx, orgID, id)
+}
+
+func (s *OrgService) ListTeamMembers(ctx context.Context, orgID, teamID int, limit, offset int) ([]*Member, error) {
+	if err := authenticated(ctx); err != nil {
+		return nil, err
+	}
+	if _, err := s.repo.GetTeam(ctx, orgID, teamID); err != nil {
+		return nil, err
+	}
+	return s.repo.ListTeamMembers(ctx, orgID, teamID, limit, offset)
+}
+
+// SetTeamMember adds a user to a team or changes their role. The user must
+// be a member of the organization.
+func (s *OrgService) SetTeamMember(ctx context.Context, orgID, teamID, userID int, role string) (*Member, error) {
+	if _, err := s.callerRole(ctx, orgID); err != nil {
+		return nil, err
+	}
+	return s.repo.SetTeamMember(ctx, orgID, teamID, userID, role)
+}
+
+func (s *OrgService) RemoveTeamMember(ctx context.Context, orgID, teamID, userID int) error {
+	if _, err := s.callerRole(ctx, orgID); err != nil {
+		return err
+	}
+	return s.repo.RemoveTeamMember(ctx, orgID, teamID, userID)
+}
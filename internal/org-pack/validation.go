@@ -0,0 +1,47 @@
+package orgPack
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+func ValidateOrganization(org *Organization) error {
+	if org.Name == "" || org.Slug == "" {
+		return fmt.Errorf("name and slug are required")
+	}
+	if len(org.Name) > 100 {
+		return fmt.Errorf("name must be at most 100 characters")
+	}
+	if len(org.Slug) > 63 || !slugPattern.MatchString(org.Slug) {
+		return fmt.Errorf("slug must be lowercase letters, digits and single dashes, at most 63 characters")
+	}
+	return nil
+}
+
+func ValidateTeam(team *Team) error {
+	if team.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(team.Name) > 100 {
+		return fmt.Errorf("name must be at most 100 characters")
+	}
+	return nil
+}
+
+func ValidateRole(role string) error {
+	switch role {
+	case RoleOwner, RoleAdmin, RoleMember:
+		return nil
+	}
+	return fmt.Errorf("role must be one of %s, %s or %s", RoleOwner, RoleAdmin, RoleMember)
+}
+
+func ValidateTeamRole(role string) error {
+	switch role {
+	case TeamRoleMaintainer, TeamRoleMember:
+		return nil
+	}
+	return fmt.Errorf("role must be %s or %s", TeamRoleMaintainer, TeamRoleMember)
+}
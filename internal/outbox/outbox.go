@@ -0,0 +1,46 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+
+	EventSecurityLockout = "security.lockout"
+	EventSecurityUnlock  = "security.unlock"
+)
+
+// Message is an outbox row as handed to a Publisher. Key identifies the
+// aggregate (the user id); messages with the same key are published in the
+// order they were written.
+type Message struct {
+	ID      int64           `json:"id"`
+	Type    string          `json:"type"`
+	Key     string          `json:"key"`
+	Payload json.RawMessage `json:"payload"`
+	Created time.Time       `json:"created"`
+}
+
+// Enqueue records an event in the outbox as part of tx, so the event is
+// stored if and only if the change that produced it is committed.
+func Enqueue(ctx context.Context, tx pgx.Tx, eventType string, aggregateID int, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Enqueue: failed to encode %s payload: %w", eventType, err)
+	}
+	_, err = tx.Exec(ctx, "INSERT INTO outbox (aggregate_id, event_type, payload) VALUES ($1, $2, $3)",
+		strconv.Itoa(aggregateID), eventType, data)
+	if err != nil {
+		return fmt.Errorf("Enqueue: failed to insert %s event: %w", eventType, err)
+	}
+	return nil
+}
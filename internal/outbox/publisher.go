@@ -0,0 +1,177 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+// Publisher delivers outbox messages to a broker. Publish must only return
+// nil once the broker has accepted the message; the relay retries otherwise.
+// Messages may be delivered more than once, so consumers should deduplicate
+// by Message.ID.
+type Publisher interface {
+	Publish(ctx context.Context, msg *Message) error
+	Close() error
+}
+
+// WriterPublisher writes messages as JSON lines. It is meant for local
+// development and tests.
+type WriterPublisher struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func NewWriterPublisher(w io.Writer) *WriterPublisher {
+	return &WriterPublisher{w: w}
+}
+
+// NewFilePublisher appends messages to the file at path, or writes them to
+// stdout if path is "-".
+func NewFilePublisher(path string) (*WriterPublisher, error) {
+	if path == "-" {
+		return NewWriterPublisher(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("NewFilePublisher: failed to open %s: %w", path, err)
+	}
+	return &WriterPublisher{w: f, closer: f}, nil
+}
+
+func (p *WriterPublisher) Publish(ctx context.Context, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message %d: %w", msg.ID, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write message %d: %w", msg.ID, err)
+	}
+	return nil
+}
+
+func (p *WriterPublisher) Close() error {
+	if p.closer != nil {
+		return p.closer.Close()
+	}
+	return nil
+}
+
+// NATSPublisher publishes to JetStream on subject <prefix>.<event type>, e.g.
+// users.user.created. A stream must cover the subjects; JetStream acks make
+// delivery at-least-once and the Nats-Msg-Id header lets it drop duplicates.
+type NATSPublisher struct {
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	prefix string
+}
+
+func NewNATSPublisher(url, subjectPrefix string) (*NATSPublisher, error) {
+	conn, err := nats.Connect(url, nats.Name("user-api outbox"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("NewNATSPublisher: failed to connect to %s: %w", url, err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("NewNATSPublisher: failed to open JetStream context: %w", err)
+	}
+	return &NATSPublisher{conn: conn, js: js, prefix: subjectPrefix}, nil
+}
+
+func (p *NATSPublisher) Publish(ctx context.Context, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message %d: %w", msg.ID, err)
+	}
+
+	natsMsg := nats.NewMsg(p.prefix + "." + msg.Type)
+	natsMsg.Data = data
+	natsMsg.Header.Set(nats.MsgIdHdr, fmt.Sprint(msg.ID))
+	natsMsg.Header.Set("User-Id", msg.Key)
+	if _, err := p.js.PublishMsg(natsMsg, nats.Context(ctx)); err != nil {
+		return fmt.Errorf("failed to publish message %d to NATS: %w", msg.ID, err)
+	}
+	return nil
+}
+
+func (p *NATSPublisher) Close() error {
+	return p.conn.Drain()
+}
+
+// KafkaPublisher writes to a single topic keyed by user id, so all events of
+// a user land in the same partition and keep their order.
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaPublisher(brokers, topic string) *KafkaPublisher {
+	return &KafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(brokers, ",")...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		MaxAttempts:  1,
+		BatchTimeout: 10 * time.Millisecond,
+	}}
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode message %d: %w", msg.ID, err)
+	}
+
+	err = p.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(msg.Key),
+		Value: data,
+		Headers: []kafka.Header{
+			{Key: "event-type", Value: []byte(msg.Type)},
+			{Key: "message-id", Value: []byte(fmt.Sprint(msg.ID))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish message %d to Kafka: %w", msg.ID, err)
+	}
+	return nil
+}
+
+func (p *KafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+// MultiPublisher publishes every message to all of its publishers in order.
+// If one fails the whole message is retried, so earlier publishers may see
+// it again; put idempotent ones first.
+type MultiPublisher []Publisher
+
+func (m MultiPublisher) Publish(ctx context.Context, msg *Message) error {
+	for _, p := range m {
+		if err := p.Publish(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m MultiPublisher) Close() error {
+	var firstErr error
+	for _, p := range m {
+		if err := p.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
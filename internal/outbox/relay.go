@@ -0,0 +1,93 @@
+package outbox
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+type RelayConfig struct {
+	// BatchSize is the maximum number of messages claimed per round.
+	BatchSize int
+	// PollInterval is how long the relay sleeps when the outbox is empty.
+	PollInterval time.Duration
+	// MinBackoff and MaxBackoff bound the exponential retry delay of a
+	// message that failed to publish.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Retention is how long published messages are kept before purging.
+	Retention time.Duration
+}
+
+// Relay moves outbox rows to a Publisher. Delivery is at-least-once, see
+// PostgresRepository.ProcessDueMessages.
+type Relay struct {
+	repo      Repository
+	publisher Publisher
+	cfg       RelayConfig
+}
+
+func NewRelay(repo Repository, publisher Publisher, cfg RelayConfig) *Relay {
+	return &Relay{repo: repo, publisher: publisher, cfg: cfg}
+}
+
+// Run relays messages until ctx is cancelled. Several relays may run against
+// the same database.
+func (r *Relay) Run(ctx context.Context) error {
+	go r.purge(ctx)
+
+	for {
+		n, err := r.RelayOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Relay: %v", err)
+		}
+		if n > 0 && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.cfg.PollInterval):
+		}
+	}
+}
+
+// RelayOnce publishes one batch of due messages and returns how many were
+// attempted. Messages that fail are retried with exponential backoff.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	return r.repo.ProcessDueMessages(ctx, r.cfg.BatchSize, func(msg *Message, attempts int) PublishResult {
+		if err := r.publisher.Publish(ctx, msg); err != nil {
+			delay := r.backoff(attempts + 1)
+			log.Printf("Relay: failed to publish message %d (%s), retrying in %s: %v", msg.ID, msg.Type, delay, err)
+			return PublishResult{Error: err.Error(), NextAttemptAt: time.Now().Add(delay)}
+		}
+		return PublishResult{Published: true}
+	})
+}
+
+func (r *Relay) backoff(attempt int) time.Duration {
+	delay := r.cfg.MinBackoff
+	for i := 1; i < attempt && delay < r.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.cfg.MaxBackoff {
+		delay = r.cfg.MaxBackoff
+	}
+	return delay
+}
+
+func (r *Relay) purge(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := r.repo.PurgePublished(ctx, time.Now().Add(-r.cfg.Retention)); err != nil && ctx.Err() == nil {
+			log.Printf("Relay: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
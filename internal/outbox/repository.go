@@ -0,0 +1,105 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// PublishResult is the outcome of one attempt to publish a message. Failed
+// messages stay unpublished until NextAttemptAt.
+type PublishResult struct {
+	Published     bool
+	Error         string
+	NextAttemptAt time.Time
+}
+
+type Repository interface {
+	// ProcessDueMessages claims up to limit due messages, calls publish for
+	// each with the number of earlier attempts and records the results. Only
+	// the oldest unpublished message of each key is due, so messages of a
+	// key are published in order even with several relays.
+	ProcessDueMessages(ctx context.Context, limit int, publish func(msg *Message, attempts int) PublishResult) (int, error)
+	// PurgePublished deletes messages published before before.
+	PurgePublished(ctx context.Context, before time.Time) error
+}
+
+type PostgresRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresRepository(db *pgxpool.Pool) *PostgresRepository {
+	return &PostgresRepository{db: db}
+}
+
+// ProcessDueMessages marks a message published only after publish returns,
+// in the same transaction that claimed it, so a crash in between causes a
+// redelivery rather than a loss. Rows are claimed with FOR UPDATE SKIP
+// LOCKED; a claimed row still holds back the later messages of its key.
+func (r *PostgresRepository) ProcessDueMessages(ctx context.Context, limit int, publish func(msg *Message, attempts int) PublishResult) (int, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ProcessDueMessages: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `
+		SELECT o.id, o.event_type, o.aggregate_id, o.payload, o.created, o.attempts
+		FROM outbox o
+		WHERE o.published_at IS NULL
+			AND o.next_attempt_at <= now()
+			AND NOT EXISTS (
+				SELECT 1 FROM outbox p
+				WHERE p.aggregate_id = o.aggregate_id AND p.published_at IS NULL AND p.id < o.id
+			)
+		ORDER BY o.id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`, limit)
+	if err != nil {
+		return 0, fmt.Errorf("ProcessDueMessages: failed to claim messages: %w", err)
+	}
+
+	var messages []*Message
+	var attempts []int
+	for rows.Next() {
+		var msg Message
+		var n int
+		if err := rows.Scan(&msg.ID, &msg.Type, &msg.Key, &msg.Payload, &msg.Created, &n); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("ProcessDueMessages: failed to scan message: %w", err)
+		}
+		messages = append(messages, &msg)
+		attempts = append(attempts, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("ProcessDueMessages: failed to read messages: %w", err)
+	}
+
+	for i, msg := range messages {
+		result := publish(msg, attempts[i])
+		if result.Published {
+			_, err = tx.Exec(ctx, "UPDATE outbox SET published_at = now(), attempts = attempts + 1, last_error = NULL WHERE id = $1", msg.ID)
+		} else {
+			_, err = tx.Exec(ctx, "UPDATE outbox SET attempts = attempts + 1, next_attempt_at = $1, last_error = $2 WHERE id = $3",
+				result.NextAttemptAt, result.Error, msg.ID)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("ProcessDueMessages: failed to record message %d: %w", msg.ID, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("ProcessDueMessages: failed to commit transaction: %w", err)
+	}
+	return len(messages), nil
+}
+
+func (r *PostgresRepository) PurgePublished(ctx context.Context, before time.Time) error {
+	if _, err := r.db.Exec(ctx, "DELETE FROM outbox WHERE published_at < $1", before); err != nil {
+		return fmt.Errorf("PurgePublished: failed to delete published messages: %w", err)
+	}
+	return nil
+}
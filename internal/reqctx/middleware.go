@@ -0,0 +1,241 @@
+package reqctx
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Headers (and gRPC metadata keys) the metadata is read from. Actor headers
+// are only honoured from trusted proxies and the REST gateway, which proves
+// itself with the key in GatewayKeyHeader. Only the gateway can pass on
+// that it verified the actor, and the client address in ClientIPHeader.
+const (
+	RequestIDHeader     = "X-Request-ID"
+	ActorHeader         = "X-Actor"
+	ActorRolesHeader    = "X-Actor-Roles"
+	ActorVerifiedHeader = "X-Actor-Verified"
+	TenantHeader        = "X-Tenant-ID"
+	GatewayKeyHeader    = "X-Gateway-Key"
+	ClientIPHeader      = "X-Gateway-Client-IP"
+)
+
+type options struct {
+	trustedProxies []*net.IPNet
+	gatewayKey     string
+}
+
+// Option configures whom the middleware takes actor headers from.
+type Option func(*options)
+
+// WithTrustedProxies honours the actor headers of requests whose peer is in
+// one of proxies. Without it, actors come from client certificates and
+// access tokens only.
+func WithTrustedProxies(proxies []*net.IPNet) Option {
+	return func(o *options) {
+		o.trustedProxies = proxies
+	}
+}
+
+// WithGatewayKey honours the actor metadata of RPCs carrying key, which the
+// REST gateway sends to the gRPC server behind it.
+func WithGatewayKey(key string) Option {
+	return func(o *options) {
+		o.gatewayKey = key
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *options) trusts(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, proxy := range o.trustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient is the client a trusted proxy forwarded the request for:
+// the last X-Forwarded-For entry not added by another trusted proxy, as gin
+// takes it. Entries further left are up to the client.
+func (o *options) forwardedClient(values []string) string {
+	var hops []string
+	for _, value := range values {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			return ""
+		}
+		if !o.trusts(hop) || i == 0 {
+			return hop
+		}
+	}
+	return ""
+}
+
+func (o *options) isGateway(key string) bool {
+	return o.gatewayKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(o.gatewayKey)) == 1
+}
+
+// ParseTrustedProxies parses a comma separated list of IP addresses and
+// CIDR ranges.
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR range", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, proxy, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR range", entry)
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies, nil
+}
+
+// GinMiddleware attaches Meta to every REST request and echoes the request ID.
+func GinMiddleware(opts ...Option) gin.HandlerFunc {
+	o := newOptions(opts)
+	return func(ctx *gin.Context) {
+		meta := &Meta{
+			RequestID: ctx.GetHeader(RequestIDHeader),
+			Source:    SourceREST,
+			TenantID:  ctx.GetHeader(TenantHeader),
+			ClientIP:  ctx.ClientIP(),
+		}
+		if o.trusts(ctx.RemoteIP()) {
+			meta.Actor = ctx.GetHeader(ActorHeader)
+			meta.Roles = splitRoles(ctx.GetHeader(ActorRolesHeader))
+		}
+		if meta.RequestID == "" {
+			meta.RequestID = newRequestID()
+		}
+		ctx.Header(RequestIDHeader, meta.RequestID)
+		ctx.Request = ctx.Request.WithContext(WithMeta(ctx.Request.Context(), meta))
+		ctx.Next()
+	}
+}
+
+func grpcMeta(ctx context.Context, o *options) *Meta {
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	meta := &Meta{
+		RequestID: get(RequestIDHeader),
+		Source:    SourceGRPC,
+		TenantID:  get(TenantHeader),
+	}
+	gateway, peer := o.isGateway(get(GatewayKeyHeader)), peerIP(ctx)
+	trusted := o.trusts(peer)
+	if gateway || trusted {
+		meta.Actor = get(ActorHeader)
+		meta.Roles = splitRoles(get(ActorRolesHeader))
+		meta.Verified = gateway && get(ActorVerifiedHeader) == "true"
+	}
+	switch {
+	case gateway:
+		meta.ClientIP = get(ClientIPHeader)
+	case trusted:
+		meta.ClientIP = o.forwardedClient(md.Get("x-forwarded-for"))
+	}
+	if meta.ClientIP == "" {
+		meta.ClientIP = peer
+	}
+	if meta.RequestID == "" {
+		meta.RequestID = newRequestID()
+	}
+	return meta
+}
+
+// UnaryServerInterceptor attaches Meta to every unary RPC and echoes the
+// request ID.
+func UnaryServerInterceptor(opts ...Option) grpc.UnaryServerInterceptor {
+	o := newOptions(opts)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		meta := grpcMeta(ctx, o)
+		grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, meta.RequestID))
+		return handler(WithMeta(ctx, meta), req)
+	}
+}
+
+// StreamServerInterceptor attaches Meta to every streaming RPC and echoes
+// the request ID.
+func StreamServerInterceptor(opts ...Option) grpc.StreamServerInterceptor {
+	o := newOptions(opts)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		meta := grpcMeta(ss.Context(), o)
+		ss.SetHeader(metadata.Pairs(RequestIDHeader, meta.RequestID))
+		return handler(srv, &serverStream{ServerStream: ss, ctx: WithMeta(ss.Context(), meta)})
+	}
+}
+
+// peerIP is the address the RPC came from, without the port.
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	ip := p.Addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// PeerIP is the address of the gRPC client, which the login lockout,
+// password reset throttling and rate limits key on. Behind the REST
+// gateway and trusted proxies it is the client they forwarded the call for;
+// X-Forwarded-For from anyone else is ignored.
+func PeerIP(ctx context.Context) string {
+	if ip := FromContext(ctx).ClientIP; ip != "" {
+		return ip
+	}
+	return peerIP(ctx)
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,127 @@
+package reqctx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+const (
+	SourceREST = "rest"
+	SourceGRPC = "grpc"
+	SourceSCIM = "scim"
+
+	RoleAdmin = "admin"
+	// RolePlatformAdmin may act across tenants; row-level security is
+	// bypassed for its requests.
+	RolePlatformAdmin = "platform-admin"
+
+	// DefaultTenant owns requests that name no tenant.
+	DefaultTenant = "default"
+
+	// UserActorPrefix marks actors that are users of the service, followed
+	// by the user id.
+	UserActorPrefix = "user:"
+)
+
+// Meta describes who made a request and through which transport. It is
+// attached to the request context by the transport middleware. Verified is
+// set when the actor was established from a client certificate or an
+// access token rather than taken from headers.
+type Meta struct {
+	RequestID string
+	Actor     string
+	Roles     []string
+	Verified  bool
+	Source    string
+	TenantID  string
+	// ClientIP is the address of the client behind the trusted proxies and
+	// the REST gateway.
+	ClientIP string
+}
+
+func (m *Meta) HasRole(role string) bool {
+	for _, r := range m.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Meta) IsAdmin() bool {
+	return m.HasRole(RoleAdmin)
+}
+
+// IsPlatformAdmin only holds for verified actors: the role lifts tenant
+// isolation, which no header may do.
+func (m *Meta) IsPlatformAdmin() bool {
+	return m.Verified && m.HasRole(RolePlatformAdmin)
+}
+
+// UserID returns the id of the user a verified actor names. Actors from
+// headers or client certificates have none.
+func (m *Meta) UserID() (int, bool) {
+	if !m.Verified || !strings.HasPrefix(m.Actor, UserActorPrefix) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(m.Actor, UserActorPrefix))
+	return id, err == nil
+}
+
+// Tenant returns the tenant the request acts for, DefaultTenant if none
+// was given.
+func (m *Meta) Tenant() string {
+	if m.TenantID == "" {
+		return DefaultTenant
+	}
+	return m.TenantID
+}
+
+type metaKey struct{}
+
+func WithMeta(ctx context.Context, meta *Meta) context.Context {
+	return context.WithValue(ctx, metaKey{}, meta)
+}
+
+// FromContext returns the request metadata, or an empty Meta for contexts
+// that did not come through a transport (background jobs, tests).
+func FromContext(ctx context.Context) *Meta {
+	if meta, ok := ctx.Value(metaKey{}).(*Meta); ok {
+		return meta
+	}
+	return &Meta{}
+}
+
+// WithTenant returns ctx with a copy of its metadata acting for tenantID.
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	meta := *FromContext(ctx)
+	meta.TenantID = tenantID
+	return WithMeta(ctx, &meta)
+}
+
+// WithActor returns ctx with a copy of its metadata naming actor with
+// roles, for identities established by the transport rather than headers.
+func WithActor(ctx context.Context, actor string, roles []string) context.Context {
+	meta := *FromContext(ctx)
+	meta.Actor, meta.Roles, meta.Verified = actor, roles, true
+	return WithMeta(ctx, &meta)
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func splitRoles(roles string) []string {
+	var out []string
+	for _, role := range strings.Split(roles, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			out = append(out, role)
+		}
+	}
+	return out
+}
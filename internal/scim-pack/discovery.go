@@ -0,0 +1,135 @@
+package scimPack
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The discovery endpoints (RFC 7644, section 4) describe what this server
+// supports, so clients such as Okta and Entra ID can configure themselves.
+
+type schemaAttribute struct {
+	Name          string            `json:"name"`
+	Type          string            `json:"type"`
+	MultiValued   bool              `json:"multiValued"`
+	Required      bool              `json:"required"`
+	CaseExact     bool              `json:"caseExact"`
+	Mutability    string            `json:"mutability"`
+	Returned      string            `json:"returned"`
+	Uniqueness    string            `json:"uniqueness"`
+	SubAttributes []schemaAttribute `json:"subAttributes,omitempty"`
+}
+
+func stringAttr(name, mutability string, required bool) schemaAttribute {
+	return schemaAttribute{Name: name, Type: "string", Required: required, Mutability: mutability, Returned: "default", Uniqueness: "none"}
+}
+
+var userSchema = gin.H{
+	"schemas":     []string{SchemaSchema},
+	"id":          SchemaUser,
+	"name":        "User",
+	"description": "User Account",
+	"attributes": []schemaAttribute{
+		{Name: "userName", Type: "string", Required: true, Mutability: "readWrite", Returned: "default", Uniqueness: "server"},
+		{Name: "name", Type: "complex", Mutability: "readWrite", Returned: "default", Uniqueness: "none", SubAttributes: []schemaAttribute{
+			stringAttr("formatted", "readOnly", false),
+			stringAttr("givenName", "readWrite", true),
+			stringAttr("familyName", "readWrite", true),
+		}},
+		stringAttr("displayName", "readOnly", false),
+		{Name: "emails", Type: "complex", MultiValued: true, Mutability: "readWrite", Returned: "default", Uniqueness: "none", SubAttributes: []schemaAttribute{
+			stringAttr("value", "readWrite", true),
+			stringAttr("type", "readWrite", false),
+			{Name: "primary", Type: "boolean", Mutability: "readWrite", Returned: "default", Uniqueness: "none"},
+		}},
+		{Name: "active", Type: "boolean", Mutability: "readWrite", Returned: "default", Uniqueness: "none"},
+		{Name: "password", Type: "string", Mutability: "writeOnly", Returned: "never", Uniqueness: "none"},
+	},
+	"meta": gin.H{"resourceType": "Schema"},
+}
+
+var groupSchema = gin.H{
+	"schemas":     []string{SchemaSchema},
+	"id":          SchemaGroup,
+	"name":        "Group",
+	"description": "Group",
+	"attributes": []schemaAttribute{
+		{Name: "displayName", Type: "string", Required: true, Mutability: "readWrite", Returned: "default", Uniqueness: "server"},
+		{Name: "members", Type: "complex", MultiValued: true, Mutability: "readWrite", Returned: "default", Uniqueness: "none", SubAttributes: []schemaAttribute{
+			{Name: "value", Type: "string", Mutability: "immutable", Returned: "default", Uniqueness: "none"},
+			stringAttr("display", "readOnly", false),
+			{Name: "$ref", Type: "reference", Mutability: "immutable", Returned: "default", Uniqueness: "none"},
+			stringAttr("type", "immutable", false),
+		}},
+	},
+	"meta": gin.H{"resourceType": "Schema"},
+}
+
+var resourceTypes = map[string]gin.H{
+	"User": {
+		"schemas":     []string{SchemaResourceType},
+		"id":          "User",
+		"name":        "User",
+		"endpoint":    "/Users",
+		"description": "User Account",
+		"schema":      SchemaUser,
+		"meta":        gin.H{"resourceType": "ResourceType"},
+	},
+	"Group": {
+		"schemas":     []string{SchemaResourceType},
+		"id":          "Group",
+		"name":        "Group",
+		"endpoint":    "/Groups",
+		"description": "Group",
+		"schema":      SchemaGroup,
+		"meta":        gin.H{"resourceType": "ResourceType"},
+	},
+}
+
+func (c *ScimHandler) ServiceProviderConfig(ctx *gin.Context) {
+	respond(ctx, http.StatusOK, gin.H{
+		"schemas":        []string{SchemaServiceProviderConfig},
+		"patch":          gin.H{"supported": true},
+		"bulk":           gin.H{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         gin.H{"supported": true, "maxResults": maxCount},
+		"changePassword": gin.H{"supported": false},
+		"sort":           gin.H{"supported": false},
+		"etag":           gin.H{"supported": false},
+		"authenticationSchemes": []gin.H{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "Authentication with a bearer token issued per tenant",
+			"primary":     true,
+		}},
+		"meta": gin.H{"resourceType": "ServiceProviderConfig"},
+	})
+}
+
+func (c *ScimHandler) ListSchemas(ctx *gin.Context) {
+	respond(ctx, http.StatusOK, listResponse([]gin.H{userSchema, groupSchema}, 2, 2, 1))
+}
+
+func (c *ScimHandler) GetSchema(ctx *gin.Context) {
+	switch ctx.Param("id") {
+	case SchemaUser:
+		respond(ctx, http.StatusOK, userSchema)
+	case SchemaGroup:
+		respond(ctx, http.StatusOK, groupSchema)
+	default:
+		respond(ctx, http.StatusNotFound, errorBody(http.StatusNotFound, "", "schema not found"))
+	}
+}
+
+func (c *ScimHandler) ListResourceTypes(ctx *gin.Context) {
+	respond(ctx, http.StatusOK, listResponse([]gin.H{resourceTypes["User"], resourceTypes["Group"]}, 2, 2, 1))
+}
+
+func (c *ScimHandler) GetResourceType(ctx *gin.Context) {
+	resourceType, ok := resourceTypes[ctx.Param("id")]
+	if !ok {
+		respond(ctx, http.StatusNotFound, errorBody(http.StatusNotFound, "", "resource type not found"))
+		return
+	}
+	respond(ctx, http.StatusOK, resourceType)
+}
@@ -0,0 +1,303 @@
+package scimPack
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Filter is a parsed SCIM filter expression (RFC 7644, section 3.4.2.2).
+// It is one of *LogicalFilter, *NotFilter or *AttrFilter.
+type Filter interface {
+	filter()
+}
+
+// LogicalFilter joins two filters with "and" or "or".
+type LogicalFilter struct {
+	Op          string
+	Left, Right Filter
+}
+
+type NotFilter struct {
+	Filter Filter
+}
+
+// AttrFilter compares an attribute with a value. Path is lower-cased with
+// the core schema prefix removed, and value paths such as
+// emails[value eq "x"] are flattened to emails.value. Value is a string,
+// float64, bool or nil; it is nil for the "pr" operator.
+type AttrFilter struct {
+	Path  string
+	Op    string
+	Value interface{}
+}
+
+func (*LogicalFilter) filter() {}
+func (*NotFilter) filter()     {}
+func (*AttrFilter) filter()    {}
+
+var compareOps = map[string]bool{"eq": true, "ne": true, "co": true, "sw": true, "ew": true, "gt": true, "ge": true, "lt": true, "le": true}
+
+// ParseFilter parses a filter. Operators and attribute names are case
+// insensitive.
+func ParseFilter(s string) (Filter, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	f, err := p.parseOr("")
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidFilter, p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenPunct
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+}
+
+func tokenizeFilter(s string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, filterToken{tokenPunct, string(c)})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("%w: unterminated string", ErrInvalidFilter)
+			}
+			value, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad string %s", ErrInvalidFilter, s[i:end+1])
+			}
+			tokens = append(tokens, filterToken{tokenString, value})
+			i = end + 1
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t()[]\"", rune(s[end])) {
+				end++
+			}
+			tokens = append(tokens, filterToken{tokenWord, s[i:end]})
+			i = end
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: empty filter", ErrInvalidFilter)
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() *filterToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *filterParser) keyword(word string) bool {
+	if t := p.peek(); t != nil && t.kind == tokenWord && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) punct(c string) bool {
+	if t := p.peek(); t != nil && t.kind == tokenPunct && t.text == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// The parse functions take the path of the enclosing value filter, if any,
+// which prefixes the attributes inside the brackets.
+
+func (p *filterParser) parseOr(parent string) (Filter, error) {
+	left, err := p.parseAnd(parent)
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd(parent)
+		if err != nil {
+			return nil, err
+		}
+		left = &LogicalFilter{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd(parent string) (Filter, error) {
+	left, err := p.parseUnary(parent)
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary(parent)
+		if err != nil {
+			return nil, err
+		}
+		left = &LogicalFilter{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary(parent string) (Filter, error) {
+	if p.keyword("not") {
+		if !p.punct("(") {
+			return nil, fmt.Errorf("%w: expected ( after not", ErrInvalidFilter)
+		}
+		f, err := p.parseGroup(parent)
+		if err != nil {
+			return nil, err
+		}
+		return &NotFilter{Filter: f}, nil
+	}
+	if p.punct("(") {
+		return p.parseGroup(parent)
+	}
+	return p.parseAttr(parent)
+}
+
+func (p *filterParser) parseGroup(parent string) (Filter, error) {
+	f, err := p.parseOr(parent)
+	if err != nil {
+		return nil, err
+	}
+	if !p.punct(")") {
+		return nil, fmt.Errorf("%w: missing )", ErrInvalidFilter)
+	}
+	return f, nil
+}
+
+func (p *filterParser) parseAttr(parent string) (Filter, error) {
+	t := p.peek()
+	if t == nil || t.kind != tokenWord {
+		return nil, fmt.Errorf("%w: expected an attribute", ErrInvalidFilter)
+	}
+	p.pos++
+	path, err := attributePath(t.text)
+	if err != nil {
+		return nil, err
+	}
+	if parent != "" {
+		path = parent + "." + path
+	}
+
+	if p.punct("[") {
+		if parent != "" {
+			return nil, fmt.Errorf("%w: nested value filters", ErrInvalidFilter)
+		}
+		f, err := p.parseOr(path)
+		if err != nil {
+			return nil, err
+		}
+		if !p.punct("]") {
+			return nil, fmt.Errorf("%w: missing ]", ErrInvalidFilter)
+		}
+		return f, nil
+	}
+
+	op := p.peek()
+	if op == nil || op.kind != tokenWord {
+		return nil, fmt.Errorf("%w: expected an operator after %s", ErrInvalidFilter, t.text)
+	}
+	p.pos++
+	name := strings.ToLower(op.text)
+	if name == "pr" {
+		return &AttrFilter{Path: path, Op: name}, nil
+	}
+	if !compareOps[name] {
+		return nil, fmt.Errorf("%w: unknown operator %q", ErrInvalidFilter, op.text)
+	}
+
+	v := p.peek()
+	if v == nil || v.kind == tokenPunct {
+		return nil, fmt.Errorf("%w: expected a value after %s", ErrInvalidFilter, op.text)
+	}
+	p.pos++
+	value, err := filterValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return &AttrFilter{Path: path, Op: name, Value: value}, nil
+}
+
+func filterValue(t *filterToken) (interface{}, error) {
+	if t.kind == tokenString {
+		return t.text, nil
+	}
+	switch strings.ToLower(t.text) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	n, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad value %q", ErrInvalidFilter, t.text)
+	}
+	return n, nil
+}
+
+// attributePath normalizes an attribute path: the core schema URNs are
+// dropped and the rest is lower-cased.
+func attributePath(s string) (string, error) {
+	lower := strings.ToLower(s)
+	for _, schema := range []string{SchemaUser, SchemaGroup} {
+		if prefix := strings.ToLower(schema) + ":"; strings.HasPrefix(lower, prefix) {
+			lower = lower[len(prefix):]
+		}
+	}
+	for _, part := range strings.Split(lower, ".") {
+		if part == "" || !isAttrName(part) {
+			return "", fmt.Errorf("%w: bad attribute %q", ErrInvalidFilter, s)
+		}
+	}
+	return lower, nil
+}
+
+func isAttrName(s string) bool {
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || r == '$' || (i > 0 && (unicode.IsDigit(r) || r == '_' || r == '-'))) {
+			return false
+		}
+	}
+	return true
+}
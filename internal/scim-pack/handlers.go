@@ -0,0 +1,540 @@
+package scimPack
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+
+	"user-api/internal/reqctx"
+	"user-api/internal/throttle"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/ratelimit"
+)
+
+// BasePath is where the SCIM endpoints are mounted.
+const BasePath = "/scim/v2"
+
+// actor is recorded as the actor of the changes made by SCIM clients.
+const actor = "scim"
+
+type ScimHandler struct {
+	service *ScimService
+	// tokens maps the SHA-256 of each bearer token to its tenant.
+	tokens map[[sha256.Size]byte]string
+}
+
+// NewScimHandler serves the SCIM endpoints to clients presenting one of
+// tokens, a map of bearer token to the tenant it provisions.
+func NewScimHandler(service *ScimService, tokens map[string]string) *ScimHandler {
+	hashed := make(map[[sha256.Size]byte]string, len(tokens))
+	for token, tenant := range tokens {
+		hashed[sha256.Sum256([]byte(token))] = tenant
+	}
+	return &ScimHandler{service: service, tokens: hashed}
+}
+
+// ParseTokens parses a comma separated list of tenant:token pairs.
+func ParseTokens(s string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		tenant, token, ok := strings.Cut(pair, ":")
+		if !ok || tenant == "" || token == "" {
+			return nil, fmt.Errorf("SCIM token %q is not tenant:token", pair)
+		}
+		tokens[token] = tenant
+	}
+	return tokens, nil
+}
+
+// Authenticate accepts the bearer tokens of the handler and scopes the
+// request to the tenant of the token.
+func (c *ScimHandler) Authenticate() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		tenant, found := "", false
+		if ok {
+			sum := sha256.Sum256([]byte(token))
+			// Compare with every token so the time taken does not tell
+			// which one nearly matched.
+			for known, t := range c.tokens {
+				if subtle.ConstantTimeCompare(sum[:], known[:]) == 1 {
+					tenant, found = t, true
+				}
+			}
+		}
+		if !found {
+			ctx.Header("WWW-Authenticate", `Bearer realm="SCIM"`)
+			respond(ctx, http.StatusUnauthorized, errorBody(http.StatusUnauthorized, "", "a valid bearer token is required"))
+			ctx.Abort()
+			return
+		}
+
+		meta := *reqctx.FromContext(ctx.Request.Context())
+		meta.TenantID = tenant
+		meta.Actor = actor
+		meta.Source = reqctx.SourceSCIM
+		meta.Roles = nil
+		ctx.Request = ctx.Request.WithContext(reqctx.WithMeta(ctx.Request.Context(), &meta))
+		ctx.Next()
+	}
+}
+
+func (c *ScimHandler) CreateUser(ctx *gin.Context) {
+	var req UserResource
+	if !bind(ctx, &req) {
+		return
+	}
+	u := userFromResource(&req)
+	u.User.Password = req.Password
+	if err := userPack.ValidateUser(u.User); err != nil {
+		respondError(ctx, badRequest("invalidValue", "%v", err))
+		return
+	}
+
+	if err := c.service.CreateUser(ctx.Request.Context(), u); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	res := userResource(ctx, u)
+	ctx.Header("Location", res.Meta.Location)
+	respond(ctx, http.StatusCreated, res)
+}
+
+func (c *ScimHandler) GetUser(ctx *gin.Context) {
+	id, ok := resourceID(ctx)
+	if !ok {
+		return
+	}
+
+	u, err := c.service.GetUser(ctx.Request.Context(), id)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	respond(ctx, http.StatusOK, userResource(ctx, u))
+}
+
+func (c *ScimHandler) ListUsers(ctx *gin.Context) {
+	filter, startIndex, count, ok := listParams(ctx)
+	if !ok {
+		return
+	}
+
+	users, total, err := c.service.ListUsers(ctx.Request.Context(), filter, startIndex, count)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	resources := make([]*UserResource, 0, len(users))
+	for _, u := range users {
+		resources = append(resources, userResource(ctx, u))
+	}
+	respond(ctx, http.StatusOK, listResponse(resources, len(resources), total, startIndex))
+}
+
+// ReplaceUser handles PUT. Attributes missing from the body are cleared
+// where they can be; a missing active leaves the status alone.
+func (c *ScimHandler) ReplaceUser(ctx *gin.Context) {
+	id, ok := resourceID(ctx)
+	if !ok {
+		return
+	}
+	var req UserResource
+	if !bind(ctx, &req) {
+		return
+	}
+	replacement := userFromResource(&req)
+
+	u, err := c.service.UpdateUser(ctx.Request.Context(), id, func(u *ProvisionedUser) error {
+		u.User.Email = replacement.User.Email
+		u.User.Firstname = replacement.User.Firstname
+		u.User.Lastname = replacement.User.Lastname
+		u.ExternalID = replacement.ExternalID
+		if req.Active != nil {
+			u.Active = *req.Active
+		}
+		return nil
+	})
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	respond(ctx, http.StatusOK, userResource(ctx, u))
+}
+
+func (c *ScimHandler) PatchUser(ctx *gin.Context) {
+	id, ok := resourceID(ctx)
+	if !ok {
+		return
+	}
+	var req PatchRequest
+	if !bind(ctx, &req) {
+		return
+	}
+
+	u, err := c.service.UpdateUser(ctx.Request.Context(), id, func(u *ProvisionedUser) error {
+		return PatchUser(u, req.Operations)
+	})
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	respond(ctx, http.StatusOK, userResource(ctx, u))
+}
+
+func (c *ScimHandler) DeleteUser(ctx *gin.Context) {
+	id, ok := resourceID(ctx)
+	if !ok {
+		return
+	}
+
+	if err := c.service.DeleteUser(ctx.Request.Context(), id); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *ScimHandler) CreateGroup(ctx *gin.Context) {
+	var req GroupResource
+	if !bind(ctx, &req) {
+		return
+	}
+	group, err := groupFromResource(&req)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	if err := c.service.CreateGroup(ctx.Request.Context(), group); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	res := groupResource(ctx, group)
+	ctx.Header("Location", res.Meta.Location)
+	respond(ctx, http.StatusCreated, res)
+}
+
+func (c *ScimHandler) GetGroup(ctx *gin.Context) {
+	id, ok := resourceID(ctx)
+	if !ok {
+		return
+	}
+
+	group, err := c.service.GetGroup(ctx.Request.Context(), id)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	respond(ctx, http.StatusOK, groupResource(ctx, group))
+}
+
+func (c *ScimHandler) ListGroups(ctx *gin.Context) {
+	filter, startIndex, count, ok := listParams(ctx)
+	if !ok {
+		return
+	}
+
+	groups, total, err := c.service.ListGroups(ctx.Request.Context(), filter, startIndex, count)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	resources := make([]*GroupResource, 0, len(groups))
+	for _, group := range groups {
+		resources = append(resources, groupResource(ctx, group))
+	}
+	respond(ctx, http.StatusOK, listResponse(resources, len(resources), total, startIndex))
+}
+
+func (c *ScimHandler) ReplaceGroup(ctx *gin.Context) {
+	id, ok := resourceID(ctx)
+	if !ok {
+		return
+	}
+	var req GroupResource
+	if !bind(ctx, &req) {
+		return
+	}
+	replacement, err := groupFromResource(&req)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	group, err := c.service.UpdateGroup(ctx.Request.Context(), id, func(group *Group) error {
+		group.DisplayName = replacement.DisplayName
+		group.ExternalID = replacement.ExternalID
+		group.Members = replacement.Members
+		return nil
+	})
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	respond(ctx, http.StatusOK, groupResource(ctx, group))
+}
+
+func (c *ScimHandler) PatchGroup(ctx *gin.Context) {
+	id, ok := resourceID(ctx)
+	if !ok {
+		return
+	}
+	var req PatchRequest
+	if !bind(ctx, &req) {
+		return
+	}
+
+	group, err := c.service.UpdateGroup(ctx.Request.Context(), id, func(group *Group) error {
+		return PatchGroup(group, req.Operations)
+	})
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	respond(ctx, http.StatusOK, groupResource(ctx, group))
+}
+
+func (c *ScimHandler) DeleteGroup(ctx *gin.Context) {
+	id, ok := resourceID(ctx)
+	if !ok {
+		return
+	}
+
+	if err := c.service.DeleteGroup(ctx.Request.Context(), id); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func userFromResource(req *UserResource) *ProvisionedUser {
+	user := &userPack.User{Email: req.UserName}
+	if user.Email == "" {
+		user.Email = primaryEmail(req.Emails)
+	}
+	if req.Name != nil {
+		user.Firstname = req.Name.GivenName
+		user.Lastname = req.Name.FamilyName
+	}
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+	return &ProvisionedUser{User: user, ExternalID: req.ExternalID, Active: active}
+}
+
+func userResource(ctx *gin.Context, u *ProvisionedUser) *UserResource {
+	id := strconv.Itoa(u.User.ID)
+	active := u.Active
+	created := u.User.Created
+	displayName := strings.TrimSpace(u.User.Firstname + " " + u.User.Lastname)
+	return &UserResource{
+		Schemas:    []string{SchemaUser},
+		ID:         id,
+		ExternalID: u.ExternalID,
+		UserName:   u.User.Email,
+		Name: &Name{
+			Formatted:  displayName,
+			GivenName:  u.User.Firstname,
+			FamilyName: u.User.Lastname,
+		},
+		DisplayName: displayName,
+		Emails:      []Email{{Value: u.User.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta:        &Meta{ResourceType: "User", Created: &created, Location: location(ctx, "Users", id)},
+	}
+}
+
+func groupFromResource(req *GroupResource) (*Group, error) {
+	if strings.TrimSpace(req.DisplayName) == "" {
+		return nil, badRequest("invalidValue", "displayName is required")
+	}
+	group := &Group{DisplayName: req.DisplayName, ExternalID: req.ExternalID}
+	for _, ref := range req.Members {
+		id, err := strconv.Atoi(ref.Value)
+		if err != nil {
+			return nil, badRequest("invalidValue", "member %q is not a user id", ref.Value)
+		}
+		group.Members = append(group.Members, GroupMember{UserID: id})
+	}
+	return group, nil
+}
+
+func groupResource(ctx *gin.Context, group *Group) *GroupResource {
+	id := strconv.Itoa(group.ID)
+	created := group.Created
+	res := &GroupResource{
+		Schemas:     []string{SchemaGroup},
+		ID:          id,
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Meta:        &Meta{ResourceType: "Group", Created: &created, Location: location(ctx, "Groups", id)},
+	}
+	for _, m := range group.Members {
+		member := strconv.Itoa(m.UserID)
+		res.Members = append(res.Members, MemberRef{
+			Value:   member,
+			Display: m.Display,
+			Ref:     location(ctx, "Users", member),
+			Type:    "User",
+		})
+	}
+	return res
+}
+
+func listResponse(resources interface{}, n, total, startIndex int) *ListResponse {
+	return &ListResponse{
+		Schemas:      []string{SchemaListResponse},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: n,
+		Resources:    resources,
+	}
+}
+
+// location is the absolute URL of a resource, as the request reached us.
+func location(ctx *gin.Context, resourceType, id string) string {
+	scheme := "http"
+	if ctx.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := ctx.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + ctx.Request.Host + BasePath + "/" + resourceType + "/" + id
+}
+
+// listParams reads filter, startIndex and count. startIndex is 1-based
+// and values below 1 mean 1; count is capped at maxCount.
+func listParams(ctx *gin.Context) (Filter, int, int, bool) {
+	var filter Filter
+	if s := ctx.Query("filter"); s != "" {
+		f, err := ParseFilter(s)
+		if err != nil {
+			respondError(ctx, err)
+			return nil, 0, 0, false
+		}
+		filter = f
+	}
+
+	startIndex, count := 1, defaultCount
+	if s := ctx.Query("startIndex"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			respondError(ctx, badRequest("invalidValue", "startIndex must be an integer"))
+			return nil, 0, 0, false
+		}
+		if n > 1 {
+			startIndex = n
+		}
+	}
+	if s := ctx.Query("count"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			respondError(ctx, badRequest("invalidValue", "count must be an integer"))
+			return nil, 0, 0, false
+		}
+		count = n
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > maxCount {
+		count = maxCount
+	}
+	return filter, startIndex, count, true
+}
+
+func resourceID(ctx *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		respond(ctx, http.StatusNotFound, errorBody(http.StatusNotFound, "", "resource not found"))
+		return 0, false
+	}
+	return id, true
+}
+
+func bind(ctx *gin.Context, v interface{}) bool {
+	if err := ctx.ShouldBindJSON(v); err != nil {
+		respondError(ctx, badRequest("invalidSyntax", "%v", err))
+		return false
+	}
+	return true
+}
+
+// respond writes body as JSON with the SCIM media type.
+func respond(ctx *gin.Context, status int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+	ctx.Data(status, ContentType+"; charset=utf-8", data)
+}
+
+type errorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+func errorBody(status int, scimType, detail string) *errorResponse {
+	return &errorResponse{
+		Schemas:  []string{SchemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	}
+}
+
+func respondError(ctx *gin.Context, err error) {
+	var scimErr *Error
+	var quota *ratelimit.QuotaError
+	switch {
+	case errors.As(err, &scimErr):
+		respond(ctx, scimErr.Status, errorBody(scimErr.Status, scimErr.ScimType, scimErr.Detail))
+	case errors.As(err, &quota):
+		throttle.SetRetryAfter(ctx.Writer.Header(), time.Until(quota.Reset))
+		respond(ctx, http.StatusTooManyRequests, errorBody(http.StatusTooManyRequests, "", err.Error()))
+	case errors.Is(err, userPack.ErrUserNotFound), errors.Is(err, pgx.ErrNoRows):
+		respond(ctx, http.StatusNotFound, errorBody(http.StatusNotFound, "", "User not found"))
+	case errors.Is(err, ErrGroupNotFound):
+		respond(ctx, http.StatusNotFound, errorBody(http.StatusNotFound, "", "Group not found"))
+	case errors.Is(err, userPack.ErrEmailTaken), errors.Is(err, ErrExternalIDTaken), errors.Is(err, ErrGroupNameTaken):
+		respond(ctx, http.StatusConflict, errorBody(http.StatusConflict, "uniqueness", err.Error()))
+	case errors.Is(err, ErrUnknownMember):
+		respond(ctx, http.StatusBadRequest, errorBody(http.StatusBadRequest, "invalidValue", err.Error()))
+	case errors.Is(err, ErrInvalidFilter), errors.Is(err, ErrUnsupportedFilter):
+		respond(ctx, http.StatusBadRequest, errorBody(http.StatusBadRequest, "invalidFilter", err.Error()))
+	case errors.Is(err, userPack.ErrInvalidStatusTransition):
+		respond(ctx, http.StatusBadRequest, errorBody(http.StatusBadRequest, "mutability", err.Error()))
+	default:
+		respond(ctx, http.StatusInternalServerError, errorBody(http.StatusInternalServerError, "", err.Error()))
+	}
+}
@@ -0,0 +1,309 @@
+package scimPack
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Error is a failure with its own status and scimType (RFC 7644, section
+// 3.12), such as a PATCH on an attribute that does not exist.
+type Error struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+func badRequest(scimType, format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusBadRequest, ScimType: scimType, Detail: fmt.Sprintf(format, args...)}
+}
+
+// patchPath splits a PATCH path such as emails[type eq "work"].value into
+// the attribute, the value filter and the sub-attribute.
+var patchPath = regexp.MustCompile(`^([^\[\].]+(?:\.[^\[\].]+)?)(?:\[(.*)\])?(?:\.([^\[\].]+))?$`)
+
+type patchTarget struct {
+	attr   string
+	filter Filter
+}
+
+func parsePatchPath(path string) (*patchTarget, error) {
+	m := patchPath.FindStringSubmatch(path)
+	if m == nil {
+		return nil, badRequest("invalidPath", "bad path %q", path)
+	}
+	attr, err := attributePath(m[1])
+	if err != nil {
+		return nil, badRequest("invalidPath", "bad path %q", path)
+	}
+	target := &patchTarget{attr: attr}
+	if m[2] != "" {
+		if target.filter, err = ParseFilter(m[2]); err != nil {
+			return nil, badRequest("invalidFilter", "bad value filter in path %q: %v", path, err)
+		}
+	}
+	if m[3] != "" {
+		target.attr += "." + strings.ToLower(m[3])
+	}
+	return target, nil
+}
+
+// eachPatch calls apply for every attribute the operations touch. An
+// operation without a path carries an object of attribute paths and values.
+func eachPatch(ops []PatchOperation, apply func(op string, target *patchTarget, value json.RawMessage) error) error {
+	if len(ops) == 0 {
+		return badRequest("invalidValue", "no operations")
+	}
+	for _, operation := range ops {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return badRequest("invalidSyntax", "unknown op %q", operation.Op)
+		}
+
+		if operation.Path != "" {
+			target, err := parsePatchPath(operation.Path)
+			if err != nil {
+				return err
+			}
+			if err := apply(op, target, operation.Value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if op == "remove" {
+			return badRequest("noTarget", "remove needs a path")
+		}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(operation.Value, &values); err != nil {
+			return badRequest("invalidValue", "an operation without a path needs an object value")
+		}
+		paths := make([]string, 0, len(values))
+		for path := range values {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			target, err := parsePatchPath(path)
+			if err != nil {
+				return err
+			}
+			if err := apply(op, target, values[path]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func patchString(attr string, value json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return "", badRequest("invalidValue", "%s must be a string", attr)
+	}
+	return s, nil
+}
+
+// patchBool also takes "True" and "False" strings, which some clients send.
+func patchBool(attr string, value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		if b, err := strconv.ParseBool(strings.ToLower(s)); err == nil {
+			return b, nil
+		}
+	}
+	return false, badRequest("invalidValue", "%s must be a boolean", attr)
+}
+
+func primaryEmail(emails []Email) string {
+	for _, e := range emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(emails) > 0 {
+		return emails[0].Value
+	}
+	return ""
+}
+
+// PatchUser applies PATCH operations to u. userName and the email values
+// both set the email of the user; displayName and name.formatted are
+// derived from the name and ignored.
+func PatchUser(u *ProvisionedUser, ops []PatchOperation) error {
+	return eachPatch(ops, func(op string, target *patchTarget, value json.RawMessage) error {
+		if op == "remove" {
+			switch target.attr {
+			case "externalid":
+				u.ExternalID = ""
+				return nil
+			case "displayname", "name.formatted":
+				return nil
+			}
+			return badRequest("mutability", "%s cannot be removed", target.attr)
+		}
+
+		var err error
+		switch target.attr {
+		case "active":
+			u.Active, err = patchBool(target.attr, value)
+		case "username", "emails.value":
+			u.User.Email, err = patchString(target.attr, value)
+		case "emails":
+			var emails []Email
+			if err := json.Unmarshal(value, &emails); err != nil || primaryEmail(emails) == "" {
+				return badRequest("invalidValue", "emails must be a list with a value")
+			}
+			u.User.Email = primaryEmail(emails)
+		case "name":
+			var name Name
+			if err := json.Unmarshal(value, &name); err != nil {
+				return badRequest("invalidValue", "name must be an object")
+			}
+			if name.GivenName != "" {
+				u.User.Firstname = name.GivenName
+			}
+			if name.FamilyName != "" {
+				u.User.Lastname = name.FamilyName
+			}
+		case "name.givenname":
+			u.User.Firstname, err = patchString(target.attr, value)
+		case "name.familyname":
+			u.User.Lastname, err = patchString(target.attr, value)
+		case "externalid":
+			u.ExternalID, err = patchString(target.attr, value)
+		case "displayname", "name.formatted":
+		case "id", "meta", "schemas", "password":
+			return badRequest("mutability", "%s cannot be changed", target.attr)
+		default:
+			return badRequest("invalidPath", "unknown attribute %s", target.attr)
+		}
+		return err
+	})
+}
+
+// PatchGroup applies PATCH operations to group. Members can be removed
+// by filter, members[value eq "42"], or by listing them in the value.
+func PatchGroup(group *Group, ops []PatchOperation) error {
+	return eachPatch(ops, func(op string, target *patchTarget, value json.RawMessage) error {
+		var err error
+		switch target.attr {
+		case "displayname":
+			if op == "remove" {
+				return badRequest("mutability", "displayName is required")
+			}
+			group.DisplayName, err = patchString(target.attr, value)
+		case "externalid":
+			if op == "remove" {
+				group.ExternalID = ""
+				return nil
+			}
+			group.ExternalID, err = patchString(target.attr, value)
+		case "members", "members.value":
+			return patchMembers(group, op, target.filter, value)
+		case "id", "meta", "schemas":
+			return badRequest("mutability", "%s cannot be changed", target.attr)
+		default:
+			return badRequest("invalidPath", "unknown attribute %s", target.attr)
+		}
+		return err
+	})
+}
+
+func patchMembers(group *Group, op string, filter Filter, value json.RawMessage) error {
+	var ids []int
+	if len(value) > 0 && string(value) != "null" {
+		var refs []MemberRef
+		if err := json.Unmarshal(value, &refs); err != nil {
+			return badRequest("invalidValue", "members must be a list of {\"value\": id}")
+		}
+		for _, ref := range refs {
+			id, err := strconv.Atoi(ref.Value)
+			if err != nil {
+				return badRequest("invalidValue", "member %q is not a user id", ref.Value)
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	switch op {
+	case "add":
+		for _, id := range ids {
+			group.Members = append(group.Members, GroupMember{UserID: id})
+		}
+	case "replace":
+		if filter != nil {
+			return badRequest("invalidPath", "members cannot be replaced by filter")
+		}
+		group.Members = nil
+		for _, id := range ids {
+			group.Members = append(group.Members, GroupMember{UserID: id})
+		}
+	case "remove":
+		remove := make(map[int]bool)
+		for _, id := range ids {
+			remove[id] = true
+		}
+		kept := group.Members[:0]
+		for _, m := range group.Members {
+			matched := filter == nil && len(ids) == 0
+			if filter != nil {
+				ok, err := matchMember(filter, m)
+				if err != nil {
+					return err
+				}
+				matched = ok
+			}
+			if !matched && !remove[m.UserID] {
+				kept = append(kept, m)
+			}
+		}
+		group.Members = kept
+	}
+	return nil
+}
+
+// matchMember evaluates a value filter of a members path against m. Only
+// the value sub-attribute can be compared.
+func matchMember(f Filter, m GroupMember) (bool, error) {
+	switch f := f.(type) {
+	case *LogicalFilter:
+		left, err := matchMember(f.Left, m)
+		if err != nil {
+			return false, err
+		}
+		right, err := matchMember(f.Right, m)
+		if err != nil {
+			return false, err
+		}
+		if f.Op == "and" {
+			return left && right, nil
+		}
+		return left || right, nil
+	case *NotFilter:
+		ok, err := matchMember(f.Filter, m)
+		return !ok, err
+	case *AttrFilter:
+		if f.Path != "value" || (f.Op != "eq" && f.Op != "ne") {
+			return false, badRequest("invalidFilter", "members can only be matched with value eq")
+		}
+		value := fmt.Sprint(f.Value)
+		if n, ok := f.Value.(float64); ok {
+			value = strconv.Itoa(int(n))
+		}
+		return (value == strconv.Itoa(m.UserID)) == (f.Op == "eq"), nil
+	}
+	return false, badRequest("invalidFilter", "unsupported member filter")
+}
@@ -0,0 +1,531 @@
+package scimPack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"user-api/internal/reqctx"
+	"user-api/internal/tenant"
+	userPack "user-api/internal/user-pack"
+)
+
+var (
+	ErrGroupNotFound     = errors.New("group not found")
+	ErrGroupNameTaken    = errors.New("a group with this displayName already exists")
+	ErrExternalIDTaken   = errors.New("externalId is already in use")
+	ErrUnknownMember     = errors.New("group member does not exist")
+	ErrUnsupportedFilter = errors.New("filter is not supported")
+)
+
+// ScimRepository stores what SCIM adds to users and the groups. Users
+// themselves are created and changed through the UserService.
+type ScimRepository interface {
+	// ListUserIDs returns the ids of users matching filter, ordered by id,
+	// along with the total number of matches. A nil filter matches all.
+	ListUserIDs(ctx context.Context, filter Filter, offset, limit int) ([]int, int, error)
+	GetExternalIDs(ctx context.Context, userIDs []int) (map[int]string, error)
+	// SetExternalID replaces the externalId of a user; an empty one removes it.
+	SetExternalID(ctx context.Context, userID int, externalID string) error
+
+	CreateGroup(ctx context.Context, group *Group) error
+	GetGroup(ctx context.Context, id int) (*Group, error)
+	ListGroups(ctx context.Context, filter Filter, offset, limit int) ([]*Group, int, error)
+	// ReplaceGroup stores the name, externalId and members of group.
+	ReplaceGroup(ctx context.Context, group *Group) error
+	DeleteGroup(ctx context.Context, id int) error
+}
+
+type PostgresScimRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresScimRepository(db *pgxpool.Pool) *PostgresScimRepository {
+	return &PostgresScimRepository{db: db}
+}
+
+func (r *PostgresScimRepository) withTx(ctx context.Context, op string, fn func(tx pgx.Tx) error) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tenant.Scope(ctx, tx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+	return nil
+}
+
+// constraintError maps unique and foreign key violations to the errors of
+// this package by constraint name. It returns nil for other errors.
+func constraintError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return nil
+	}
+	switch pgErr.ConstraintName {
+	case "scim_groups_tenant_id_display_name_key":
+		return ErrGroupNameTaken
+	case "scim_users_tenant_id_external_id_key":
+		return ErrExternalIDTaken
+	case "scim_users_user_id_fkey", "scim_group_members_user_id_fkey":
+		return userPack.ErrUserNotFound
+	}
+	return nil
+}
+
+type attrKind int
+
+const (
+	kindString attrKind = iota
+	kindInt
+	kindBool
+	kindTime
+)
+
+// attribute maps a filter path onto SQL. exists, if set, wraps the
+// comparison in a subquery for multi-valued attributes.
+type attribute struct {
+	column string
+	kind   attrKind
+	exists string
+}
+
+var userAttributes = map[string]attribute{
+	"id":              {column: "u.id", kind: kindInt},
+	"username":        {column: "u.email", kind: kindString},
+	"emails":          {column: "u.email", kind: kindString},
+	"emails.value":    {column: "u.email", kind: kindString},
+	"name.givenname":  {column: "u.firstname", kind: kindString},
+	"name.familyname": {column: "u.lastname", kind: kindString},
+	"name.formatted":  {column: "u.firstname || ' ' || u.lastname", kind: kindString},
+	"displayname":     {column: "u.firstname || ' ' || u.lastname", kind: kindString},
+	"externalid":      {column: "x.external_id", kind: kindString},
+	"active":          {column: "u.status IN ('pending', 'active')", kind: kindBool},
+	"meta.created":    {column: "u.created", kind: kindTime},
+}
+
+var groupAttributes = map[string]attribute{
+	"id":            {column: "g.id", kind: kindInt},
+	"displayname":   {column: "g.display_name", kind: kindString},
+	"externalid":    {column: "g.external_id", kind: kindString},
+	"meta.created":  {column: "g.created", kind: kindTime},
+	"members":       {column: "m.user_id", kind: kindInt, exists: "EXISTS (SELECT 1 FROM scim_group_members m WHERE m.group_id = g.id AND %s)"},
+	"members.value": {column: "m.user_id", kind: kindInt, exists: "EXISTS (SELECT 1 FROM scim_group_members m WHERE m.group_id = g.id AND %s)"},
+}
+
+// compileFilter turns f into a SQL condition over attrs, appending its
+// parameters to args.
+func compileFilter(f Filter, attrs map[string]attribute, args *[]interface{}) (string, error) {
+	switch f := f.(type) {
+	case nil:
+		return "TRUE", nil
+	case *LogicalFilter:
+		left, err := compileFilter(f.Left, attrs, args)
+		if err != nil {
+			return "", err
+		}
+		right, err := compileFilter(f.Right, attrs, args)
+		if err != nil {
+			return "", err
+		}
+		return "(" + left + " " + strings.ToUpper(f.Op) + " " + right + ")", nil
+	case *NotFilter:
+		inner, err := compileFilter(f.Filter, attrs, args)
+		if err != nil {
+			return "", err
+		}
+		return "NOT COALESCE(" + inner + ", FALSE)", nil
+	case *AttrFilter:
+		attr, ok := attrs[f.Path]
+		if !ok {
+			return "", fmt.Errorf("%w: attribute %s cannot be filtered on", ErrUnsupportedFilter, f.Path)
+		}
+		cond, err := compileComparison(attr, f, args)
+		if err != nil {
+			return "", err
+		}
+		if attr.exists != "" {
+			cond = fmt.Sprintf(attr.exists, cond)
+		}
+		return cond, nil
+	}
+	return "", fmt.Errorf("%w: unknown filter %T", ErrInvalidFilter, f)
+}
+
+func compileComparison(attr attribute, f *AttrFilter, args *[]interface{}) (string, error) {
+	col := attr.column
+	param := func(v interface{}) string {
+		*args = append(*args, v)
+		return "$" + strconv.Itoa(len(*args))
+	}
+
+	if f.Op == "pr" {
+		if attr.kind == kindString {
+			return fmt.Sprintf("(%s IS NOT NULL AND %s <> '')", col, col), nil
+		}
+		return col + " IS NOT NULL", nil
+	}
+	if f.Value == nil {
+		switch f.Op {
+		case "eq":
+			return col + " IS NULL", nil
+		case "ne":
+			return col + " IS NOT NULL", nil
+		}
+		return "", fmt.Errorf("%w: null only works with eq and ne", ErrInvalidFilter)
+	}
+
+	ordering := map[string]string{"eq": "=", "ne": "<>", "gt": ">", "ge": ">=", "lt": "<", "le": "<="}
+	switch attr.kind {
+	case kindString:
+		s, ok := f.Value.(string)
+		if !ok {
+			return "", fmt.Errorf("%w: %s takes a string", ErrInvalidFilter, f.Path)
+		}
+		// String attributes are case insensitive (caseExact false).
+		switch f.Op {
+		case "eq":
+			return fmt.Sprintf("lower(%s) = lower(%s)", col, param(s)), nil
+		case "ne":
+			return fmt.Sprintf("(%s IS NULL OR lower(%s) <> lower(%s))", col, col, param(s)), nil
+		case "co":
+			return fmt.Sprintf("strpos(lower(%s), lower(%s)) > 0", col, param(s)), nil
+		case "sw":
+			return fmt.Sprintf("starts_with(lower(%s), lower(%s))", col, param(s)), nil
+		case "ew":
+			p := param(s)
+			return fmt.Sprintf("right(lower(%s), length(%s)) = lower(%s)", col, p, p), nil
+		}
+		return fmt.Sprintf("%s %s %s", col, ordering[f.Op], param(s)), nil
+	case kindInt:
+		sqlOp, ok := ordering[f.Op]
+		if !ok {
+			return "", fmt.Errorf("%w: %s cannot be used with %s", ErrInvalidFilter, f.Op, f.Path)
+		}
+		var n int
+		switch v := f.Value.(type) {
+		case string:
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				// No resource has an id that is not a number.
+				return strconv.FormatBool(f.Op == "ne"), nil
+			}
+			n = id
+		case float64:
+			n = int(v)
+		default:
+			return "", fmt.Errorf("%w: %s takes a number", ErrInvalidFilter, f.Path)
+		}
+		return fmt.Sprintf("%s %s %s", col, sqlOp, param(n)), nil
+	case kindBool:
+		b, ok := f.Value.(bool)
+		if !ok || (f.Op != "eq" && f.Op != "ne") {
+			return "", fmt.Errorf("%w: %s only compares with true or false", ErrInvalidFilter, f.Path)
+		}
+		return fmt.Sprintf("(%s) %s %s", col, ordering[f.Op], param(b)), nil
+	case kindTime:
+		s, _ := f.Value.(string)
+		t, err := time.Parse(time.RFC3339, s)
+		sqlOp, ok := ordering[f.Op]
+		if err != nil || !ok {
+			return "", fmt.Errorf("%w: %s compares with an RFC 3339 timestamp", ErrInvalidFilter, f.Path)
+		}
+		return fmt.Sprintf("%s %s %s", col, sqlOp, param(t)), nil
+	}
+	return "", fmt.Errorf("%w: attribute %s", ErrUnsupportedFilter, f.Path)
+}
+
+func (r *PostgresScimRepository) ListUserIDs(ctx context.Context, filter Filter, offset, limit int) ([]int, int, error) {
+	var args []interface{}
+	cond, err := compileFilter(filter, userAttributes, &args)
+	if err != nil {
+		return nil, 0, err
+	}
+	from := " FROM users u LEFT JOIN scim_users x ON x.user_id = u.id WHERE " + cond
+
+	var ids []int
+	var total int
+	err = r.withTx(ctx, "ListUserIDs", func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, "SELECT count(*)"+from, args...).Scan(&total); err != nil {
+			return fmt.Errorf("ListUserIDs: failed to count users: %w", err)
+		}
+		if limit == 0 || offset >= total {
+			return nil
+		}
+
+		n := len(args)
+		rows, err := tx.Query(ctx, fmt.Sprintf("SELECT u.id%s ORDER BY u.id LIMIT $%d OFFSET $%d", from, n+1, n+2), append(args, limit, offset)...)
+		if err != nil {
+			return fmt.Errorf("ListUserIDs: failed to query users: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return fmt.Errorf("ListUserIDs: failed to scan user id: %w", err)
+			}
+			ids = append(ids, id)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("ListUserIDs: failed to read user ids: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return ids, total, nil
+}
+
+func (r *PostgresScimRepository) GetExternalIDs(ctx context.Context, userIDs []int) (map[int]string, error) {
+	externalIDs := make(map[int]string)
+	err := r.withTx(ctx, "GetExternalIDs", func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT user_id, external_id FROM scim_users WHERE user_id = ANY($1)", userIDs)
+		if err != nil {
+			return fmt.Errorf("GetExternalIDs: failed to query external ids: %w", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			var externalID string
+			if err := rows.Scan(&id, &externalID); err != nil {
+				return fmt.Errorf("GetExternalIDs: failed to scan external id: %w", err)
+			}
+			externalIDs[id] = externalID
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("GetExternalIDs: failed to read external ids: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return externalIDs, nil
+}
+
+func (r *PostgresScimRepository) SetExternalID(ctx context.Context, userID int, externalID string) error {
+	return r.withTx(ctx, "SetExternalID", func(tx pgx.Tx) error {
+		if externalID == "" {
+			if _, err := tx.Exec(ctx, "DELETE FROM scim_users WHERE user_id = $1", userID); err != nil {
+				return fmt.Errorf("SetExternalID: failed to remove external id of user %d: %w", userID, err)
+			}
+			return nil
+		}
+		_, err := tx.Exec(ctx, `
+			INSERT INTO scim_users (user_id, tenant_id, external_id) VALUES ($1, $2, $3)
+			ON CONFLICT (user_id) DO UPDATE SET external_id = EXCLUDED.external_id`,
+			userID, reqctx.FromContext(ctx).Tenant(), externalID)
+		if cerr := constraintError(err); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("SetExternalID: failed to store external id of user %d: %w", userID, err)
+		}
+		return nil
+	})
+}
+
+func (r *PostgresScimRepository) CreateGroup(ctx context.Context, group *Group) error {
+	return r.withTx(ctx, "CreateGroup", func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "INSERT INTO scim_groups (tenant_id, display_name, external_id) VALUES ($1, $2, NULLIF($3, '')) RETURNING id, created",
+			reqctx.FromContext(ctx).Tenant(), group.DisplayName, group.ExternalID).Scan(&group.ID, &group.Created)
+		if cerr := constraintError(err); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("CreateGroup: failed to insert group: %w", err)
+		}
+		return setMembers(ctx, tx, "CreateGroup", group)
+	})
+}
+
+// setMembers replaces the members of group and fills in their display
+// names. Users of other tenants are invisible here and count as unknown.
+func setMembers(ctx context.Context, tx pgx.Tx, op string, group *Group) error {
+	if _, err := tx.Exec(ctx, "DELETE FROM scim_group_members WHERE group_id = $1", group.ID); err != nil {
+		return fmt.Errorf("%s: failed to delete members of group %d: %w", op, group.ID, err)
+	}
+
+	seen := make(map[int]bool)
+	var ids []int
+	for _, m := range group.Members {
+		if !seen[m.UserID] {
+			seen[m.UserID] = true
+			ids = append(ids, m.UserID)
+		}
+	}
+	if len(ids) > 0 {
+		tag, err := tx.Exec(ctx, "INSERT INTO scim_group_members (group_id, user_id) SELECT $1, id FROM users WHERE id = ANY($2)", group.ID, ids)
+		if err != nil {
+			return fmt.Errorf("%s: failed to insert members of group %d: %w", op, group.ID, err)
+		}
+		if int(tag.RowsAffected()) != len(ids) {
+			return ErrUnknownMember
+		}
+	}
+
+	members, err := groupMembers(ctx, tx, op, []int{group.ID})
+	if err != nil {
+		return err
+	}
+	group.Members = members[group.ID]
+	return nil
+}
+
+func groupMembers(ctx context.Context, tx pgx.Tx, op string, groupIDs []int) (map[int][]GroupMember, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT m.group_id, u.id, u.firstname || ' ' || u.lastname
+		FROM scim_group_members m JOIN users u ON u.id = m.user_id
+		WHERE m.group_id = ANY($1) ORDER BY m.group_id, u.id`, groupIDs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to query group members: %w", op, err)
+	}
+	defer rows.Close()
+
+	members := make(map[int][]GroupMember)
+	for rows.Next() {
+		var groupID int
+		var m GroupMember
+		if err := rows.Scan(&groupID, &m.UserID, &m.Display); err != nil {
+			return nil, fmt.Errorf("%s: failed to scan group member: %w", op, err)
+		}
+		members[groupID] = append(members[groupID], m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: failed to read group members: %w", op, err)
+	}
+	return members, nil
+}
+
+const groupColumns = "g.id, g.display_name, COALESCE(g.external_id, ''), g.created"
+
+func scanGroup(row pgx.Row) (*Group, error) {
+	var g Group
+	if err := row.Scan(&g.ID, &g.DisplayName, &g.ExternalID, &g.Created); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (r *PostgresScimRepository) GetGroup(ctx context.Context, id int) (*Group, error) {
+	var group *Group
+	err := r.withTx(ctx, "GetGroup", func(tx pgx.Tx) error {
+		var err error
+		group, err = scanGroup(tx.QueryRow(ctx, "SELECT "+groupColumns+" FROM scim_groups g WHERE g.id = $1", id))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrGroupNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("GetGroup: failed to query group with id %d: %w", id, err)
+		}
+		members, err := groupMembers(ctx, tx, "GetGroup", []int{id})
+		if err != nil {
+			return err
+		}
+		group.Members = members[id]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func (r *PostgresScimRepository) ListGroups(ctx context.Context, filter Filter, offset, limit int) ([]*Group, int, error) {
+	var args []interface{}
+	cond, err := compileFilter(filter, groupAttributes, &args)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var groups []*Group
+	var total int
+	err = r.withTx(ctx, "ListGroups", func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, "SELECT count(*) FROM scim_groups g WHERE "+cond, args...).Scan(&total); err != nil {
+			return fmt.Errorf("ListGroups: failed to count groups: %w", err)
+		}
+		if limit == 0 || offset >= total {
+			return nil
+		}
+
+		n := len(args)
+		rows, err := tx.Query(ctx, fmt.Sprintf("SELECT %s FROM scim_groups g WHERE %s ORDER BY g.id LIMIT $%d OFFSET $%d", groupColumns, cond, n+1, n+2),
+			append(args, limit, offset)...)
+		if err != nil {
+			return fmt.Errorf("ListGroups: failed to query groups: %w", err)
+		}
+		defer rows.Close()
+		var ids []int
+		for rows.Next() {
+			group, err := scanGroup(rows)
+			if err != nil {
+				return fmt.Errorf("ListGroups: failed to scan group: %w", err)
+			}
+			groups = append(groups, group)
+			ids = append(ids, group.ID)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("ListGroups: failed to read groups: %w", err)
+		}
+		rows.Close()
+
+		members, err := groupMembers(ctx, tx, "ListGroups", ids)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			group.Members = members[group.ID]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return groups, total, nil
+}
+
+func (r *PostgresScimRepository) ReplaceGroup(ctx context.Context, group *Group) error {
+	return r.withTx(ctx, "ReplaceGroup", func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "UPDATE scim_groups SET display_name = $1, external_id = NULLIF($2, '') WHERE id = $3 RETURNING created",
+			group.DisplayName, group.ExternalID, group.ID).Scan(&group.Created)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrGroupNotFound
+		}
+		if cerr := constraintError(err); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return fmt.Errorf("ReplaceGroup: failed to update group with id %d: %w", group.ID, err)
+		}
+		return setMembers(ctx, tx, "ReplaceGroup", group)
+	})
+}
+
+func (r *PostgresScimRepository) DeleteGroup(ctx context.Context, id int) error {
+	return r.withTx(ctx, "DeleteGroup", func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "DELETE FROM scim_groups WHERE id = $1", id)
+		if err != nil {
+			return fmt.Errorf("DeleteGroup: failed to delete group with id %d: %w", id, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrGroupNotFound
+		}
+		return nil
+	})
+}
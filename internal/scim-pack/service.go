@@ -0,0 +1,165 @@
+package scimPack
+
+import (
+	"context"
+
+	userPack "user-api/internal/user-pack"
+)
+
+// Reasons recorded in the audit trail when the SCIM client flips active.
+const (
+	reasonDeprovisioned = "deprovisioned by the SCIM client"
+	reasonProvisioned   = "provisioned again by the SCIM client"
+)
+
+type ScimService struct {
+	users *userPack.UserService
+	repo  ScimRepository
+}
+
+func NewScimService(users *userPack.UserService, repo ScimRepository) *ScimService {
+	return &ScimService{users: users, repo: repo}
+}
+
+// CreateUser creates the user through the UserService, so it is validated,
+// audited and published like any other, then records what only SCIM knows.
+func (s *ScimService) CreateUser(ctx context.Context, u *ProvisionedUser) error {
+	if u.ExternalID != "" {
+		_, taken, err := s.repo.ListUserIDs(ctx, &AttrFilter{Path: "externalid", Op: "eq", Value: u.ExternalID}, 0, 0)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrExternalIDTaken
+		}
+	}
+
+	if err := s.users.CreateUser(ctx, u.User); err != nil {
+		return err
+	}
+	if u.ExternalID != "" {
+		if err := s.repo.SetExternalID(ctx, u.User.ID, u.ExternalID); err != nil {
+			return err
+		}
+	}
+	if !u.Active {
+		user, err := s.users.SuspendUser(ctx, u.User.ID, reasonDeprovisioned)
+		if err != nil {
+			return err
+		}
+		u.User = user
+	}
+	return nil
+}
+
+func (s *ScimService) GetUser(ctx context.Context, id int) (*ProvisionedUser, error) {
+	user, err := s.users.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	externalIDs, err := s.repo.GetExternalIDs(ctx, []int{id})
+	if err != nil {
+		return nil, err
+	}
+	return &ProvisionedUser{User: user, ExternalID: externalIDs[id], Active: user.Status.CanLogIn()}, nil
+}
+
+// ListUsers returns the page of users matching filter that starts at the
+// 1-based startIndex, along with the total number of matches.
+func (s *ScimService) ListUsers(ctx context.Context, filter Filter, startIndex, count int) ([]*ProvisionedUser, int, error) {
+	ids, total, err := s.repo.ListUserIDs(ctx, filter, startIndex-1, count)
+	if err != nil || len(ids) == 0 {
+		return nil, total, err
+	}
+	users, _, err := s.users.BatchGetUsers(ctx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	externalIDs, err := s.repo.GetExternalIDs(ctx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	out := make([]*ProvisionedUser, 0, len(users))
+	for _, user := range users {
+		out = append(out, &ProvisionedUser{User: user, ExternalID: externalIDs[user.ID], Active: user.Status.CanLogIn()})
+	}
+	return out, total, nil
+}
+
+// UpdateUser applies update to the current state of the user and stores
+// what changed. A new userName goes through email verification like any
+// other email change, so it shows up once the user confirms it.
+func (s *ScimService) UpdateUser(ctx context.Context, id int, update func(*ProvisionedUser) error) (*ProvisionedUser, error) {
+	current, err := s.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	user := *current.User
+	next := &ProvisionedUser{User: &user, ExternalID: current.ExternalID, Active: current.Active}
+	if err := update(next); err != nil {
+		return nil, err
+	}
+
+	before := current.User
+	if user.Firstname != before.Firstname || user.Lastname != before.Lastname || user.Email != before.Email {
+		if err := userPack.ValidateUser(&user); err != nil {
+			return nil, badRequest("invalidValue", "%v", err)
+		}
+		if err := s.users.UpdateUser(ctx, id, &user); err != nil {
+			return nil, err
+		}
+	}
+	if next.ExternalID != current.ExternalID {
+		if err := s.repo.SetExternalID(ctx, id, next.ExternalID); err != nil {
+			return nil, err
+		}
+	}
+	if next.Active != current.Active {
+		if next.Active {
+			_, err = s.users.ReactivateUser(ctx, id, reasonProvisioned)
+		} else {
+			_, err = s.users.SuspendUser(ctx, id, reasonDeprovisioned)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.GetUser(ctx, id)
+}
+
+func (s *ScimService) DeleteUser(ctx context.Context, id int) error {
+	return s.users.DeleteUser(ctx, id)
+}
+
+func (s *ScimService) CreateGroup(ctx context.Context, group *Group) error {
+	return s.repo.CreateGroup(ctx, group)
+}
+
+func (s *ScimService) GetGroup(ctx context.Context, id int) (*Group, error) {
+	return s.repo.GetGroup(ctx, id)
+}
+
+func (s *ScimService) ListGroups(ctx context.Context, filter Filter, startIndex, count int) ([]*Group, int, error) {
+	return s.repo.ListGroups(ctx, filter, startIndex-1, count)
+}
+
+// UpdateGroup applies update to the stored group and replaces it.
+func (s *ScimService) UpdateGroup(ctx context.Context, id int, update func(*Group) error) (*Group, error) {
+	group, err := s.repo.GetGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := update(group); err != nil {
+		return nil, err
+	}
+	group.ID = id
+	if err := s.repo.ReplaceGroup(ctx, group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+func (s *ScimService) DeleteGroup(ctx context.Context, id int) error {
+	return s.repo.DeleteGroup(ctx, id)
+}
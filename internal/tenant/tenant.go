@@ -0,0 +1,52 @@
+// Package tenant scopes database transactions to the tenant of a request.
+// Tables holding tenant data are protected by row-level security policies
+// that compare their tenant_id with the app.tenant_id setting, so a query
+// can only see and write rows of the tenant its transaction was scoped to.
+package tenant
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+
+	"user-api/internal/reqctx"
+)
+
+// Scope sets app.tenant_id for the rest of tx to the tenant of ctx. For
+// platform admins app.bypass_rls is turned on as well, which lets the
+// policies through for every tenant. The role only counts for actors
+// verified by a client certificate or an access token, see
+// reqctx.Meta.IsPlatformAdmin.
+//
+// Row-level security does not apply to superusers and table owners unless
+// the tables force it; the migrations do, but the service should still
+// connect as a role without BYPASSRLS.
+func Scope(ctx context.Context, tx pgx.Tx) error {
+	meta := reqctx.FromContext(ctx)
+	bypass := "off"
+	if meta.IsPlatformAdmin() {
+		bypass = "on"
+	}
+	if _, err := tx.Exec(ctx, "SELECT set_config('app.tenant_id', $1, true), set_config('app.bypass_rls', $2, true)", meta.Tenant(), bypass); err != nil {
+		return fmt.Errorf("failed to scope transaction to tenant %s: %w", meta.Tenant(), err)
+	}
+	return nil
+}
+
+// All turns app.bypass_rls on for the rest of tx, for background jobs
+// that work on the rows of every tenant and have no request to scope to.
+func All(ctx context.Context, tx pgx.Tx) error {
+	if _, err := tx.Exec(ctx, "SELECT set_config('app.bypass_rls', 'on', true)"); err != nil {
+		return fmt.Errorf("failed to lift tenant isolation: %w", err)
+	}
+	return nil
+}
+
+// Visible reports whether a row of tenantID may be shown to the caller of
+// ctx. It is the in-process counterpart of the policies, for data that
+// reaches the service without a scoped query, such as change notifications.
+func Visible(ctx context.Context, tenantID string) bool {
+	meta := reqctx.FromContext(ctx)
+	return meta.IsPlatformAdmin() || tenantID == meta.Tenant()
+}
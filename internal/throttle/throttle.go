@@ -0,0 +1,205 @@
+// Package throttle rate limits REST routes and RPCs per client, keyed by
+// API key, principal or IP.
+package throttle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"user-api/internal/reqctx"
+	"user-api/pkg/ratelimit"
+)
+
+const (
+	// APIKeyHeader (or gRPC metadata key) identifies integrations. The
+	// key is only used to tell clients apart; checking it is up to the
+	// gateway in front of the service.
+	APIKeyHeader = "X-API-Key"
+
+	// DefaultRule is the limit of routes and RPCs without one of their own.
+	DefaultRule = "*"
+)
+
+var ErrRateLimited = errors.New("rate limit exceeded, try again later")
+
+// Limiter takes a token from the bucket of the client for every request.
+// Rules are keyed by route, as "POST /users" with the route pattern of the
+// REST API, or by full RPC method, as "/user.UserService/CreateUser".
+// Every rule has its own buckets.
+type Limiter struct {
+	store ratelimit.Store
+	rules map[string]ratelimit.Limit
+}
+
+func NewLimiter(store ratelimit.Store, rules map[string]ratelimit.Limit) *Limiter {
+	return &Limiter{store: store, rules: rules}
+}
+
+// ParseRules parses a comma separated list of rule=limit pairs, limits as
+// in ratelimit.ParseLimit, e.g. "POST /users=10/s:20,*=100/s".
+func ParseRules(s string) (map[string]ratelimit.Limit, error) {
+	rules := make(map[string]ratelimit.Limit)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("rate limit rule %q is not rule=limit", pair)
+		}
+		limit, err := ratelimit.ParseLimit(pair[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		rules[strings.TrimSpace(pair[:i])] = limit
+	}
+	return rules, nil
+}
+
+// clientKey tells clients apart by API key, else by the principal the
+// transport established, else by IP. API keys are hashed so they are not
+// stored.
+func clientKey(meta *reqctx.Meta, apiKey, ip string) string {
+	switch {
+	case apiKey != "":
+		sum := sha256.Sum256([]byte(apiKey))
+		return "key:" + hex.EncodeToString(sum[:16])
+	case meta.Actor != "":
+		return "principal:" + meta.Actor
+	default:
+		return "ip:" + ip
+	}
+}
+
+// take takes a token for the request. It returns nil if no rule applies
+// or the store failed; limits are not worth failing requests for.
+func (l *Limiter) take(ctx context.Context, rule, client string) *ratelimit.Result {
+	limit, ok := l.rules[rule]
+	if !ok {
+		rule = DefaultRule
+		if limit, ok = l.rules[rule]; !ok {
+			return nil
+		}
+	}
+	res, err := l.store.Take(ctx, "rate:"+rule+"|"+client, limit)
+	if err != nil {
+		log.Printf("Failed to check rate limit of %s: %v", client, err)
+		return nil
+	}
+	return &res
+}
+
+// headers are the RateLimit-* fields describing res.
+func headers(res *ratelimit.Result) [][2]string {
+	return [][2]string{
+		{"RateLimit-Limit", strconv.Itoa(res.Limit)},
+		{"RateLimit-Remaining", strconv.Itoa(res.Remaining)},
+		{"RateLimit-Reset", seconds(res.Reset)},
+	}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Middleware limits REST requests. It has to run after the middlewares
+// establishing the actor.
+func (l *Limiter) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		rule := ctx.Request.Method + " " + ctx.FullPath()
+		client := clientKey(reqctx.FromContext(ctx.Request.Context()), ctx.GetHeader(APIKeyHeader), ctx.ClientIP())
+		res := l.take(ctx.Request.Context(), rule, client)
+		if res == nil {
+			ctx.Next()
+			return
+		}
+		for _, h := range headers(res) {
+			ctx.Header(h[0], h[1])
+		}
+		if !res.Allowed {
+			SetRetryAfter(ctx.Writer.Header(), res.RetryAfter)
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": ErrRateLimited.Error()})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func (l *Limiter) limitRPC(ctx context.Context, method string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var apiKey string
+	if values := md.Get(APIKeyHeader); len(values) > 0 {
+		apiKey = values[0]
+	}
+	res := l.take(ctx, method, clientKey(reqctx.FromContext(ctx), apiKey, reqctx.PeerIP(ctx)))
+	if res == nil {
+		return nil
+	}
+	md = metadata.MD{}
+	for _, h := range headers(res) {
+		md.Set(h[0], h[1])
+	}
+	grpc.SetHeader(ctx, md)
+	if !res.Allowed {
+		return ResourceExhausted(ErrRateLimited.Error(), res.RetryAfter)
+	}
+	return nil
+}
+
+// UnaryInterceptor and StreamInterceptor limit RPCs. They have to be
+// chained after the interceptors establishing the actor.
+func (l *Limiter) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := l.limitRPC(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (l *Limiter) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := l.limitRPC(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// ResourceExhausted returns a ResourceExhausted status telling clients to
+// retry after retryAfter.
+func ResourceExhausted(msg string, retryAfter time.Duration) error {
+	st := status.New(codes.ResourceExhausted, msg)
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// RetryAfter returns the delay of the RetryInfo in the status of err.
+func RetryAfter(err error) (time.Duration, bool) {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+// SetRetryAfter sets the Retry-After header in whole seconds.
+func SetRetryAfter(h http.Header, retryAfter time.Duration) {
+	h.Set("Retry-After", seconds(retryAfter))
+}
@@ -0,0 +1,111 @@
+package userPack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+
+	"user-api/internal/reqctx"
+)
+
+const (
+	AuditActionCreate = "create"
+	AuditActionUpdate = "update"
+	AuditActionDelete = "delete"
+)
+
+// FieldChange holds the value of a field before and after a mutation. Before
+// is nil for creates and After is nil for deletes.
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type AuditEvent struct {
+	ID        int64                  `json:"id"`
+	UserID    int                    `json:"user_id"`
+	Action    string                 `json:"action"`
+	Actor     string                 `json:"actor"`
+	RequestID string                 `json:"request_id"`
+	Source    string                 `json:"source"`
+	Changes   map[string]FieldChange `json:"changes"`
+	Created   time.Time              `json:"created"`
+}
+
+func auditFields(user *User) map[string]interface{} {
+	if user == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"firstname": user.Firstname,
+		"lastname":  user.Lastname,
+		"email":     user.Email,
+		"age":       user.Age,
+		"status":    string(user.Status),
+	}
+}
+
+// diffUsers returns the fields that differ between before and after; either
+// may be nil.
+func diffUsers(before, after *User) map[string]FieldChange {
+	old, cur := auditFields(before), auditFields(after)
+	changes := make(map[string]FieldChange)
+	for _, field := range []string{"firstname", "lastname", "email", "age", "status"} {
+		var b, a interface{}
+		if old != nil {
+			b = old[field]
+		}
+		if cur != nil {
+			a = cur[field]
+		}
+		if b != a {
+			changes[field] = FieldChange{Before: b, After: a}
+		}
+	}
+	return changes
+}
+
+// insertAudit appends an entry about user to user_audit as part of tx,
+// attributing it to the actor in the request metadata. The entry belongs to
+// the tenant of the user.
+func insertAudit(ctx context.Context, tx pgx.Tx, action string, user *User, changes map[string]FieldChange) error {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("insertAudit: failed to encode changes: %w", err)
+	}
+	meta := reqctx.FromContext(ctx)
+	_, err = tx.Exec(ctx, "INSERT INTO user_audit (user_id, tenant_id, action, actor, request_id, source, changes) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		user.ID, user.TenantID, action, meta.Actor, meta.RequestID, meta.Source, data)
+	if err != nil {
+		return fmt.Errorf("insertAudit: failed to insert %s entry for user %d: %w", action, user.ID, err)
+	}
+	return nil
+}
+
+var piiFields = map[string]bool{"firstname": true, "lastname": true, "email": true}
+
+// MaskAuditEvent hides personal data in the diff, keeping enough of it to
+// tell that something changed.
+func MaskAuditEvent(event *AuditEvent) {
+	for field, change := range event.Changes {
+		if piiFields[field] {
+			event.Changes[field] = FieldChange{Before: maskValue(change.Before), After: maskValue(change.After)}
+		}
+	}
+}
+
+func maskValue(v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok || s == "" {
+		return v
+	}
+	first := string([]rune(s)[:1])
+	if at := strings.LastIndex(s, "@"); at > 0 {
+		return first + "***" + s[at:]
+	}
+	return first + "***"
+}
@@ -0,0 +1,162 @@
+package userPack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"golang.org/x/sync/singleflight"
+
+	"user-api/internal/reqctx"
+	"user-api/internal/tenant"
+	"user-api/pkg/cache"
+)
+
+// userCacheChannel carries the ids of users that were updated or deleted,
+// sent by the notify_user_cache trigger on commit.
+const userCacheChannel = "user_cache"
+
+// CachingUserRepository is a read-through cache for GetUser in front of a
+// UserRepository. Other reads go straight to the repository. Writes through
+// it drop the user from the cache right away; writes elsewhere, including
+// on other instances, reach it through Listen.
+type CachingUserRepository struct {
+	UserRepository
+	cache cache.Cache
+	ttl   time.Duration
+	group singleflight.Group
+}
+
+// NewCachingUserRepository caches the users of repo in c for ttl, which
+// also bounds how stale an entry can get if an invalidation is lost.
+func NewCachingUserRepository(repo UserRepository, c cache.Cache, ttl time.Duration) *CachingUserRepository {
+	return &CachingUserRepository{UserRepository: repo, cache: c, ttl: ttl}
+}
+
+func userCacheKey(id int) string {
+	return "user:" + strconv.Itoa(id)
+}
+
+// GetUser returns the cached user if the caller may see it. Entries are
+// shared by all tenants; one the caller may not see is read from the
+// repository, whose row-level security answers for it. Concurrent misses
+// for a user are collapsed into one query, per tenant.
+func (r *CachingUserRepository) GetUser(ctx context.Context, id int) (*User, error) {
+	key := userCacheKey(id)
+	data, ok, err := r.cache.Get(ctx, key)
+	if err != nil {
+		log.Printf("Failed to read user %d from cache: %v", id, err)
+	}
+	if ok {
+		var user User
+		if err := json.Unmarshal(data, &user); err == nil && tenant.Visible(ctx, user.TenantID) {
+			return &user, nil
+		}
+	}
+
+	meta := reqctx.FromContext(ctx)
+	flight := fmt.Sprintf("%d:%s:%t", id, meta.Tenant(), meta.IsPlatformAdmin())
+	v, err, _ := r.group.Do(flight, func() (interface{}, error) {
+		// The query is shared, so it must not fail because the caller
+		// that happened to start it went away.
+		user, err := r.UserRepository.GetUser(context.WithoutCancel(ctx), id)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(user)
+		if err == nil {
+			err = r.cache.Set(ctx, key, data, r.ttl)
+		}
+		if err != nil {
+			log.Printf("Failed to cache user %d: %v", id, err)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Every caller gets a copy of its own.
+	var user User
+	if err := json.Unmarshal(v.([]byte), &user); err != nil {
+		return nil, fmt.Errorf("GetUser: failed to decode user %d: %w", id, err)
+	}
+	return &user, nil
+}
+
+func (r *CachingUserRepository) invalidate(ctx context.Context, id int) {
+	if err := r.cache.Delete(ctx, userCacheKey(id)); err != nil {
+		log.Printf("Failed to drop user %d from cache: %v", id, err)
+	}
+}
+
+func (r *CachingUserRepository) UpdateUser(ctx context.Context, id int, user *User) error {
+	defer r.invalidate(ctx, id)
+	return r.UserRepository.UpdateUser(ctx, id, user)
+}
+
+func (r *CachingUserRepository) DeleteUser(ctx context.Context, id int) error {
+	defer r.invalidate(ctx, id)
+	return r.UserRepository.DeleteUser(ctx, id)
+}
+
+func (r *CachingUserRepository) VerifyEmail(ctx context.Context, id int, email, tokenID string, expiresAt time.Time) (*User, error) {
+	defer r.invalidate(ctx, id)
+	return r.UserRepository.VerifyEmail(ctx, id, email, tokenID, expiresAt)
+}
+
+func (r *CachingUserRepository) SetUserStatus(ctx context.Context, id int, from, to UserStatus, reason string) (*User, error) {
+	defer r.invalidate(ctx, id)
+	return r.UserRepository.SetUserStatus(ctx, id, from, to, reason)
+}
+
+// Listen drops users from the cache as user_cache notifications arrive,
+// until ctx is cancelled, reconnecting after failures. An in-process cache
+// is purged on every (re)connect, as notifications sent in between are
+// lost.
+func (r *CachingUserRepository) Listen(ctx context.Context, db *pgxpool.Pool) {
+	for {
+		err := r.listen(ctx, db)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("CachingUserRepository: listener stopped, reconnecting: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (r *CachingUserRepository) listen(ctx context.Context, db *pgxpool.Pool) error {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+userCacheChannel); err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	if lru, ok := r.cache.(*cache.LRU); ok {
+		lru.Purge()
+	}
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+		id, err := strconv.Atoi(n.Payload)
+		if err != nil {
+			log.Printf("CachingUserRepository: invalid notification %q", n.Payload)
+			continue
+		}
+		r.invalidate(ctx, id)
+	}
+}
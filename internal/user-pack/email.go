@@ -0,0 +1,205 @@
+package userPack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+
+	"user-api/internal/outbox"
+	"user-api/internal/reqctx"
+	"user-api/pkg/mailer"
+	"user-api/pkg/signedtoken"
+)
+
+var (
+	ErrInvalidEmailToken        = errors.New("invalid, expired or already used verification token")
+	ErrEmailAlreadyVerified     = errors.New("email is already verified")
+	ErrEmailTaken               = errors.New("email is already in use")
+	ErrEmailVerificationMissing = errors.New("email verification is not configured")
+)
+
+type EmailVerificationConfig struct {
+	// URL is the verification endpoint linked from the mail; the token is
+	// appended as the "token" query parameter.
+	URL string
+	// TTL is how long a verification link stays valid.
+	TTL time.Duration
+}
+
+// emailClaims bind a verification token to a user, the tenant of the user
+// and the address it was sent to, so it cannot confirm any other address.
+type emailClaims struct {
+	ID       string `json:"jti"`
+	UserID   int    `json:"uid"`
+	TenantID string `json:"tid,omitempty"`
+	Email    string `json:"email"`
+	Expires  int64  `json:"exp"`
+}
+
+// WithEmailVerification sends verification mails on sign-up and email
+// changes. Tokens are signed with signer.
+func WithEmailVerification(m mailer.Mailer, signer *signedtoken.Signer, cfg EmailVerificationConfig) UserServiceOption {
+	return func(s *UserService) {
+		s.mailer = m
+		s.emailSigner = signer
+		s.emailCfg = cfg
+	}
+}
+
+// sendVerification mails a verification link for email. Failures are only
+// logged: the change itself is committed and the user can ask for a new
+// link.
+func (s *UserService) sendVerification(ctx context.Context, userID int, email string) {
+	if err := s.mailVerification(ctx, userID, email); err != nil {
+		log.Printf("Failed to send verification mail to user %d: %v", userID, err)
+	}
+}
+
+func (s *UserService) mailVerification(ctx context.Context, userID int, email string) error {
+	if s.mailer == nil {
+		return ErrEmailVerificationMissing
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("failed to generate token id: %w", err)
+	}
+	expires := time.Now().Add(s.emailCfg.TTL)
+	token, err := s.emailSigner.Sign(&emailClaims{
+		ID:       hex.EncodeToString(id),
+		UserID:   userID,
+		TenantID: reqctx.FromContext(ctx).Tenant(),
+		Email:    email,
+		Expires:  expires.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := s.emailCfg.URL + "?" + url.Values{"token": {token}}.Encode()
+	return s.mailer.Send(ctx, &mailer.Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Please confirm that %s is your email address by opening this link:\n\n%s\n\n"+
+			"The link expires on %s. If you did not ask for this, you can ignore this mail.\n",
+			email, link, expires.UTC().Format(time.RFC1123)),
+	})
+}
+
+// SendEmailVerification sends a new link for the pending email, or for the
+// current one if it is not verified yet.
+func (s *UserService) SendEmailVerification(ctx context.Context, id int) error {
+	user, err := s.repo.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case user.PendingEmail != "":
+		return s.mailVerification(ctx, id, user.PendingEmail)
+	case !user.EmailVerified:
+		return s.mailVerification(ctx, id, user.Email)
+	default:
+		return ErrEmailAlreadyVerified
+	}
+}
+
+// VerifyEmail redeems a verification token. It marks the current email as
+// verified, or swaps in the pending email the token was sent to. The token
+// is redeemed in the tenant it was issued in, whatever tenant the request
+// names: the link is opened from a mail, without credentials.
+func (s *UserService) VerifyEmail(ctx context.Context, token string) (*User, error) {
+	if s.emailSigner == nil {
+		return nil, ErrEmailVerificationMissing
+	}
+	var claims emailClaims
+	if err := s.emailSigner.Verify(token, &claims); err != nil {
+		return nil, ErrInvalidEmailToken
+	}
+	expires := time.Unix(claims.Expires, 0)
+	if claims.ID == "" || time.Now().After(expires) {
+		return nil, ErrInvalidEmailToken
+	}
+	return s.repo.VerifyEmail(reqctx.WithTenant(ctx, claims.TenantID), claims.UserID, claims.Email, claims.ID, expires)
+}
+
+// VerifyEmail records tokenID as used and applies the verification. Used
+// token ids are kept until they expire; a token for an address that is
+// neither the current nor the pending email of the user is stale.
+func (r *PostgresUserRepository) VerifyEmail(ctx context.Context, id int, email, tokenID string, expiresAt time.Time) (*User, error) {
+	var user User
+	err := r.withTx(ctx, "VerifyEmail", func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "DELETE FROM email_token_uses WHERE expires_at < now()"); err != nil {
+			return fmt.Errorf("VerifyEmail: failed to purge expired token ids: %w", err)
+		}
+		tag, err := tx.Exec(ctx, "INSERT INTO email_token_uses (id, expires_at) VALUES ($1, $2) ON CONFLICT DO NOTHING", tokenID, expiresAt)
+		if err != nil {
+			return fmt.Errorf("VerifyEmail: failed to record token use: %w", err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrInvalidEmailToken
+		}
+
+		before, err := scanUser(tx.QueryRow(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 FOR UPDATE", id))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("VerifyEmail: failed to query user with id %d: %w", id, err)
+		}
+
+		// Confirming an address is what activates a pending account.
+		user = *before
+		user.EmailVerified = true
+		if before.Status == StatusPending {
+			user.Status = StatusActive
+		}
+		switch email {
+		case before.PendingEmail:
+			user.Email, user.PendingEmail = before.PendingEmail, ""
+			err = tx.QueryRow(ctx, "UPDATE users SET email = $1, pending_email = NULL, email_verified = true, status = $2 WHERE id = $3 RETURNING updated", user.Email, user.Status, id).Scan(&user.Updated)
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+				return ErrEmailTaken
+			}
+			if err != nil {
+				return fmt.Errorf("VerifyEmail: failed to change email of user %d: %w", id, err)
+			}
+			changes := diffUsers(before, &user)
+			changes["email_verified"] = FieldChange{Before: before.EmailVerified, After: true}
+			if err := insertAudit(ctx, tx, AuditActionUpdate, before, changes); err != nil {
+				return err
+			}
+			return outbox.Enqueue(ctx, tx, outbox.EventUserUpdated, id, &user)
+		case before.Email:
+			if before.EmailVerified {
+				user = *before
+				return nil
+			}
+			if err := tx.QueryRow(ctx, "UPDATE users SET email_verified = true, status = $1 WHERE id = $2 RETURNING updated", user.Status, id).Scan(&user.Updated); err != nil {
+				return fmt.Errorf("VerifyEmail: failed to verify email of user %d: %w", id, err)
+			}
+			changes := diffUsers(before, &user)
+			changes["email_verified"] = FieldChange{Before: false, After: true}
+			if err := insertAudit(ctx, tx, AuditActionUpdate, before, changes); err != nil {
+				return err
+			}
+			if user.Status == before.Status {
+				return nil
+			}
+			return outbox.Enqueue(ctx, tx, outbox.EventUserUpdated, id, &user)
+		default:
+			return ErrInvalidEmailToken
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
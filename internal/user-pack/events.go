@@ -0,0 +1,115 @@
+package userPack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// PostgresUserEventStore reads user_events. Only events of transactions
+// below the oldest one still running can be read: the others may yet be
+// joined by events of transactions that commit later.
+type PostgresUserEventStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresUserEventStore(db *pgxpool.Pool) *PostgresUserEventStore {
+	return &PostgresUserEventStore{db: db}
+}
+
+func (s *PostgresUserEventStore) LastEventPosition(ctx context.Context) (EventPosition, error) {
+	var pos EventPosition
+	err := s.db.QueryRow(ctx, `
+		SELECT txid, id FROM user_events
+		WHERE txid < txid_snapshot_xmin(txid_current_snapshot())
+		ORDER BY txid DESC, id DESC
+		LIMIT 1`).Scan(&pos.TxID, &pos.ID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return EventPosition{}, fmt.Errorf("LastEventPosition: failed to query last event: %w", err)
+	}
+	return pos, nil
+}
+
+func (s *PostgresUserEventStore) OldestEventPosition(ctx context.Context) (EventPosition, error) {
+	var pos EventPosition
+	err := s.db.QueryRow(ctx, "SELECT txid, id FROM user_events ORDER BY txid, id LIMIT 1").Scan(&pos.TxID, &pos.ID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return EventPosition{}, fmt.Errorf("OldestEventPosition: failed to query oldest event: %w", err)
+	}
+	return pos, nil
+}
+
+func (s *PostgresUserEventStore) EventsAfter(ctx context.Context, pos EventPosition) ([]*UserEvent, error) {
+	rows, err := s.db.Query(ctx, `
+		SELECT txid, id, event_type, payload, created FROM user_events
+		WHERE (txid, id) > ($1, $2) AND txid < txid_snapshot_xmin(txid_current_snapshot())
+		ORDER BY txid, id`, pos.TxID, pos.ID)
+	if err != nil {
+		return nil, fmt.Errorf("EventsAfter: failed to query events after %d.%d: %w", pos.TxID, pos.ID, err)
+	}
+	defer rows.Close()
+
+	var events []*UserEvent
+	for rows.Next() {
+		var event UserEvent
+		var payload []byte
+		if err := rows.Scan(&event.Position.TxID, &event.Position.ID, &event.Type, &payload, &event.Occurred); err != nil {
+			return nil, fmt.Errorf("EventsAfter: failed to scan event: %w", err)
+		}
+		if err := json.Unmarshal(payload, &event.User); err != nil {
+			return nil, fmt.Errorf("EventsAfter: failed to decode event %d: %w", event.Position.ID, err)
+		}
+		events = append(events, &event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("EventsAfter: failed to read events: %w", err)
+	}
+	return events, nil
+}
+
+// Listen also wakes up every watchPollInterval: events held back by an
+// older transaction are not announced again once it finishes.
+func (s *PostgresUserEventStore) Listen(ctx context.Context, wake func(context.Context) error) error {
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+userEventsChannel); err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	// Events committed while we were not listening are picked up here.
+	if err := wake(ctx); err != nil {
+		return err
+	}
+
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, watchPollInterval)
+		_, err := conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		if err != nil && (ctx.Err() != nil || !errors.Is(err, context.DeadlineExceeded)) {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+		if err := wake(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// PurgeEvents keeps the newest event, so the resume token of a feed that
+// has been quiet for longer than the retention stays valid.
+func (s *PostgresUserEventStore) PurgeEvents(ctx context.Context, before time.Time) error {
+	_, err := s.db.Exec(ctx, `
+		DELETE FROM user_events
+		WHERE created < $1 AND (txid, id) < (SELECT txid, id FROM user_events ORDER BY txid DESC, id DESC LIMIT 1)`, before)
+	if err != nil {
+		return fmt.Errorf("PurgeEvents: failed to delete old events: %w", err)
+	}
+	return nil
+}
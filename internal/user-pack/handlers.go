@@ -2,84 +2,417 @@ package userPack
 
 import (
 	"context"
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
+	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+
+	"user-api/internal/reqctx"
+	"user-api/pkg/httpcache"
+	"user-api/pkg/negotiate"
 )
 
 type UserHandlerInterface interface {
 	CreateUser(ctx context.Context, user *User) error
 	GetUser(ctx context.Context, id int) (*User, error)
 	UpdateUser(ctx context.Context, id int, user *User) error
+	DeleteUser(ctx context.Context, id int) error
 }
 type UserHandler struct {
-	service *UserService
+	service           *UserService
+	heartbeatInterval time.Duration
 }
 
-func NewUserHandler(service *UserService) *UserHandler {
-	return &UserHandler{service: service}
+type UserHandlerOption func(*UserHandler)
+
+// WithHeartbeatInterval sets how often WatchUsers sends heartbeats.
+func WithHeartbeatInterval(interval time.Duration) UserHandlerOption {
+	return func(h *UserHandler) {
+		h.heartbeatInterval = interval
+	}
+}
+
+func NewUserHandler(service *UserService, opts ...UserHandlerOption) *UserHandler {
+	h := &UserHandler{service: service, heartbeatInterval: 15 * time.Second}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 func (c *UserHandler) CreateUser(ctx *gin.Context) {
 	var user User
-	if err := ctx.ShouldBindJSON(&user); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !negotiate.Bind(ctx, &user) {
 		return
 	}
 
 	if err := ValidateUser(&user); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := c.service.CreateUser(context.Background(), &user); err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := c.service.CreateUser(ctx.Request.Context(), &user); err != nil {
+		negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	ctx.JSON(http.StatusCreated, user)
+	negotiate.Render(ctx, http.StatusCreated, &user)
 }
 
 func (c *UserHandler) GetUser(ctx *gin.Context) {
 	idStr := ctx.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
-	user, err := c.service.GetUser(context.Background(), id)
+	var user *User
+	if asOf := ctx.Query("as_of"); asOf != "" {
+		t, err := time.Parse(time.RFC3339, asOf)
+		if err != nil {
+			negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid as_of timestamp, expected RFC 3339"})
+			return
+		}
+		user, err = c.service.GetUserAsOf(ctx.Request.Context(), id, t)
+	} else {
+		user, err = c.service.GetUser(ctx.Request.Context(), id)
+	}
 	if err != nil {
-		ctx.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		negotiate.Render(ctx, http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, user)
+	httpcache.SetLastModified(ctx.Writer.Header(), user.Updated)
+	negotiate.Render(ctx, http.StatusOK, user)
 }
 
 func (c *UserHandler) UpdateUser(ctx *gin.Context) {
 	idStr := ctx.Param("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
 
 	var user User
-	if err := ctx.ShouldBindJSON(&user); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !negotiate.Bind(ctx, &user) {
 		return
 	}
 
-	if err := c.service.UpdateUser(context.Background(), id, &user); err != nil {
+	if err := c.service.UpdateUser(ctx.Request.Context(), id, &user); err != nil {
 		if err.Error() == "user not found" {
-			ctx.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			negotiate.Render(ctx, http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if user.PendingEmail != "" {
+		negotiate.Render(ctx, http.StatusOK, gin.H{"message": "User updated, the new email is pending verification", "pending_email": user.PendingEmail})
+		return
+	}
+	negotiate.Render(ctx, http.StatusOK, gin.H{"message": "User updated"})
+}
+
+// SendEmailVerification mails a new verification link to the pending or
+// unverified email of a user.
+func (c *UserHandler) SendEmailVerification(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := c.service.SendEmailVerification(ctx.Request.Context(), id); err != nil {
+		switch {
+		case errors.Is(err, ErrEmailAlreadyVerified):
+			negotiate.Render(ctx, http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrEmailVerificationMissing):
+			negotiate.Render(ctx, http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrUserNotFound), errors.Is(err, pgx.ErrNoRows):
+			negotiate.Render(ctx, http.StatusNotFound, gin.H{"error": "User not found"})
+		default:
+			negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	negotiate.Render(ctx, http.StatusAccepted, gin.H{"message": "Verification email sent"})
+}
+
+// VerifyEmail redeems the token from a verification link.
+func (c *UserHandler) VerifyEmail(ctx *gin.Context) {
+	token := ctx.Query("token")
+	if token == "" {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+
+	user, err := c.service.VerifyEmail(ctx.Request.Context(), token)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidEmailToken), errors.Is(err, ErrUserNotFound):
+			negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": ErrInvalidEmailToken.Error()})
+		case errors.Is(err, ErrEmailTaken):
+			negotiate.Render(ctx, http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrEmailVerificationMissing):
+			negotiate.Render(ctx, http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		default:
+			negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	negotiate.Render(ctx, http.StatusOK, user)
+}
+
+// SuspendUser, ReactivateUser and DeactivateUser change the status of a
+// user (admin). The body carries the reason; the actor is X-Actor.
+func (c *UserHandler) SuspendUser(ctx *gin.Context) {
+	c.changeStatus(ctx, c.service.SuspendUser)
+}
+
+func (c *UserHandler) ReactivateUser(ctx *gin.Context) {
+	c.changeStatus(ctx, c.service.ReactivateUser)
+}
+
+func (c *UserHandler) DeactivateUser(ctx *gin.Context) {
+	c.changeStatus(ctx, c.service.DeactivateUser)
+}
+
+func (c *UserHandler) changeStatus(ctx *gin.Context, change func(ctx context.Context, id int, reason string) (*User, error)) {
+	if !reqctx.FromContext(ctx.Request.Context()).IsAdmin() {
+		negotiate.Render(ctx, http.StatusForbidden, gin.H{"error": "Only admins can change the status of users"})
+		return
+	}
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	var req StatusChangeRequest
+	if !negotiate.Bind(ctx, &req) {
+		return
+	}
+
+	user, err := change(ctx.Request.Context(), id, req.Reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrStatusReasonRequired):
+			negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrInvalidStatusTransition):
+			negotiate.Render(ctx, http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrUserNotFound), errors.Is(err, pgx.ErrNoRows):
+			negotiate.Render(ctx, http.StatusNotFound, gin.H{"error": "User not found"})
+		default:
+			negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	negotiate.Render(ctx, http.StatusOK, user)
+}
+
+func (c *UserHandler) DeleteUser(ctx *gin.Context) {
+	idStr := ctx.Param("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := c.service.DeleteUser(ctx.Request.Context(), id); err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			negotiate.Render(ctx, http.StatusNotFound, gin.H{"error": "User not found"})
 			return
 		}
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"message": "User updated"})
+	ctx.Status(http.StatusNoContent)
+}
+
+// ListUserAuditEvents returns the audit trail of a user, newest first.
+func (c *UserHandler) ListUserAuditEvents(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	offset, err := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	events, err := c.service.ListUserAuditEvents(ctx.Request.Context(), id, limit, offset)
+	if err != nil {
+		negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The trail is append-only, so the first page changes only when an
+	// event is added; later pages also shift then, by an older event.
+	if offset == 0 && len(events) > 0 {
+		httpcache.SetLastModified(ctx.Writer.Header(), events[0].Created)
+	}
+	negotiate.Render(ctx, http.StatusOK, gin.H{"events": events})
+}
+
+// ListUserVersions returns every recorded version of a user, oldest first.
+func (c *UserHandler) ListUserVersions(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	versions, err := c.service.ListUserVersions(ctx.Request.Context(), id)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			negotiate.Render(ctx, http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var modified time.Time
+	for _, v := range versions {
+		if v.ValidFrom.After(modified) {
+			modified = v.ValidFrom
+		}
+		if v.ValidTo != nil && v.ValidTo.After(modified) {
+			modified = *v.ValidTo
+		}
+	}
+	httpcache.SetLastModified(ctx.Writer.Header(), modified)
+	negotiate.Render(ctx, http.StatusOK, gin.H{"versions": versions})
+}
+
+// RestoreUserVersion rolls a user back to the given version as a new update.
+func (c *UserHandler) RestoreUserVersion(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	version, err := strconv.Atoi(ctx.Param("version"))
+	if err != nil {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	user, err := c.service.RestoreUserVersion(ctx.Request.Context(), id, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrVersionNotFound):
+			negotiate.Render(ctx, http.StatusNotFound, gin.H{"error": "Version not found"})
+		case errors.Is(err, ErrUserNotFound):
+			negotiate.Render(ctx, http.StatusNotFound, gin.H{"error": "User not found"})
+		default:
+			negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	negotiate.Render(ctx, http.StatusOK, user)
+}
+
+// CollectionMethod serves custom methods on the users collection, such as
+// GET /users:watch and GET /users:search. Gin cannot route a literal colon inside a path segment,
+// so the route is registered as /users:method and dispatched here.
+func (c *UserHandler) CollectionMethod(ctx *gin.Context) {
+	switch ctx.Param("method") {
+	case ":watch":
+		c.WatchUsers(ctx)
+	case ":verifyEmail":
+		c.VerifyEmail(ctx)
+	case ":search":
+		c.SearchUsers(ctx)
+	default:
+		negotiate.Render(ctx, http.StatusNotFound, gin.H{"error": "Not found"})
+	}
+}
+
+// SearchUsers finds users matching the q query parameter, best match first.
+// prefix=true matches unfinished words, for search as you type.
+func (c *UserHandler) SearchUsers(ctx *gin.Context) {
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", strconv.Itoa(DefaultSearchResults)))
+	if err != nil || limit < 1 || limit > MaxSearchResults {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	prefix, err := strconv.ParseBool(ctx.DefaultQuery("prefix", "false"))
+	if err != nil {
+		negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": "Invalid prefix"})
+		return
+	}
+
+	results, err := c.service.SearchUsers(ctx.Request.Context(), ctx.Query("q"), prefix, limit)
+	if err != nil {
+		if errors.Is(err, ErrInvalidSearchQuery) {
+			negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if results == nil {
+		results = []*SearchResult{}
+	}
+	negotiate.Render(ctx, http.StatusOK, gin.H{"results": results})
+}
+
+// WatchUsers streams user changes as Server-Sent Events. Clients resume with
+// the resume_token query parameter or the standard Last-Event-ID header.
+func (c *UserHandler) WatchUsers(ctx *gin.Context) {
+	resumeToken := ctx.Query("resume_token")
+	if resumeToken == "" {
+		resumeToken = ctx.GetHeader("Last-Event-ID")
+	}
+
+	events, err := c.service.WatchUsers(ctx.Request.Context(), resumeToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrResumeTokenExpired):
+			negotiate.Render(ctx, http.StatusGone, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrInvalidResumeToken):
+			negotiate.Render(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrWatchUnavailable):
+			negotiate.Render(ctx, http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		default:
+			negotiate.Render(ctx, http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	heartbeat := time.NewTicker(c.heartbeatInterval)
+	defer heartbeat.Stop()
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			ctx.Render(-1, sse.Event{Id: event.ResumeToken(), Event: event.Type, Data: event})
+		case now := <-heartbeat.C:
+			ctx.SSEvent("heartbeat", gin.H{"time": now.UTC()})
+		}
+		return true
+	})
 }
@@ -0,0 +1,108 @@
+package userPack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var ErrVersionNotFound = errors.New("user version not found")
+
+// UserVersion is the state of a user during [ValidFrom, ValidTo). ValidTo is
+// nil for the current version of an existing user.
+type UserVersion struct {
+	Version   int        `json:"version"`
+	User      *User      `json:"user"`
+	ValidFrom time.Time  `json:"valid_from"`
+	ValidTo   *time.Time `json:"valid_to"`
+}
+
+// users_history is maintained by the users_history_trigger trigger, so every
+// write path (including batch inserts and manual SQL) is versioned.
+
+// Versions written before status and email verification were versioned have
+// neither; they come back without a status and unverified.
+const userVersionColumns = "version, user_id, firstname, lastname, email, age, created, tenant_id, " +
+	"COALESCE(status, ''), COALESCE(status_reason, ''), COALESCE(email_verified, false), " +
+	"valid_from, CASE WHEN valid_to = 'infinity' THEN NULL ELSE valid_to END"
+
+func scanUserVersion(row pgx.Row) (*UserVersion, error) {
+	v := UserVersion{User: &User{}}
+	err := row.Scan(&v.Version, &v.User.ID, &v.User.Firstname, &v.User.Lastname, &v.User.Email, &v.User.Age, &v.User.Created, &v.User.TenantID,
+		&v.User.Status, &v.User.StatusReason, &v.User.EmailVerified, &v.ValidFrom, &v.ValidTo)
+	if err != nil {
+		return nil, err
+	}
+	// A version changes nothing after it was written.
+	v.User.Updated = v.ValidFrom
+	return &v, nil
+}
+
+// GetUserAsOf returns the user as it was at the given moment.
+func (r *PostgresUserRepository) GetUserAsOf(ctx context.Context, id int, asOf time.Time) (*User, error) {
+	var v *UserVersion
+	err := r.withTx(ctx, "GetUserAsOf", func(tx pgx.Tx) error {
+		var err error
+		v, err = scanUserVersion(tx.QueryRow(ctx, "SELECT "+userVersionColumns+" FROM users_history WHERE user_id = $1 AND valid_from <= $2 AND valid_to > $2", id, asOf))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("GetUserAsOf: failed to query user with id %d as of %s: %w", id, asOf, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.User, nil
+}
+
+func (r *PostgresUserRepository) ListUserVersions(ctx context.Context, id int) ([]*UserVersion, error) {
+	var versions []*UserVersion
+	err := r.withTx(ctx, "ListUserVersions", func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT "+userVersionColumns+" FROM users_history WHERE user_id = $1 ORDER BY version", id)
+		if err != nil {
+			return fmt.Errorf("ListUserVersions: failed to query versions of user %d: %w", id, err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			v, err := scanUserVersion(rows)
+			if err != nil {
+				return fmt.Errorf("ListUserVersions: failed to scan version: %w", err)
+			}
+			versions = append(versions, v)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("ListUserVersions: failed to read versions: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (r *PostgresUserRepository) GetUserVersion(ctx context.Context, id, version int) (*UserVersion, error) {
+	var v *UserVersion
+	err := r.withTx(ctx, "GetUserVersion", func(tx pgx.Tx) error {
+		var err error
+		v, err = scanUserVersion(tx.QueryRow(ctx, "SELECT "+userVersionColumns+" FROM users_history WHERE user_id = $1 AND version = $2", id, version))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrVersionNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("GetUserVersion: failed to query version %d of user %d: %w", version, id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -4,6 +4,17 @@ import (
 	"time"
 )
 
+// UserStatus is the lifecycle state of an account. Only UserService moves a
+// user between states, see ChangeUserStatus.
+type UserStatus string
+
+const (
+	StatusPending     UserStatus = "pending"
+	StatusActive      UserStatus = "active"
+	StatusSuspended   UserStatus = "suspended"
+	StatusDeactivated UserStatus = "deactivated"
+)
+
 type User struct {
 	ID        int       `json:"id"`
 	Firstname string    `json:"firstname"`
@@ -11,4 +22,32 @@ type User struct {
 	Email     string    `json:"email"`
 	Age       uint      `json:"age"`
 	Created   time.Time `json:"created"`
+
+	// Updated is when the user last changed. It is set by the database on
+	// every write and is read-only for clients.
+	Updated time.Time `json:"updated"`
+
+	// EmailVerified and PendingEmail are maintained by the service. A new
+	// email only replaces Email once it is confirmed; until then it waits
+	// in PendingEmail and the old address keeps working.
+	EmailVerified bool   `json:"email_verified"`
+	PendingEmail  string `json:"pending_email,omitempty"`
+
+	// Status is read-only for clients; StatusReason explains the last
+	// change.
+	Status       UserStatus `json:"status,omitempty"`
+	StatusReason string     `json:"status_reason,omitempty"`
+
+	// TenantID is the tenant the user belongs to. It is taken from the
+	// request on create and never changes.
+	TenantID string `json:"tenant_id,omitempty"`
+
+	// Password is accepted on create only and is never returned; the
+	// service replaces it with PasswordHash before the user is stored.
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"-"`
+}
+
+type StatusChangeRequest struct {
+	Reason string `json:"reason"`
 }
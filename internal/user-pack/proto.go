@@ -0,0 +1,75 @@
+package userPack
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	userpb "user-api/gen/user"
+)
+
+var userStatuses = map[UserStatus]userpb.UserStatus{
+	StatusPending:     userpb.UserStatus_USER_STATUS_PENDING,
+	StatusActive:      userpb.UserStatus_USER_STATUS_ACTIVE,
+	StatusSuspended:   userpb.UserStatus_USER_STATUS_SUSPENDED,
+	StatusDeactivated: userpb.UserStatus_USER_STATUS_DEACTIVATED,
+}
+
+// ToProto returns the user as the gRPC API and the REST API in
+// application/x-protobuf represent it. The password is never part of it.
+func (u *User) ToProto() *userpb.User {
+	return &userpb.User{
+		Id:        int32(u.ID),
+		Firstname: u.Firstname,
+		Lastname:  u.Lastname,
+		Email:     u.Email,
+		Age:       uint32(u.Age),
+		Created:   u.Created.Format(time.RFC3339),
+		Updated:   u.Updated.Format(time.RFC3339),
+
+		EmailVerified: u.EmailVerified,
+		PendingEmail:  u.PendingEmail,
+		Status:        userStatuses[u.Status],
+		StatusReason:  u.StatusReason,
+		TenantId:      u.TenantID,
+	}
+}
+
+// UserFromProto is the inverse of ToProto. Malformed timestamps are left
+// zero.
+func UserFromProto(pb *userpb.User) *User {
+	user := &User{
+		ID:            int(pb.Id),
+		Firstname:     pb.Firstname,
+		Lastname:      pb.Lastname,
+		Email:         pb.Email,
+		Age:           uint(pb.Age),
+		EmailVerified: pb.EmailVerified,
+		PendingEmail:  pb.PendingEmail,
+		StatusReason:  pb.StatusReason,
+		TenantID:      pb.TenantId,
+	}
+	user.Created, _ = time.Parse(time.RFC3339, pb.Created)
+	user.Updated, _ = time.Parse(time.RFC3339, pb.Updated)
+	for status, value := range userStatuses {
+		if value == pb.Status {
+			user.Status = status
+		}
+	}
+	return user
+}
+
+// MarshalProto and UnmarshalProto let negotiate encode users as
+// application/x-protobuf.
+func (u *User) MarshalProto() ([]byte, error) {
+	return proto.Marshal(u.ToProto())
+}
+
+func (u *User) UnmarshalProto(data []byte) error {
+	var pb userpb.User
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return err
+	}
+	*u = *UserFromProto(&pb)
+	return nil
+}
@@ -2,48 +2,253 @@ package userPack
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"user-api/internal/outbox"
+	"user-api/internal/tenant"
 )
 
+var ErrUserNotFound = errors.New("user not found")
+
 type UserRepository interface {
 	CreateUser(ctx context.Context, user *User) error
 	GetUser(ctx context.Context, id int) (*User, error)
 	UpdateUser(ctx context.Context, id int, user *User) error
+	DeleteUser(ctx context.Context, id int) error
+	GetUsers(ctx context.Context, ids []int) ([]*User, error)
+	CreateUsers(ctx context.Context, users []*User) ([]error, error)
+	ListAuditEvents(ctx context.Context, userID int, limit, offset int) ([]*AuditEvent, error)
+	GetUserAsOf(ctx context.Context, id int, asOf time.Time) (*User, error)
+	ListUserVersions(ctx context.Context, id int) ([]*UserVersion, error)
+	GetUserVersion(ctx context.Context, id, version int) (*UserVersion, error)
+	VerifyEmail(ctx context.Context, id int, email, tokenID string, expiresAt time.Time) (*User, error)
+	SetUserStatus(ctx context.Context, id int, from, to UserStatus, reason string) (*User, error)
+	SearchUsers(ctx context.Context, query string, prefix bool, limit int) ([]*SearchResult, error)
 }
 
+// PostgresUserRepository writes every change together with its outbox event
+// and audit entry in one transaction. Every query runs in a transaction
+// scoped to the tenant of the request, so row-level security keeps tenants
+// apart.
 type PostgresUserRepository struct {
-	db *pgx.Conn
+	db *pgxpool.Pool
 }
 
-func NewPostgresUserRepository(db *pgx.Conn) *PostgresUserRepository {
+func NewPostgresUserRepository(db *pgxpool.Pool) *PostgresUserRepository {
 	return &PostgresUserRepository{db: db}
 }
 
+const userColumns = "id, firstname, lastname, email, age, created, email_verified, COALESCE(pending_email, ''), status, COALESCE(status_reason, ''), tenant_id, updated"
+
+func scanUser(row pgx.Row) (*User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.Firstname, &user.Lastname, &user.Email, &user.Age, &user.Created,
+		&user.EmailVerified, &user.PendingEmail, &user.Status, &user.StatusReason, &user.TenantID, &user.Updated)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *PostgresUserRepository) withTx(ctx context.Context, op string, fn func(tx pgx.Tx) error) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tenant.Scope(ctx, tx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+	return nil
+}
+
 func (r *PostgresUserRepository) CreateUser(ctx context.Context, user *User) error {
-	err := r.db.QueryRow(ctx, "INSERT INTO users (firstname, lastname, email, age, created) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		user.Firstname, user.Lastname, user.Email, user.Age, user.Created).Scan(&user.ID)
+	return r.withTx(ctx, "CreateUser", func(tx pgx.Tx) error {
+		return insertUser(ctx, tx, user)
+	})
+}
+
+func insertUser(ctx context.Context, tx pgx.Tx, user *User) error {
+	err := tx.QueryRow(ctx, "INSERT INTO users (firstname, lastname, email, age, created, password_hash, status, tenant_id) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8) RETURNING id, updated",
+		user.Firstname, user.Lastname, user.Email, user.Age, user.Created, user.PasswordHash, user.Status, user.TenantID).Scan(&user.ID, &user.Updated)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrEmailTaken
+	}
 	if err != nil {
 		return fmt.Errorf("CreateUser: failed to insert user: %w", err)
 	}
-	return nil
+	if err := insertAudit(ctx, tx, AuditActionCreate, user, diffUsers(nil, user)); err != nil {
+		return err
+	}
+	return outbox.Enqueue(ctx, tx, outbox.EventUserCreated, user.ID, user)
 }
 
 func (r *PostgresUserRepository) GetUser(ctx context.Context, id int) (*User, error) {
-	var user User
-	err := r.db.QueryRow(ctx, "SELECT id, firstname, lastname, email, age, created FROM users WHERE id = $1", id).Scan(&user.ID, &user.Firstname, &user.Lastname, &user.Email, &user.Age, &user.Created)
+	var user *User
+	err := r.withTx(ctx, "GetUser", func(tx pgx.Tx) error {
+		var err error
+		user, err = scanUser(tx.QueryRow(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1", id))
+		if err != nil {
+			return fmt.Errorf("GetUser: failed to query user with id %d: %w", id, err)
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("GetUser: failed to query user with id %d: %w", id, err)
+		return nil, err
 	}
-	return &user, nil
+	return user, nil
 }
 
 func (r *PostgresUserRepository) UpdateUser(ctx context.Context, id int, user *User) error {
-	_, err := r.db.Exec(ctx, "UPDATE users SET firstname = $1, lastname = $2, email = $3, age = $4 WHERE id = $5",
-		user.Firstname, user.Lastname, user.Email, user.Age, id)
+	return r.withTx(ctx, "UpdateUser", func(tx pgx.Tx) error {
+		before, err := scanUser(tx.QueryRow(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 FOR UPDATE", id))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("UpdateUser: failed to query user with id %d: %w", id, err)
+		}
+
+		// A new email is only recorded as pending; VerifyEmail swaps it in.
+		// user.PendingEmail tells the caller whether this update requested
+		// a change that needs a confirmation mail.
+		pending, requested := before.PendingEmail, ""
+		if user.Email != before.Email {
+			pending, requested = user.Email, user.Email
+		}
+		err = tx.QueryRow(ctx, "UPDATE users SET firstname = $1, lastname = $2, age = $3, pending_email = NULLIF($4, '') WHERE id = $5 RETURNING updated",
+			user.Firstname, user.Lastname, user.Age, pending, id).Scan(&user.Updated)
+		if err != nil {
+			return fmt.Errorf("UpdateUser: failed to update user with id %d: %w", id, err)
+		}
+		user.Email, user.EmailVerified, user.PendingEmail = before.Email, before.EmailVerified, requested
+		user.Status, user.StatusReason, user.TenantID = before.Status, before.StatusReason, before.TenantID
+
+		updated := *user
+		updated.ID, updated.Created, updated.PendingEmail = id, before.Created, pending
+		if err := insertAudit(ctx, tx, AuditActionUpdate, before, diffUsers(before, &updated)); err != nil {
+			return err
+		}
+		return outbox.Enqueue(ctx, tx, outbox.EventUserUpdated, id, &updated)
+	})
+}
+
+func (r *PostgresUserRepository) DeleteUser(ctx context.Context, id int) error {
+	return r.withTx(ctx, "DeleteUser", func(tx pgx.Tx) error {
+		user, err := scanUser(tx.QueryRow(ctx, "DELETE FROM users WHERE id = $1 RETURNING "+userColumns, id))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("DeleteUser: failed to delete user with id %d: %w", id, err)
+		}
+		if err := insertAudit(ctx, tx, AuditActionDelete, user, diffUsers(user, nil)); err != nil {
+			return err
+		}
+		return outbox.Enqueue(ctx, tx, outbox.EventUserDeleted, id, user)
+	})
+}
+
+func (r *PostgresUserRepository) GetUsers(ctx context.Context, ids []int) ([]*User, error) {
+	var users []*User
+	err := r.withTx(ctx, "GetUsers", func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT "+userColumns+" FROM users WHERE id = ANY($1) ORDER BY id", ids)
+		if err != nil {
+			return fmt.Errorf("GetUsers: failed to query users: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				return fmt.Errorf("GetUsers: failed to scan user: %w", err)
+			}
+			users = append(users, user)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("GetUsers: failed to read users: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("UpdateUser: failed to update user with id %d: %w", id, err)
+		return nil, err
 	}
-	return nil
+	return users, nil
+}
+
+// CreateUsers inserts users in a single transaction. Every insert runs in its
+// own savepoint, so a failing row is reported in the returned slice without
+// aborting the rest of the batch.
+func (r *PostgresUserRepository) CreateUsers(ctx context.Context, users []*User) ([]error, error) {
+	errs := make([]error, len(users))
+	err := r.withTx(ctx, "CreateUsers", func(tx pgx.Tx) error {
+		for i, user := range users {
+			sp, err := tx.Begin(ctx)
+			if err != nil {
+				return fmt.Errorf("CreateUsers: failed to create savepoint: %w", err)
+			}
+			if err := insertUser(ctx, sp, user); err != nil {
+				errs[i] = err
+				if err := sp.Rollback(ctx); err != nil {
+					return fmt.Errorf("CreateUsers: failed to roll back savepoint: %w", err)
+				}
+				continue
+			}
+			if err := sp.Commit(ctx); err != nil {
+				return fmt.Errorf("CreateUsers: failed to release savepoint: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
+func (r *PostgresUserRepository) ListAuditEvents(ctx context.Context, userID int, limit, offset int) ([]*AuditEvent, error) {
+	var events []*AuditEvent
+	err := r.withTx(ctx, "ListAuditEvents", func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT id, user_id, action, actor, request_id, source, changes, created FROM user_audit WHERE user_id = $1 ORDER BY id DESC LIMIT $2 OFFSET $3",
+			userID, limit, offset)
+		if err != nil {
+			return fmt.Errorf("ListAuditEvents: failed to query audit events for user %d: %w", userID, err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var event AuditEvent
+			var changes []byte
+			if err := rows.Scan(&event.ID, &event.UserID, &event.Action, &event.Actor, &event.RequestID, &event.Source, &changes, &event.Created); err != nil {
+				return fmt.Errorf("ListAuditEvents: failed to scan audit event: %w", err)
+			}
+			if err := json.Unmarshal(changes, &event.Changes); err != nil {
+				return fmt.Errorf("ListAuditEvents: failed to decode changes of audit event %d: %w", event.ID, err)
+			}
+			events = append(events, &event)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("ListAuditEvents: failed to read audit events: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
 }
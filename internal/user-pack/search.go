@@ -0,0 +1,225 @@
+package userPack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var ErrInvalidSearchQuery = errors.New("search query must contain a letter or digit")
+
+// DefaultSearchResults is how many results a search without a limit
+// returns; MaxSearchResults caps the limit.
+const (
+	DefaultSearchResults = 20
+	MaxSearchResults     = 100
+)
+
+// SearchResult is a user matching a search. Highlights holds the matched
+// fields with the matches wrapped in <mark> tags and the rest HTML escaped;
+// fields without a match are left out.
+type SearchResult struct {
+	User       *User             `json:"user"`
+	Rank       float64           `json:"rank"`
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// searchTerms splits a query into lower-cased words, the way the simple
+// text search configuration does. Emails split at their punctuation too,
+// which is how search_document indexes them.
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// tsQuery builds a to_tsquery expression that needs every term. With prefix,
+// terms also match the words they start, for search as you type. The terms
+// hold nothing but letters and digits, so nothing needs quoting.
+func tsQuery(terms []string, prefix bool) string {
+	parts := make([]string, len(terms))
+	for i, term := range terms {
+		parts[i] = term
+		if prefix {
+			parts[i] += ":*"
+		}
+	}
+	return strings.Join(parts, " & ")
+}
+
+// SearchUsers ranks users by full-text match on search_document plus the
+// trigram similarity of the query to the name and the email, which catches
+// typos the text search misses. Both sides are backed by GIN indexes.
+func (r *PostgresUserRepository) SearchUsers(ctx context.Context, query string, prefix bool, limit int) ([]*SearchResult, error) {
+	var results []*SearchResult
+	err := r.withTx(ctx, "SearchUsers", func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			SELECT `+userColumns+`,
+				ts_rank_cd(search_document, q) + GREATEST(word_similarity($1, firstname || ' ' || lastname), similarity($1, email)) AS rank
+			FROM users, to_tsquery('simple', $2) q
+			WHERE search_document @@ q OR $1 <% (firstname || ' ' || lastname) OR $1 % email
+			ORDER BY rank DESC, id
+			LIMIT $3`,
+			query, tsQuery(searchTerms(query), prefix), limit)
+		if err != nil {
+			return fmt.Errorf("SearchUsers: failed to search users: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var result SearchResult
+			var user User
+			err := rows.Scan(&user.ID, &user.Firstname, &user.Lastname, &user.Email, &user.Age, &user.Created,
+				&user.EmailVerified, &user.PendingEmail, &user.Status, &user.StatusReason, &user.TenantID, &user.Updated, &result.Rank)
+			if err != nil {
+				return fmt.Errorf("SearchUsers: failed to scan user: %w", err)
+			}
+			result.User = &user
+			results = append(results, &result)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("SearchUsers: failed to read users: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// SearchUsers finds users by partial or misspelled names and emails, best
+// match first. With prefix, the words of the query may be unfinished.
+func (s *UserService) SearchUsers(ctx context.Context, query string, prefix bool, limit int) ([]*SearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, ErrInvalidSearchQuery
+	}
+	switch {
+	case limit <= 0:
+		limit = DefaultSearchResults
+	case limit > MaxSearchResults:
+		limit = MaxSearchResults
+	}
+
+	results, err := s.repo.SearchUsers(ctx, strings.TrimSpace(query), prefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		result.Highlights = highlights(result.User, terms, prefix)
+	}
+	return results, nil
+}
+
+func highlights(user *User, terms []string, prefix bool) map[string]string {
+	fields := map[string]string{}
+	for name, value := range map[string]string{"firstname": user.Firstname, "lastname": user.Lastname, "email": user.Email} {
+		if marked, ok := highlight(value, terms, prefix); ok {
+			fields[name] = marked
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// highlight marks the words of value that match a term: whole words, the
+// start of words with prefix, and words a typo or two away from a term,
+// which is what the trigram side of the search finds.
+func highlight(value string, terms []string, prefix bool) (string, bool) {
+	runes := []rune(value)
+	marked := make([]bool, len(runes))
+	found := false
+	for start := 0; start < len(runes); {
+		if !isWordRune(runes[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(runes) && isWordRune(runes[end]) {
+			end++
+		}
+		word := strings.ToLower(string(runes[start:end]))
+		if n := matchLength(word, terms, prefix); n > 0 {
+			for i := start; i < min(start+n, end); i++ {
+				marked[i] = true
+			}
+			found = true
+		}
+		start = end
+	}
+	if !found {
+		return "", false
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(runes); {
+		j := i
+		for j < len(runes) && marked[j] == marked[i] {
+			j++
+		}
+		text := html.EscapeString(string(runes[i:j]))
+		if marked[i] {
+			text = "<mark>" + text + "</mark>"
+		}
+		b.WriteString(text)
+		i = j
+	}
+	return b.String(), true
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// matchLength returns how many runes of word match one of terms, or 0.
+func matchLength(word string, terms []string, prefix bool) int {
+	best := 0
+	wordLen := len([]rune(word))
+	for _, term := range terms {
+		termLen := len([]rune(term))
+		switch {
+		case word == term:
+			return wordLen
+		case prefix && strings.HasPrefix(word, term) && termLen > best:
+			best = termLen
+		case termLen >= 4 && editDistance(word, term) <= termLen/4:
+			return wordLen
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b, counting the
+// swap of two neighbouring letters as one edit, as typos go.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
@@ -2,31 +2,266 @@ package userPack
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
+
+	"user-api/internal/reqctx"
+	"user-api/pkg/mailer"
+	"user-api/pkg/password"
+	"user-api/pkg/ratelimit"
+	"user-api/pkg/signedtoken"
 )
 
+var ErrWatchUnavailable = errors.New("user change feed is not available")
+
 type UserServiceInterface interface {
 	CreateUser(ctx context.Context, user *User) error
 	GetUser(ctx context.Context, id int) (*User, error)
 	UpdateUser(ctx context.Context, id int, user *User) error
+	DeleteUser(ctx context.Context, id int) error
+	BatchGetUsers(ctx context.Context, ids []int) ([]*User, []int, error)
+	CreateUsers(ctx context.Context, users []*User) ([]error, error)
+	ListUserAuditEvents(ctx context.Context, id int, limit, offset int) ([]*AuditEvent, error)
+	GetUserAsOf(ctx context.Context, id int, asOf time.Time) (*User, error)
+	ListUserVersions(ctx context.Context, id int) ([]*UserVersion, error)
+	RestoreUserVersion(ctx context.Context, id, version int) (*User, error)
+	SendEmailVerification(ctx context.Context, id int) error
+	VerifyEmail(ctx context.Context, token string) (*User, error)
+	ChangeUserStatus(ctx context.Context, id int, status UserStatus, reason string) (*User, error)
+	SuspendUser(ctx context.Context, id int, reason string) (*User, error)
+	ReactivateUser(ctx context.Context, id int, reason string) (*User, error)
+	DeactivateUser(ctx context.Context, id int, reason string) (*User, error)
+	SearchUsers(ctx context.Context, query string, prefix bool, limit int) ([]*SearchResult, error)
 }
 type UserService struct {
-	repo UserRepository
+	repo    UserRepository
+	watcher *UserWatcher
+	hasher  *password.Hasher
+
+	mailer      mailer.Mailer
+	emailSigner *signedtoken.Signer
+	emailCfg    EmailVerificationConfig
+
+	createQuota *ratelimit.Quota
+}
+
+type UserServiceOption func(*UserService)
+
+// WithWatcher enables WatchUsers.
+func WithWatcher(watcher *UserWatcher) UserServiceOption {
+	return func(s *UserService) {
+		s.watcher = watcher
+	}
 }
 
-func NewUserService(repo UserRepository) *UserService {
-	return &UserService{repo: repo}
+// WithPasswordHasher sets the hasher for passwords given on create.
+func WithPasswordHasher(hasher *password.Hasher) UserServiceOption {
+	return func(s *UserService) {
+		s.hasher = hasher
+	}
 }
 
+// WithCreateQuota caps the users each tenant may create per day. Creating
+// more fails with a *ratelimit.QuotaError.
+func WithCreateQuota(quota *ratelimit.Quota) UserServiceOption {
+	return func(s *UserService) {
+		s.createQuota = quota
+	}
+}
+
+func NewUserService(repo UserRepository, opts ...UserServiceOption) *UserService {
+	s := &UserService{repo: repo, hasher: password.NewHasher(password.DefaultParams)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// CreateUser stores a user with an unverified email and mails a
+// verification link to it. With email verification the user stays pending
+// until the link is opened.
 func (s *UserService) CreateUser(ctx context.Context, user *User) error {
 	user.Created = time.Now()
-	return s.repo.CreateUser(ctx, user)
+	s.resetManagedFields(ctx, user)
+	if err := s.hashPassword(user); err != nil {
+		return err
+	}
+	if err := s.reserveCreates(ctx, 1); err != nil {
+		return err
+	}
+	if err := s.repo.CreateUser(ctx, user); err != nil {
+		s.releaseCreates(ctx, 1)
+		return err
+	}
+	if s.mailer != nil {
+		s.sendVerification(ctx, user.ID, user.Email)
+	}
+	return nil
+}
+
+// resetManagedFields drops values clients may not set on create. Users are
+// always created in the tenant of the request.
+func (s *UserService) resetManagedFields(ctx context.Context, user *User) {
+	user.TenantID = reqctx.FromContext(ctx).Tenant()
+	user.EmailVerified, user.PendingEmail = false, ""
+	user.Status, user.StatusReason = StatusActive, ""
+	if s.mailer != nil {
+		user.Status = StatusPending
+	}
+}
+
+// hashPassword moves a plaintext password into PasswordHash, so it is never
+// stored, logged or returned.
+func (s *UserService) hashPassword(user *User) error {
+	if user.Password == "" {
+		return nil
+	}
+	hash, err := s.hasher.Hash(user.Password)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	user.Password, user.PasswordHash = "", hash
+	return nil
 }
 
 func (s *UserService) GetUser(ctx context.Context, id int) (*User, error) {
 	return s.repo.GetUser(ctx, id)
 }
 
+// UpdateUser applies changes to a user. A different email is not applied
+// right away: it is kept in PendingEmail and a verification link is mailed
+// to it.
 func (s *UserService) UpdateUser(ctx context.Context, id int, user *User) error {
-	return s.repo.UpdateUser(ctx, id, user)
+	if err := s.repo.UpdateUser(ctx, id, user); err != nil {
+		return err
+	}
+	if user.PendingEmail != "" && s.mailer != nil {
+		s.sendVerification(ctx, id, user.PendingEmail)
+	}
+	return nil
+}
+
+func (s *UserService) DeleteUser(ctx context.Context, id int) error {
+	return s.repo.DeleteUser(ctx, id)
+}
+
+// BatchGetUsers resolves ids in one query and returns the users found along
+// with the ids that do not exist.
+func (s *UserService) BatchGetUsers(ctx context.Context, ids []int) ([]*User, []int, error) {
+	users, err := s.repo.GetUsers(ctx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	found := make(map[int]bool, len(users))
+	for _, user := range users {
+		found[user.ID] = true
+	}
+	var missing []int
+	for _, id := range ids {
+		if !found[id] {
+			missing = append(missing, id)
+			found[id] = true
+		}
+	}
+	return users, missing, nil
+}
+
+func (s *UserService) CreateUsers(ctx context.Context, users []*User) ([]error, error) {
+	now := time.Now()
+	for _, user := range users {
+		user.Created = now
+		s.resetManagedFields(ctx, user)
+		if err := s.hashPassword(user); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.reserveCreates(ctx, len(users)); err != nil {
+		return nil, err
+	}
+	errs, err := s.repo.CreateUsers(ctx, users)
+	if err != nil {
+		s.releaseCreates(ctx, len(users))
+		return nil, err
+	}
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			failed++
+		} else if s.mailer != nil {
+			s.sendVerification(ctx, users[i].ID, users[i].Email)
+		}
+	}
+	s.releaseCreates(ctx, failed)
+	return errs, nil
+}
+
+// reserveCreates counts n users against the creation quota of the tenant.
+func (s *UserService) reserveCreates(ctx context.Context, n int) error {
+	if s.createQuota == nil {
+		return nil
+	}
+	return s.createQuota.Reserve(ctx, reqctx.FromContext(ctx).Tenant(), n)
+}
+
+// releaseCreates gives back the quota of users that were not created.
+func (s *UserService) releaseCreates(ctx context.Context, n int) {
+	if s.createQuota != nil {
+		s.createQuota.Release(ctx, reqctx.FromContext(ctx).Tenant(), n)
+	}
+}
+
+// WatchUsers streams user changes that happened after resumeToken.
+func (s *UserService) WatchUsers(ctx context.Context, resumeToken string) (<-chan *UserEvent, error) {
+	if s.watcher == nil {
+		return nil, ErrWatchUnavailable
+	}
+	return s.watcher.Subscribe(ctx, resumeToken)
+}
+
+// ListUserAuditEvents returns the audit trail of a user, newest first.
+// Personal data in the diffs is masked unless the caller is an admin.
+func (s *UserService) ListUserAuditEvents(ctx context.Context, id int, limit, offset int) ([]*AuditEvent, error) {
+	events, err := s.repo.ListAuditEvents(ctx, id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	if !reqctx.FromContext(ctx).IsAdmin() {
+		for _, event := range events {
+			MaskAuditEvent(event)
+		}
+	}
+	return events, nil
+}
+
+// GetUserAsOf returns the user as it was at asOf, including users that have
+// since been deleted.
+func (s *UserService) GetUserAsOf(ctx context.Context, id int, asOf time.Time) (*User, error) {
+	return s.repo.GetUserAsOf(ctx, id, asOf)
+}
+
+func (s *UserService) ListUserVersions(ctx context.Context, id int) ([]*UserVersion, error) {
+	versions, err := s.repo.ListUserVersions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return versions, nil
+}
+
+// RestoreUserVersion rolls a user back to a previous version. The rollback is
+// an ordinary update, so it gets its own version, audit entry and event. Only
+// the profile is rolled back; status and email verification stay as they are.
+func (s *UserService) RestoreUserVersion(ctx context.Context, id, version int) (*User, error) {
+	v, err := s.repo.GetUserVersion(ctx, id, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.UpdateUser(ctx, id, v.User); err != nil {
+		return nil, err
+	}
+	return s.repo.GetUser(ctx, id)
 }
@@ -0,0 +1,119 @@
+package userPack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+
+	"user-api/internal/outbox"
+	"user-api/internal/reqctx"
+)
+
+var (
+	ErrInvalidStatus           = errors.New("invalid user status")
+	ErrInvalidStatusTransition = errors.New("user status cannot change that way")
+	ErrStatusReasonRequired    = errors.New("a reason and an actor are required to change the status")
+)
+
+// statusTransitions lists the states each state may move to. Deactivation is
+// final.
+var statusTransitions = map[UserStatus][]UserStatus{
+	StatusPending:     {StatusActive, StatusSuspended, StatusDeactivated},
+	StatusActive:      {StatusSuspended, StatusDeactivated},
+	StatusSuspended:   {StatusActive, StatusDeactivated},
+	StatusDeactivated: nil,
+}
+
+func canTransition(from, to UserStatus) bool {
+	for _, next := range statusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CanLogIn reports whether users in this state may sign in. Pending users
+// can, so they are not locked out while the verification mail is on its
+// way.
+func (s UserStatus) CanLogIn() bool {
+	return s == StatusPending || s == StatusActive
+}
+
+// ChangeUserStatus moves a user to status. The change needs a reason and an
+// actor, taken from the request metadata; both end up in the audit trail.
+func (s *UserService) ChangeUserStatus(ctx context.Context, id int, status UserStatus, reason string) (*User, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" || reqctx.FromContext(ctx).Actor == "" {
+		return nil, ErrStatusReasonRequired
+	}
+	if _, ok := statusTransitions[status]; !ok {
+		return nil, fmt.Errorf("%w %q", ErrInvalidStatus, status)
+	}
+
+	user, err := s.repo.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !canTransition(user.Status, status) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrInvalidStatusTransition, user.Status, status)
+	}
+	return s.repo.SetUserStatus(ctx, id, user.Status, status, reason)
+}
+
+// SuspendUser blocks an account without deleting it. Suspended users cannot
+// log in or refresh their tokens.
+func (s *UserService) SuspendUser(ctx context.Context, id int, reason string) (*User, error) {
+	return s.ChangeUserStatus(ctx, id, StatusSuspended, reason)
+}
+
+// ReactivateUser lifts a suspension.
+func (s *UserService) ReactivateUser(ctx context.Context, id int, reason string) (*User, error) {
+	return s.ChangeUserStatus(ctx, id, StatusActive, reason)
+}
+
+// DeactivateUser closes an account for good.
+func (s *UserService) DeactivateUser(ctx context.Context, id int, reason string) (*User, error) {
+	return s.ChangeUserStatus(ctx, id, StatusDeactivated, reason)
+}
+
+// SetUserStatus changes the status of a user from from to to. It returns
+// ErrInvalidStatusTransition if the status is no longer from, so concurrent
+// changes cannot skip the checks of the service.
+func (r *PostgresUserRepository) SetUserStatus(ctx context.Context, id int, from, to UserStatus, reason string) (*User, error) {
+	var user *User
+	err := r.withTx(ctx, "SetUserStatus", func(tx pgx.Tx) error {
+		before, err := scanUser(tx.QueryRow(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 FOR UPDATE", id))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("SetUserStatus: failed to query user with id %d: %w", id, err)
+		}
+		if before.Status != from {
+			return fmt.Errorf("%w: %s to %s", ErrInvalidStatusTransition, before.Status, to)
+		}
+
+		updated := *before
+		updated.Status, updated.StatusReason = to, reason
+		err = tx.QueryRow(ctx, "UPDATE users SET status = $1, status_reason = $2 WHERE id = $3 RETURNING updated", to, reason, id).Scan(&updated.Updated)
+		if err != nil {
+			return fmt.Errorf("SetUserStatus: failed to update status of user %d: %w", id, err)
+		}
+		user = &updated
+
+		changes := diffUsers(before, user)
+		changes["status_reason"] = FieldChange{Before: before.StatusReason, After: reason}
+		if err := insertAudit(ctx, tx, AuditActionUpdate, before, changes); err != nil {
+			return err
+		}
+		return outbox.Enqueue(ctx, tx, outbox.EventUserUpdated, id, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -17,5 +17,17 @@ func ValidateUser(user *User) error {
 	if !IsValidEmail(user.Email) {
 		return fmt.Errorf("invalid email format")
 	}
+	if user.Password != "" {
+		if err := ValidatePassword(user.Password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ValidatePassword(password string) error {
+	if len(password) < 8 || len(password) > 256 {
+		return fmt.Errorf("password must be between 8 and 256 characters")
+	}
 	return nil
 }
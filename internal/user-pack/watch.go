@@ -0,0 +1,265 @@
+package userPack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"user-api/internal/tenant"
+)
+
+const (
+	UserEventCreated = "created"
+	UserEventUpdated = "updated"
+	UserEventDeleted = "deleted"
+
+	userEventsChannel = "user_events"
+	watchPollInterval = time.Second
+)
+
+var (
+	ErrInvalidResumeToken = errors.New("invalid resume token")
+	// ErrResumeTokenExpired is an ErrInvalidResumeToken whose events are no
+	// longer retained; the client has to start over without one.
+	ErrResumeTokenExpired = fmt.Errorf("%w: events after it are no longer retained", ErrInvalidResumeToken)
+)
+
+// UserEvent is a change to the users table recorded by the notify_user_change
+// trigger. User holds the record as it was after the change (before it, for
+// deletes).
+type UserEvent struct {
+	Position EventPosition `json:"-"`
+	Type     string        `json:"type"`
+	User     *User         `json:"user"`
+	Occurred time.Time     `json:"occurred"`
+}
+
+// EventPosition orders events by the transaction that recorded them, then by
+// id. Events are only read once every transaction with a lower id has
+// finished, so no event can turn up behind a position already read, even
+// though concurrent transactions commit in any order.
+type EventPosition struct {
+	TxID int64
+	ID   int64
+}
+
+func (p EventPosition) after(q EventPosition) bool {
+	return p.TxID > q.TxID || (p.TxID == q.TxID && p.ID > q.ID)
+}
+
+// ResumeToken identifies the event, so a client can continue a feed after it.
+func (e *UserEvent) ResumeToken() string {
+	return strconv.FormatInt(e.Position.TxID, 10) + "." + strconv.FormatInt(e.Position.ID, 10)
+}
+
+func parseResumeToken(token string) (EventPosition, error) {
+	if token == "" {
+		return EventPosition{}, nil
+	}
+	txID, id, ok := strings.Cut(token, ".")
+	var pos EventPosition
+	var errTx, errID error
+	if ok {
+		pos.TxID, errTx = strconv.ParseInt(txID, 10, 64)
+		pos.ID, errID = strconv.ParseInt(id, 10, 64)
+	}
+	if !ok || errTx != nil || errID != nil || pos.TxID < 0 || pos.ID < 0 {
+		return EventPosition{}, fmt.Errorf("%w %q", ErrInvalidResumeToken, token)
+	}
+	return pos, nil
+}
+
+// UserEventStore is where the watcher reads the events recorded by the
+// notify_user_change trigger.
+type UserEventStore interface {
+	// LastEventPosition is the position of the newest event that can be
+	// read, or the zero position if there is none.
+	LastEventPosition(ctx context.Context) (EventPosition, error)
+	// OldestEventPosition is the position of the oldest retained event, or
+	// the zero position if there is none.
+	OldestEventPosition(ctx context.Context) (EventPosition, error)
+	// EventsAfter returns the readable events after pos, in order.
+	EventsAfter(ctx context.Context, pos EventPosition) ([]*UserEvent, error)
+	// Listen calls wake once listening and again whenever events may have
+	// been recorded, until ctx is done or listening fails.
+	Listen(ctx context.Context, wake func(context.Context) error) error
+	// PurgeEvents deletes events recorded before before, except the newest.
+	PurgeEvents(ctx context.Context, before time.Time) error
+}
+
+// UserWatcher listens for user_events notifications and fans the recorded
+// events out to subscribers. Notifications are only used as a wake-up signal:
+// events are always read back from user_events, so nothing is lost while the
+// listener reconnects.
+type UserWatcher struct {
+	store     UserEventStore
+	retention time.Duration
+
+	mu          sync.Mutex
+	last        EventPosition
+	subscribers map[chan *UserEvent]struct{}
+}
+
+// NewUserWatcher creates a watcher that keeps recorded events for retention,
+// which bounds how old a resume token can be.
+func NewUserWatcher(store UserEventStore, retention time.Duration) *UserWatcher {
+	return &UserWatcher{store: store, retention: retention, subscribers: make(map[chan *UserEvent]struct{})}
+}
+
+// Run listens for notifications until ctx is cancelled, reconnecting after
+// failures.
+func (w *UserWatcher) Run(ctx context.Context) error {
+	last, err := w.store.LastEventPosition(ctx)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.last = last
+	w.mu.Unlock()
+
+	go w.purge(ctx)
+
+	for {
+		err := w.store.Listen(ctx, w.dispatch)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("UserWatcher: listener stopped, reconnecting: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (w *UserWatcher) purge(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := w.store.PurgeEvents(ctx, time.Now().Add(-w.retention)); err != nil && ctx.Err() == nil {
+			log.Printf("UserWatcher: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *UserWatcher) dispatch(ctx context.Context) error {
+	events, err := w.store.EventsAfter(ctx, w.last)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, event := range events {
+		w.last = event.Position
+		for ch := range w.subscribers {
+			select {
+			case ch <- event:
+			default:
+				// A subscriber that cannot keep up is dropped; it can
+				// reconnect with its last resume token.
+				delete(w.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+	return nil
+}
+
+// Subscribe returns a channel of events that happened after resumeToken, or
+// only new events if the token is empty. Tokens of events that are no longer
+// retained fail with ErrResumeTokenExpired. Only events of the tenant of ctx are
+// sent, unless the caller is a platform admin. The channel is closed when ctx is
+// done or when the subscriber falls too far behind.
+func (w *UserWatcher) Subscribe(ctx context.Context, resumeToken string) (<-chan *UserEvent, error) {
+	after, err := parseResumeToken(resumeToken)
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(chan *UserEvent, 256)
+	w.mu.Lock()
+	w.subscribers[live] = struct{}{}
+	if resumeToken == "" {
+		after = w.last
+	}
+	w.mu.Unlock()
+
+	// Subscribing before the replay means no event can fall between the two;
+	// events seen in both are skipped by position.
+	backlog, err := w.store.EventsAfter(ctx, after)
+	if err != nil {
+		w.unsubscribe(live)
+		return nil, err
+	}
+	// Checked after the replay was read, so no purge can slip in between.
+	if resumeToken != "" {
+		oldest, err := w.store.OldestEventPosition(ctx)
+		if err != nil {
+			w.unsubscribe(live)
+			return nil, err
+		}
+		if oldest.after(after) {
+			w.unsubscribe(live)
+			return nil, fmt.Errorf("%w: %q", ErrResumeTokenExpired, resumeToken)
+		}
+	}
+
+	out := make(chan *UserEvent)
+	go func() {
+		defer close(out)
+		defer w.unsubscribe(live)
+
+		last := after
+		send := func(event *UserEvent) bool {
+			if !event.Position.after(last) || !tenant.Visible(ctx, event.User.TenantID) {
+				return true
+			}
+			select {
+			case out <- event:
+				last = event.Position
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, event := range backlog {
+			if !send(event) {
+				return
+			}
+		}
+		for {
+			select {
+			case event, ok := <-live:
+				if !ok || !send(event) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (w *UserWatcher) unsubscribe(ch chan *UserEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.subscribers[ch]; ok {
+		delete(w.subscribers, ch)
+		close(ch)
+	}
+}
@@ -0,0 +1,156 @@
+package webhookPack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type DispatcherConfig struct {
+	BatchSize    int
+	PollInterval time.Duration
+	Timeout      time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	// MaxAttempts is the number of attempts after which a delivery is dead.
+	MaxAttempts int
+	// AllowPrivateNetworks lets deliveries reach loopback, link-local and
+	// private addresses, for local development and tests.
+	AllowPrivateNetworks bool
+}
+
+// Dispatcher sends pending deliveries to subscriber URLs.
+type Dispatcher struct {
+	repo   WebhookRepository
+	client *http.Client
+	cfg    DispatcherConfig
+}
+
+func NewDispatcher(repo WebhookRepository, cfg DispatcherConfig) *Dispatcher {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !cfg.AllowPrivateNetworks {
+		// A proxy would dial the receiver where publicOnly cannot see it.
+		transport.Proxy = nil
+		transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: publicOnly}).DialContext
+	}
+	return &Dispatcher{repo: repo, client: &http.Client{Timeout: cfg.Timeout, Transport: transport}, cfg: cfg}
+}
+
+// publicOnly refuses connections to private addresses. It checks the
+// address being dialed, after DNS resolution and on every redirect, so
+// neither a host name nor a redirect can lead a delivery into the network.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+	return nil
+}
+
+func (d *Dispatcher) Run(ctx context.Context) error {
+	for {
+		n, err := d.DispatchOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Dispatcher: %v", err)
+		}
+		if n > 0 && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(d.cfg.PollInterval):
+		}
+	}
+}
+
+// DispatchOnce sends one batch of due deliveries and returns how many were
+// attempted. The batch is claimed and its results recorded in transactions
+// of their own, none of them open while receivers answer.
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	claimed, err := d.repo.ClaimDueDeliveries(ctx, d.cfg.BatchSize, d.lease())
+	if err != nil || len(claimed) == 0 {
+		return 0, err
+	}
+	results := make([]DeliveryResult, len(claimed))
+	for i, c := range claimed {
+		results[i] = d.deliver(ctx, c.Subscription, c.Delivery)
+	}
+	if err := d.repo.RecordDeliveries(ctx, claimed, results); err != nil {
+		return 0, err
+	}
+	return len(claimed), nil
+}
+
+// lease is how long a batch is held: long enough to send every delivery of
+// it with the full timeout, and record the results.
+func (d *Dispatcher) lease() time.Duration {
+	return time.Duration(d.cfg.BatchSize)*d.cfg.Timeout + time.Minute
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, sub *Subscription, delivery *Delivery) DeliveryResult {
+	status, err := d.send(ctx, sub, delivery)
+	if err == nil {
+		return DeliveryResult{Status: DeliverySucceeded, ResponseStatus: status, NextAttemptAt: time.Now()}
+	}
+
+	attempts := delivery.Attempts + 1
+	if attempts >= d.cfg.MaxAttempts {
+		return DeliveryResult{Status: DeliveryDead, ResponseStatus: status, Error: err.Error(), NextAttemptAt: time.Now()}
+	}
+	return DeliveryResult{Status: DeliveryFailed, ResponseStatus: status, Error: err.Error(), NextAttemptAt: time.Now().Add(d.backoff(attempts))}
+}
+
+func (d *Dispatcher) send(ctx context.Context, sub *Subscription, delivery *Delivery) (int, error) {
+	body, err := json.Marshal(Event{ID: delivery.MessageID, Type: delivery.EventType, Created: delivery.Created, Data: delivery.Payload})
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to build request: %w", err)
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "user-api-webhooks")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.cfg.MinBackoff
+	for i := 1; i < attempt && delay < d.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.cfg.MaxBackoff {
+		delay = d.cfg.MaxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,170 @@
+package webhookPack
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebhookHandler struct {
+	service *WebhookService
+}
+
+func NewWebhookHandler(service *WebhookService) *WebhookHandler {
+	return &WebhookHandler{service: service}
+}
+
+func (c *WebhookHandler) CreateSubscription(ctx *gin.Context) {
+	sub := Subscription{Active: true}
+	if err := ctx.ShouldBindJSON(&sub); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := ValidateSubscription(&sub); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := c.service.CreateSubscription(ctx.Request.Context(), &sub); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, sub)
+}
+
+func (c *WebhookHandler) ListSubscriptions(ctx *gin.Context) {
+	subs, err := c.service.ListSubscriptions(ctx.Request.Context())
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"subscriptions": subs})
+}
+
+func (c *WebhookHandler) GetSubscription(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+		return
+	}
+
+	sub, err := c.service.GetSubscription(ctx.Request.Context(), id)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, sub)
+}
+
+// UpdateSubscription patches the fields present in the body. Sending a new
+// secret rotates it.
+func (c *WebhookHandler) UpdateSubscription(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+		return
+	}
+
+	var invalid error
+	sub, err := c.service.UpdateSubscription(ctx.Request.Context(), id, func(sub *Subscription) error {
+		if err := ctx.ShouldBindJSON(sub); err != nil {
+			invalid = err
+			return err
+		}
+		if err := ValidateSubscription(sub); err != nil {
+			invalid = err
+			return err
+		}
+		return nil
+	})
+	if invalid != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": invalid.Error()})
+		return
+	}
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, sub)
+}
+
+func (c *WebhookHandler) DeleteSubscription(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+		return
+	}
+
+	if err := c.service.DeleteSubscription(ctx.Request.Context(), id); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// ListDeliveries returns the delivery log of a subscription, newest first,
+// optionally filtered by ?status=.
+func (c *WebhookHandler) ListDeliveries(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+		return
+	}
+	limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+		return
+	}
+	offset, err := strconv.Atoi(ctx.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return
+	}
+
+	deliveries, err := c.service.ListDeliveries(ctx.Request.Context(), id, ctx.Query("status"), limit, offset)
+	if err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+func (c *WebhookHandler) ReplayDelivery(ctx *gin.Context) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+		return
+	}
+	deliveryID, err := strconv.ParseInt(ctx.Param("deliveryId"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+		return
+	}
+
+	if err := c.service.ReplayDelivery(ctx.Request.Context(), id, deliveryID); err != nil {
+		respondError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{"message": "Delivery scheduled"})
+}
+
+func respondError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrSubscriptionNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+	case errors.Is(err, ErrDeliveryNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
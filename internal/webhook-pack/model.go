@@ -0,0 +1,65 @@
+package webhookPack
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryFailed    = "failed"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead"
+)
+
+type Subscription struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types"`
+	Secret     string    `json:"secret,omitempty"`
+	Active     bool      `json:"active"`
+	Created    time.Time `json:"created"`
+	// TenantID is the tenant whose events the subscription receives. It is
+	// taken from the request on create and never changes.
+	TenantID string `json:"tenant_id,omitempty"`
+}
+
+// Delivery is one attempt series of sending an event to a subscription.
+// Failed deliveries are retried until they succeed or become dead.
+type Delivery struct {
+	ID             int64           `json:"id"`
+	SubscriptionID int             `json:"subscription_id"`
+	MessageID      int64           `json:"message_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastError      string          `json:"last_error,omitempty"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	Created        time.Time       `json:"created"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// ClaimedDelivery is a delivery a dispatcher holds the lease of, with the
+// subscription it goes to.
+type ClaimedDelivery struct {
+	Subscription *Subscription
+	Delivery     *Delivery
+}
+
+// DeliveryResult is the outcome of one attempt, recorded on the delivery.
+type DeliveryResult struct {
+	Status         string
+	ResponseStatus int
+	Error          string
+	NextAttemptAt  time.Time
+}
+
+// Event is the JSON body posted to subscribers.
+type Event struct {
+	ID      int64           `json:"id"`
+	Type    string          `json:"type"`
+	Created time.Time       `json:"created"`
+	Data    json.RawMessage `json:"data"`
+}
@@ -0,0 +1,25 @@
+package webhookPack
+
+import (
+	"context"
+
+	"user-api/internal/outbox"
+)
+
+// Publisher feeds outbox messages into webhook deliveries. It only records
+// them; the Dispatcher sends them.
+type Publisher struct {
+	repo WebhookRepository
+}
+
+func NewPublisher(repo WebhookRepository) *Publisher {
+	return &Publisher{repo: repo}
+}
+
+func (p *Publisher) Publish(ctx context.Context, msg *outbox.Message) error {
+	return p.repo.EnqueueDeliveries(ctx, msg)
+}
+
+func (p *Publisher) Close() error {
+	return nil
+}
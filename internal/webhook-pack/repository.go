@@ -0,0 +1,326 @@
+package webhookPack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"user-api/internal/outbox"
+	"user-api/internal/reqctx"
+	"user-api/internal/tenant"
+)
+
+var (
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	ErrDeliveryNotFound     = errors.New("delivery not found")
+)
+
+type WebhookRepository interface {
+	CreateSubscription(ctx context.Context, sub *Subscription) error
+	GetSubscription(ctx context.Context, id int) (*Subscription, error)
+	ListSubscriptions(ctx context.Context) ([]*Subscription, error)
+	UpdateSubscription(ctx context.Context, id int, sub *Subscription) error
+	DeleteSubscription(ctx context.Context, id int) error
+
+	// EnqueueDeliveries creates a pending delivery of msg for every active
+	// subscription to its type. It is idempotent per message.
+	EnqueueDeliveries(ctx context.Context, msg *outbox.Message) error
+	ListDeliveries(ctx context.Context, subscriptionID int, status string, limit, offset int) ([]*Delivery, error)
+	ReplayDelivery(ctx context.Context, subscriptionID int, id int64) error
+	// ClaimDueDeliveries leases up to limit due deliveries for lease and
+	// returns them with their subscriptions. Other dispatchers skip them
+	// until the lease runs out, so deliveries of a dispatcher that dies
+	// while sending are retried.
+	ClaimDueDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*ClaimedDelivery, error)
+	// RecordDeliveries records the results of claimed deliveries. Results
+	// of deliveries whose lease ran out are dropped.
+	RecordDeliveries(ctx context.Context, claimed []*ClaimedDelivery, results []DeliveryResult) error
+}
+
+// PostgresWebhookRepository keeps subscriptions and their deliveries per
+// tenant. Requests only see those of their tenant; the outbox fans events
+// out in a transaction scoped to the tenant in the payload, and the
+// dispatcher works on the deliveries of every tenant.
+type PostgresWebhookRepository struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresWebhookRepository(db *pgxpool.Pool) *PostgresWebhookRepository {
+	return &PostgresWebhookRepository{db: db}
+}
+
+// withTx runs fn in a transaction set up by scope, tenant.Scope for
+// requests.
+func (r *PostgresWebhookRepository) withTx(ctx context.Context, op string, scope func(context.Context, pgx.Tx) error, fn func(tx pgx.Tx) error) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := scope(ctx, tx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+	return nil
+}
+
+func (r *PostgresWebhookRepository) CreateSubscription(ctx context.Context, sub *Subscription) error {
+	sub.TenantID = reqctx.FromContext(ctx).Tenant()
+	return r.withTx(ctx, "CreateSubscription", tenant.Scope, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "INSERT INTO webhook_subscriptions (url, event_types, secret, active, created, tenant_id) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+			sub.URL, sub.EventTypes, sub.Secret, sub.Active, sub.Created, sub.TenantID).Scan(&sub.ID)
+		if err != nil {
+			return fmt.Errorf("CreateSubscription: failed to insert subscription: %w", err)
+		}
+		return nil
+	})
+}
+
+func (r *PostgresWebhookRepository) GetSubscription(ctx context.Context, id int) (*Subscription, error) {
+	var sub Subscription
+	err := r.withTx(ctx, "GetSubscription", tenant.Scope, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, "SELECT id, url, event_types, secret, active, created, tenant_id FROM webhook_subscriptions WHERE id = $1", id).
+			Scan(&sub.ID, &sub.URL, &sub.EventTypes, &sub.Secret, &sub.Active, &sub.Created, &sub.TenantID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrSubscriptionNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("GetSubscription: failed to query subscription with id %d: %w", id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (r *PostgresWebhookRepository) ListSubscriptions(ctx context.Context) ([]*Subscription, error) {
+	var subs []*Subscription
+	err := r.withTx(ctx, "ListSubscriptions", tenant.Scope, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT id, url, event_types, secret, active, created, tenant_id FROM webhook_subscriptions ORDER BY id")
+		if err != nil {
+			return fmt.Errorf("ListSubscriptions: failed to query subscriptions: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var sub Subscription
+			if err := rows.Scan(&sub.ID, &sub.URL, &sub.EventTypes, &sub.Secret, &sub.Active, &sub.Created, &sub.TenantID); err != nil {
+				return fmt.Errorf("ListSubscriptions: failed to scan subscription: %w", err)
+			}
+			subs = append(subs, &sub)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("ListSubscriptions: failed to read subscriptions: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subs, nil
+}
+
+func (r *PostgresWebhookRepository) UpdateSubscription(ctx context.Context, id int, sub *Subscription) error {
+	return r.withTx(ctx, "UpdateSubscription", tenant.Scope, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "UPDATE webhook_subscriptions SET url = $1, event_types = $2, secret = $3, active = $4 WHERE id = $5",
+			sub.URL, sub.EventTypes, sub.Secret, sub.Active, id)
+		if err != nil {
+			return fmt.Errorf("UpdateSubscription: failed to update subscription with id %d: %w", id, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrSubscriptionNotFound
+		}
+		return nil
+	})
+}
+
+func (r *PostgresWebhookRepository) DeleteSubscription(ctx context.Context, id int) error {
+	return r.withTx(ctx, "DeleteSubscription", tenant.Scope, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "DELETE FROM webhook_subscriptions WHERE id = $1", id)
+		if err != nil {
+			return fmt.Errorf("DeleteSubscription: failed to delete subscription with id %d: %w", id, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrSubscriptionNotFound
+		}
+		return nil
+	})
+}
+
+// EnqueueDeliveries only fans msg out to subscriptions of the tenant named
+// by the tenant_id of its payload. Messages without one, such as IP
+// lockouts, go to no subscription.
+func (r *PostgresWebhookRepository) EnqueueDeliveries(ctx context.Context, msg *outbox.Message) error {
+	var payload struct {
+		TenantID string `json:"tenant_id"`
+	}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return fmt.Errorf("EnqueueDeliveries: failed to decode payload of message %d: %w", msg.ID, err)
+	}
+	if payload.TenantID == "" {
+		return nil
+	}
+	ctx = reqctx.WithTenant(ctx, payload.TenantID)
+	return r.withTx(ctx, "EnqueueDeliveries", tenant.Scope, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO webhook_deliveries (subscription_id, message_id, event_type, payload, tenant_id)
+			SELECT id, $1, $2, $3, tenant_id FROM webhook_subscriptions WHERE active AND $2 = ANY(event_types) AND tenant_id = $4
+			ON CONFLICT (subscription_id, message_id) DO NOTHING`,
+			msg.ID, msg.Type, []byte(msg.Payload), payload.TenantID)
+		if err != nil {
+			return fmt.Errorf("EnqueueDeliveries: failed to enqueue message %d: %w", msg.ID, err)
+		}
+		return nil
+	})
+}
+
+const deliveryColumns = "id, subscription_id, message_id, event_type, payload, status, attempts, next_attempt_at, COALESCE(last_error, ''), COALESCE(response_status, 0), created, delivered_at"
+
+func scanDelivery(row pgx.Row) (*Delivery, error) {
+	var d Delivery
+	err := row.Scan(&d.ID, &d.SubscriptionID, &d.MessageID, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.LastError, &d.ResponseStatus, &d.Created, &d.DeliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (r *PostgresWebhookRepository) ListDeliveries(ctx context.Context, subscriptionID int, status string, limit, offset int) ([]*Delivery, error) {
+	var deliveries []*Delivery
+	err := r.withTx(ctx, "ListDeliveries", tenant.Scope, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE subscription_id = $1 AND ($2 = '' OR status = $2) ORDER BY id DESC LIMIT $3 OFFSET $4",
+			subscriptionID, status, limit, offset)
+		if err != nil {
+			return fmt.Errorf("ListDeliveries: failed to query deliveries: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			d, err := scanDelivery(rows)
+			if err != nil {
+				return fmt.Errorf("ListDeliveries: failed to scan delivery: %w", err)
+			}
+			deliveries = append(deliveries, d)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("ListDeliveries: failed to read deliveries: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (r *PostgresWebhookRepository) ReplayDelivery(ctx context.Context, subscriptionID int, id int64) error {
+	return r.withTx(ctx, "ReplayDelivery", tenant.Scope, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "UPDATE webhook_deliveries SET status = $1, attempts = 0, next_attempt_at = now(), last_error = NULL WHERE id = $2 AND subscription_id = $3",
+			DeliveryPending, id, subscriptionID)
+		if err != nil {
+			return fmt.Errorf("ReplayDelivery: failed to reset delivery %d: %w", id, err)
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrDeliveryNotFound
+		}
+		return nil
+	})
+}
+
+// ClaimDueDeliveries commits the lease before the deliveries are sent, so
+// no transaction stays open while receivers answer. The lease moves
+// next_attempt_at, which RecordDeliveries checks to tell whether the
+// delivery is still ours.
+func (r *PostgresWebhookRepository) ClaimDueDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*ClaimedDelivery, error) {
+	var claimed []*ClaimedDelivery
+	err := r.withTx(ctx, "ClaimDueDeliveries", tenant.All, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `
+			WITH due AS (
+				SELECT d.id
+				FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id
+				WHERE d.status IN ('pending', 'failed') AND d.next_attempt_at <= now() AND s.active
+				ORDER BY d.id
+				LIMIT $1
+				FOR UPDATE OF d SKIP LOCKED
+			)
+			UPDATE webhook_deliveries d SET next_attempt_at = now() + $2::interval
+			FROM due, webhook_subscriptions s
+			WHERE d.id = due.id AND s.id = d.subscription_id
+			RETURNING d.id, d.subscription_id, d.message_id, d.event_type, d.payload, d.status, d.attempts, d.next_attempt_at,
+				COALESCE(d.last_error, ''), COALESCE(d.response_status, 0), d.created, d.delivered_at,
+				s.url, s.secret, s.tenant_id`, limit, lease)
+		if err != nil {
+			return fmt.Errorf("ClaimDueDeliveries: failed to claim deliveries: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var d Delivery
+			sub := Subscription{Active: true}
+			err := rows.Scan(&d.ID, &d.SubscriptionID, &d.MessageID, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+				&d.NextAttemptAt, &d.LastError, &d.ResponseStatus, &d.Created, &d.DeliveredAt, &sub.URL, &sub.Secret, &sub.TenantID)
+			if err != nil {
+				return fmt.Errorf("ClaimDueDeliveries: failed to scan delivery: %w", err)
+			}
+			sub.ID = d.SubscriptionID
+			claimed = append(claimed, &ClaimedDelivery{Subscription: &sub, Delivery: &d})
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("ClaimDueDeliveries: failed to read deliveries: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].Delivery.ID < claimed[j].Delivery.ID })
+	return claimed, nil
+}
+
+func (r *PostgresWebhookRepository) RecordDeliveries(ctx context.Context, claimed []*ClaimedDelivery, results []DeliveryResult) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("RecordDeliveries: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := tenant.All(ctx, tx); err != nil {
+		return fmt.Errorf("RecordDeliveries: %w", err)
+	}
+	for i, c := range claimed {
+		result := results[i]
+		tag, err := tx.Exec(ctx, `
+			UPDATE webhook_deliveries
+			SET status = $1, attempts = attempts + 1, next_attempt_at = $2, last_error = NULLIF($3, ''),
+				response_status = NULLIF($4, 0), delivered_at = CASE WHEN $1 = 'succeeded' THEN now() END
+			WHERE id = $5 AND next_attempt_at = $6`,
+			result.Status, result.NextAttemptAt, result.Error, result.ResponseStatus, c.Delivery.ID, c.Delivery.NextAttemptAt)
+		if err != nil {
+			return fmt.Errorf("RecordDeliveries: failed to record delivery %d: %w", c.Delivery.ID, err)
+		}
+		if tag.RowsAffected() == 0 {
+			log.Printf("RecordDeliveries: lease of delivery %d ran out or it was replayed, dropping the result", c.Delivery.ID)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("RecordDeliveries: failed to commit transaction: %w", err)
+	}
+	return nil
+}
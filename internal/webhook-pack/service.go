@@ -0,0 +1,99 @@
+package webhookPack
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+type WebhookService struct {
+	repo WebhookRepository
+}
+
+func NewWebhookService(repo WebhookRepository) *WebhookService {
+	return &WebhookService{repo: repo}
+}
+
+// CreateSubscription stores sub, generating a secret if none was given. The
+// secret is only returned here; reads hide it.
+func (s *WebhookService) CreateSubscription(ctx context.Context, sub *Subscription) error {
+	if sub.Secret == "" {
+		secret, err := generateSecret()
+		if err != nil {
+			return err
+		}
+		sub.Secret = secret
+	}
+	sub.Created = time.Now()
+	return s.repo.CreateSubscription(ctx, sub)
+}
+
+func (s *WebhookService) GetSubscription(ctx context.Context, id int) (*Subscription, error) {
+	sub, err := s.repo.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	sub.Secret = ""
+	return sub, nil
+}
+
+func (s *WebhookService) ListSubscriptions(ctx context.Context) ([]*Subscription, error) {
+	subs, err := s.repo.ListSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		sub.Secret = ""
+	}
+	return subs, nil
+}
+
+// UpdateSubscription applies update to the stored subscription. update is
+// called with the current record so callers can patch it in place; an empty
+// secret after the update keeps the current one.
+func (s *WebhookService) UpdateSubscription(ctx context.Context, id int, update func(*Subscription) error) (*Subscription, error) {
+	sub, err := s.repo.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	secret := sub.Secret
+	sub.Secret = ""
+	if err := update(sub); err != nil {
+		return nil, err
+	}
+	if sub.Secret == "" {
+		sub.Secret = secret
+	}
+	if err := s.repo.UpdateSubscription(ctx, id, sub); err != nil {
+		return nil, err
+	}
+	sub.Secret = ""
+	return sub, nil
+}
+
+func (s *WebhookService) DeleteSubscription(ctx context.Context, id int) error {
+	return s.repo.DeleteSubscription(ctx, id)
+}
+
+func (s *WebhookService) ListDeliveries(ctx context.Context, subscriptionID int, status string, limit, offset int) ([]*Delivery, error) {
+	if _, err := s.repo.GetSubscription(ctx, subscriptionID); err != nil {
+		return nil, err
+	}
+	return s.repo.ListDeliveries(ctx, subscriptionID, status, limit, offset)
+}
+
+// ReplayDelivery schedules a delivery to be sent again right away with a
+// fresh retry budget, whatever its current status.
+func (s *WebhookService) ReplayDelivery(ctx context.Context, subscriptionID int, id int64) error {
+	return s.repo.ReplayDelivery(ctx, subscriptionID, id)
+}
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,55 @@
+package webhookPack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"user-api/internal/outbox"
+)
+
+var eventTypes = map[string]bool{
+	outbox.EventUserCreated: true,
+	outbox.EventUserUpdated: true,
+	outbox.EventUserDeleted: true,
+
+	outbox.EventSecurityLockout: true,
+	outbox.EventSecurityUnlock:  true,
+}
+
+var ErrPrivateAddress = errors.New("webhook receivers must not be on loopback, link-local or private addresses")
+
+// privateIP reports whether ip is an address a webhook must not reach from
+// inside the network: loopback, link-local (cloud metadata services live on
+// 169.254.169.254), RFC 1918 and unique local ranges, and the unspecified
+// address.
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// ValidateSubscription rejects URLs naming a private address or localhost.
+// Host names resolving to one are refused by the dispatcher when it dials.
+func ValidateSubscription(sub *Subscription) error {
+	if sub.URL == "" || len(sub.EventTypes) == 0 {
+		return fmt.Errorf("url and event_types are required")
+	}
+	u, err := url.Parse(sub.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrPrivateAddress
+	}
+	if ip := net.ParseIP(host); ip != nil && privateIP(ip) {
+		return ErrPrivateAddress
+	}
+	for _, eventType := range sub.EventTypes {
+		if !eventTypes[eventType] {
+			return fmt.Errorf("unknown event type %q", eventType)
+		}
+	}
+	return nil
+}
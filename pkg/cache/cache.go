@@ -0,0 +1,17 @@
+// Package cache stores encoded values with a time to live, either in
+// process with least recently used eviction or in Redis, where all
+// instances share them.
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+type Cache interface {
+	// Get returns the value of key, and false if there is none or it
+	// expired.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+}
@@ -0,0 +1,145 @@
+// Package certreload keeps a TLS certificate and a client CA bundle loaded
+// from files and reloads them when the files change, so certificates can be
+// rotated without a restart.
+package certreload
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type Reloader struct {
+	certFile, keyFile, caFile string
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	pool  *x509.CertPool
+	stamp string
+}
+
+// New loads the certificate and key, and the CA bundle client certificates
+// are verified against if caFile is not empty.
+func New(certFile, keyFile, caFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. On error the loaded certificates are kept.
+func (r *Reloader) Reload() error {
+	stamp, err := r.fileStamp()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in CA bundle %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.pool, r.stamp = &cert, pool, stamp
+	r.mu.Unlock()
+	return nil
+}
+
+// Run reloads the files every interval if they have changed, until ctx is
+// done. Files are compared by size and modification time, which also
+// notices the symlink swaps of mounted Kubernetes secrets.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stamp, err := r.fileStamp()
+		if err != nil {
+			log.Printf("certreload: %v", err)
+			continue
+		}
+		r.mu.RLock()
+		changed := stamp != r.stamp
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		// A rotation writes several files; a half-written pair fails to
+		// load and is retried on the next tick.
+		if err := r.Reload(); err != nil {
+			log.Printf("certreload: %v", err)
+			continue
+		}
+		log.Printf("certreload: reloaded %s", r.certFile)
+	}
+}
+
+func (r *Reloader) fileStamp() (string, error) {
+	var stamp string
+	for _, name := range []string{r.certFile, r.keyFile, r.caFile} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%s:%d:%d;", name, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return stamp, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ClientCAs returns the current CA bundle, nil without one.
+func (r *Reloader) ClientCAs() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
+
+// TLSConfig returns a server configuration that picks up reloaded
+// certificates on the next handshake. clientAuth decides whether clients
+// must present a certificate signed by the CA bundle.
+func (r *Reloader) TLSConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	base := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: r.GetCertificate,
+		ClientAuth:     clientAuth,
+	}
+	// ClientCAs has no callback, so every handshake gets a copy of the
+	// configuration with the bundle loaded at that time.
+	config := base.Clone()
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.ClientCAs = r.ClientCAs()
+		return c, nil
+	}
+	return config
+}
@@ -0,0 +1,383 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	Server        ServerConfig
+	GRPC          GRPCConfig
+	Watch         WatchConfig
+	Outbox        OutboxConfig
+	Webhooks      WebhooksConfig
+	Password      PasswordConfig
+	Tokens        TokensConfig
+	MFA           MFAConfig
+	Mail          MailConfig
+	Email         EmailConfig
+	PasswordReset PasswordResetConfig
+	Lockout       LockoutConfig
+	SCIM          SCIMConfig
+	GraphQL       GraphQLConfig
+	RateLimit     RateLimitConfig
+	UserCache     UserCacheConfig
+	HTTPCache     HTTPCacheConfig
+	Compression   CompressionConfig
+}
+
+type ServerConfig struct {
+	// Mode is "single" to serve REST, gRPC, gRPC-Web and Connect on Addr,
+	// or "dual" to serve gRPC on GRPCAddr and the rest on Addr.
+	Mode     string
+	Addr     string
+	GRPCAddr string
+	// TLSCertFile and TLSKeyFile turn on TLS for Addr and GRPCAddr; gRPC
+	// clients then negotiate HTTP/2 through ALPN instead of using h2c. The
+	// files are reloaded every TLSReloadInterval if they changed.
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSReloadInterval time.Duration
+	// TLSClientAuth is "none", "optional" or "require": whether clients
+	// may or must present a certificate signed by TLSClientCAFile.
+	TLSClientAuth   string
+	TLSClientCAFile string
+	// ClientCertRoles gives principals of client certificates their roles,
+	// as comma separated principal=role|role pairs.
+	ClientCertRoles string
+	// AllowedOrigins lists the origins browsers may call gRPC-Web and
+	// Connect from, comma separated; "*" allows any.
+	AllowedOrigins string
+	// TrustedProxies lists the proxies, as comma separated IP addresses or
+	// CIDR ranges, whose X-Actor and X-Actor-Roles headers are honoured.
+	TrustedProxies string
+}
+
+type GRPCConfig struct {
+	// BatchChunkSize is the number of users BatchCreateUsers commits per transaction.
+	BatchChunkSize int
+}
+
+type WatchConfig struct {
+	// HeartbeatInterval is how often idle change feeds send a heartbeat.
+	HeartbeatInterval time.Duration
+	// Retention is how long change events are kept for resuming feeds.
+	Retention time.Duration
+}
+
+type OutboxConfig struct {
+	// Publisher selects the broker outbox events go to besides webhooks:
+	// "stdout", "file", "nats", "kafka" or "none". It has to be chosen
+	// explicitly; by default events only reach webhooks.
+	Publisher string
+	File      string
+
+	NATSURL           string
+	NATSSubjectPrefix string
+
+	KafkaBrokers string
+	KafkaTopic   string
+
+	BatchSize    int
+	PollInterval time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	Retention    time.Duration
+}
+
+type WebhooksConfig struct {
+	BatchSize    int
+	PollInterval time.Duration
+	Timeout      time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	MaxAttempts  int
+	// AllowPrivateNetworks lets deliveries reach loopback and private
+	// addresses. Only meant for local development.
+	AllowPrivateNetworks bool
+}
+
+// PasswordConfig holds the Argon2id parameters for new password hashes.
+// Existing hashes are upgraded to them on the next successful login.
+type PasswordConfig struct {
+	Memory      int
+	Iterations  int
+	Parallelism int
+}
+
+type TokensConfig struct {
+	Issuer   string
+	Audience string
+	// SigningAlgorithm is "EdDSA" or "RS256".
+	SigningAlgorithm string
+	// KeyRotationInterval is how long a signing key is used before a new one
+	// is generated. Retired keys stay in the JWKS until tokens they signed
+	// have expired.
+	KeyRotationInterval time.Duration
+	AccessTokenTTL      time.Duration
+	RefreshTokenTTL     time.Duration
+}
+
+type MFAConfig struct {
+	// EncryptionKey is the base64 encoded 32 byte AES key TOTP secrets are
+	// encrypted with. Enrollment is disabled while it is unset.
+	EncryptionKey string
+	// Issuer labels the account in authenticator apps.
+	Issuer string
+}
+
+type MailConfig struct {
+	// Mailer selects how mail is sent: "log", "file" or "smtp".
+	Mailer string
+	File   string
+
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	From         string
+	Timeout      time.Duration
+}
+
+type EmailConfig struct {
+	// VerificationURL is linked from verification mails.
+	VerificationURL string
+	TokenTTL        time.Duration
+	// TokenSecret signs verification tokens. If unset a random one is used,
+	// and links stop working when the service restarts.
+	TokenSecret string
+}
+
+type PasswordResetConfig struct {
+	// URL is linked from password reset mails.
+	URL      string
+	TokenTTL time.Duration
+	// EmailLimit and IPLimit cap reset requests per email address and per
+	// client IP within Window.
+	EmailLimit int
+	IPLimit    int
+	Window     time.Duration
+}
+
+// LockoutConfig sets when failed logins lock an account or client IP out.
+// Lockouts start at BaseDuration and double up to MaxDuration; counters
+// without failures for ResetAfter start over.
+type LockoutConfig struct {
+	AccountThreshold int
+	IPThreshold      int
+	BaseDuration     time.Duration
+	MaxDuration      time.Duration
+	ResetAfter       time.Duration
+}
+
+type SCIMConfig struct {
+	// Tokens lists the bearer tokens of SCIM clients as comma separated
+	// tenant:token pairs. The SCIM endpoints reject everything while it is
+	// unset.
+	Tokens string
+}
+
+type GraphQLConfig struct {
+	// MaxDepth and MaxComplexity reject queries that nest too deep or
+	// select too much before anything is resolved.
+	MaxDepth      int
+	MaxComplexity int
+	// PersistedQueries is the number of persisted queries kept in memory.
+	PersistedQueries int
+}
+
+type RateLimitConfig struct {
+	// Backend is "memory" for limits per instance or "postgres" for limits
+	// shared by all instances.
+	Backend string
+	// Rules are comma separated rule=limit pairs. A rule is a route such as
+	// "POST /users", an RPC such as "/user.UserService/CreateUser", or "*"
+	// for everything else; a limit is N/s, N/m, N/h or N/d, optionally
+	// followed by ":burst". No rules means no limits.
+	Rules string
+	// DailyCreateQuota caps the users a tenant may create per day, 0 for
+	// no cap. TenantCreateQuotas overrides it as tenant=quota pairs.
+	DailyCreateQuota   int
+	TenantCreateQuotas string
+}
+
+type UserCacheConfig struct {
+	// Backend is "memory" for a cache per instance, "redis" for one shared
+	// through RedisURL, or "none".
+	Backend string
+	// Size is the number of users the memory cache holds.
+	Size     int
+	TTL      time.Duration
+	RedisURL string
+}
+
+type HTTPCacheConfig struct {
+	// UserCacheControl and ListCacheControl are the Cache-Control headers
+	// of a user and of pages of lists about users. The default lets
+	// clients keep responses but makes them revalidate with the ETag.
+	UserCacheControl string
+	ListCacheControl string
+}
+
+type CompressionConfig struct {
+	// Encodings are the comma separated content codings (zstd, gzip) user
+	// responses may be compressed with, in order of preference. Empty
+	// disables compression.
+	Encodings string
+	// MinSize is the smallest body worth compressing, in bytes.
+	MinSize int
+}
+
+// Load reads the configuration from environment variables, falling back to
+// defaults for anything that is unset or malformed.
+func Load() Config {
+	return Config{
+		Server: ServerConfig{
+			Mode:              getEnv("SERVER_MODE", "single"),
+			Addr:              getEnv("SERVER_ADDR", ":8080"),
+			GRPCAddr:          getEnv("GRPC_ADDR", ":50051"),
+			TLSCertFile:       getEnv("TLS_CERT_FILE", ""),
+			TLSKeyFile:        getEnv("TLS_KEY_FILE", ""),
+			TLSReloadInterval: getEnvDuration("TLS_RELOAD_INTERVAL", 10*time.Second),
+			TLSClientAuth:     getEnv("TLS_CLIENT_AUTH", "none"),
+			TLSClientCAFile:   getEnv("TLS_CLIENT_CA_FILE", ""),
+			ClientCertRoles:   getEnv("CLIENT_CERT_ROLES", ""),
+			AllowedOrigins:    getEnv("CORS_ALLOWED_ORIGINS", ""),
+			TrustedProxies:    getEnv("TRUSTED_PROXIES", ""),
+		},
+		GRPC: GRPCConfig{
+			BatchChunkSize: getEnvInt("GRPC_BATCH_CHUNK_SIZE", 100),
+		},
+		Watch: WatchConfig{
+			HeartbeatInterval: getEnvDuration("WATCH_HEARTBEAT_INTERVAL", 15*time.Second),
+			Retention:         getEnvDuration("WATCH_RETENTION", 24*time.Hour),
+		},
+		Outbox: OutboxConfig{
+			Publisher:         getEnv("OUTBOX_PUBLISHER", "none"),
+			File:              getEnv("OUTBOX_FILE", "outbox.jsonl"),
+			NATSURL:           getEnv("NATS_URL", "nats://localhost:4222"),
+			NATSSubjectPrefix: getEnv("NATS_SUBJECT_PREFIX", "users"),
+			KafkaBrokers:      getEnv("KAFKA_BROKERS", "localhost:9092"),
+			KafkaTopic:        getEnv("KAFKA_TOPIC", "user-events"),
+			BatchSize:         getEnvInt("OUTBOX_BATCH_SIZE", 100),
+			PollInterval:      getEnvDuration("OUTBOX_POLL_INTERVAL", time.Second),
+			MinBackoff:        getEnvDuration("OUTBOX_MIN_BACKOFF", time.Second),
+			MaxBackoff:        getEnvDuration("OUTBOX_MAX_BACKOFF", 5*time.Minute),
+			Retention:         getEnvDuration("OUTBOX_RETENTION", 7*24*time.Hour),
+		},
+		Webhooks: WebhooksConfig{
+			BatchSize:    getEnvInt("WEBHOOK_BATCH_SIZE", 20),
+			PollInterval: getEnvDuration("WEBHOOK_POLL_INTERVAL", time.Second),
+			Timeout:      getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+			MinBackoff:   getEnvDuration("WEBHOOK_MIN_BACKOFF", 10*time.Second),
+			MaxBackoff:   getEnvDuration("WEBHOOK_MAX_BACKOFF", time.Hour),
+			MaxAttempts:  getEnvInt("WEBHOOK_MAX_ATTEMPTS", 10),
+
+			AllowPrivateNetworks: getEnvBool("WEBHOOK_ALLOW_PRIVATE_NETWORKS", false),
+		},
+		Password: PasswordConfig{
+			Memory:      getEnvInt("ARGON2_MEMORY_KIB", 64*1024),
+			Iterations:  getEnvInt("ARGON2_ITERATIONS", 3),
+			Parallelism: getEnvInt("ARGON2_PARALLELISM", 2),
+		},
+		Tokens: TokensConfig{
+			Issuer:              getEnv("JWT_ISSUER", "user-api"),
+			Audience:            getEnv("JWT_AUDIENCE", "user-api"),
+			SigningAlgorithm:    getEnv("JWT_SIGNING_ALGORITHM", "EdDSA"),
+			KeyRotationInterval: getEnvDuration("JWT_KEY_ROTATION_INTERVAL", 24*time.Hour),
+			AccessTokenTTL:      getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+			RefreshTokenTTL:     getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		},
+		MFA: MFAConfig{
+			EncryptionKey: getEnv("MFA_ENCRYPTION_KEY", ""),
+			Issuer:        getEnv("MFA_ISSUER", "user-api"),
+		},
+		Mail: MailConfig{
+			Mailer:       getEnv("MAILER", "log"),
+			File:         getEnv("MAIL_FILE", "mail.log"),
+			SMTPAddr:     getEnv("SMTP_ADDR", "localhost:25"),
+			SMTPUsername: getEnv("SMTP_USERNAME", ""),
+			SMTPPassword: getEnv("SMTP_PASSWORD", ""),
+			From:         getEnv("MAIL_FROM", "user-api <no-reply@localhost>"),
+			Timeout:      getEnvDuration("SMTP_TIMEOUT", 10*time.Second),
+		},
+		Email: EmailConfig{
+			VerificationURL: getEnv("EMAIL_VERIFICATION_URL", "http://localhost:8080/users:verifyEmail"),
+			TokenTTL:        getEnvDuration("EMAIL_TOKEN_TTL", 24*time.Hour),
+			TokenSecret:     getEnv("EMAIL_TOKEN_SECRET", ""),
+		},
+		PasswordReset: PasswordResetConfig{
+			URL:        getEnv("PASSWORD_RESET_URL", "http://localhost:8080/reset-password"),
+			TokenTTL:   getEnvDuration("PASSWORD_RESET_TOKEN_TTL", 30*time.Minute),
+			EmailLimit: getEnvInt("PASSWORD_RESET_EMAIL_LIMIT", 3),
+			IPLimit:    getEnvInt("PASSWORD_RESET_IP_LIMIT", 10),
+			Window:     getEnvDuration("PASSWORD_RESET_WINDOW", time.Hour),
+		},
+		Lockout: LockoutConfig{
+			AccountThreshold: getEnvInt("LOCKOUT_ACCOUNT_THRESHOLD", 5),
+			IPThreshold:      getEnvInt("LOCKOUT_IP_THRESHOLD", 50),
+			BaseDuration:     getEnvDuration("LOCKOUT_BASE_DURATION", time.Minute),
+			MaxDuration:      getEnvDuration("LOCKOUT_MAX_DURATION", 24*time.Hour),
+			ResetAfter:       getEnvDuration("LOCKOUT_RESET_AFTER", 24*time.Hour),
+		},
+		SCIM: SCIMConfig{
+			Tokens: getEnv("SCIM_TOKENS", ""),
+		},
+		GraphQL: GraphQLConfig{
+			MaxDepth:         getEnvInt("GRAPHQL_MAX_DEPTH", 10),
+			MaxComplexity:    getEnvInt("GRAPHQL_MAX_COMPLEXITY", 1000),
+			PersistedQueries: getEnvInt("GRAPHQL_PERSISTED_QUERIES", 1000),
+		},
+		RateLimit: RateLimitConfig{
+			Backend:            getEnv("RATE_LIMIT_BACKEND", "memory"),
+			Rules:              getEnv("RATE_LIMITS", ""),
+			DailyCreateQuota:   getEnvInt("TENANT_DAILY_CREATE_QUOTA", 0),
+			TenantCreateQuotas: getEnv("TENANT_CREATE_QUOTAS", ""),
+		},
+		UserCache: UserCacheConfig{
+			Backend:  getEnv("USER_CACHE", "memory"),
+			Size:     getEnvInt("USER_CACHE_SIZE", 10000),
+			TTL:      getEnvDuration("USER_CACHE_TTL", time.Minute),
+			RedisURL: getEnv("REDIS_URL", "redis://localhost:6379/0"),
+		},
+		HTTPCache: HTTPCacheConfig{
+			UserCacheControl: getEnv("USER_CACHE_CONTROL", "private, no-cache"),
+			ListCacheControl: getEnv("USER_LIST_CACHE_CONTROL", "private, no-cache"),
+		},
+		Compression: CompressionConfig{
+			Encodings: getEnv("RESPONSE_COMPRESSION", "zstd,gzip"),
+			MinSize:   getEnvInt("RESPONSE_COMPRESSION_MIN_SIZE", 1024),
+		},
+	}
+}
+
+func getEnv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func getEnvInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
+
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
+
+func getEnvBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
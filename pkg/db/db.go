@@ -5,16 +5,17 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
-func InitDB() (*pgx.Conn, error) {
-	dbURL := os.Getenv("DATABASE_URL")
-	db, err := pgx.Connect(context.Background(), dbURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to the database: %w", err)
-	}
-	_, err = db.Exec(context.Background(), `
+// migrationLockID is the advisory lock key that serialises migrations when
+// several instances start at the same time.
+const migrationLockID = 7245001
+
+// migrations are applied in order on every start, so each statement must be
+// idempotent.
+var migrations = []string{
+	`
 		CREATE TABLE IF NOT EXISTS users (
 			id SERIAL PRIMARY KEY,
 			firstname VARCHAR(100) NOT NULL,
@@ -23,9 +24,725 @@ func InitDB() (*pgx.Conn, error) {
 			age INT,
 			created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)
-	`)
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS user_events (
+			id BIGSERIAL PRIMARY KEY,
+			event_type VARCHAR(16) NOT NULL,
+			user_id INT NOT NULL,
+			payload JSONB NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`,
+	`
+		CREATE OR REPLACE FUNCTION user_event_payload(u users) RETURNS JSONB AS $$
+			SELECT jsonb_build_object(
+				'id', u.id,
+				'firstname', u.firstname,
+				'lastname', u.lastname,
+				'email', u.email,
+				'age', u.age,
+				'created', to_char(u.created, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')
+			)
+		$$ LANGUAGE sql STABLE
+	`,
+	`
+		CREATE OR REPLACE FUNCTION notify_user_change() RETURNS trigger AS $$
+		DECLARE
+			event_id BIGINT;
+		BEGIN
+			-- Ids must become visible in commit order, otherwise a watcher that
+			-- has already read a later id would skip this one.
+			PERFORM pg_advisory_xact_lock(hashtext('user_events'));
+			IF TG_OP = 'DELETE' THEN
+				INSERT INTO user_events (event_type, user_id, payload)
+				VALUES ('deleted', OLD.id, user_event_payload(OLD)) RETURNING id INTO event_id;
+			ELSIF TG_OP = 'UPDATE' THEN
+				INSERT INTO user_events (event_type, user_id, payload)
+				VALUES ('updated', NEW.id, user_event_payload(NEW)) RETURNING id INTO event_id;
+			ELSE
+				INSERT INTO user_events (event_type, user_id, payload)
+				VALUES ('created', NEW.id, user_event_payload(NEW)) RETURNING id INTO event_id;
+			END IF;
+			PERFORM pg_notify('user_events', event_id::text);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql
+	`,
+	`DROP TRIGGER IF EXISTS users_notify_change ON users`,
+	`
+		CREATE TRIGGER users_notify_change
+		AFTER INSERT OR DELETE OR UPDATE OF firstname, lastname, email, age ON users
+		FOR EACH ROW EXECUTE FUNCTION notify_user_change()
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS outbox (
+			id BIGSERIAL PRIMARY KEY,
+			aggregate_id TEXT NOT NULL,
+			event_type VARCHAR(64) NOT NULL,
+			payload JSONB NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			attempts INT NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			last_error TEXT,
+			published_at TIMESTAMPTZ
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (aggregate_id, id) WHERE published_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS outbox_published_idx ON outbox (published_at) WHERE published_at IS NOT NULL`,
+	`
+		CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+			id SERIAL PRIMARY KEY,
+			url TEXT NOT NULL,
+			event_types TEXT[] NOT NULL,
+			secret TEXT NOT NULL,
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			created TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id BIGSERIAL PRIMARY KEY,
+			subscription_id INT NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+			message_id BIGINT NOT NULL,
+			event_type VARCHAR(64) NOT NULL,
+			payload JSONB NOT NULL,
+			status VARCHAR(16) NOT NULL DEFAULT 'pending',
+			attempts INT NOT NULL DEFAULT 0,
+			next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			last_error TEXT,
+			response_status INT,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			delivered_at TIMESTAMPTZ,
+			UNIQUE (subscription_id, message_id)
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status IN ('pending', 'failed')`,
+	`
+		CREATE TABLE IF NOT EXISTS user_audit (
+			id BIGSERIAL PRIMARY KEY,
+			user_id INT NOT NULL,
+			action VARCHAR(16) NOT NULL,
+			actor TEXT NOT NULL,
+			request_id TEXT NOT NULL,
+			source VARCHAR(16) NOT NULL,
+			changes JSONB NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS user_audit_user_idx ON user_audit (user_id, id)`,
+	`
+		CREATE OR REPLACE FUNCTION user_audit_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'user_audit is append-only';
+		END;
+		$$ LANGUAGE plpgsql
+	`,
+	`DROP TRIGGER IF EXISTS user_audit_append_only ON user_audit`,
+	`
+		CREATE TRIGGER user_audit_append_only
+		BEFORE UPDATE OR DELETE OR TRUNCATE ON user_audit
+		FOR EACH STATEMENT EXECUTE FUNCTION user_audit_append_only()
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS users_history (
+			user_id INT NOT NULL,
+			version INT NOT NULL,
+			firstname VARCHAR(100) NOT NULL,
+			lastname VARCHAR(100) NOT NULL,
+			email VARCHAR(100) NOT NULL,
+			age INT,
+			created TIMESTAMP,
+			valid_from TIMESTAMPTZ NOT NULL,
+			valid_to TIMESTAMPTZ NOT NULL DEFAULT 'infinity',
+			PRIMARY KEY (user_id, version)
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS users_history_validity_idx ON users_history (user_id, valid_from, valid_to)`,
+	`
+		INSERT INTO users_history (user_id, version, firstname, lastname, email, age, created, valid_from)
+		SELECT id, 1, firstname, lastname, email, age, created, COALESCE(created, now())
+		FROM users u
+		WHERE NOT EXISTS (SELECT 1 FROM users_history h WHERE h.user_id = u.id)
+	`,
+	`
+		CREATE OR REPLACE FUNCTION users_history_trigger() RETURNS trigger AS $$
+		BEGIN
+			IF TG_OP IN ('UPDATE', 'DELETE') THEN
+				UPDATE users_history SET valid_to = now() WHERE user_id = OLD.id AND valid_to = 'infinity';
+			END IF;
+			IF TG_OP IN ('INSERT', 'UPDATE') THEN
+				INSERT INTO users_history (user_id, version, firstname, lastname, email, age, created, valid_from)
+				SELECT NEW.id, COALESCE(MAX(version), 0) + 1, NEW.firstname, NEW.lastname, NEW.email, NEW.age, NEW.created, now()
+				FROM users_history WHERE user_id = NEW.id;
+			END IF;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql
+	`,
+	`DROP TRIGGER IF EXISTS users_history ON users`,
+	`
+		CREATE TRIGGER users_history
+		AFTER INSERT OR DELETE OR UPDATE OF firstname, lastname, email, age ON users
+		FOR EACH ROW EXECUTE FUNCTION users_history_trigger()
+	`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash TEXT`,
+	`
+		CREATE TABLE IF NOT EXISTS signing_keys (
+			id TEXT PRIMARY KEY,
+			algorithm TEXT NOT NULL,
+			private_key BYTEA NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id BIGSERIAL PRIMARY KEY,
+			token_hash BYTEA NOT NULL UNIQUE,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			family_id TEXT NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ,
+			revoked_at TIMESTAMPTZ
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family_id)`,
+	`CREATE INDEX IF NOT EXISTS refresh_tokens_user_idx ON refresh_tokens (user_id) WHERE revoked_at IS NULL`,
+	`
+		CREATE TABLE IF NOT EXISTS mfa_totp (
+			user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			secret BYTEA NOT NULL,
+			last_counter BIGINT NOT NULL DEFAULT 0,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			confirmed_at TIMESTAMPTZ
+		)
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			code_hash BYTEA NOT NULL,
+			used_at TIMESTAMPTZ,
+			PRIMARY KEY (user_id, code_hash)
+		)
+	`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email VARCHAR(100)`,
+	`
+		CREATE TABLE IF NOT EXISTS email_token_uses (
+			id TEXT PRIMARY KEY,
+			expires_at TIMESTAMPTZ NOT NULL
+		)
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS password_reset_tokens (
+			token_hash BYTEA PRIMARY KEY,
+			user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			used_at TIMESTAMPTZ
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS password_reset_tokens_user_idx ON password_reset_tokens (user_id)`,
+	`
+		CREATE TABLE IF NOT EXISTS auth_throttle (
+			key TEXT NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS auth_throttle_key_idx ON auth_throttle (key, created)`,
+	`CREATE INDEX IF NOT EXISTS auth_throttle_created_idx ON auth_throttle (created)`,
+	`
+		CREATE TABLE IF NOT EXISTS login_failures (
+			key TEXT PRIMARY KEY,
+			failures INTEGER NOT NULL DEFAULT 0,
+			lockouts INTEGER NOT NULL DEFAULT 0,
+			last_failure TIMESTAMPTZ NOT NULL DEFAULT now(),
+			locked_until TIMESTAMPTZ
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS login_failures_locked_idx ON login_failures (locked_until) WHERE locked_until IS NOT NULL`,
+	`
+		CREATE TABLE IF NOT EXISTS security_events (
+			id BIGSERIAL PRIMARY KEY,
+			event_type VARCHAR(32) NOT NULL,
+			subject TEXT NOT NULL,
+			user_id INT,
+			actor TEXT NOT NULL,
+			request_id TEXT NOT NULL,
+			source VARCHAR(16) NOT NULL,
+			details JSONB NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS security_events_subject_idx ON security_events (subject, id)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'active'`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS status_reason TEXT`,
+	`ALTER TABLE users DROP CONSTRAINT IF EXISTS users_status_check`,
+	`ALTER TABLE users ADD CONSTRAINT users_status_check CHECK (status IN ('pending', 'active', 'suspended', 'deactivated'))`,
+	`
+		CREATE OR REPLACE FUNCTION user_event_payload(u users) RETURNS JSONB AS $$
+			SELECT jsonb_build_object(
+				'id', u.id,
+				'firstname', u.firstname,
+				'lastname', u.lastname,
+				'email', u.email,
+				'age', u.age,
+				'created', to_char(u.created, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+				'status', u.status
+			)
+		$$ LANGUAGE sql STABLE
+	`,
+	`DROP TRIGGER IF EXISTS users_notify_change ON users`,
+	`
+		CREATE TRIGGER users_notify_change
+		AFTER INSERT OR DELETE OR UPDATE OF firstname, lastname, email, age, status ON users
+		FOR EACH ROW EXECUTE FUNCTION notify_user_change()
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS organizations (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			slug VARCHAR(63) NOT NULL,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			CONSTRAINT organizations_slug_key UNIQUE (slug)
+		)
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS organization_members (
+			org_id INT NOT NULL,
+			user_id INT NOT NULL,
+			role VARCHAR(16) NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (org_id, user_id),
+			CONSTRAINT organization_members_org_id_fkey FOREIGN KEY (org_id) REFERENCES organizations (id) ON DELETE CASCADE,
+			CONSTRAINT organization_members_user_id_fkey FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS organization_members_user_idx ON organization_members (user_id, org_id)`,
+	`
+		CREATE TABLE IF NOT EXISTS teams (
+			id SERIAL PRIMARY KEY,
+			org_id INT NOT NULL,
+			name VARCHAR(100) NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			CONSTRAINT teams_org_id_fkey FOREIGN KEY (org_id) REFERENCES organizations (id) ON DELETE CASCADE,
+			CONSTRAINT teams_org_id_name_key UNIQUE (org_id, name),
+			CONSTRAINT teams_id_org_id_key UNIQUE (id, org_id)
+		)
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS team_members (
+			team_id INT NOT NULL,
+			org_id INT NOT NULL,
+			user_id INT NOT NULL,
+			role VARCHAR(16) NOT NULL CHECK (role IN ('maintainer', 'member')),
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			PRIMARY KEY (team_id, user_id),
+			CONSTRAINT team_members_team_fkey FOREIGN KEY (team_id, org_id) REFERENCES teams (id, org_id) ON DELETE CASCADE,
+			CONSTRAINT team_members_member_fkey FOREIGN KEY (org_id, user_id) REFERENCES organization_members (org_id, user_id) ON DELETE CASCADE
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS team_members_member_idx ON team_members (org_id, user_id)`,
+	`
+		CREATE OR REPLACE FUNCTION keep_organization_owner() RETURNS trigger AS $$
+		BEGIN
+			-- Only deletes the API did not check get here: a deleted user was
+			-- the last owner. Promote the oldest admin, else the oldest member,
+			-- and drop the organization once nobody is left. When the
+			-- organization itself is deleted nothing is found either way.
+			IF OLD.role <> 'owner' OR EXISTS (
+				SELECT 1 FROM organization_members WHERE org_id = OLD.org_id AND role = 'owner'
+			) THEN
+				RETURN NULL;
+			END IF;
+			UPDATE organization_members SET role = 'owner'
+			WHERE org_id = OLD.org_id AND user_id = (
+				SELECT user_id FROM organization_members WHERE org_id = OLD.org_id
+				ORDER BY role = 'admin' DESC, created, user_id LIMIT 1
+			);
+			IF NOT FOUND THEN
+				DELETE FROM organizations WHERE id = OLD.org_id;
+			END IF;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql
+	`,
+	`DROP TRIGGER IF EXISTS organization_members_keep_owner ON organization_members`,
+	`
+		CREATE TRIGGER organization_members_keep_owner
+		AFTER DELETE ON organization_members
+		FOR EACH ROW EXECUTE FUNCTION keep_organization_owner()
+	`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default'`,
+	`ALTER TABLE users ALTER COLUMN tenant_id DROP DEFAULT`,
+	`ALTER TABLE users_history ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default'`,
+	`ALTER TABLE users_history ALTER COLUMN tenant_id DROP DEFAULT`,
+	`ALTER TABLE user_audit ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default'`,
+	`ALTER TABLE user_audit ALTER COLUMN tenant_id DROP DEFAULT`,
+	`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default'`,
+	`ALTER TABLE password_reset_tokens ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default'`,
+	// Emails are unique per tenant.
+	`ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_tenant_email_key ON users (tenant_id, email)`,
+	`CREATE INDEX IF NOT EXISTS user_audit_tenant_idx ON user_audit (tenant_id)`,
+	`
+		CREATE OR REPLACE FUNCTION users_history_trigger() RETURNS trigger AS $$
+		BEGIN
+			IF TG_OP IN ('UPDATE', 'DELETE') THEN
+				UPDATE users_history SET valid_to = now() WHERE user_id = OLD.id AND valid_to = 'infinity';
+			END IF;
+			IF TG_OP IN ('INSERT', 'UPDATE') THEN
+				INSERT INTO users_history (user_id, version, firstname, lastname, email, age, created, tenant_id, valid_from)
+				SELECT NEW.id, COALESCE(MAX(version), 0) + 1, NEW.firstname, NEW.lastname, NEW.email, NEW.age, NEW.created, NEW.tenant_id, now()
+				FROM users_history WHERE user_id = NEW.id;
+			END IF;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql
+	`,
+	`
+		CREATE OR REPLACE FUNCTION user_event_payload(u users) RETURNS JSONB AS $$
+			SELECT jsonb_build_object(
+				'id', u.id,
+				'firstname', u.firstname,
+				'lastname', u.lastname,
+				'email', u.email,
+				'age', u.age,
+				'created', to_char(u.created, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+				'status', u.status,
+				'tenant_id', u.tenant_id
+			)
+		$$ LANGUAGE sql STABLE
+	`,
+	// Row-level security: a transaction only sees the rows of the tenant in
+	// app.tenant_id, unless app.bypass_rls is on. FORCE applies the
+	// policies to the table owner too.
+	`ALTER TABLE users ENABLE ROW LEVEL SECURITY`,
+	`ALTER TABLE users FORCE ROW LEVEL SECURITY`,
+	`DROP POLICY IF EXISTS tenant_isolation ON users`,
+	`
+		CREATE POLICY tenant_isolation ON users
+		USING (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+		WITH CHECK (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+	`,
+	`ALTER TABLE users_history ENABLE ROW LEVEL SECURITY`,
+	`ALTER TABLE users_history FORCE ROW LEVEL SECURITY`,
+	`DROP POLICY IF EXISTS tenant_isolation ON users_history`,
+	`
+		CREATE POLICY tenant_isolation ON users_history
+		USING (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+		WITH CHECK (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+	`,
+	`ALTER TABLE user_audit ENABLE ROW LEVEL SECURITY`,
+	`ALTER TABLE user_audit FORCE ROW LEVEL SECURITY`,
+	`DROP POLICY IF EXISTS tenant_isolation ON user_audit`,
+	`
+		CREATE POLICY tenant_isolation ON user_audit
+		USING (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+		WITH CHECK (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS scim_users (
+			user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			tenant_id TEXT NOT NULL,
+			external_id TEXT NOT NULL,
+			UNIQUE (tenant_id, external_id)
+		)
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS scim_groups (
+			id SERIAL PRIMARY KEY,
+			tenant_id TEXT NOT NULL,
+			display_name TEXT NOT NULL,
+			external_id TEXT,
+			created TIMESTAMPTZ NOT NULL DEFAULT now(),
+			UNIQUE (tenant_id, display_name)
+		)
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS scim_group_members (
+			group_id INT NOT NULL REFERENCES scim_groups(id) ON DELETE CASCADE,
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			PRIMARY KEY (group_id, user_id)
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS scim_group_members_user_idx ON scim_group_members (user_id)`,
+	`ALTER TABLE scim_users ENABLE ROW LEVEL SECURITY`,
+	`ALTER TABLE scim_users FORCE ROW LEVEL SECURITY`,
+	`DROP POLICY IF EXISTS tenant_isolation ON scim_users`,
+	`
+		CREATE POLICY tenant_isolation ON scim_users
+		USING (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+		WITH CHECK (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+	`,
+	`ALTER TABLE scim_groups ENABLE ROW LEVEL SECURITY`,
+	`ALTER TABLE scim_groups FORCE ROW LEVEL SECURITY`,
+	`DROP POLICY IF EXISTS tenant_isolation ON scim_groups`,
+	`
+		CREATE POLICY tenant_isolation ON scim_groups
+		USING (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+		WITH CHECK (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+			key TEXT PRIMARY KEY,
+			tokens DOUBLE PRECISION NOT NULL,
+			updated TIMESTAMPTZ NOT NULL,
+			full_at TIMESTAMPTZ NOT NULL
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS rate_limit_buckets_full_idx ON rate_limit_buckets (full_at)`,
+	`
+		CREATE TABLE IF NOT EXISTS rate_limit_counters (
+			key TEXT PRIMARY KEY,
+			used INT NOT NULL,
+			expires TIMESTAMPTZ NOT NULL
+		)
+	`,
+	`CREATE INDEX IF NOT EXISTS rate_limit_counters_expires_idx ON rate_limit_counters (expires)`,
+	`
+		CREATE OR REPLACE FUNCTION notify_user_cache() RETURNS trigger AS $$
+		BEGIN
+			-- Sent on commit; caches of every instance drop the user.
+			PERFORM pg_notify('user_cache', OLD.id::text);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql
+	`,
+	`DROP TRIGGER IF EXISTS users_notify_cache ON users`,
+	`
+		CREATE TRIGGER users_notify_cache
+		AFTER UPDATE OR DELETE ON users
+		FOR EACH ROW EXECUTE FUNCTION notify_user_cache()
+	`,
+	// updated backs ETag and Last-Modified. Existing users start at the
+	// time of the migration, which costs clients one refetch at most.
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS updated TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	`
+		CREATE OR REPLACE FUNCTION users_touch_updated() RETURNS trigger AS $$
+		BEGIN
+			IF NEW IS DISTINCT FROM OLD THEN
+				NEW.updated := now();
+			END IF;
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql
+	`,
+	`DROP TRIGGER IF EXISTS users_touch_updated ON users`,
+	`
+		CREATE TRIGGER users_touch_updated
+		BEFORE UPDATE ON users
+		FOR EACH ROW EXECUTE FUNCTION users_touch_updated()
+	`,
+	`
+		CREATE OR REPLACE FUNCTION user_event_payload(u users) RETURNS JSONB AS $$
+			SELECT jsonb_build_object(
+				'id', u.id,
+				'firstname', u.firstname,
+				'lastname', u.lastname,
+				'email', u.email,
+				'age', u.age,
+				'created', to_char(u.created, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+				'updated', to_char(u.updated AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+				'status', u.status,
+				'tenant_id', u.tenant_id
+			)
+		$$ LANGUAGE sql STABLE
+	`,
+	// User search: full text over names and emails, with emails split at
+	// their punctuation so parts of them match, plus trigrams for typos.
+	`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+	`
+		ALTER TABLE users ADD COLUMN IF NOT EXISTS search_document tsvector GENERATED ALWAYS AS (
+			setweight(to_tsvector('simple', firstname || ' ' || lastname), 'A') ||
+			setweight(to_tsvector('simple', email || ' ' || translate(email, '@.+_-', '     ')), 'B')
+		) STORED
+	`,
+	`CREATE INDEX IF NOT EXISTS users_search_idx ON users USING GIN (search_document)`,
+	`CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users USING GIN ((firstname || ' ' || lastname) gin_trgm_ops)`,
+	`CREATE INDEX IF NOT EXISTS users_email_trgm_idx ON users USING GIN (email gin_trgm_ops)`,
+	// Roles go into the access tokens of a user, which is what admin
+	// endpoints check. They are granted in the database.
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS roles TEXT[] NOT NULL DEFAULT '{}'`,
+	// Account lockouts are kept per tenant; counters from before were all
+	// in the default tenant. IP counters have no tenant.
+	`ALTER TABLE login_failures ADD COLUMN IF NOT EXISTS tenant_id TEXT`,
+	`
+		UPDATE login_failures SET tenant_id = 'default', key = 'account:default:' || substr(key, length('account:') + 1)
+		WHERE key LIKE 'account:%' AND tenant_id IS NULL
+	`,
+	`CREATE INDEX IF NOT EXISTS login_failures_tenant_idx ON login_failures (tenant_id)`,
+	// Watchers read events in the order of the transactions that recorded
+	// them, up to the oldest one still running, instead of serialising every
+	// write to users on one advisory lock.
+	`ALTER TABLE user_events ADD COLUMN IF NOT EXISTS txid BIGINT NOT NULL DEFAULT txid_current()`,
+	`CREATE INDEX IF NOT EXISTS user_events_position_idx ON user_events (txid, id)`,
+	`
+		CREATE OR REPLACE FUNCTION notify_user_change() RETURNS trigger AS $$
+		DECLARE
+			event_id BIGINT;
+		BEGIN
+			IF TG_OP = 'DELETE' THEN
+				INSERT INTO user_events (event_type, user_id, payload)
+				VALUES ('deleted', OLD.id, user_event_payload(OLD)) RETURNING id INTO event_id;
+			ELSIF TG_OP = 'UPDATE' THEN
+				INSERT INTO user_events (event_type, user_id, payload)
+				VALUES ('updated', NEW.id, user_event_payload(NEW)) RETURNING id INTO event_id;
+			ELSE
+				INSERT INTO user_events (event_type, user_id, payload)
+				VALUES ('created', NEW.id, user_event_payload(NEW)) RETURNING id INTO event_id;
+			END IF;
+			PERFORM pg_notify('user_events', event_id::text);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql
+	`,
+	// Status changes and email verifications are versioned too. Versions
+	// written before know neither; the current ones take the values the
+	// users have now.
+	`ALTER TABLE users_history ADD COLUMN IF NOT EXISTS status VARCHAR(16)`,
+	`ALTER TABLE users_history ADD COLUMN IF NOT EXISTS status_reason TEXT`,
+	`ALTER TABLE users_history ADD COLUMN IF NOT EXISTS email_verified BOOLEAN`,
+	`
+		UPDATE users_history h SET status = u.status, status_reason = u.status_reason, email_verified = u.email_verified
+		FROM users u
+		WHERE h.user_id = u.id AND h.valid_to = 'infinity' AND h.status IS NULL
+	`,
+	`
+		CREATE OR REPLACE FUNCTION users_history_trigger() RETURNS trigger AS $$
+		BEGIN
+			IF TG_OP IN ('UPDATE', 'DELETE') THEN
+				UPDATE users_history SET valid_to = now() WHERE user_id = OLD.id AND valid_to = 'infinity';
+			END IF;
+			IF TG_OP IN ('INSERT', 'UPDATE') THEN
+				INSERT INTO users_history (user_id, version, firstname, lastname, email, age, created, tenant_id,
+					status, status_reason, email_verified, valid_from)
+				SELECT NEW.id, COALESCE(MAX(version), 0) + 1, NEW.firstname, NEW.lastname, NEW.email, NEW.age, NEW.created, NEW.tenant_id,
+					NEW.status, NEW.status_reason, NEW.email_verified, now()
+				FROM users_history WHERE user_id = NEW.id;
+			END IF;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql
+	`,
+	`DROP TRIGGER IF EXISTS users_history ON users`,
+	`
+		CREATE TRIGGER users_history
+		AFTER INSERT OR DELETE OR UPDATE OF firstname, lastname, email, age, status, status_reason, email_verified ON users
+		FOR EACH ROW EXECUTE FUNCTION users_history_trigger()
+	`,
+	// Organizations and their teams belong to a tenant; those created before
+	// take the tenant of their oldest owner. Slugs are unique per tenant.
+	`ALTER TABLE organizations ADD COLUMN IF NOT EXISTS tenant_id TEXT`,
+	`
+		UPDATE organizations o SET tenant_id = COALESCE((
+			SELECT u.tenant_id FROM organization_members m JOIN users u ON u.id = m.user_id
+			WHERE m.org_id = o.id ORDER BY m.role = 'owner' DESC, m.created, m.user_id LIMIT 1
+		), 'default')
+		WHERE tenant_id IS NULL
+	`,
+	`ALTER TABLE organizations ALTER COLUMN tenant_id SET NOT NULL`,
+	`ALTER TABLE teams ADD COLUMN IF NOT EXISTS tenant_id TEXT`,
+	`UPDATE teams t SET tenant_id = o.tenant_id FROM organizations o WHERE o.id = t.org_id AND t.tenant_id IS NULL`,
+	`ALTER TABLE teams ALTER COLUMN tenant_id SET NOT NULL`,
+	`ALTER TABLE organizations DROP CONSTRAINT IF EXISTS organizations_slug_key`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS organizations_tenant_slug_key ON organizations (tenant_id, slug)`,
+	`CREATE INDEX IF NOT EXISTS teams_tenant_idx ON teams (tenant_id)`,
+	`ALTER TABLE organizations ENABLE ROW LEVEL SECURITY`,
+	`ALTER TABLE organizations FORCE ROW LEVEL SECURITY`,
+	`DROP POLICY IF EXISTS tenant_isolation ON organizations`,
+	`
+		CREATE POLICY tenant_isolation ON organizations
+		USING (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+		WITH CHECK (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+	`,
+	`ALTER TABLE teams ENABLE ROW LEVEL SECURITY`,
+	`ALTER TABLE teams FORCE ROW LEVEL SECURITY`,
+	`DROP POLICY IF EXISTS tenant_isolation ON teams`,
+	`
+		CREATE POLICY tenant_isolation ON teams
+		USING (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+		WITH CHECK (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+	`,
+	// Webhook subscriptions and their deliveries belong to a tenant; those
+	// created before go to the default tenant.
+	`ALTER TABLE webhook_subscriptions ADD COLUMN IF NOT EXISTS tenant_id TEXT`,
+	`UPDATE webhook_subscriptions SET tenant_id = 'default' WHERE tenant_id IS NULL`,
+	`ALTER TABLE webhook_subscriptions ALTER COLUMN tenant_id SET NOT NULL`,
+	`ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS tenant_id TEXT`,
+	`UPDATE webhook_deliveries d SET tenant_id = s.tenant_id FROM webhook_subscriptions s WHERE s.id = d.subscription_id AND d.tenant_id IS NULL`,
+	`ALTER TABLE webhook_deliveries ALTER COLUMN tenant_id SET NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS webhook_subscriptions_tenant_idx ON webhook_subscriptions (tenant_id)`,
+	`ALTER TABLE webhook_subscriptions ENABLE ROW LEVEL SECURITY`,
+	`ALTER TABLE webhook_subscriptions FORCE ROW LEVEL SECURITY`,
+	`DROP POLICY IF EXISTS tenant_isolation ON webhook_subscriptions`,
+	`
+		CREATE POLICY tenant_isolation ON webhook_subscriptions
+		USING (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+		WITH CHECK (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+	`,
+	`ALTER TABLE webhook_deliveries ENABLE ROW LEVEL SECURITY`,
+	`ALTER TABLE webhook_deliveries FORCE ROW LEVEL SECURITY`,
+	`DROP POLICY IF EXISTS tenant_isolation ON webhook_deliveries`,
+	`
+		CREATE POLICY tenant_isolation ON webhook_deliveries
+		USING (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+		WITH CHECK (tenant_id = current_setting('app.tenant_id', true) OR current_setting('app.bypass_rls', true) = 'on')
+	`,
+}
+
+// InitDB connects to DATABASE_URL and applies the migrations. They run
+// over MIGRATION_DATABASE_URL if it is set, so the service itself can
+// connect as a role that owns no tables and is subject to row-level
+// security.
+func InitDB() (*pgxpool.Pool, error) {
+	dbURL := os.Getenv("DATABASE_URL")
+	db, err := pgxpool.Connect(context.Background(), dbURL)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create users table: %w", err)
+		return nil, fmt.Errorf("failed to connect to the database: %w", err)
+	}
+	if err := migrateURL(context.Background(), db, os.Getenv("MIGRATION_DATABASE_URL")); err != nil {
+		db.Close()
+		return nil, err
 	}
 	return db, nil
 }
+
+func migrateURL(ctx context.Context, db *pgxpool.Pool, migrationURL string) error {
+	if migrationURL == "" {
+		return migrate(ctx, db)
+	}
+	owner, err := pgxpool.Connect(ctx, migrationURL)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the database for migrations: %w", err)
+	}
+	defer owner.Close()
+	return migrate(ctx, owner)
+}
+
+func migrate(ctx context.Context, db *pgxpool.Pool) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	// Backfills have to see the rows of every tenant.
+	if _, err := tx.Exec(ctx, "SELECT set_config('app.bypass_rls', 'on', true)"); err != nil {
+		return fmt.Errorf("failed to bypass row-level security: %w", err)
+	}
+	for i, migration := range migrations {
+		if _, err := tx.Exec(ctx, migration); err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", i, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit migrations: %w", err)
+	}
+	return nil
+}
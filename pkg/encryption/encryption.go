@@ -0,0 +1,68 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// version prefixes every ciphertext so the format can change later.
+const version byte = 1
+
+var ErrDecrypt = errors.New("failed to decrypt: wrong key or corrupted data")
+
+// Cipher encrypts small secrets for storage with AES-256-GCM. Callers pass
+// associated data (usually the owning row's id) so a ciphertext copied to
+// another row does not decrypt.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// ParseKey decodes a base64 encoded 32 byte key.
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key encoding: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+func NewCipher(key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("NewCipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("NewCipher: %w", err)
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt returns version || nonce || ciphertext.
+func (c *Cipher) Encrypt(plaintext, associatedData []byte) ([]byte, error) {
+	out := make([]byte, 1+c.aead.NonceSize(), 1+c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	out[0] = version
+	if _, err := rand.Read(out[1:]); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return c.aead.Seal(out, out[1:], plaintext, associatedData), nil
+}
+
+func (c *Cipher) Decrypt(ciphertext, associatedData []byte) ([]byte, error) {
+	n := 1 + c.aead.NonceSize()
+	if len(ciphertext) < n || ciphertext[0] != version {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := c.aead.Open(nil, ciphertext[1:n], ciphertext[n:], associatedData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,135 @@
+// Package graphql is a small GraphQL (October 2021) server: a parser for
+// queries, schemas built in Go, validation with depth and complexity
+// limits, and an executor that batches loads across sibling fields.
+// Interfaces, unions and introspection are not supported.
+package graphql
+
+// The AST covers the executable part of GraphQL: operations and fragments.
+// Type definitions are not parsed; schemas are built in Go.
+
+type Location struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+type Document struct {
+	Operations []*Operation
+	Fragments  map[string]*Fragment
+}
+
+const (
+	OperationQuery        = "query"
+	OperationMutation     = "mutation"
+	OperationSubscription = "subscription"
+)
+
+type Operation struct {
+	Type         string
+	Name         string
+	Variables    []*VariableDefinition
+	Directives   []*Directive
+	SelectionSet []Selection
+	Loc          Location
+}
+
+type VariableDefinition struct {
+	Name    string
+	Type    *TypeRef
+	Default Value
+	Loc     Location
+}
+
+// TypeRef is a type as written in a variable definition: a name, or a
+// list of Elem, possibly non-null.
+type TypeRef struct {
+	Name    string
+	Elem    *TypeRef
+	NonNull bool
+}
+
+func (t *TypeRef) String() string {
+	s := t.Name
+	if t.Elem != nil {
+		s = "[" + t.Elem.String() + "]"
+	}
+	if t.NonNull {
+		s += "!"
+	}
+	return s
+}
+
+// Selection is one of *Field, *FragmentSpread or *InlineFragment.
+type Selection interface {
+	selection()
+}
+
+type Field struct {
+	Alias        string
+	Name         string
+	Arguments    []*Argument
+	Directives   []*Directive
+	SelectionSet []Selection
+	Loc          Location
+}
+
+// ResponseKey is the key of the field in the result.
+func (f *Field) ResponseKey() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+type FragmentSpread struct {
+	Name       string
+	Directives []*Directive
+	Loc        Location
+}
+
+type InlineFragment struct {
+	TypeCondition string
+	Directives    []*Directive
+	SelectionSet  []Selection
+	Loc           Location
+}
+
+func (*Field) selection()          {}
+func (*FragmentSpread) selection() {}
+func (*InlineFragment) selection() {}
+
+type Fragment struct {
+	Name          string
+	TypeCondition string
+	Directives    []*Directive
+	SelectionSet  []Selection
+	Loc           Location
+}
+
+type Argument struct {
+	Name  string
+	Value Value
+	Loc   Location
+}
+
+type Directive struct {
+	Name      string
+	Arguments []*Argument
+	Loc       Location
+}
+
+// Value is a literal in a query: int64, float64, string, bool, nil,
+// Variable, EnumValue, ListValue or ObjectValue.
+type Value interface{}
+
+type Variable string
+
+type EnumValue string
+
+type ListValue []Value
+
+type ObjectValue []*ObjectField
+
+type ObjectField struct {
+	Name  string
+	Value Value
+}
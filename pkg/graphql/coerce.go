@@ -0,0 +1,283 @@
+package graphql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// inputType resolves a variable type reference against the schema.
+func (s *Schema) inputType(ref *TypeRef) (Type, error) {
+	var t Type
+	if ref.Elem != nil {
+		elem, err := s.inputType(ref.Elem)
+		if err != nil {
+			return nil, err
+		}
+		t = NewList(elem)
+	} else {
+		named, ok := s.types[ref.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %q", ref.Name)
+		}
+		switch named.(type) {
+		case *Scalar, *Enum, *InputObject:
+		default:
+			return nil, fmt.Errorf("type %q is not an input type", ref.Name)
+		}
+		t = named
+	}
+	if ref.NonNull {
+		t = NewNonNull(t)
+	}
+	return t, nil
+}
+
+func coerceVariables(s *Schema, op *Operation, values map[string]interface{}) (map[string]interface{}, []*Error) {
+	coerced := make(map[string]interface{})
+	var errs []*Error
+	for _, def := range op.Variables {
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, &Error{
+				Message:   fmt.Sprintf("Variable \"$%s\" ", def.Name) + fmt.Sprintf(format, args...),
+				Locations: []Location{def.Loc},
+			})
+		}
+		t, err := s.inputType(def.Type)
+		if err != nil {
+			fail("has an invalid type: %v.", err)
+			continue
+		}
+
+		value, given := values[def.Name]
+		if !given {
+			if def.Default != nil {
+				v, err := coerceLiteral(t, def.Default, nil)
+				if err != nil {
+					fail("has an invalid default value: %v.", err)
+					continue
+				}
+				coerced[def.Name] = v
+			} else if _, ok := t.(*NonNull); ok {
+				fail("of required type %q was not provided.", def.Type)
+			}
+			continue
+		}
+		v, err := coerceValue(t, value)
+		if err != nil {
+			fail("got invalid value: %v.", err)
+			continue
+		}
+		coerced[def.Name] = v
+	}
+	return coerced, errs
+}
+
+// coerceValue coerces a value decoded from JSON variables to t.
+func coerceValue(t Type, value interface{}) (interface{}, error) {
+	switch t := t.(type) {
+	case *NonNull:
+		if value == nil {
+			return nil, fmt.Errorf("expected a non-null %s", t.Of)
+		}
+		return coerceValue(t.Of, value)
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	switch t := t.(type) {
+	case *List:
+		items, ok := value.([]interface{})
+		if !ok {
+			// A single value stands for a list of one.
+			item, err := coerceValue(t.Of, value)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{item}, nil
+		}
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			v, err := coerceValue(t.Of, item)
+			if err != nil {
+				return nil, fmt.Errorf("at index %d: %w", i, err)
+			}
+			out[i] = v
+		}
+		return out, nil
+	case *Scalar:
+		return t.ParseValue(value)
+	case *Enum:
+		name, ok := value.(string)
+		if !ok {
+			return nil, coerceError(t, value)
+		}
+		v, ok := t.value(name)
+		if !ok {
+			return nil, coerceError(t, value)
+		}
+		return v, nil
+	case *InputObject:
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected an object for %s", t.Name)
+		}
+		return coerceInputObject(t, fields, func(def *ArgumentDefinition, v interface{}) (interface{}, error) {
+			return coerceValue(def.Type, v)
+		})
+	}
+	return nil, fmt.Errorf("%s is not an input type", t)
+}
+
+func coerceInputObject(t *InputObject, fields map[string]interface{}, coerce func(*ArgumentDefinition, interface{}) (interface{}, error)) (map[string]interface{}, error) {
+	for name := range fields {
+		if fieldDefinition(t.Fields, name) == nil {
+			return nil, fmt.Errorf("field %q is not defined by type %s", name, t.Name)
+		}
+	}
+	out := make(map[string]interface{})
+	for _, def := range t.Fields {
+		v, given := fields[def.Name]
+		if !given {
+			if def.Default != nil {
+				out[def.Name] = def.Default
+			} else if _, ok := def.Type.(*NonNull); ok {
+				return nil, fmt.Errorf("field %s.%s of required type %s was not provided", t.Name, def.Name, def.Type)
+			}
+			continue
+		}
+		c, err := coerce(def, v)
+		if err != nil {
+			return nil, fmt.Errorf("field %s.%s: %w", t.Name, def.Name, err)
+		}
+		out[def.Name] = c
+	}
+	return out, nil
+}
+
+func fieldDefinition(defs []*ArgumentDefinition, name string) *ArgumentDefinition {
+	for _, def := range defs {
+		if def.Name == name {
+			return def
+		}
+	}
+	return nil
+}
+
+// coerceLiteral coerces a literal of the query to t, substituting
+// variables.
+func coerceLiteral(t Type, value Value, variables map[string]interface{}) (interface{}, error) {
+	if name, ok := value.(Variable); ok {
+		v, given := variables[string(name)]
+		if _, nonNull := t.(*NonNull); nonNull && (!given || v == nil) {
+			return nil, fmt.Errorf("variable $%s must not be null", name)
+		}
+		return v, nil
+	}
+
+	switch t := t.(type) {
+	case *NonNull:
+		if value == nil {
+			return nil, fmt.Errorf("expected a non-null %s", t.Of)
+		}
+		return coerceLiteral(t.Of, value, variables)
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	switch t := t.(type) {
+	case *List:
+		items, ok := value.(ListValue)
+		if !ok {
+			item, err := coerceLiteral(t.Of, value, variables)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{item}, nil
+		}
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			v, err := coerceLiteral(t.Of, item, variables)
+			if err != nil {
+				return nil, fmt.Errorf("at index %d: %w", i, err)
+			}
+			out[i] = v
+		}
+		return out, nil
+	case *Scalar:
+		return t.ParseLiteral(value)
+	case *Enum:
+		name, ok := value.(EnumValue)
+		if !ok {
+			return nil, coerceError(t, value)
+		}
+		v, ok := t.value(string(name))
+		if !ok {
+			return nil, coerceError(t, name)
+		}
+		return v, nil
+	case *InputObject:
+		obj, ok := value.(ObjectValue)
+		if !ok {
+			return nil, fmt.Errorf("expected an object for %s", t.Name)
+		}
+		fields := make(map[string]interface{}, len(obj))
+		for _, f := range obj {
+			// A field set to an absent variable counts as not given.
+			if name, ok := f.Value.(Variable); ok {
+				if _, given := variables[string(name)]; !given {
+					continue
+				}
+			}
+			fields[f.Name] = f.Value
+		}
+		return coerceInputObject(t, fields, func(def *ArgumentDefinition, v interface{}) (interface{}, error) {
+			return coerceLiteral(def.Type, v, variables)
+		})
+	}
+	return nil, fmt.Errorf("%s is not an input type", t)
+}
+
+func coerceArguments(defs []*ArgumentDefinition, args []*Argument, variables map[string]interface{}) (map[string]interface{}, error) {
+	var unknown []string
+	for _, arg := range args {
+		if fieldDefinition(defs, arg.Name) == nil {
+			unknown = append(unknown, arg.Name)
+		}
+	}
+	if unknown != nil {
+		return nil, fmt.Errorf("unknown argument %s", strings.Join(unknown, ", "))
+	}
+
+	out := make(map[string]interface{})
+	for _, def := range defs {
+		var arg *Argument
+		for _, a := range args {
+			if a.Name == def.Name {
+				arg = a
+			}
+		}
+		if arg != nil {
+			if name, ok := arg.Value.(Variable); ok {
+				if _, given := variables[string(name)]; !given {
+					arg = nil
+				}
+			}
+		}
+		if arg == nil {
+			if def.Default != nil {
+				out[def.Name] = def.Default
+			} else if _, ok := def.Type.(*NonNull); ok {
+				return nil, fmt.Errorf("argument %q of type %s is required", def.Name, def.Type)
+			}
+			continue
+		}
+		v, err := coerceLiteral(def.Type, arg.Value, variables)
+		if err != nil {
+			return nil, fmt.Errorf("argument %q: %w", def.Name, err)
+		}
+		out[def.Name] = v
+	}
+	return out, nil
+}
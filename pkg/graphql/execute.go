@@ -0,0 +1,490 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Error is a GraphQL error as it appears in the "errors" of a response.
+type Error struct {
+	Message    string                 `json:"message"`
+	Locations  []Location             `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ExtendedError is implemented by resolver errors that carry extensions,
+// such as an error code for clients.
+type ExtendedError interface {
+	error
+	Extensions() map[string]interface{}
+}
+
+// Result is the response to a request.
+type Result struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []*Error    `json:"errors,omitempty"`
+}
+
+// Thunk is a value that is computed later. Resolvers return thunks from a
+// Loader so that the loads of sibling fields are made in one batch.
+type Thunk func() (interface{}, error)
+
+// OrderedMap is a JSON object that keeps the order of the selection set.
+type OrderedMap struct {
+	Keys   []string
+	Values []interface{}
+}
+
+func (m *OrderedMap) Get(key string) (interface{}, bool) {
+	for i, k := range m.Keys {
+		if k == key {
+			return m.Values[i], true
+		}
+	}
+	return nil, false
+}
+
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range m.Keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		b.Write(key)
+		b.WriteByte(':')
+		value, err := json.Marshal(m.Values[i])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Request is a parsed request, ready to run.
+type Request struct {
+	Schema        *Schema
+	Document      *Document
+	OperationName string
+	Variables     map[string]interface{}
+	Limits        Limits
+	// ExecutionContext, if set, derives the context of every execution
+	// from the context of the request. Subscriptions execute once per
+	// event, so this is where per-execution state such as loaders goes.
+	ExecutionContext func(ctx context.Context) context.Context
+}
+
+// prepared is a request whose operation is chosen and whose variables
+// are coerced and validated.
+type prepared struct {
+	schema    *Schema
+	operation *Operation
+	fragments map[string]*Fragment
+	variables map[string]interface{}
+
+	executionContext func(ctx context.Context) context.Context
+}
+
+func (r *Request) prepare() (*prepared, []*Error) {
+	op, err := r.Document.operation(r.OperationName)
+	if err != nil {
+		return nil, []*Error{err}
+	}
+	if r.Schema.rootType(op.Type) == nil {
+		return nil, []*Error{{Message: fmt.Sprintf("Schema does not support %s operations.", op.Type), Locations: []Location{op.Loc}}}
+	}
+	variables, errs := coerceVariables(r.Schema, op, r.Variables)
+	if errs != nil {
+		return nil, errs
+	}
+	p := &prepared{schema: r.Schema, operation: op, fragments: r.Document.Fragments, variables: variables, executionContext: r.ExecutionContext}
+	if errs := p.validate(r.Limits); errs != nil {
+		return nil, errs
+	}
+	return p, nil
+}
+
+// Operation returns the type of the operation the request runs:
+// "query", "mutation" or "subscription".
+func (r *Request) Operation() (string, error) {
+	op, err := r.Document.operation(r.OperationName)
+	if err != nil {
+		return "", err
+	}
+	return op.Type, nil
+}
+
+func (d *Document) operation(name string) (*Operation, *Error) {
+	if name == "" {
+		if len(d.Operations) != 1 {
+			return nil, &Error{Message: "Must provide operation name if query contains multiple operations."}
+		}
+		return d.Operations[0], nil
+	}
+	for _, op := range d.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, &Error{Message: fmt.Sprintf("Unknown operation named %q.", name)}
+}
+
+// Execute runs a query or a mutation.
+func Execute(ctx context.Context, r *Request) *Result {
+	p, errs := r.prepare()
+	if errs != nil {
+		return &Result{Errors: errs}
+	}
+	if p.operation.Type == OperationSubscription {
+		return &Result{Errors: []*Error{{Message: "Subscriptions must be run with Subscribe.", Locations: []Location{p.operation.Loc}}}}
+	}
+	return p.execute(ctx, p.schema.rootType(p.operation.Type), nil)
+}
+
+// Subscribe starts a subscription and returns a channel with the result
+// for every event. The channel is closed when the event source ends or
+// ctx is done. Errors before the subscription starts are returned as a
+// result instead.
+func Subscribe(ctx context.Context, r *Request) (<-chan *Result, *Result) {
+	p, errs := r.prepare()
+	if errs != nil {
+		return nil, &Result{Errors: errs}
+	}
+	if p.operation.Type != OperationSubscription {
+		return nil, &Result{Errors: []*Error{{Message: "Subscribe needs a subscription operation.", Locations: []Location{p.operation.Loc}}}}
+	}
+
+	root := p.schema.Subscription
+	e := &executor{prepared: p}
+	fields := e.collectFields(root, p.operation.SelectionSet, nil, nil)
+	if len(fields.keys) != 1 {
+		return nil, &Result{Errors: []*Error{{Message: "A subscription must select exactly one top level field.", Locations: []Location{p.operation.Loc}}}}
+	}
+	field := fields.fields[0][0]
+	def := root.field(field.Name)
+	if def == nil || def.Subscribe == nil {
+		return nil, &Result{Errors: []*Error{{Message: fmt.Sprintf("Field %q cannot be subscribed to.", field.Name), Locations: []Location{field.Loc}}}}
+	}
+	args, err := coerceArguments(def.Args, field.Arguments, p.variables)
+	if err != nil {
+		return nil, &Result{Errors: []*Error{{Message: err.Error(), Locations: []Location{field.Loc}}}}
+	}
+	events, err := def.Subscribe(ResolveParams{Context: ctx, Args: args, Path: []interface{}{field.ResponseKey()}})
+	if err != nil {
+		return nil, &Result{Errors: []*Error{locatedError(err, field, []interface{}{field.ResponseKey()})}}
+	}
+
+	results := make(chan *Result)
+	go func() {
+		defer close(results)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				select {
+				case results <- p.execute(ctx, root, event):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return results, nil
+}
+
+// execute runs the operation against root. Fields are resolved in waves:
+// thunks returned by the resolvers of one wave are forced together in the
+// next, after every sibling had the chance to queue its load.
+func (p *prepared) execute(ctx context.Context, root *Object, source interface{}) *Result {
+	if p.executionContext != nil {
+		ctx = p.executionContext(ctx)
+	}
+	e := &executor{prepared: p}
+	data := &outValue{typ: root}
+	fields := e.collectFields(root, p.operation.SelectionSet, nil, nil)
+
+	obj := &outObject{}
+	data.value = obj
+	for i, key := range fields.keys {
+		slot := &outValue{}
+		obj.keys = append(obj.keys, key)
+		obj.values = append(obj.values, slot)
+		e.executeField(ctx, root, source, fields.fields[i], []interface{}{key}, slot)
+		// Mutations run one after another, each with all its loads.
+		if p.operation.Type == OperationMutation {
+			e.drain()
+		}
+	}
+	e.drain()
+
+	value, _ := finalize(data)
+	return &Result{Data: value, Errors: e.errors}
+}
+
+type executor struct {
+	*prepared
+	errors  []*Error
+	pending []func()
+}
+
+func (e *executor) drain() {
+	for len(e.pending) > 0 {
+		wave := e.pending
+		e.pending = nil
+		for _, run := range wave {
+			run()
+		}
+	}
+}
+
+// outValue is a completed value before null propagation. value is nil,
+// a serialized leaf, an *outObject or a []*outValue.
+type outValue struct {
+	typ   Type
+	value interface{}
+}
+
+type outObject struct {
+	keys   []string
+	values []*outValue
+}
+
+// finalize builds the response from the completed values. A null in a
+// non-null position makes the closest nullable parent null; ok is false if
+// the null has to go further up.
+func finalize(v *outValue) (interface{}, bool) {
+	_, nonNull := v.typ.(*NonNull)
+	switch value := v.value.(type) {
+	case nil:
+		return nil, !nonNull
+	case *outObject:
+		m := &OrderedMap{Keys: value.keys, Values: make([]interface{}, len(value.values))}
+		for i, child := range value.values {
+			child, ok := finalize(child)
+			if !ok {
+				return nil, !nonNull
+			}
+			m.Values[i] = child
+		}
+		return m, true
+	case []*outValue:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			item, ok := finalize(item)
+			if !ok {
+				return nil, !nonNull
+			}
+			list[i] = item
+		}
+		return list, true
+	}
+	return v.value, true
+}
+
+func extendPath(path []interface{}, key interface{}) []interface{} {
+	out := make([]interface{}, len(path)+1)
+	copy(out, path)
+	out[len(path)] = key
+	return out
+}
+
+func locatedError(err error, field *Field, path []interface{}) *Error {
+	gqlErr := &Error{Message: err.Error(), Locations: []Location{field.Loc}, Path: path}
+	if ext, ok := err.(ExtendedError); ok {
+		gqlErr.Extensions = ext.Extensions()
+	}
+	return gqlErr
+}
+
+func (e *executor) executeField(ctx context.Context, obj *Object, source interface{}, fields []*Field, path []interface{}, slot *outValue) {
+	field := fields[0]
+	if field.Name == "__typename" {
+		slot.typ = NewNonNull(String)
+		slot.value = obj.Name
+		return
+	}
+	def := obj.field(field.Name)
+	slot.typ = def.Type
+
+	args, err := coerceArguments(def.Args, field.Arguments, e.variables)
+	if err != nil {
+		e.errors = append(e.errors, locatedError(err, field, path))
+		return
+	}
+	var value interface{}
+	if def.Resolve != nil {
+		value, err = def.Resolve(ResolveParams{Context: ctx, Source: source, Args: args, Path: path})
+	} else {
+		value = source
+	}
+	e.complete(ctx, def.Type, fields, path, value, err, slot)
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface, reflect.Func:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// complete turns a resolved value into a value of typ and stores it in
+// slot. Thunks are queued for the next wave.
+func (e *executor) complete(ctx context.Context, typ Type, fields []*Field, path []interface{}, value interface{}, err error, slot *outValue) {
+	if err != nil {
+		e.errors = append(e.errors, locatedError(err, fields[0], path))
+		return
+	}
+	if thunk, ok := value.(Thunk); ok {
+		e.pending = append(e.pending, func() {
+			value, err := thunk()
+			e.complete(ctx, typ, fields, path, value, err, slot)
+		})
+		return
+	}
+
+	if nonNull, ok := typ.(*NonNull); ok {
+		if isNil(value) {
+			e.errors = append(e.errors, &Error{
+				Message:   fmt.Sprintf("Cannot return null for non-nullable field %s.", fields[0].Name),
+				Locations: []Location{fields[0].Loc},
+				Path:      path,
+			})
+			return
+		}
+		e.complete(ctx, nonNull.Of, fields, path, value, nil, slot)
+		return
+	}
+	if isNil(value) {
+		return
+	}
+
+	switch t := typ.(type) {
+	case *List:
+		rv := reflect.ValueOf(value)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			e.errors = append(e.errors, locatedError(fmt.Errorf("expected a list for field %s, got %T", fields[0].Name, value), fields[0], path))
+			return
+		}
+		items := make([]*outValue, rv.Len())
+		for i := range items {
+			items[i] = &outValue{typ: t.Of}
+			e.complete(ctx, t.Of, fields, extendPath(path, i), rv.Index(i).Interface(), nil, items[i])
+		}
+		slot.value = items
+	case *Scalar:
+		v, err := t.Serialize(value)
+		if err != nil {
+			e.errors = append(e.errors, locatedError(err, fields[0], path))
+			return
+		}
+		slot.value = v
+	case *Enum:
+		name, ok := t.name(value)
+		if !ok {
+			e.errors = append(e.errors, locatedError(coerceError(t, value), fields[0], path))
+			return
+		}
+		slot.value = name
+	case *Object:
+		var selections []Selection
+		for _, f := range fields {
+			selections = append(selections, f.SelectionSet...)
+		}
+		sub := e.collectFields(t, selections, nil, nil)
+		obj := &outObject{}
+		for i, key := range sub.keys {
+			child := &outValue{}
+			obj.keys = append(obj.keys, key)
+			obj.values = append(obj.values, child)
+			e.executeField(ctx, t, value, sub.fields[i], extendPath(path, key), child)
+		}
+		slot.value = obj
+	}
+}
+
+// collectedFields are the fields of a selection set grouped by response
+// key, in order of appearance.
+type collectedFields struct {
+	keys   []string
+	fields [][]*Field
+}
+
+func (c *collectedFields) add(f *Field) {
+	key := f.ResponseKey()
+	for i, k := range c.keys {
+		if k == key {
+			c.fields[i] = append(c.fields[i], f)
+			return
+		}
+	}
+	c.keys = append(c.keys, key)
+	c.fields = append(c.fields, []*Field{f})
+}
+
+func (e *executor) collectFields(obj *Object, selections []Selection, into *collectedFields, visited map[string]bool) *collectedFields {
+	if into == nil {
+		into = &collectedFields{}
+	}
+	if visited == nil {
+		visited = make(map[string]bool)
+	}
+	for _, sel := range selections {
+		switch sel := sel.(type) {
+		case *Field:
+			if e.included(sel.Directives) {
+				into.add(sel)
+			}
+		case *InlineFragment:
+			if e.included(sel.Directives) && (sel.TypeCondition == "" || sel.TypeCondition == obj.Name) {
+				e.collectFields(obj, sel.SelectionSet, into, visited)
+			}
+		case *FragmentSpread:
+			if visited[sel.Name] || !e.included(sel.Directives) {
+				continue
+			}
+			visited[sel.Name] = true
+			if f := e.fragments[sel.Name]; f != nil && f.TypeCondition == obj.Name {
+				e.collectFields(obj, f.SelectionSet, into, visited)
+			}
+		}
+	}
+	return into
+}
+
+// included evaluates @skip and @include.
+func (p *prepared) included(directives []*Directive) bool {
+	for _, d := range directives {
+		if d.Name != "skip" && d.Name != "include" {
+			continue
+		}
+		args, err := coerceArguments(conditionArgs, d.Arguments, p.variables)
+		if err != nil {
+			continue
+		}
+		if args["if"] == (d.Name == "skip") {
+			return false
+		}
+	}
+	return true
+}
+
+var conditionArgs = []*ArgumentDefinition{{Name: "if", Type: NewNonNull(Boolean)}}
@@ -0,0 +1,70 @@
+package graphql
+
+import (
+	"context"
+	"sync"
+)
+
+// BatchFunc loads the values of keys in one go. Keys missing from the
+// result resolve to nil.
+type BatchFunc func(ctx context.Context, keys []int) (map[int]interface{}, error)
+
+// Loader batches and caches loads by integer key for the lifetime of a
+// request. Load only queues the key; the batch is fetched when the first
+// of the returned thunks is forced, which the executor does after all
+// sibling fields have been resolved.
+type Loader struct {
+	batch BatchFunc
+
+	mu      sync.Mutex
+	queued  []int
+	results map[int]interface{}
+	errs    map[int]error
+}
+
+func NewLoader(batch BatchFunc) *Loader {
+	return &Loader{batch: batch, results: make(map[int]interface{}), errs: make(map[int]error)}
+}
+
+func (l *Loader) Load(ctx context.Context, key int) Thunk {
+	l.mu.Lock()
+	_, done := l.results[key]
+	if _, failed := l.errs[key]; !done && !failed && !l.isQueued(key) {
+		l.queued = append(l.queued, key)
+	}
+	l.mu.Unlock()
+
+	return func() (interface{}, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.isQueued(key) {
+			l.dispatch(ctx)
+		}
+		if err, ok := l.errs[key]; ok {
+			return nil, err
+		}
+		return l.results[key], nil
+	}
+}
+
+func (l *Loader) isQueued(key int) bool {
+	for _, k := range l.queued {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Loader) dispatch(ctx context.Context) {
+	keys := l.queued
+	l.queued = nil
+	values, err := l.batch(ctx, keys)
+	for _, key := range keys {
+		if err != nil {
+			l.errs[key] = err
+			continue
+		}
+		l.results[key] = values[key]
+	}
+}
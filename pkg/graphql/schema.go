@@ -0,0 +1,474 @@
+package graphql
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Type is one of *Scalar, *Enum, *Object, *InputObject, *List or *NonNull.
+type Type interface {
+	String() string
+}
+
+// namedType is a type with a name of its own, as opposed to a wrapper.
+type namedType interface {
+	Type
+	typeName() string
+}
+
+type List struct {
+	Of Type
+}
+
+type NonNull struct {
+	Of Type
+}
+
+func (t *List) String() string    { return "[" + t.Of.String() + "]" }
+func (t *NonNull) String() string { return t.Of.String() + "!" }
+
+// NewList, NewNonNull and NonNullList wrap a type, for readable schema
+// definitions. NonNullList is [T!]!.
+func NewList(of Type) *List        { return &List{Of: of} }
+func NewNonNull(of Type) *NonNull  { return &NonNull{Of: of} }
+func NonNullList(of Type) *NonNull { return NewNonNull(NewList(NewNonNull(of))) }
+
+func (t *Scalar) typeName() string      { return t.Name }
+func (t *Enum) typeName() string        { return t.Name }
+func (t *Object) typeName() string      { return t.Name }
+func (t *InputObject) typeName() string { return t.Name }
+
+// Scalar is a leaf type. Serialize turns a resolved value into its JSON
+// form; ParseValue and ParseLiteral read it from variables and from the
+// query.
+type Scalar struct {
+	Name         string
+	Description  string
+	Serialize    func(v interface{}) (interface{}, error)
+	ParseValue   func(v interface{}) (interface{}, error)
+	ParseLiteral func(v Value) (interface{}, error)
+}
+
+func (t *Scalar) String() string { return t.Name }
+
+type EnumValueDefinition struct {
+	Name        string
+	Description string
+	// Value is what resolvers return and arguments receive. It defaults
+	// to Name.
+	Value interface{}
+}
+
+type Enum struct {
+	Name        string
+	Description string
+	Values      []*EnumValueDefinition
+}
+
+func (t *Enum) String() string { return t.Name }
+
+func (t *Enum) value(name string) (interface{}, bool) {
+	for _, v := range t.Values {
+		if v.Name == name {
+			if v.Value == nil {
+				return v.Name, true
+			}
+			return v.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (t *Enum) name(value interface{}) (string, bool) {
+	for _, v := range t.Values {
+		if v.Value == value || (v.Value == nil && v.Name == value) {
+			return v.Name, true
+		}
+	}
+	return "", false
+}
+
+// ResolveParams is what a resolver gets: the value of the parent object
+// and the coerced arguments of the field.
+type ResolveParams struct {
+	Context context.Context
+	Source  interface{}
+	Args    map[string]interface{}
+	Path    []interface{}
+}
+
+// ResolveFunc resolves a field. It may return a Thunk to be forced once
+// the sibling fields have been resolved, which is how loaders batch.
+type ResolveFunc func(p ResolveParams) (interface{}, error)
+
+// SubscribeFunc starts a subscription. Every value sent on the channel is
+// the source of one execution of the subscription; the channel is closed
+// when the subscription ends.
+type SubscribeFunc func(p ResolveParams) (<-chan interface{}, error)
+
+// ComplexityFunc estimates the cost of a field from the cost of its
+// selection set and its arguments.
+type ComplexityFunc func(childComplexity int, args map[string]interface{}) int
+
+type FieldDefinition struct {
+	Name        string
+	Description string
+	Type        Type
+	Args        []*ArgumentDefinition
+	Resolve     ResolveFunc
+	Subscribe   SubscribeFunc
+	Complexity  ComplexityFunc
+	// Deprecated, if set, is the reason the field should not be used.
+	Deprecated string
+}
+
+// ArgumentDefinition is an argument of a field or a field of an input
+// object.
+type ArgumentDefinition struct {
+	Name        string
+	Description string
+	Type        Type
+	Default     interface{}
+}
+
+type Object struct {
+	Name        string
+	Description string
+	Fields      []*FieldDefinition
+}
+
+func (t *Object) String() string { return t.Name }
+
+func (t *Object) field(name string) *FieldDefinition {
+	for _, f := range t.Fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+type InputObject struct {
+	Name        string
+	Description string
+	Fields      []*ArgumentDefinition
+}
+
+func (t *InputObject) String() string { return t.Name }
+
+// Schema holds the root types. Every type must be reachable from them.
+type Schema struct {
+	Query        *Object
+	Mutation     *Object
+	Subscription *Object
+	types        map[string]namedType
+}
+
+// NewSchema checks that the type names are unique and indexes the types.
+func NewSchema(query, mutation, subscription *Object) (*Schema, error) {
+	if query == nil {
+		return nil, fmt.Errorf("a schema needs a query type")
+	}
+	s := &Schema{Query: query, Mutation: mutation, Subscription: subscription, types: make(map[string]namedType)}
+	for _, t := range []Type{Int, Float, String, Boolean, ID, query, mutation, subscription} {
+		if o, ok := t.(*Object); ok && o == nil {
+			continue
+		}
+		if err := s.addType(t); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Schema) addType(t Type) error {
+	switch t := t.(type) {
+	case *List:
+		return s.addType(t.Of)
+	case *NonNull:
+		return s.addType(t.Of)
+	}
+	named := t.(namedType)
+	if existing, ok := s.types[named.typeName()]; ok {
+		if existing != named {
+			return fmt.Errorf("type %s is defined twice", named.typeName())
+		}
+		return nil
+	}
+	s.types[named.typeName()] = named
+
+	switch t := t.(type) {
+	case *Object:
+		for _, f := range t.Fields {
+			if err := s.addType(f.Type); err != nil {
+				return err
+			}
+			for _, arg := range f.Args {
+				if err := s.addType(arg.Type); err != nil {
+					return err
+				}
+			}
+		}
+	case *InputObject:
+		for _, f := range t.Fields {
+			if err := s.addType(f.Type); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) rootType(operation string) *Object {
+	switch operation {
+	case OperationMutation:
+		return s.Mutation
+	case OperationSubscription:
+		return s.Subscription
+	}
+	return s.Query
+}
+
+// SDL prints the schema in the schema definition language, for client
+// code generators.
+func (s *Schema) SDL() string {
+	var b strings.Builder
+	names := make([]string, 0, len(s.types))
+	for name := range s.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	description := func(indent, text string) {
+		if text != "" {
+			fmt.Fprintf(&b, "%s\"\"\"%s\"\"\"\n", indent, text)
+		}
+	}
+	args := func(args []*ArgumentDefinition) string {
+		if len(args) == 0 {
+			return ""
+		}
+		parts := make([]string, len(args))
+		for i, arg := range args {
+			parts[i] = arg.Name + ": " + arg.Type.String()
+			if arg.Default != nil {
+				parts[i] += fmt.Sprintf(" = %v", formatDefault(arg.Default))
+			}
+		}
+		return "(" + strings.Join(parts, ", ") + ")"
+	}
+
+	for _, name := range names {
+		switch t := s.types[name].(type) {
+		case *Scalar:
+			if builtinScalars[name] {
+				continue
+			}
+			description("", t.Description)
+			fmt.Fprintf(&b, "scalar %s\n\n", t.Name)
+		case *Enum:
+			description("", t.Description)
+			fmt.Fprintf(&b, "enum %s {\n", t.Name)
+			for _, v := range t.Values {
+				description("  ", v.Description)
+				fmt.Fprintf(&b, "  %s\n", v.Name)
+			}
+			b.WriteString("}\n\n")
+		case *Object:
+			description("", t.Description)
+			fmt.Fprintf(&b, "type %s {\n", t.Name)
+			for _, f := range t.Fields {
+				description("  ", f.Description)
+				fmt.Fprintf(&b, "  %s%s: %s", f.Name, args(f.Args), f.Type)
+				if f.Deprecated != "" {
+					fmt.Fprintf(&b, " @deprecated(reason: %q)", f.Deprecated)
+				}
+				b.WriteString("\n")
+			}
+			b.WriteString("}\n\n")
+		case *InputObject:
+			description("", t.Description)
+			fmt.Fprintf(&b, "input %s {\n", t.Name)
+			for _, f := range t.Fields {
+				description("  ", f.Description)
+				fmt.Fprintf(&b, "  %s: %s\n", f.Name, f.Type)
+			}
+			b.WriteString("}\n\n")
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func formatDefault(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprint(v)
+}
+
+var builtinScalars = map[string]bool{"Int": true, "Float": true, "String": true, "Boolean": true, "ID": true}
+
+func coerceError(t Type, v interface{}) error {
+	return fmt.Errorf("%s cannot represent %v", t, v)
+}
+
+func toInt(v interface{}) (int, bool) {
+	switch v := v.(type) {
+	case int:
+		return v, true
+	case int32:
+		return int(v), true
+	case int64:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			return int(v), true
+		}
+	case uint:
+		if v <= math.MaxInt32 {
+			return int(v), true
+		}
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt32 && v <= math.MaxInt32 {
+			return int(v), true
+		}
+	}
+	return 0, false
+}
+
+// The built-in scalars. Int is 32 bits wide, as the spec demands; ID is
+// serialized as a string and accepts strings and integers.
+var (
+	Int = &Scalar{
+		Name: "Int",
+		Serialize: func(v interface{}) (interface{}, error) {
+			if n, ok := toInt(v); ok {
+				return n, nil
+			}
+			return nil, coerceError(&Scalar{Name: "Int"}, v)
+		},
+		ParseValue: func(v interface{}) (interface{}, error) {
+			if n, ok := toInt(v); ok {
+				return n, nil
+			}
+			return nil, coerceError(&Scalar{Name: "Int"}, v)
+		},
+		ParseLiteral: func(v Value) (interface{}, error) {
+			if n, ok := v.(int64); ok {
+				if n, ok := toInt(n); ok {
+					return n, nil
+				}
+			}
+			return nil, coerceError(&Scalar{Name: "Int"}, v)
+		},
+	}
+	Float = &Scalar{
+		Name: "Float",
+		Serialize: func(v interface{}) (interface{}, error) {
+			switch v := v.(type) {
+			case float64:
+				return v, nil
+			case float32:
+				return float64(v), nil
+			}
+			if n, ok := toInt(v); ok {
+				return float64(n), nil
+			}
+			return nil, coerceError(&Scalar{Name: "Float"}, v)
+		},
+		ParseValue: func(v interface{}) (interface{}, error) {
+			if f, ok := v.(float64); ok {
+				return f, nil
+			}
+			return nil, coerceError(&Scalar{Name: "Float"}, v)
+		},
+		ParseLiteral: func(v Value) (interface{}, error) {
+			switch v := v.(type) {
+			case float64:
+				return v, nil
+			case int64:
+				return float64(v), nil
+			}
+			return nil, coerceError(&Scalar{Name: "Float"}, v)
+		},
+	}
+	String = &Scalar{
+		Name: "String",
+		Serialize: func(v interface{}) (interface{}, error) {
+			switch v := v.(type) {
+			case string:
+				return v, nil
+			case fmt.Stringer:
+				return v.String(), nil
+			}
+			return nil, coerceError(&Scalar{Name: "String"}, v)
+		},
+		ParseValue: func(v interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+			return nil, coerceError(&Scalar{Name: "String"}, v)
+		},
+		ParseLiteral: func(v Value) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+			return nil, coerceError(&Scalar{Name: "String"}, v)
+		},
+	}
+	Boolean = &Scalar{
+		Name: "Boolean",
+		Serialize: func(v interface{}) (interface{}, error) {
+			if b, ok := v.(bool); ok {
+				return b, nil
+			}
+			return nil, coerceError(&Scalar{Name: "Boolean"}, v)
+		},
+		ParseValue: func(v interface{}) (interface{}, error) {
+			if b, ok := v.(bool); ok {
+				return b, nil
+			}
+			return nil, coerceError(&Scalar{Name: "Boolean"}, v)
+		},
+		ParseLiteral: func(v Value) (interface{}, error) {
+			if b, ok := v.(bool); ok {
+				return b, nil
+			}
+			return nil, coerceError(&Scalar{Name: "Boolean"}, v)
+		},
+	}
+	ID = &Scalar{
+		Name: "ID",
+		Serialize: func(v interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+			if n, ok := v.(int64); ok {
+				return fmt.Sprint(n), nil
+			}
+			if n, ok := toInt(v); ok {
+				return fmt.Sprint(n), nil
+			}
+			return nil, coerceError(&Scalar{Name: "ID"}, v)
+		},
+		ParseValue: func(v interface{}) (interface{}, error) {
+			if s, ok := v.(string); ok {
+				return s, nil
+			}
+			if n, ok := toInt(v); ok {
+				return fmt.Sprint(n), nil
+			}
+			return nil, coerceError(&Scalar{Name: "ID"}, v)
+		},
+		ParseLiteral: func(v Value) (interface{}, error) {
+			switch v := v.(type) {
+			case string:
+				return v, nil
+			case int64:
+				return fmt.Sprint(v), nil
+			}
+			return nil, coerceError(&Scalar{Name: "ID"}, v)
+		},
+	}
+)
@@ -0,0 +1,201 @@
+package graphql
+
+import (
+	"fmt"
+)
+
+// Limits bound the cost of a request; zero means no limit. Depth counts
+// nested fields, the root fields being at depth 1. Complexity counts one
+// per field, with the selection set of list fields counted ListSize times
+// unless the field has a ComplexityFunc.
+type Limits struct {
+	MaxDepth      int
+	MaxComplexity int
+	ListSize      int
+}
+
+const defaultListSize = 10
+
+type validator struct {
+	*prepared
+	limits   Limits
+	declared map[string]bool
+	errors   []*Error
+	// spreading holds the fragments being expanded, to catch cycles.
+	spreading map[string]bool
+}
+
+func (p *prepared) validate(limits Limits) []*Error {
+	if limits.ListSize <= 0 {
+		limits.ListSize = defaultListSize
+	}
+	v := &validator{prepared: p, limits: limits, declared: make(map[string]bool), spreading: make(map[string]bool)}
+	for _, def := range p.operation.Variables {
+		v.declared[def.Name] = true
+	}
+	for _, f := range p.fragments {
+		if _, ok := p.schema.types[f.TypeCondition].(*Object); !ok {
+			v.errorf(f.Loc, "Unknown type %q.", f.TypeCondition)
+		}
+	}
+	if v.errors != nil {
+		return v.errors
+	}
+
+	root := p.schema.rootType(p.operation.Type)
+	depth, complexity := v.selectionSet(root, p.operation.SelectionSet)
+	if v.errors != nil {
+		return v.errors
+	}
+	if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+		v.errorf(p.operation.Loc, "Query depth %d exceeds the maximum of %d.", depth, limits.MaxDepth)
+	}
+	if limits.MaxComplexity > 0 && complexity > limits.MaxComplexity {
+		v.errorf(p.operation.Loc, "Query complexity %d exceeds the maximum of %d.", complexity, limits.MaxComplexity)
+	}
+	for _, e := range v.errors {
+		e.Extensions = map[string]interface{}{"code": "QUERY_TOO_COMPLEX"}
+	}
+	return v.errors
+}
+
+func (v *validator) errorf(loc Location, format string, args ...interface{}) {
+	v.errors = append(v.errors, &Error{Message: fmt.Sprintf(format, args...), Locations: []Location{loc}})
+}
+
+// selectionSet checks a selection set on obj and returns its depth and
+// complexity.
+func (v *validator) selectionSet(obj *Object, selections []Selection) (int, int) {
+	depth, complexity := 0, 0
+	add := func(d, c int) {
+		if d > depth {
+			depth = d
+		}
+		complexity += c
+	}
+
+	for _, sel := range selections {
+		switch sel := sel.(type) {
+		case *Field:
+			v.directives(sel.Directives)
+			add(v.field(obj, sel))
+		case *InlineFragment:
+			v.directives(sel.Directives)
+			if sel.TypeCondition != "" && sel.TypeCondition != obj.Name {
+				v.errorf(sel.Loc, "Fragment cannot be spread here as objects of type %q can never be of type %q.", obj.Name, sel.TypeCondition)
+				continue
+			}
+			add(v.selectionSet(obj, sel.SelectionSet))
+		case *FragmentSpread:
+			v.directives(sel.Directives)
+			f, ok := v.fragments[sel.Name]
+			if !ok {
+				v.errorf(sel.Loc, "Unknown fragment %q.", sel.Name)
+				continue
+			}
+			if v.spreading[sel.Name] {
+				v.errorf(sel.Loc, "Cannot spread fragment %q within itself.", sel.Name)
+				continue
+			}
+			if f.TypeCondition != obj.Name {
+				v.errorf(sel.Loc, "Fragment %q cannot be spread here as objects of type %q can never be of type %q.", sel.Name, obj.Name, f.TypeCondition)
+				continue
+			}
+			v.spreading[sel.Name] = true
+			add(v.selectionSet(obj, f.SelectionSet))
+			delete(v.spreading, sel.Name)
+		}
+	}
+	return depth, complexity
+}
+
+func (v *validator) field(obj *Object, field *Field) (int, int) {
+	if field.Name == "__typename" {
+		if field.SelectionSet != nil {
+			v.errorf(field.Loc, "Field \"__typename\" must not have a selection.")
+		}
+		return 1, 1
+	}
+	def := obj.field(field.Name)
+	if def == nil {
+		v.errorf(field.Loc, "Cannot query field %q on type %q.", field.Name, obj.Name)
+		return 0, 0
+	}
+
+	for _, arg := range field.Arguments {
+		v.checkVariables(arg.Value, arg.Loc)
+	}
+	args, err := coerceArguments(def.Args, field.Arguments, v.variables)
+	if err != nil {
+		v.errorf(field.Loc, "Field %q: %v.", field.Name, err)
+		return 0, 0
+	}
+
+	t, list := def.Type, false
+	for {
+		if nonNull, ok := t.(*NonNull); ok {
+			t = nonNull.Of
+			continue
+		}
+		if l, ok := t.(*List); ok {
+			t, list = l.Of, true
+			continue
+		}
+		break
+	}
+
+	childDepth, childComplexity := 0, 0
+	if obj, ok := t.(*Object); ok {
+		if field.SelectionSet == nil {
+			v.errorf(field.Loc, "Field %q of type %q must have a selection of subfields.", field.Name, def.Type)
+			return 0, 0
+		}
+		childDepth, childComplexity = v.selectionSet(obj, field.SelectionSet)
+	} else if field.SelectionSet != nil {
+		v.errorf(field.Loc, "Field %q must not have a selection since type %q has no subfields.", field.Name, def.Type)
+		return 0, 0
+	}
+
+	if def.Complexity != nil {
+		return childDepth + 1, def.Complexity(childComplexity, args)
+	}
+	if list {
+		return childDepth + 1, 1 + childComplexity*v.limits.ListSize
+	}
+	return childDepth + 1, 1 + childComplexity
+}
+
+func (v *validator) directives(directives []*Directive) {
+	for _, d := range directives {
+		switch d.Name {
+		case "skip", "include":
+			for _, arg := range d.Arguments {
+				v.checkVariables(arg.Value, d.Loc)
+			}
+			if _, err := coerceArguments(conditionArgs, d.Arguments, v.variables); err != nil {
+				v.errorf(d.Loc, "Directive \"@%s\": %v.", d.Name, err)
+			}
+		default:
+			v.errorf(d.Loc, "Unknown directive \"@%s\".", d.Name)
+		}
+	}
+}
+
+// checkVariables reports variables used in value that the operation does not
+// declare.
+func (v *validator) checkVariables(value Value, loc Location) {
+	switch value := value.(type) {
+	case Variable:
+		if !v.declared[string(value)] {
+			v.errorf(loc, "Variable \"$%s\" is not defined.", value)
+		}
+	case ListValue:
+		for _, item := range value {
+			v.checkVariables(item, loc)
+		}
+	case ObjectValue:
+		for _, f := range value {
+			v.checkVariables(f.Value, loc)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Package grpcbridge serves gRPC, gRPC-Web and the Connect protocol from one
+// gRPC server next to a plain HTTP handler, so all of them can share a
+// listener. Requests are routed by content type; gRPC-Web and Connect
+// requests are translated into gRPC and run through the server's ServeHTTP,
+// so they pass the same interceptors as native gRPC calls.
+package grpcbridge
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// Protocols a request can be routed to.
+const (
+	ProtocolGRPC    = "grpc"
+	ProtocolGRPCWeb = "grpc-web"
+	ProtocolConnect = "connect"
+)
+
+// maxMessageSize matches the default receive limit of the gRPC server.
+const maxMessageSize = 4 << 20
+
+type Bridge struct {
+	server  *grpc.Server
+	methods map[string]protoreflect.MethodDescriptor
+
+	origins    map[string]bool
+	anyOrigin  bool
+	exposeHdrs string
+}
+
+type Option func(*Bridge)
+
+// WithAllowedOrigins lets browsers on origins call the RPC endpoints from
+// other sites. "*" allows every origin.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(b *Bridge) {
+		for _, origin := range origins {
+			if origin = strings.TrimSpace(origin); origin == "*" {
+				b.anyOrigin = true
+			} else if origin != "" {
+				b.origins[origin] = true
+			}
+		}
+	}
+}
+
+// WithExposedHeaders adds response headers browsers may read besides the
+// gRPC status headers, such as a request id.
+func WithExposedHeaders(headers ...string) Option {
+	return func(b *Bridge) {
+		b.exposeHdrs = strings.Join(append([]string{b.exposeHdrs}, headers...), ", ")
+	}
+}
+
+// New returns a bridge for the services registered on server. Their
+// descriptors must be linked into the binary, which generated code does.
+func New(server *grpc.Server, opts ...Option) *Bridge {
+	b := &Bridge{
+		server:     server,
+		methods:    make(map[string]protoreflect.MethodDescriptor),
+		origins:    make(map[string]bool),
+		exposeHdrs: "Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin",
+	}
+	for name := range server.GetServiceInfo() {
+		d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			continue
+		}
+		service, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			continue
+		}
+		methods := service.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			b.methods["/"+name+"/"+string(methods.Get(i).Name())] = methods.Get(i)
+		}
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Handler serves the RPCs of every protocol and passes any other request
+// to next.
+func (b *Bridge) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch b.Protocol(r) {
+		case ProtocolGRPC:
+			b.server.ServeHTTP(w, r)
+		case ProtocolGRPCWeb:
+			b.cors(w, r)
+			b.serveGRPCWeb(w, r)
+		case ProtocolConnect:
+			b.cors(w, r)
+			b.serveConnect(w, r)
+		default:
+			if b.preflight(w, r) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Protocol tells which RPC protocol r speaks, or "" for any other request.
+// Connect unary calls use plain application/json or application/proto, so
+// they are only told from REST calls by their path.
+func (b *Bridge) Protocol(r *http.Request) string {
+	contentType := mediaType(r.Header.Get("Content-Type"))
+	switch {
+	case contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+"):
+		return ProtocolGRPC
+	case strings.HasPrefix(contentType, "application/grpc-web"):
+		return ProtocolGRPCWeb
+	case strings.HasPrefix(contentType, "application/connect+"):
+		return ProtocolConnect
+	case contentType == "application/proto" || contentType == "application/json":
+		if _, ok := b.methods[r.URL.Path]; ok && r.Method == http.MethodPost {
+			return ProtocolConnect
+		}
+	}
+	return ""
+}
+
+func mediaType(contentType string) string {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return t
+}
+
+// cors answers the CORS checks of browsers calling from allowed origins.
+func (b *Bridge) cors(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !(b.anyOrigin || b.origins[origin]) {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Expose-Headers", b.exposeHdrs)
+	return true
+}
+
+// preflight answers the OPTIONS request a browser sends before an RPC from
+// another origin.
+func (b *Bridge) preflight(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	if _, ok := b.methods[r.URL.Path]; !ok {
+		return false
+	}
+	if b.cors(w, r) {
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+			w.Header().Set("Access-Control-Allow-Headers", h)
+		}
+		w.Header().Set("Access-Control-Max-Age", "7200")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// responder writes the answer of a translated call in the protocol of the
+// original request.
+type responder interface {
+	// headers gets the response metadata before the first message.
+	headers(md http.Header)
+	// message gets each response message in the binary format.
+	message(msg []byte)
+	// end gets the status and the trailers.
+	end(st *status.Status, trailer http.Header)
+}
+
+// invoke runs r on the gRPC server with body as the stream of request
+// frames and hands the answer to resp.
+func (b *Bridge) invoke(resp responder, r *http.Request, body io.Reader, timeout string) {
+	req := r.Clone(r.Context())
+	req.Method = http.MethodPost
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Body = io.NopCloser(body)
+	req.ContentLength = -1
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "connect-") || lk == "content-length" ||
+			lk == "content-encoding" || lk == "accept-encoding" || lk == "x-grpc-web" {
+			req.Header.Del(k)
+		}
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	if timeout != "" {
+		req.Header.Set("Grpc-Timeout", timeout)
+	}
+
+	w := &callWriter{header: make(http.Header), resp: resp}
+	b.server.ServeHTTP(w, req)
+	w.finish()
+}
+
+// callWriter is the http.ResponseWriter the gRPC server answers into. It
+// splits the response body into messages and reads the status from the
+// trailers once the call is over.
+type callWriter struct {
+	header http.Header
+	resp   responder
+	sent   bool
+	code   int
+	buf    []byte
+	failed string
+}
+
+func (w *callWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *callWriter) WriteHeader(code int) {
+	if !w.sent {
+		w.code = code
+		w.sendHeaders()
+	}
+}
+
+func (w *callWriter) Write(p []byte) (int, error) {
+	if !w.sent {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.code != http.StatusOK {
+		// The server refused the request before the call, with a
+		// plain text reason.
+		w.failed += string(p)
+		return len(p), nil
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= 5 {
+		n := int(binary.BigEndian.Uint32(w.buf[1:5]))
+		if len(w.buf) < 5+n {
+			break
+		}
+		w.resp.message(w.buf[5 : 5+n])
+		w.buf = w.buf[5+n:]
+	}
+	return len(p), nil
+}
+
+func (w *callWriter) Flush() {
+	if !w.sent {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (w *callWriter) sendHeaders() {
+	w.sent = true
+	if w.code != http.StatusOK {
+		return
+	}
+	md := make(http.Header)
+	for k, v := range w.header {
+		switch strings.ToLower(k) {
+		case "content-type", "trailer", "grpc-encoding", "date":
+			continue
+		}
+		md[k] = v
+	}
+	w.resp.headers(md)
+}
+
+func (w *callWriter) finish() {
+	if !w.sent || w.code != http.StatusOK {
+		w.resp.end(status.New(codes.Internal, strings.TrimSpace(w.failed)), nil)
+		return
+	}
+
+	trailer := make(http.Header)
+	for k, v := range w.header {
+		if name, ok := strings.CutPrefix(k, http.TrailerPrefix); ok {
+			trailer[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	w.resp.end(callStatus(w.header), trailer)
+}
+
+// callStatus reads the status the gRPC server put in the trailers.
+func callStatus(h http.Header) *status.Status {
+	code, err := strconv.Atoi(h.Get("Grpc-Status"))
+	if err != nil {
+		return status.New(codes.Unknown, "missing status in the response")
+	}
+	if details := h.Get("Grpc-Status-Details-Bin"); details != "" {
+		if data, err := decodeBinary(details); err == nil {
+			var st spb.Status
+			if proto.Unmarshal(data, &st) == nil {
+				return status.FromProto(&st)
+			}
+		}
+	}
+	msg, err := url.PathUnescape(h.Get("Grpc-Message"))
+	if err != nil {
+		msg = h.Get("Grpc-Message")
+	}
+	return status.New(codes.Code(code), msg)
+}
+
+// decodeBinary decodes the value of a -Bin header, padded or not.
+func decodeBinary(v string) ([]byte, error) {
+	if len(v)%4 == 0 {
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return base64.RawStdEncoding.DecodeString(v)
+}
+
+// frame prefixes msg with the flags and length of a gRPC message, which is
+// also the envelope of gRPC-Web and Connect streams.
+func frame(flags byte, msg []byte) []byte {
+	out := make([]byte, 5+len(msg))
+	out[0] = flags
+	binary.BigEndian.PutUint32(out[1:5], uint32(len(msg)))
+	copy(out[5:], msg)
+	return out
+}
+
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
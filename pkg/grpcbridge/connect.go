@@ -0,0 +1,387 @@
+package grpcbridge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// endStreamFlag marks the Connect envelope ending a stream, which carries
+// the error and trailers as JSON.
+const endStreamFlag = 0x02
+
+// connectCodes are the names of the codes in Connect errors, and
+// connectHTTPStatus the statuses of unary responses failing with them.
+var connectCodes = map[codes.Code]string{
+	codes.Canceled:           "canceled",
+	codes.Unknown:            "unknown",
+	codes.InvalidArgument:    "invalid_argument",
+	codes.DeadlineExceeded:   "deadline_exceeded",
+	codes.NotFound:           "not_found",
+	codes.AlreadyExists:      "already_exists",
+	codes.PermissionDenied:   "permission_denied",
+	codes.ResourceExhausted:  "resource_exhausted",
+	codes.FailedPrecondition: "failed_precondition",
+	codes.Aborted:            "aborted",
+	codes.OutOfRange:         "out_of_range",
+	codes.Unimplemented:      "unimplemented",
+	codes.Internal:           "internal",
+	codes.Unavailable:        "unavailable",
+	codes.DataLoss:           "data_loss",
+	codes.Unauthenticated:    "unauthenticated",
+}
+
+var connectHTTPStatus = map[codes.Code]int{
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// serveConnect answers Connect requests: unary calls as application/proto
+// or application/json with the bare message as body, streams as
+// application/connect+proto or application/connect+json with enveloped
+// messages. See https://connectrpc.com/docs/protocol.
+func (b *Bridge) serveConnect(w http.ResponseWriter, r *http.Request) {
+	contentType := mediaType(r.Header.Get("Content-Type"))
+	streaming := strings.HasPrefix(contentType, "application/connect+")
+	codecName := strings.TrimPrefix(strings.TrimPrefix(contentType, "application/connect+"), "application/")
+	if codecName != "proto" && codecName != "json" {
+		http.Error(w, fmt.Sprintf("unsupported content type %q", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Connect requests must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	method := b.methods[r.URL.Path]
+	if !streaming && method != nil && (method.IsStreamingClient() || method.IsStreamingServer()) {
+		http.Error(w, "streaming methods need a streaming content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	var fail func(*status.Status)
+	if streaming {
+		fail = func(st *status.Status) { (&connectStream{w: w, contentType: contentType}).end(st, nil) }
+	} else {
+		fail = func(st *status.Status) { writeConnectError(w, st) }
+	}
+
+	c := &codec{}
+	if codecName == "json" {
+		if method == nil {
+			fail(status.Newf(codes.Unimplemented, "unknown method %s", r.URL.Path))
+			return
+		}
+		var err error
+		if c, err = newJSONCodec(method); err != nil {
+			fail(status.New(codes.Internal, err.Error()))
+			return
+		}
+	}
+	timeout, err := grpcTimeout(r.Header.Get("Connect-Timeout-Ms"))
+	if err != nil {
+		fail(status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	if streaming {
+		if enc := r.Header.Get("Connect-Content-Encoding"); enc != "" && enc != "identity" {
+			fail(status.Newf(codes.Unimplemented, "unsupported compression %q", enc))
+			return
+		}
+		body := &envelopeReader{r: r.Body, convert: c.request}
+		b.invoke(&connectStream{w: w, contentType: contentType, codec: c}, r, body, timeout)
+		return
+	}
+
+	var body io.Reader = r.Body
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			fail(status.New(codes.InvalidArgument, err.Error()))
+			return
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		fail(status.Newf(codes.Unimplemented, "unsupported compression %q", enc))
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxMessageSize+1))
+	if err != nil {
+		fail(status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+	if len(data) > maxMessageSize {
+		fail(status.Newf(codes.ResourceExhausted, "message larger than %d bytes", maxMessageSize))
+		return
+	}
+	msg, err := c.request(data)
+	if err != nil {
+		fail(status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+	b.invoke(&connectUnary{w: w, contentType: contentType, codec: c}, r, bytes.NewReader(frame(0, msg)), timeout)
+}
+
+// grpcTimeout turns a Connect-Timeout-Ms value into a grpc-timeout one,
+// which has at most eight digits.
+func grpcTimeout(ms string) (string, error) {
+	if ms == "" {
+		return "", nil
+	}
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil || n < 0 || len(ms) > 10 {
+		return "", fmt.Errorf("invalid Connect-Timeout-Ms %q", ms)
+	}
+	if n <= 99999999 {
+		return fmt.Sprintf("%dm", n), nil
+	}
+	return fmt.Sprintf("%dS", (n+999)/1000), nil
+}
+
+// codec converts messages between the encoding of the request and the
+// binary one of gRPC. The zero codec is for binary requests.
+type codec struct {
+	in, out protoreflect.MessageType
+}
+
+func newJSONCodec(method protoreflect.MethodDescriptor) (*codec, error) {
+	in, err := protoregistry.GlobalTypes.FindMessageByName(method.Input().FullName())
+	if err != nil {
+		return nil, err
+	}
+	out, err := protoregistry.GlobalTypes.FindMessageByName(method.Output().FullName())
+	if err != nil {
+		return nil, err
+	}
+	return &codec{in: in, out: out}, nil
+}
+
+func (c *codec) request(data []byte) ([]byte, error) {
+	if c.in == nil {
+		return data, nil
+	}
+	msg := c.in.New().Interface()
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(msg)
+}
+
+func (c *codec) response(data []byte) ([]byte, error) {
+	if c.out == nil {
+		return data, nil
+	}
+	msg := c.out.New().Interface()
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return protojson.Marshal(msg)
+}
+
+// envelopeReader reads a stream of Connect envelopes as gRPC frames.
+type envelopeReader struct {
+	r       io.Reader
+	convert func([]byte) ([]byte, error)
+	buf     []byte
+	err     error
+}
+
+func (e *envelopeReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		e.buf, e.err = e.next()
+	}
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+func (e *envelopeReader) next() ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(e.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0]&0x01 != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxMessageSize {
+		return nil, fmt.Errorf("message larger than %d bytes", maxMessageSize)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(e.r, data); err != nil {
+		return nil, err
+	}
+	if hdr[0]&endStreamFlag != 0 {
+		return nil, io.EOF
+	}
+	msg, err := e.convert(data)
+	if err != nil {
+		return nil, err
+	}
+	return frame(0, msg), nil
+}
+
+type connectError struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message,omitempty"`
+	Details []connectDetail `json:"details,omitempty"`
+}
+
+type connectDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+func newConnectError(st *status.Status) *connectError {
+	e := &connectError{Code: connectCodes[st.Code()], Message: st.Message()}
+	if e.Code == "" {
+		e.Code = connectCodes[codes.Unknown]
+	}
+	for _, d := range st.Proto().Details {
+		e.Details = append(e.Details, connectDetail{
+			Type:  d.TypeUrl[strings.LastIndex(d.TypeUrl, "/")+1:],
+			Value: base64.RawStdEncoding.EncodeToString(d.Value),
+		})
+	}
+	return e
+}
+
+func writeConnectError(w http.ResponseWriter, st *status.Status) {
+	code, ok := connectHTTPStatus[st.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(newConnectError(st))
+}
+
+// connectUnary answers a unary call with the bare message, or an error
+// with its HTTP status. Trailers become Trailer- headers.
+type connectUnary struct {
+	w           http.ResponseWriter
+	contentType string
+	codec       *codec
+	md          http.Header
+	msg         []byte
+}
+
+func (c *connectUnary) headers(md http.Header) {
+	c.md = md
+}
+
+func (c *connectUnary) message(msg []byte) {
+	c.msg = append([]byte(nil), msg...)
+}
+
+func (c *connectUnary) end(st *status.Status, trailer http.Header) {
+	h := c.w.Header()
+	for k, v := range c.md {
+		h[k] = v
+	}
+	for k, vv := range trailer {
+		for _, v := range vv {
+			h.Add("Trailer-"+k, v)
+		}
+	}
+	if st.Code() != codes.OK {
+		writeConnectError(c.w, st)
+		return
+	}
+	msg, err := c.codec.response(c.msg)
+	if err != nil {
+		writeConnectError(c.w, status.New(codes.Internal, err.Error()))
+		return
+	}
+	h.Set("Content-Type", c.contentType)
+	c.w.WriteHeader(http.StatusOK)
+	c.w.Write(msg)
+}
+
+// connectStream answers a stream with enveloped messages, ending with an
+// envelope holding the error, if any, and the trailers.
+type connectStream struct {
+	w           http.ResponseWriter
+	contentType string
+	codec       *codec
+	started     bool
+	err         *status.Status
+}
+
+func (c *connectStream) headers(md http.Header) {
+	c.started = true
+	h := c.w.Header()
+	for k, v := range md {
+		h[k] = v
+	}
+	h.Set("Content-Type", c.contentType)
+	c.w.WriteHeader(http.StatusOK)
+}
+
+func (c *connectStream) message(msg []byte) {
+	if c.err != nil {
+		return
+	}
+	msg, err := c.codec.response(msg)
+	if err != nil {
+		c.err = status.New(codes.Internal, err.Error())
+		return
+	}
+	c.w.Write(frame(0, msg))
+	flush(c.w)
+}
+
+func (c *connectStream) end(st *status.Status, trailer http.Header) {
+	if !c.started {
+		c.headers(nil)
+	}
+	if c.err != nil {
+		st = c.err
+	}
+	end := struct {
+		Error    *connectError `json:"error,omitempty"`
+		Metadata http.Header   `json:"metadata,omitempty"`
+	}{Metadata: trailer}
+	if st.Code() != codes.OK {
+		end.Error = newConnectError(st)
+	}
+	data, _ := json.Marshal(end)
+	c.w.Write(frame(endStreamFlag, data))
+	flush(c.w)
+}
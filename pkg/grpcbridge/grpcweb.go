@@ -0,0 +1,140 @@
+package grpcbridge
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// trailerFlag marks the gRPC-Web frame carrying the status and trailers.
+const trailerFlag = 0x80
+
+// serveGRPCWeb answers application/grpc-web[-text][+proto] requests. The
+// message frames are those of gRPC; the trailers travel in a last frame
+// since browsers cannot read HTTP trailers. The -text variant is the same
+// stream in base64.
+func (b *Bridge) serveGRPCWeb(w http.ResponseWriter, r *http.Request) {
+	contentType := mediaType(r.Header.Get("Content-Type"))
+	text := strings.HasPrefix(contentType, "application/grpc-web-text")
+	switch strings.TrimPrefix(strings.TrimPrefix(contentType, "application/grpc-web-text"), "application/grpc-web") {
+	case "", "+proto":
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content type %q", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "gRPC-Web requests must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if text {
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize*4/3+8))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body, err = decodeText(data); err != nil {
+			http.Error(w, "malformed base64 body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if text {
+		contentType = "application/grpc-web-text+proto"
+	} else {
+		contentType = "application/grpc-web+proto"
+	}
+	b.invoke(&webResponder{w: w, text: text, contentType: contentType}, r, body, r.Header.Get("Grpc-Timeout"))
+}
+
+// decodeText decodes base64 in groups of four characters, which also reads
+// a concatenation of padded strings.
+func decodeText(data []byte) (io.Reader, error) {
+	data = bytes.TrimSpace(data)
+	if len(data)%4 != 0 {
+		return nil, base64.CorruptInputError(len(data))
+	}
+	out := make([]byte, 0, len(data)/4*3)
+	var group [3]byte
+	for i := 0; i < len(data); i += 4 {
+		n, err := base64.StdEncoding.Decode(group[:], data[i:i+4])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, group[:n]...)
+	}
+	return bytes.NewReader(out), nil
+}
+
+type webResponder struct {
+	w           http.ResponseWriter
+	text        bool
+	contentType string
+	started     bool
+}
+
+func (c *webResponder) headers(md http.Header) {
+	c.started = true
+	h := c.w.Header()
+	for k, v := range md {
+		h[k] = v
+	}
+	h.Set("Content-Type", c.contentType)
+	c.w.WriteHeader(http.StatusOK)
+}
+
+func (c *webResponder) message(msg []byte) {
+	c.write(frame(0, msg))
+}
+
+func (c *webResponder) end(st *status.Status, trailer http.Header) {
+	if !c.started {
+		c.headers(nil)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "grpc-status: %d\r\n", st.Code())
+	if msg := st.Message(); msg != "" {
+		fmt.Fprintf(&buf, "grpc-message: %s\r\n", encodeMessage(msg))
+	}
+	if p := st.Proto(); len(p.Details) > 0 {
+		if data, err := proto.Marshal(p); err == nil {
+			fmt.Fprintf(&buf, "grpc-status-details-bin: %s\r\n", base64.RawStdEncoding.EncodeToString(data))
+		}
+	}
+	for k, vv := range trailer {
+		for _, v := range vv {
+			fmt.Fprintf(&buf, "%s: %s\r\n", strings.ToLower(k), v)
+		}
+	}
+	c.write(frame(trailerFlag, buf.Bytes()))
+}
+
+func (c *webResponder) write(data []byte) {
+	if c.text {
+		data = []byte(base64.StdEncoding.EncodeToString(data))
+	}
+	c.w.Write(data)
+	flush(c.w)
+}
+
+// encodeMessage percent-encodes a status message the way gRPC does, so it
+// fits in a header line.
+func encodeMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,161 @@
+// Package httpcache answers conditional GET and HEAD requests (RFC 9110)
+// from the response a handler rendered. The body is tagged with a strong
+// ETag, so a collection gets one that changes with any of its members,
+// and replaced by 304 Not Modified when If-None-Match or If-Modified-Since
+// show the client has it already. Handlers only set Last-Modified.
+package httpcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware buffers successful GET and HEAD responses to tag and check
+// them, and sets cacheControl on them unless it is empty. Streaming
+// handlers must not be behind it.
+func Middleware(cacheControl string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		method := ctx.Request.Method
+		if method != http.MethodGet && method != http.MethodHead {
+			ctx.Next()
+			return
+		}
+
+		w := &bufferedWriter{ResponseWriter: ctx.Writer, status: http.StatusOK}
+		ctx.Writer = w
+		ctx.Next()
+		ctx.Writer = w.ResponseWriter
+
+		header := w.Header()
+		if w.status != http.StatusOK {
+			w.flush(method)
+			return
+		}
+		if header.Get("ETag") == "" {
+			header.Set("ETag", ETag(w.body.Bytes()))
+		}
+		if cacheControl != "" && header.Get("Cache-Control") == "" {
+			header.Set("Cache-Control", cacheControl)
+		}
+		if NotModified(ctx.Request, header) {
+			header.Del("Content-Type")
+			header.Del("Content-Length")
+			w.ResponseWriter.WriteHeader(http.StatusNotModified)
+			w.ResponseWriter.WriteHeaderNow()
+			return
+		}
+		w.flush(method)
+	}
+}
+
+// ETag returns a strong entity tag for body.
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+}
+
+// SetLastModified sets the Last-Modified header to t, unless t is zero.
+func SetLastModified(header http.Header, t time.Time) {
+	if !t.IsZero() {
+		header.Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+}
+
+// NotModified reports whether the response with header is one the client
+// of r has already. If-None-Match takes precedence over If-Modified-Since,
+// as the latter cannot tell changes within a second apart.
+func NotModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return matchETag(inm, header.Get("ETag"))
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.After(ims)
+}
+
+// matchETag compares etag with the list of If-None-Match, which uses weak
+// comparison.
+func matchETag(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedWriter keeps the response of a handler until Middleware has
+// decided what to send.
+type bufferedWriter struct {
+	gin.ResponseWriter
+	status  int
+	written bool
+	body    bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	if status > 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferedWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *bufferedWriter) Write(p []byte) (int, error) {
+	w.written = true
+	return w.body.Write(p)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	w.written = true
+	return w.body.WriteString(s)
+}
+
+func (w *bufferedWriter) Status() int {
+	return w.status
+}
+
+func (w *bufferedWriter) Size() int {
+	if !w.written {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *bufferedWriter) Written() bool {
+	return w.written
+}
+
+// flush sends what the handler wrote; HEAD responses keep the length of
+// the body but not the body.
+func (w *bufferedWriter) flush(method string) {
+	if w.status == http.StatusOK {
+		w.Header().Set("Content-Length", strconv.Itoa(w.body.Len()))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if method == http.MethodHead {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	w.ResponseWriter.Write(w.body.Bytes())
+}
@@ -0,0 +1,128 @@
+package negotiate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	ugorji "github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProtoMarshaler and ProtoUnmarshaler are implemented by values that have
+// a protobuf form without being messages themselves.
+type ProtoMarshaler interface {
+	MarshalProto() ([]byte, error)
+}
+
+type ProtoUnmarshaler interface {
+	UnmarshalProto(data []byte) error
+}
+
+// codec encodes one media type. mediaTypes holds the name responses are
+// sent as first, then the aliases clients may use.
+type codec struct {
+	mediaTypes   []string
+	responseType string
+	marshal      func(v interface{}) ([]byte, error)
+	unmarshal    func(data []byte, v interface{}) error
+	supports     func(v interface{}) bool
+}
+
+func (c *codec) quality(accept string) float64 {
+	q := 0.0
+	for _, t := range c.mediaTypes {
+		if tq := quality(accept, t); tq > q {
+			q = tq
+		}
+	}
+	return q
+}
+
+func always(v interface{}) bool {
+	return true
+}
+
+var jsonCodec = &codec{
+	mediaTypes:   []string{"application/json"},
+	responseType: "application/json; charset=utf-8",
+	marshal:      json.Marshal,
+	unmarshal: func(data []byte, v interface{}) error {
+		// Like gin, so an empty body is an EOF error.
+		return json.NewDecoder(bytes.NewReader(data)).Decode(v)
+	},
+	supports: always,
+}
+
+var errNoProtobuf = errors.New("no protobuf form")
+
+var protobufCodec = &codec{
+	mediaTypes:   []string{"application/x-protobuf", "application/protobuf"},
+	responseType: "application/x-protobuf",
+	marshal: func(v interface{}) ([]byte, error) {
+		switch m := v.(type) {
+		case proto.Message:
+			return proto.Marshal(m)
+		case ProtoMarshaler:
+			return m.MarshalProto()
+		}
+		return nil, errNoProtobuf
+	},
+	unmarshal: func(data []byte, v interface{}) error {
+		switch m := v.(type) {
+		case proto.Message:
+			return proto.Unmarshal(data, m)
+		case ProtoUnmarshaler:
+			return m.UnmarshalProto(data)
+		}
+		return ErrUnsupportedMediaType
+	},
+	supports: func(v interface{}) bool {
+		switch v.(type) {
+		case proto.Message, ProtoMarshaler:
+			return true
+		}
+		return false
+	},
+}
+
+// msgpackHandle uses the json tags and the timestamp extension for times.
+var msgpackHandle = func() *ugorji.MsgpackHandle {
+	h := &ugorji.MsgpackHandle{WriteExt: true}
+	h.RawToString = true
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return h
+}()
+
+var msgpackCodec = &codec{
+	mediaTypes:   []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"},
+	responseType: "application/msgpack",
+	marshal: func(v interface{}) ([]byte, error) {
+		var b []byte
+		err := ugorji.NewEncoderBytes(&b, msgpackHandle).Encode(v)
+		return b, err
+	},
+	unmarshal: func(data []byte, v interface{}) error {
+		return ugorji.NewDecoderBytes(data, msgpackHandle).Decode(v)
+	},
+	supports: always,
+}
+
+// cborEncMode writes times as RFC 3339 strings, as JSON does.
+var cborEncMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+
+var cborDecMode, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+
+var cborCodec = &codec{
+	mediaTypes:   []string{"application/cbor"},
+	responseType: "application/cbor",
+	marshal:      cborEncMode.Marshal,
+	unmarshal:    cborDecMode.Unmarshal,
+	supports:     always,
+}
+
+// codecs are in the order of preference when a client accepts several
+// equally.
+var codecs = []*codec{jsonCodec, protobufCodec, msgpackCodec, cborCodec}
@@ -0,0 +1,143 @@
+package negotiate
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is a compressor that Compress reuses across responses.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var encoders = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} { return gzip.NewWriter(nil) }},
+	"zstd": {New: func() interface{} {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return e
+	}},
+}
+
+// ParseEncodings parses a comma separated list of content codings for
+// Compress, in order of preference. An empty list disables compression.
+func ParseEncodings(s string) ([]string, error) {
+	var encodings []string
+	for _, e := range strings.Split(s, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if encoders[e] == nil {
+			return nil, fmt.Errorf("unsupported content coding %q", e)
+		}
+		encodings = append(encodings, e)
+	}
+	return encodings, nil
+}
+
+// Compress encodes response bodies of at least minSize bytes with the
+// coding of encodings the client accepts best, preferring earlier ones on
+// ties. Only the first write of a response counts towards minSize, so
+// streams start compressing right away or not at all. Strong ETags become
+// weak on compressed responses, whose bytes differ from what was tagged.
+func Compress(encodings []string, minSize int) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if len(encodings) == 0 {
+			ctx.Next()
+			return
+		}
+		ctx.Writer.Header().Add("Vary", "Accept-Encoding")
+		encoding := chooseEncoding(ctx.GetHeader("Accept-Encoding"), encodings)
+		if encoding == "" || ctx.Request.Method == http.MethodHead {
+			ctx.Next()
+			return
+		}
+
+		w := &compressWriter{ResponseWriter: ctx.Writer, encoding: encoding, minSize: minSize}
+		ctx.Writer = w
+		defer func() {
+			w.close()
+			ctx.Writer = w.ResponseWriter
+		}()
+		ctx.Next()
+	}
+}
+
+func chooseEncoding(accept string, encodings []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return ""
+	}
+	best, bestQ := "", 0.0
+	for _, e := range encodings {
+		if q := quality(accept, e); q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int
+	decided  bool
+	enc      encoder
+}
+
+// start decides on the first write whether to compress the response.
+func (w *compressWriter) start(n int) {
+	w.decided = true
+	header := w.Header()
+	status := w.Status()
+	if n < w.minSize || header.Get("Content-Encoding") != "" ||
+		status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		return
+	}
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	w.enc = encoders[w.encoding].Get().(encoder)
+	w.enc.Reset(w.ResponseWriter)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.start(len(p))
+	}
+	if w.enc == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.enc.Write(p)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) Flush() {
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) close() {
+	if w.enc == nil {
+		return
+	}
+	w.enc.Close()
+	w.enc.Reset(nil)
+	encoders[w.encoding].Put(w.enc)
+	w.enc = nil
+}
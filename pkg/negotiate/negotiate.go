@@ -0,0 +1,177 @@
+// Package negotiate lets REST handlers speak the formats clients ask for
+// with Accept and Content-Type: JSON, protobuf, MessagePack and CBOR. It
+// also compresses responses with the content coding Accept-Encoding asks
+// for, see Compress.
+package negotiate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+var (
+	ErrNotAcceptable        = errors.New("none of the accepted media types is supported")
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+)
+
+// Middleware answers 406 Not Acceptable when Accept rules out every
+// supported media type, and 415 Unsupported Media Type when the body is in
+// none of them, before the handler runs.
+func Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !acceptable(ctx.GetHeader("Accept")) {
+			ctx.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H{"error": ErrNotAcceptable.Error()})
+			return
+		}
+		if hasBody(ctx.Request) {
+			if _, err := forContentType(ctx.GetHeader("Content-Type")); err != nil {
+				ctx.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		ctx.Next()
+	}
+}
+
+// Render writes v in the media type the client accepts best among those
+// that can encode it. Accept is disregarded, as RFC 9110 allows, when none
+// can: Middleware has refused requests no format could satisfy, and
+// errors have to reach clients that only accept protobuf too.
+func Render(ctx *gin.Context, status int, v interface{}) {
+	ctx.Writer.Header().Add("Vary", "Accept")
+	c := negotiate(ctx.GetHeader("Accept"), v)
+	body, err := c.marshal(v)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to encode response: %v", err)})
+		return
+	}
+	ctx.Data(status, c.responseType, body)
+}
+
+// ShouldBind decodes the body of the request into v in the format its
+// Content-Type names, JSON if none, and validates it like gin does.
+func ShouldBind(ctx *gin.Context, v interface{}) error {
+	c, err := forContentType(ctx.GetHeader("Content-Type"))
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return err
+	}
+	if err := c.unmarshal(body, v); err != nil {
+		return err
+	}
+	if binding.Validator == nil {
+		return nil
+	}
+	return binding.Validator.ValidateStruct(v)
+}
+
+// Bind is ShouldBind answering 415 or 400 itself on failure. It reports
+// whether the handler can go on.
+func Bind(ctx *gin.Context, v interface{}) bool {
+	err := ShouldBind(ctx, v)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, ErrUnsupportedMediaType):
+		Render(ctx, http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	default:
+		Render(ctx, http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+	return false
+}
+
+func hasBody(r *http.Request) bool {
+	return r.ContentLength > 0 || len(r.TransferEncoding) > 0
+}
+
+func forContentType(contentType string) (*codec, error) {
+	if contentType == "" {
+		return jsonCodec, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMediaType, contentType)
+	}
+	for _, c := range codecs {
+		for _, t := range c.mediaTypes {
+			if t == mediaType {
+				return c, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedMediaType, mediaType)
+}
+
+func acceptable(accept string) bool {
+	for _, c := range codecs {
+		if c.quality(accept) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate picks the codec for v with the highest quality in accept,
+// preferring earlier codecs on ties and JSON when none fits.
+func negotiate(accept string, v interface{}) *codec {
+	best, bestQ := jsonCodec, 0.0
+	for _, c := range codecs {
+		if q := c.quality(accept); q > bestQ && c.supports(v) {
+			best, bestQ = c, q
+		}
+	}
+	return best
+}
+
+// quality returns the weight accept gives to value, taken from its most
+// specific matching range. Ranges are "type/subtype", "type/*" or "*/*"
+// for media types and a token or "*" for content codings. An empty accept
+// accepts anything.
+func quality(accept, value string) float64 {
+	if strings.TrimSpace(accept) == "" {
+		return 1
+	}
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		rng := strings.ToLower(strings.TrimSpace(params[0]))
+		s := matches(rng, value)
+		if s <= specificity {
+			continue
+		}
+		q, specificity = 1, s
+		for _, param := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+	}
+	return q
+}
+
+// matches returns how specific rng is if it matches value, or -1.
+func matches(rng, value string) int {
+	switch {
+	case rng == value:
+		return 2
+	case rng == "*" || rng == "*/*":
+		return 0
+	case strings.HasSuffix(rng, "/*") && strings.HasPrefix(value, strings.TrimSuffix(rng, "*")):
+		return 1
+	}
+	return -1
+}
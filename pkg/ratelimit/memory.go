@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory store drops full buckets and
+// expired counters.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	fullAt  time.Time
+}
+
+type counter struct {
+	used    int
+	expires time.Time
+}
+
+// MemoryStore keeps buckets and counters in memory. Limits apply per
+// instance, so with several instances each allows the full rate.
+type MemoryStore struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	counters map[string]*counter
+	swept    time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:  make(map[string]*bucket),
+		counters: make(map[string]*counter),
+	}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	tokens, res := limit.take(b.tokens, now.Sub(b.updated))
+	b.tokens, b.updated, b.fullAt = tokens, now, now.Add(res.Reset)
+	return res, nil
+}
+
+func (s *MemoryStore) Reserve(ctx context.Context, key string, n, limit int, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.expires) {
+		c = &counter{expires: expires}
+		s.counters[key] = c
+	}
+	if c.used+n > limit {
+		return false, nil
+	}
+	c.used += n
+	return true, nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, key string, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.counters[key]; ok {
+		c.used = max(c.used-n, 0)
+	}
+	return nil
+}
+
+// sweep drops buckets that are full again, as a missing bucket starts
+// full, and counters that expired.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.swept) < sweepInterval {
+		return
+	}
+	s.swept = now
+	for key, b := range s.buckets {
+		if !now.Before(b.fullAt) {
+			delete(s.buckets, key)
+		}
+	}
+	for key, c := range s.counters {
+		if !now.Before(c.expires) {
+			delete(s.counters, key)
+		}
+	}
+}
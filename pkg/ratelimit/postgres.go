@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// PostgresStore keeps buckets and counters in the rate_limit_buckets and
+// rate_limit_counters tables, so all instances share the limits. Times come
+// from the database clock.
+type PostgresStore struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresStore(db *pgxpool.Pool) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return Result{}, fmt.Errorf("Take: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// The no-op update locks the row until the transaction ends, so
+	// concurrent requests for key take their tokens one after the other.
+	var tokens, elapsed float64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO rate_limit_buckets (key, tokens, updated, full_at) VALUES ($1, $2, now(), now())
+		ON CONFLICT (key) DO UPDATE SET key = EXCLUDED.key
+		RETURNING tokens, EXTRACT(EPOCH FROM now() - updated)::float8
+	`, key, float64(limit.Burst)).Scan(&tokens, &elapsed)
+	if err != nil {
+		return Result{}, fmt.Errorf("Take: failed to lock bucket %s: %w", key, err)
+	}
+	tokens, res := limit.take(tokens, time.Duration(elapsed*float64(time.Second)))
+	_, err = tx.Exec(ctx, `
+		UPDATE rate_limit_buckets SET tokens = $2, updated = now(), full_at = now() + make_interval(secs => $3)
+		WHERE key = $1
+	`, key, tokens, res.Reset.Seconds())
+	if err != nil {
+		return Result{}, fmt.Errorf("Take: failed to update bucket %s: %w", key, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return Result{}, fmt.Errorf("Take: failed to commit transaction: %w", err)
+	}
+	return res, nil
+}
+
+func (s *PostgresStore) Reserve(ctx context.Context, key string, n, limit int, expires time.Time) (bool, error) {
+	if n > limit {
+		return false, nil
+	}
+	var used int
+	err := s.db.QueryRow(ctx, `
+		INSERT INTO rate_limit_counters AS c (key, used, expires) VALUES ($1, $2, $4)
+		ON CONFLICT (key) DO UPDATE
+		SET used = CASE WHEN c.expires <= now() THEN EXCLUDED.used ELSE c.used + EXCLUDED.used END,
+			expires = EXCLUDED.expires
+		WHERE c.expires <= now() OR c.used + EXCLUDED.used <= $3
+		RETURNING used
+	`, key, n, limit, expires).Scan(&used)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Reserve: failed to count %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *PostgresStore) Release(ctx context.Context, key string, n int) error {
+	_, err := s.db.Exec(ctx, "UPDATE rate_limit_counters SET used = GREATEST(used - $2, 0) WHERE key = $1", key, n)
+	if err != nil {
+		return fmt.Errorf("Release: failed to release %s: %w", key, err)
+	}
+	return nil
+}
+
+// Run deletes buckets that are full again, as a missing bucket starts full,
+// and expired counters every interval until ctx is done.
+func (s *PostgresStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, query := range []string{
+			"DELETE FROM rate_limit_buckets WHERE full_at <= now()",
+			"DELETE FROM rate_limit_counters WHERE expires <= now()",
+		} {
+			if _, err := s.db.Exec(ctx, query); err != nil && ctx.Err() == nil {
+				log.Printf("ratelimit: failed to purge: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuotaError is returned when a reservation would exceed a quota.
+type QuotaError struct {
+	Name  string
+	Scope string
+	Limit int
+	// Reset is when the quota starts over.
+	Reset time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("daily %s quota of %d exceeded for %s", e.Name, e.Limit, e.Scope)
+}
+
+// Quota caps how much of something each scope, such as a tenant, may use
+// per day. Days start at midnight UTC.
+type Quota struct {
+	counter Counter
+	name    string
+	limit   int
+	limits  map[string]int
+}
+
+// NewQuota returns a quota of limit per scope, with limits overriding it
+// for some scopes. A limit of 0 means unlimited.
+func NewQuota(counter Counter, name string, limit int, limits map[string]int) *Quota {
+	return &Quota{counter: counter, name: name, limit: limit, limits: limits}
+}
+
+// ParseQuotas parses a comma separated list of scope=limit pairs.
+func ParseQuotas(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		scope, limit, ok := strings.Cut(pair, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("quota %q is not scope=limit", pair)
+		}
+		limits[strings.TrimSpace(scope)] = n
+	}
+	return limits, nil
+}
+
+func (q *Quota) limitOf(scope string) int {
+	if limit, ok := q.limits[scope]; ok {
+		return limit
+	}
+	return q.limit
+}
+
+func (q *Quota) key(scope string, day time.Time) string {
+	return fmt.Sprintf("quota:%s:%s:%s", q.name, scope, day.Format("2006-01-02"))
+}
+
+// Reserve counts n against the quota of scope for today, or returns a
+// QuotaError and counts nothing if that would exceed it.
+func (q *Quota) Reserve(ctx context.Context, scope string, n int) error {
+	limit := q.limitOf(scope)
+	if limit == 0 {
+		return nil
+	}
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	reset := day.Add(24 * time.Hour)
+	ok, err := q.counter.Reserve(ctx, q.key(scope, day), n, limit, reset)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &QuotaError{Name: q.name, Scope: scope, Limit: limit, Reset: reset}
+	}
+	return nil
+}
+
+// Release gives back n of a reservation that was not used, such as users
+// that failed to be created. Errors are only logged.
+func (q *Quota) Release(ctx context.Context, scope string, n int) {
+	if n == 0 || q.limitOf(scope) == 0 {
+		return
+	}
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	if err := q.counter.Release(ctx, q.key(scope, day), n); err != nil {
+		log.Printf("ratelimit: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+// Package ratelimit implements token bucket rate limits and daily quotas
+// with an in-memory backend for single instances and a Postgres backend
+// shared by all instances.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket holding up to Burst tokens that refills at Rate
+// tokens per second. Every request takes one token.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+var units = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+}
+
+// ParseLimit parses "N/unit" with unit s, m, h or d, optionally followed by
+// ":burst". Without a burst the bucket holds N tokens, so "100/m" allows
+// 100 requests at once and then one every 600ms.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	rate, burst, hasBurst := strings.Cut(s, ":")
+	n, unit, ok := strings.Cut(rate, "/")
+	count, err := strconv.Atoi(n)
+	if !ok || err != nil || count <= 0 || units[unit] == 0 {
+		return Limit{}, fmt.Errorf("rate limit %q is not N/s, N/m, N/h or N/d", s)
+	}
+	limit := Limit{Rate: float64(count) / units[unit].Seconds(), Burst: count}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return Limit{}, fmt.Errorf("rate limit %q has an invalid burst", s)
+		}
+	}
+	return limit, nil
+}
+
+// Result is the state of a bucket after a request took from it.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is how long a denied request has to wait for a token.
+	RetryAfter time.Duration
+	// Reset is how long it takes the bucket to fill up again.
+	Reset time.Duration
+}
+
+// Store keeps token buckets.
+type Store interface {
+	// Take takes a token from the bucket of key, which starts full.
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// Counter keeps counters that expire, for quotas.
+type Counter interface {
+	// Reserve adds n to the counter of key if it stays within limit. The
+	// counter is dropped at expires.
+	Reserve(ctx context.Context, key string, n, limit int, expires time.Time) (bool, error)
+	// Release takes n back from the counter of key.
+	Release(ctx context.Context, key string, n int) error
+}
+
+// Backend keeps both buckets and counters.
+type Backend interface {
+	Store
+	Counter
+}
+
+// take refills a bucket that held tokens elapsed ago and takes a token from
+// it. It returns the tokens left and when the bucket is full again.
+func (l Limit) take(tokens float64, elapsed time.Duration) (float64, Result) {
+	tokens = math.Min(float64(l.Burst), tokens+elapsed.Seconds()*l.Rate)
+	res := Result{Limit: l.Burst}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = l.duration(1 - tokens)
+	}
+	res.Remaining = int(tokens)
+	res.Reset = l.duration(float64(l.Burst) - tokens)
+	return tokens, res
+}
+
+// duration is how long refilling tokens takes.
+func (l Limit) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.Rate * float64(time.Second))
+}
@@ -0,0 +1,492 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	authPack "user-api/internal/auth-pack"
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/password"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type MockAuthRepository struct {
+	mock.Mock
+}
+
+func (m *MockAuthRepository) GetCredentials(ctx context.Context, email string) (*authPack.Credentials, error) {
+	args := m.Called(ctx, email)
+	if c, ok := args.Get(0).(*authPack.Credentials); ok {
+		return c, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockAuthRepository) GetRoles(ctx context.Context, userID int) ([]string, error) {
+	args := m.Called(ctx, userID)
+	if roles, ok := args.Get(0).([]string); ok {
+		return roles, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockAuthRepository) UpdatePasswordHash(ctx context.Context, userID int, hash string) error {
+	args := m.Called(ctx, userID, hash)
+	return args.Error(0)
+}
+
+func (m *MockAuthRepository) ListSigningKeys(ctx context.Context, since time.Time) ([]*authPack.SigningKey, error) {
+	args := m.Called(ctx, since)
+	if keys, ok := args.Get(0).([]*authPack.SigningKey); ok {
+		return keys, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockAuthRepository) CreateSigningKey(ctx context.Context, key *authPack.SigningKey) error {
+	args := m.Called(ctx, key)
+	return args.Error(0)
+}
+
+func (m *MockAuthRepository) DeleteSigningKeys(ctx context.Context, before time.Time) error {
+	args := m.Called(ctx, before)
+	return args.Error(0)
+}
+
+func (m *MockAuthRepository) CreateRefreshToken(ctx context.Context, token *authPack.RefreshToken) error {
+	args := m.Called(ctx, token)
+	return args.Error(0)
+}
+
+func (m *MockAuthRepository) RotateRefreshToken(ctx context.Context, oldHash []byte, next *authPack.RefreshToken) error {
+	args := m.Called(ctx, oldHash, next)
+	return args.Error(0)
+}
+
+func (m *MockAuthRepository) RevokeRefreshTokenFamily(ctx context.Context, hash []byte) error {
+	args := m.Called(ctx, hash)
+	return args.Error(0)
+}
+
+func (m *MockAuthRepository) RevokeUserRefreshTokens(ctx context.Context, userID int) (int64, error) {
+	args := m.Called(ctx, userID)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockAuthRepository) GetTOTPSecret(ctx context.Context, userID int) (*authPack.TOTPSecret, error) {
+	args := m.Called(ctx, userID)
+	if secret, ok := args.Get(0).(*authPack.TOTPSecret); ok {
+		return secret, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockAuthRepository) SaveTOTPSecret(ctx context.Context, userID int, secret []byte) error {
+	args := m.Called(ctx, userID, secret)
+	return args.Error(0)
+}
+
+func (m *MockAuthRepository) ConfirmTOTP(ctx context.Context, userID int, counter int64, recoveryCodeHashes [][]byte) error {
+	args := m.Called(ctx, userID, counter, recoveryCodeHashes)
+	return args.Error(0)
+}
+
+func (m *MockAuthRepository) UseTOTPCounter(ctx context.Context, userID int, counter int64) (bool, error) {
+	args := m.Called(ctx, userID, counter)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockAuthRepository) UseRecoveryCode(ctx context.Context, userID int, hash []byte) (bool, error) {
+	args := m.Called(ctx, userID, hash)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockAuthRepository) DeleteMFA(ctx context.Context, userID int) (bool, error) {
+	args := m.Called(ctx, userID)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockAuthRepository) GetUserIDByEmail(ctx context.Context, email string) (int, error) {
+	args := m.Called(ctx, email)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockAuthRepository) CreatePasswordResetToken(ctx context.Context, userID int, hash []byte, expiresAt time.Time) error {
+	args := m.Called(ctx, userID, hash, expiresAt)
+	return args.Error(0)
+}
+
+func (m *MockAuthRepository) ResetPassword(ctx context.Context, tokenHash []byte, passwordHash string) (int, error) {
+	args := m.Called(ctx, tokenHash, passwordHash)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockAuthRepository) Throttle(ctx context.Context, key string, limit int, window time.Duration) (bool, error) {
+	args := m.Called(ctx, key, limit, window)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockAuthRepository) LockedUntil(ctx context.Context, keys []string) (time.Time, error) {
+	args := m.Called(ctx, keys)
+	return args.Get(0).(time.Time), args.Error(1)
+}
+
+func (m *MockAuthRepository) RecordLoginFailure(ctx context.Context, key string, userID int, ip string, policy authPack.LockoutPolicy) (*authPack.Lockout, bool, error) {
+	args := m.Called(ctx, key, userID, ip, policy)
+	if args.Get(0) == nil {
+		return nil, args.Bool(1), args.Error(2)
+	}
+	return args.Get(0).(*authPack.Lockout), args.Bool(1), args.Error(2)
+}
+
+func (m *MockAuthRepository) ClearLoginFailures(ctx context.Context, key string) error {
+	args := m.Called(ctx, key)
+	return args.Error(0)
+}
+
+func (m *MockAuthRepository) Unlock(ctx context.Context, key string, userID int) (bool, error) {
+	args := m.Called(ctx, key, userID)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockAuthRepository) ListLockouts(ctx context.Context) ([]*authPack.Lockout, error) {
+	args := m.Called(ctx)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]*authPack.Lockout), args.Error(1)
+}
+
+// testParams keep hashing fast in tests.
+var testParams = password.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+var testTokenConfig = authPack.TokenConfig{
+	Issuer:          "user-api",
+	Audience:        "user-api",
+	AccessTokenTTL:  15 * time.Minute,
+	RefreshTokenTTL: time.Hour,
+}
+
+// newAuthService returns an AuthService whose key manager has generated a
+// fresh signing key through authRepo.
+func newAuthService(t *testing.T, authRepo *MockAuthRepository, userRepo *MockUserRepository, alg string, opts ...authPack.AuthServiceOption) *authPack.AuthService {
+	authRepo.On("ListSigningKeys", mock.Anything, mock.Anything).Return(nil, nil).Once()
+	authRepo.On("CreateSigningKey", mock.Anything, mock.Anything).Return(nil).Once()
+	authRepo.On("DeleteSigningKeys", mock.Anything, mock.Anything).Return(nil).Once()
+
+	keys, err := authPack.NewKeyManager(authRepo, authPack.KeyConfig{Algorithm: alg, RotationInterval: time.Hour, VerifyFor: 15 * time.Minute})
+	require.NoError(t, err)
+	require.NoError(t, keys.Refresh(context.Background()))
+
+	hasher := password.NewHasher(testParams)
+	service, err := authPack.NewAuthService(authRepo, userPack.NewUserService(userRepo, userPack.WithPasswordHasher(hasher)), hasher, keys, testTokenConfig, opts...)
+	require.NoError(t, err)
+	return service
+}
+
+// refreshAs returns the tokens of a refresh by userID, who holds roles. It
+// expects no other RotateRefreshToken mocks that would match first.
+func refreshAs(t *testing.T, authService *authPack.AuthService, authRepo *MockAuthRepository, userRepo *MockUserRepository, userID int, roles ...string) *authPack.TokenPair {
+	userRepo.On("GetUser", mock.Anything, userID).Return(&userPack.User{ID: userID, Status: userPack.StatusActive}, nil).Once()
+	authRepo.On("GetRoles", mock.Anything, userID).Return(roles, nil).Once()
+	authRepo.On("RotateRefreshToken", mock.Anything, mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		next := args.Get(2).(*authPack.RefreshToken)
+		next.UserID, next.FamilyID = userID, "family"
+	}).Once()
+	tokens, err := authService.Refresh(context.Background(), "refresh")
+	require.NoError(t, err)
+	return tokens
+}
+
+func postJSON(router *gin.Engine, path string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, path, bytes.NewBuffer(data))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// postJSONFrom is postJSON from a client at remoteAddr.
+func postJSONFrom(router *gin.Engine, path, remoteAddr string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, path, bytes.NewBuffer(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestCreateUserWithPassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	mockRepo := new(MockUserRepository)
+	userService := userPack.NewUserService(mockRepo, userPack.WithPasswordHasher(password.NewHasher(testParams)))
+	router.POST("/users", userPack.NewUserHandler(userService).CreateUser)
+
+	body := map[string]interface{}{"firstname": "John", "lastname": "Doe", "email": "john.doe@example.com", "age": 30, "password": "short"}
+	w := postJSON(router, "/users", body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	mockRepo.On("CreateUser", mock.Anything, mock.MatchedBy(func(u *userPack.User) bool {
+		return u.Password == "" && strings.HasPrefix(u.PasswordHash, "$argon2id$")
+	})).Return(nil)
+
+	body["password"] = "correct horse battery staple"
+	w = postJSON(router, "/users", body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NotContains(t, w.Body.String(), "password")
+	assert.NotContains(t, w.Body.String(), "argon2id")
+	mockRepo.AssertExpectations(t)
+}
+
+func TestLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	hasher := password.NewHasher(testParams)
+	hash, err := hasher.Hash("correct horse battery staple")
+	require.NoError(t, err)
+	oldParams := testParams
+	oldParams.Iterations = 2
+	oldHash, err := password.NewHasher(oldParams).Hash("correct horse battery staple")
+	require.NoError(t, err)
+
+	mockRepo := new(MockUserRepository)
+	mockAuthRepo := new(MockAuthRepository)
+	authService := newAuthService(t, mockAuthRepo, mockRepo, authPack.AlgorithmEdDSA)
+	router.POST("/auth/login", authPack.NewAuthHandler(authService).Login)
+
+	user := &userPack.User{ID: 1, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Age: 30, Status: userPack.StatusActive}
+	mockRepo.On("GetUser", mock.Anything, 1).Return(user, nil)
+	mockAuthRepo.On("GetCredentials", mock.Anything, "john.doe@example.com").Return(&authPack.Credentials{UserID: 1, PasswordHash: hash}, nil)
+	mockAuthRepo.On("GetCredentials", mock.Anything, "jane.doe@example.com").Return(&authPack.Credentials{UserID: 1, PasswordHash: oldHash}, nil)
+	mockAuthRepo.On("GetCredentials", mock.Anything, "nobody@example.com").Return(nil, authPack.ErrCredentialsNotFound)
+	mockAuthRepo.On("UpdatePasswordHash", mock.Anything, 1, mock.MatchedBy(func(h string) bool {
+		return strings.HasPrefix(h, "$argon2id$v=19$m=1024,t=1,p=1$")
+	})).Return(nil).Once()
+	mockAuthRepo.On("CreateRefreshToken", mock.Anything, mock.MatchedBy(func(token *authPack.RefreshToken) bool {
+		return token.UserID == 1 && token.FamilyID != "" && len(token.TokenHash) == 32
+	})).Return(nil)
+	mockAuthRepo.On("GetRoles", mock.Anything, 1).Return([]string{reqctx.RoleAdmin}, nil)
+	mockAuthRepo.On("GetTOTPSecret", mock.Anything, 1).Return(nil, authPack.ErrMFANotEnrolled)
+
+	// Test case: Missing password
+	w := postJSON(router, "/auth/login", authPack.LoginRequest{Email: "john.doe@example.com"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Test case: Wrong password and unknown email look the same
+	w = postJSON(router, "/auth/login", authPack.LoginRequest{Email: "john.doe@example.com", Password: "wrong password"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	wrongPassword := w.Body.String()
+	w = postJSON(router, "/auth/login", authPack.LoginRequest{Email: "nobody@example.com", Password: "wrong password"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, wrongPassword, w.Body.String())
+
+	// Test case: Successful login
+	w = postJSON(router, "/auth/login", authPack.LoginRequest{Email: "john.doe@example.com", Password: "correct horse battery staple"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"email":"john.doe@example.com"`)
+	assert.NotContains(t, w.Body.String(), "argon2id")
+	var tokens authPack.TokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+	assert.Equal(t, "Bearer", tokens.TokenType)
+	assert.Equal(t, 900, tokens.ExpiresIn)
+	assert.NotEmpty(t, tokens.RefreshToken)
+	claims, err := authService.VerifyAccessToken(tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "1", claims.Subject)
+	assert.Equal(t, []string{reqctx.RoleAdmin}, claims.Roles)
+
+	// Test case: Hash with outdated parameters is upgraded
+	w = postJSON(router, "/auth/login", authPack.LoginRequest{Email: "jane.doe@example.com", Password: "correct horse battery staple"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	mockAuthRepo.AssertExpectations(t)
+}
+
+func TestJWKS(t *testing.T) {
+	for _, alg := range []string{authPack.AlgorithmEdDSA, authPack.AlgorithmRS256} {
+		t.Run(alg, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			router := gin.Default()
+
+			mockRepo := new(MockUserRepository)
+			mockAuthRepo := new(MockAuthRepository)
+			authService := newAuthService(t, mockAuthRepo, mockRepo, alg)
+			router.GET("/.well-known/jwks.json", authPack.NewAuthHandler(authService).JWKS)
+
+			mockRepo.On("GetUser", mock.Anything, 7).Return(&userPack.User{ID: 7, Status: userPack.StatusActive}, nil)
+			mockAuthRepo.On("CreateRefreshToken", mock.Anything, mock.Anything).Return(nil)
+			mockAuthRepo.On("GetRoles", mock.Anything, 7).Return(nil, nil)
+			mockAuthRepo.On("RotateRefreshToken", mock.Anything, mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+				next := args.Get(2).(*authPack.RefreshToken)
+				next.UserID, next.FamilyID = 7, "family"
+			})
+			tokens, err := authService.Refresh(context.Background(), "refresh")
+			require.NoError(t, err)
+
+			req, _ := http.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			var set authPack.JWKS
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &set))
+			require.Len(t, set.Keys, 1)
+			key := set.Keys[0]
+			assert.Equal(t, alg, key.Algorithm)
+			assert.Equal(t, "sig", key.Use)
+
+			// Verify the access token with nothing but the published key.
+			parsed, err := jwt.Parse(tokens.AccessToken, func(token *jwt.Token) (interface{}, error) {
+				assert.Equal(t, key.KeyID, token.Header["kid"])
+				if key.KeyType == "OKP" {
+					x, err := base64.RawURLEncoding.DecodeString(key.X)
+					return ed25519.PublicKey(x), err
+				}
+				n, err := base64.RawURLEncoding.DecodeString(key.N)
+				if err != nil {
+					return nil, err
+				}
+				e, err := base64.RawURLEncoding.DecodeString(key.E)
+				return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, err
+			}, jwt.WithValidMethods([]string{alg}))
+			require.NoError(t, err)
+			sub, _ := parsed.Claims.GetSubject()
+			assert.Equal(t, "7", sub)
+		})
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	mockRepo := new(MockUserRepository)
+	mockAuthRepo := new(MockAuthRepository)
+	authService := newAuthService(t, mockAuthRepo, mockRepo, authPack.AlgorithmEdDSA)
+	handler := authPack.NewAuthHandler(authService)
+	router.POST("/auth/refresh", handler.Refresh)
+	router.POST("/auth/logout", handler.Logout)
+
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{ID: 1, Status: userPack.StatusActive}, nil)
+	hashOf := func(token string) []byte {
+		sum := sha256.Sum256([]byte(token))
+		return sum[:]
+	}
+	mockAuthRepo.On("RotateRefreshToken", mock.Anything, hashOf("current"), mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		next := args.Get(2).(*authPack.RefreshToken)
+		next.UserID, next.FamilyID = 1, "family"
+	})
+	mockAuthRepo.On("RotateRefreshToken", mock.Anything, hashOf("used"), mock.Anything).Return(authPack.ErrRefreshTokenReused)
+	mockAuthRepo.On("RotateRefreshToken", mock.Anything, hashOf("unknown"), mock.Anything).Return(authPack.ErrRefreshTokenInvalid)
+	mockAuthRepo.On("RevokeRefreshTokenFamily", mock.Anything, hashOf("current")).Return(nil)
+	mockAuthRepo.On("GetRoles", mock.Anything, 1).Return([]string{"support"}, nil)
+
+	// Test case: Missing token
+	w := postJSON(router, "/auth/refresh", authPack.RefreshRequest{})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Test case: Successful rotation
+	w = postJSON(router, "/auth/refresh", authPack.RefreshRequest{RefreshToken: "current"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var tokens authPack.TokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+	assert.NotEqual(t, "current", tokens.RefreshToken)
+	claims, err := authService.VerifyAccessToken(tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "family", claims.SessionID)
+	assert.Equal(t, []string{"support"}, claims.Roles)
+
+	// Test case: Reused and unknown tokens
+	w = postJSON(router, "/auth/refresh", authPack.RefreshRequest{RefreshToken: "used"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = postJSON(router, "/auth/refresh", authPack.RefreshRequest{RefreshToken: "unknown"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Test case: Logout
+	w = postJSON(router, "/auth/logout", authPack.RefreshRequest{RefreshToken: "current"})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	mockAuthRepo.AssertExpectations(t)
+}
+
+func TestRevokeTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.Use(reqctx.GinMiddleware(trustedProxy()))
+
+	mockRepo := new(MockUserRepository)
+	mockAuthRepo := new(MockAuthRepository)
+	authService := newAuthService(t, mockAuthRepo, mockRepo, authPack.AlgorithmEdDSA)
+	router.POST("/auth/revoke", authPack.NewAuthHandler(authService).Revoke)
+
+	tokens := refreshAs(t, authService, mockAuthRepo, mockRepo, 1)
+	adminTokens := refreshAs(t, authService, mockAuthRepo, mockRepo, 9, reqctx.RoleAdmin)
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{ID: 1}, nil)
+	mockRepo.On("GetUser", mock.Anything, 2).Return(&userPack.User{ID: 2}, nil)
+	mockRepo.On("GetUser", mock.Anything, 3).Return(nil, userPack.ErrUserNotFound)
+	mockAuthRepo.On("RevokeUserRefreshTokens", mock.Anything, 1).Return(int64(3), nil).Once()
+	mockAuthRepo.On("RevokeUserRefreshTokens", mock.Anything, 2).Return(int64(1), nil).Once()
+
+	revoke := func(token, roles string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(http.MethodPost, "/auth/revoke", bytes.NewBuffer(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = proxyAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if roles != "" {
+			req.Header.Set(reqctx.ActorRolesHeader, roles)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Test case: Missing or tampered access token
+	w := revoke("", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = revoke(tokens.AccessToken+"x", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Test case: Revoking own tokens
+	w = revoke(tokens.AccessToken, "", authPack.RevokeRequest{})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"revoked":3}`, w.Body.String())
+
+	// Test case: Other users need the admin role in the access token; an
+	// actor header does not grant it
+	w = revoke(tokens.AccessToken, "", authPack.RevokeRequest{UserID: 2})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = revoke(tokens.AccessToken, "admin", authPack.RevokeRequest{UserID: 2})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = revoke(adminTokens.AccessToken, "", authPack.RevokeRequest{UserID: 2})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Test case: Admins cannot sign out users of another tenant, which the
+	// scoped lookup does not find
+	w = revoke(adminTokens.AccessToken, "", authPack.RevokeRequest{UserID: 3})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	mockAuthRepo.AssertNotCalled(t, "RevokeUserRefreshTokens", mock.Anything, 3)
+	mockAuthRepo.AssertExpectations(t)
+}
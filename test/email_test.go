@@ -0,0 +1,254 @@
+package test
+
+import (
+	"context"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/mailer"
+	"user-api/pkg/signedtoken"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// smtpStandIn is a minimal in-process SMTP server that accepts every
+// message and keeps it for inspection.
+type smtpStandIn struct {
+	addr string
+	mu   sync.Mutex
+	mail []receivedMail
+}
+
+func startSMTPStandIn(t *testing.T) *smtpStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	s := &smtpStandIn{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP stand-in")
+
+	var current receivedMail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			current = receivedMail{From: strings.TrimPrefix(line, "MAIL FROM:")}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			current.To = append(current.To, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			current.Data = string(data)
+			s.mu.Lock()
+			s.mail = append(s.mail, current)
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (s *smtpStandIn) received() []receivedMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedMail(nil), s.mail...)
+}
+
+var tokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_.-]+)`)
+
+// mailToken decodes the quoted-printable body of a mail and returns the
+// token of the verification link in it.
+func mailToken(t *testing.T, mail receivedMail) string {
+	_, body, ok := strings.Cut(mail.Data, "\n\n")
+	require.True(t, ok)
+	decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(body)))
+	require.NoError(t, err)
+	match := tokenPattern.FindStringSubmatch(string(decoded))
+	require.NotNil(t, match, "no verification link in %q", decoded)
+	return match[1]
+}
+
+func TestEmailVerification(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	smtpServer := startSMTPStandIn(t)
+	smtpMailer := mailer.NewSMTPMailer(mailer.SMTPConfig{Addr: smtpServer.addr, From: "user-api <no-reply@example.com>", Timeout: 5 * time.Second})
+	signer := signedtoken.NewSigner([]byte("test secret"))
+
+	mockRepo := new(MockUserRepository)
+	userService := userPack.NewUserService(mockRepo, userPack.WithEmailVerification(smtpMailer, signer, userPack.EmailVerificationConfig{
+		URL: "http://localhost:8080/users:verifyEmail",
+		TTL: time.Hour,
+	}))
+	handler := userPack.NewUserHandler(userService)
+	router.POST("/users", handler.CreateUser)
+	router.PATCH("/user/:id", handler.UpdateUser)
+	router.GET("/users:method", handler.CollectionMethod)
+
+	verify := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, "/users:verifyEmail?token="+token, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Test case: Sign-up sends a verification mail and ignores a client-set flag
+	mockRepo.On("CreateUser", mock.Anything, mock.MatchedBy(func(u *userPack.User) bool {
+		return !u.EmailVerified
+	})).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(1).(*userPack.User).ID = 1
+	})
+	w := postJSON(router, "/users", map[string]interface{}{"firstname": "John", "lastname": "Doe", "email": "john.doe@example.com", "age": 30, "email_verified": true})
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), `"email_verified":false`)
+
+	mail := smtpServer.received()
+	require.Len(t, mail, 1)
+	assert.Equal(t, []string{"john.doe@example.com"}, mail[0].To)
+	assert.Contains(t, mail[0].Data, "Subject: Confirm your email address")
+	token := mailToken(t, mail[0])
+
+	// Test case: The token verifies the address once
+	verified := &userPack.User{ID: 1, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Age: 30, EmailVerified: true}
+	mockRepo.On("VerifyEmail", mock.Anything, 1, "john.doe@example.com", mock.Anything, mock.Anything).Return(verified, nil).Once()
+	mockRepo.On("VerifyEmail", mock.Anything, 1, "john.doe@example.com", mock.Anything, mock.Anything).Return(nil, userPack.ErrInvalidEmailToken).Once()
+	w = verify(token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"email_verified":true`)
+	w = verify(token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Test case: Tampered tokens never reach the repository
+	w = verify(strings.Replace(token, ".", "x.", 1))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Test case: An email change stays pending and is mailed to the new address
+	mockRepo.On("UpdateUser", mock.Anything, 1, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		user := args.Get(2).(*userPack.User)
+		user.PendingEmail, user.Email = user.Email, "john.doe@example.com"
+	}).Once()
+	body := strings.NewReader(`{"firstname":"John","lastname":"Doe","email":"john@new.example.com","age":30}`)
+	req, _ := http.NewRequest(http.MethodPatch, "/user/1", body)
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"pending_email":"john@new.example.com"`)
+
+	mail = smtpServer.received()
+	require.Len(t, mail, 2)
+	assert.Equal(t, []string{"john@new.example.com"}, mail[1].To)
+	changed := &userPack.User{ID: 1, Firstname: "John", Lastname: "Doe", Email: "john@new.example.com", Age: 30, EmailVerified: true}
+	mockRepo.On("VerifyEmail", mock.Anything, 1, "john@new.example.com", mock.Anything, mock.Anything).Return(changed, nil).Once()
+	w = verify(mailToken(t, mail[1]))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"email":"john@new.example.com"`)
+
+	// Test case: Expired tokens are rejected
+	expired := userPack.NewUserService(mockRepo, userPack.WithEmailVerification(smtpMailer, signer, userPack.EmailVerificationConfig{URL: "http://localhost", TTL: -time.Minute}))
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{ID: 1, Email: "john.doe@example.com"}, nil).Once()
+	require.NoError(t, expired.SendEmailVerification(context.Background(), 1))
+	w = verify(mailToken(t, smtpServer.received()[2]))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestFileMailer(t *testing.T) {
+	path := t.TempDir() + "/mail.log"
+	m, err := mailer.NewFileMailer(path, "no-reply@example.com")
+	require.NoError(t, err)
+	defer m.Close()
+
+	err = m.Send(context.Background(), &mailer.Message{To: "a@example.com\r\nBcc: b@example.com", Subject: "Hi", Body: "x"})
+	assert.ErrorIs(t, err, mailer.ErrInvalidHeader)
+	require.NoError(t, m.Send(context.Background(), &mailer.Message{To: "a@example.com", Subject: "Grüße", Body: "Hello"}))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "To: a@example.com\r\n")
+	assert.Contains(t, string(data), "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n")
+	assert.NotContains(t, string(data), "Bcc")
+}
+
+func TestEmailVerificationTenant(t *testing.T) {
+	smtpServer := startSMTPStandIn(t)
+	smtpMailer := mailer.NewSMTPMailer(mailer.SMTPConfig{Addr: smtpServer.addr, From: "no-reply@example.com", Timeout: 5 * time.Second})
+	mockRepo := new(MockUserRepository)
+	userService := userPack.NewUserService(mockRepo, userPack.WithEmailVerification(smtpMailer, signedtoken.NewSigner([]byte("test secret")), userPack.EmailVerificationConfig{
+		URL: "http://localhost:8080/users:verifyEmail",
+		TTL: time.Hour,
+	}))
+
+	// A link mailed in one tenant is redeemed there, although the request
+	// opening it names no tenant or another one.
+	inAcme := mock.MatchedBy(func(ctx context.Context) bool {
+		return reqctx.FromContext(ctx).Tenant() == "acme"
+	})
+	mockRepo.On("GetUser", inAcme, 4).Return(&userPack.User{ID: 4, Email: "jane@acme.example.com"}, nil).Once()
+	require.NoError(t, userService.SendEmailVerification(reqctx.WithTenant(context.Background(), "acme"), 4))
+	mail := smtpServer.received()
+	require.Len(t, mail, 1)
+	token := mailToken(t, mail[0])
+
+	verified := &userPack.User{ID: 4, Email: "jane@acme.example.com", EmailVerified: true}
+	mockRepo.On("VerifyEmail", inAcme, 4, "jane@acme.example.com", mock.Anything, mock.Anything).Return(verified, nil).Twice()
+	user, err := userService.VerifyEmail(context.Background(), token)
+	require.NoError(t, err)
+	assert.True(t, user.EmailVerified)
+	_, err = userService.VerifyEmail(reqctx.WithTenant(context.Background(), "globex"), token)
+	require.NoError(t, err)
+	mockRepo.AssertExpectations(t)
+}
@@ -0,0 +1,267 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	userpb "user-api/gen/user"
+	"user-api/internal/gateway"
+	userGrpc "user-api/internal/grpc/user"
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/config"
+	"user-api/pkg/httpcache"
+	"user-api/pkg/negotiate"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testGatewayKey is what test gateways prove themselves with to the gRPC
+// servers behind them.
+const testGatewayKey = "test-gateway-key"
+
+// proxyAddr is the peer of the requests serve makes. Routers using
+// trustedProxy honour its actor headers, as main does for TRUSTED_PROXIES.
+const proxyAddr = "10.0.0.1:4711"
+
+func trustedProxy() reqctx.Option {
+	proxies, _ := reqctx.ParseTrustedProxies("10.0.0.1")
+	return reqctx.WithTrustedProxies(proxies)
+}
+
+// newGatewayRouter serves the REST gateway and the legacy routes the way
+// main does, in front of a gRPC server over an in-memory connection.
+func newGatewayRouter(t *testing.T, repo userPack.UserRepository, opts ...userPack.UserServiceOption) *gin.Engine {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(userGrpc.ErrorUnaryInterceptor, reqctx.UnaryServerInterceptor(reqctx.WithGatewayKey(testGatewayKey))),
+	)
+	userpb.RegisterUserServiceServer(server, userGrpc.NewGRPCServer(userPack.NewUserService(repo, opts...), nil, config.Config{}))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	gw, err := gateway.NewGateway(context.Background(), conn, testGatewayKey)
+	require.NoError(t, err)
+	legacy := gateway.NewLegacyHandler(gw)
+
+	r := gin.Default()
+	r.Use(reqctx.GinMiddleware(trustedProxy()))
+	r.Any(gateway.Prefix+"/*path", gin.WrapH(gw))
+	r.GET("/openapi.json", gateway.OpenAPI)
+	users := r.Group("", negotiate.Compress([]string{"zstd", "gzip"}, 256), negotiate.Middleware())
+	users.POST("/users", legacy.CreateUser)
+	users.GET("/user/:id", httpcache.Middleware("private, no-cache"), legacy.GetUser)
+	users.HEAD("/user/:id", httpcache.Middleware("private, no-cache"), legacy.GetUser)
+	users.PATCH("/user/:id", legacy.UpdateUser)
+	users.DELETE("/user/:id", legacy.DeleteUser)
+	users.POST("/user/:id/suspend", legacy.SuspendUser)
+	return r
+}
+
+func serve(r http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if body != "" {
+		req, _ = http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req, _ = http.NewRequest(method, path, nil)
+	}
+	req.RemoteAddr = proxyAddr
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestGatewayGetUser(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	r := newGatewayRouter(t, mockRepo)
+
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{
+		ID: 1, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Age: 30,
+		Created: created, Status: userPack.StatusActive,
+	}, nil)
+	mockRepo.On("GetUser", mock.Anything, 2).Return(nil, userPack.ErrUserNotFound)
+
+	w := serve(r, http.MethodGet, "/v1/users/1", "", reqctx.RequestIDHeader, "req-1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "req-1", w.Header().Get(reqctx.RequestIDHeader))
+	var v1 struct {
+		User map[string]interface{} `json:"user"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &v1))
+	assert.Equal(t, "john.doe@example.com", v1.User["email"])
+	assert.Equal(t, "USER_STATUS_ACTIVE", v1.User["status"])
+
+	w = serve(r, http.MethodGet, "/v1/users/2", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// The legacy route answers with the bare user, as it always did.
+	w = serve(r, http.MethodGet, "/user/1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var legacy map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &legacy))
+	assert.Equal(t, float64(1), legacy["id"])
+	assert.Equal(t, "active", legacy["status"])
+	assert.NotContains(t, legacy, "pending_email")
+	assert.NotContains(t, legacy, "tenant_id")
+
+	w = serve(r, http.MethodGet, "/user/2", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"error": "User not found"}`, w.Body.String())
+
+	w = serve(r, http.MethodGet, "/user/abc", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error": "Invalid user ID"}`, w.Body.String())
+}
+
+func TestGatewayValidationMatchesREST(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	r := newGatewayRouter(t, mockRepo)
+
+	// Both routes validate like the REST handlers, with the same message.
+	for _, path := range []string{"/v1/users/1", "/user/1"} {
+		w := serve(r, http.MethodPatch, path, `{"firstname": "John"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+		assert.Contains(t, w.Body.String(), "firstname, lastname and email are required", path)
+	}
+	mockRepo.AssertNotCalled(t, "UpdateUser", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestGatewayUpdateUserPendingEmail(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	r := newGatewayRouter(t, mockRepo)
+
+	mockRepo.On("UpdateUser", mock.Anything, 1, mock.AnythingOfType("*userPack.User")).Run(func(args mock.Arguments) {
+		args.Get(2).(*userPack.User).PendingEmail = "new@example.com"
+	}).Return(nil)
+
+	body := `{"firstname": "John", "lastname": "Doe", "email": "new@example.com"}`
+	w := serve(r, http.MethodPatch, "/v1/users/1", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"message": "User updated, the new email is pending verification", "pending_email": "new@example.com"}`, w.Body.String())
+
+	w = serve(r, http.MethodPatch, "/user/1", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"message": "User updated, the new email is pending verification", "pending_email": "new@example.com"}`, w.Body.String())
+}
+
+func TestGatewayLegacyCreateAndDelete(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	r := newGatewayRouter(t, mockRepo)
+
+	mockRepo.On("CreateUser", mock.Anything, mock.MatchedBy(func(u *userPack.User) bool {
+		return u.Email == "john.doe@example.com" && u.PasswordHash != ""
+	})).Run(func(args mock.Arguments) {
+		args.Get(1).(*userPack.User).ID = 7
+	}).Return(nil)
+	mockRepo.On("DeleteUser", mock.Anything, 7).Return(nil)
+
+	w := serve(r, http.MethodPost, "/users", `{"firstname": "John", "lastname": "Doe", "email": "john.doe@example.com", "age": 30, "password": "correct horse"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var user map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &user))
+	assert.Equal(t, float64(7), user["id"])
+	assert.NotContains(t, user, "password")
+
+	w = serve(r, http.MethodDelete, "/user/7", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// Status changes are admin only on both sides.
+	w = serve(r, http.MethodPost, "/user/7/suspend", `{"reason": "spam"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestGatewayActor(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	r := newGatewayRouter(t, mockRepo)
+	mockRepo.On("GetUser", mock.Anything, 7).Return(&userPack.User{ID: 7, Status: userPack.StatusActive}, nil)
+	mockRepo.On("SetUserStatus", mock.Anything, 7, userPack.StatusActive, userPack.StatusSuspended, "spam").
+		Return(&userPack.User{ID: 7, Status: userPack.StatusSuspended}, nil).Once()
+
+	// Clients cannot hand the gRPC server an actor themselves.
+	w := serve(r, http.MethodPost, "/user/7/suspend", `{"reason": "spam"}`,
+		"Grpc-Metadata-X-Actor", "mallory", "Grpc-Metadata-X-Actor-Roles", "admin", "Grpc-Metadata-X-Gateway-Key", testGatewayKey)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Nor can they send the actor headers from outside the trusted proxies.
+	req := httptest.NewRequest(http.MethodPost, "/user/7/suspend", strings.NewReader(`{"reason": "spam"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(reqctx.ActorHeader, "mallory")
+	req.Header.Set(reqctx.ActorRolesHeader, reqctx.RoleAdmin)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// The actor a trusted proxy vouches for reaches the gRPC server.
+	w = serve(r, http.MethodPost, "/user/7/suspend", `{"reason": "spam"}`,
+		reqctx.ActorHeader, "alice", reqctx.ActorRolesHeader, reqctx.RoleAdmin)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	mockRepo.AssertExpectations(t)
+}
+
+func TestGatewayOpenAPI(t *testing.T) {
+	r := newGatewayRouter(t, new(MockUserRepository))
+
+	w := serve(r, http.MethodGet, "/openapi.json", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var doc struct {
+		Swagger string                 `json:"swagger"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, "2.0", doc.Swagger)
+	assert.Contains(t, doc.Paths, "/v1/users/{id}")
+	assert.Contains(t, doc.Paths, "/v1/auth/login")
+}
+
+func TestPeerIP(t *testing.T) {
+	peerIP := func(addr string, md metadata.MD, opts ...reqctx.Option) string {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 4711}})
+		ctx = metadata.NewIncomingContext(ctx, md)
+		var ip string
+		_, err := reqctx.UnaryServerInterceptor(opts...)(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, _ interface{}) (interface{}, error) {
+			ip = reqctx.PeerIP(ctx)
+			return nil, nil
+		})
+		require.NoError(t, err)
+		return ip
+	}
+	forwarded := metadata.Pairs("x-forwarded-for", "6.6.6.6, 203.0.113.7", reqctx.ClientIPHeader, "6.6.6.6")
+
+	// Loopback clients get no say over their address.
+	assert.Equal(t, "127.0.0.1", peerIP("127.0.0.1", forwarded))
+	assert.Equal(t, "127.0.0.1", peerIP("127.0.0.1", forwarded, reqctx.WithGatewayKey(testGatewayKey)))
+
+	// Trusted proxies forward the client they appended.
+	assert.Equal(t, "203.0.113.7", peerIP("10.0.0.1", forwarded, trustedProxy()))
+	assert.Equal(t, "10.0.0.2", peerIP("10.0.0.2", forwarded, trustedProxy()))
+
+	// The gateway names the client gin settled on.
+	fromGateway := metadata.Pairs(reqctx.GatewayKeyHeader, testGatewayKey, reqctx.ClientIPHeader, "198.51.100.4", "x-forwarded-for", "6.6.6.6")
+	assert.Equal(t, "198.51.100.4", peerIP("127.0.0.1", fromGateway, reqctx.WithGatewayKey(testGatewayKey)))
+}
@@ -0,0 +1,314 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	graphqlPack "user-api/internal/graphql-pack"
+	orgPack "user-api/internal/org-pack"
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/graphql"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func newGraphQLRouter(t *testing.T, mockRepo *MockUserRepository, mockOrgRepo *MockOrgRepository, opts ...graphqlPack.GraphQLHandlerOption) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.Use(reqctx.GinMiddleware(trustedProxy()), verifiedActor())
+
+	handler, err := graphqlPack.NewGraphQLHandler(userPack.NewUserService(mockRepo), orgPack.NewOrgService(mockOrgRepo), opts...)
+	require.NoError(t, err)
+	router.POST(graphqlPack.Path, handler.Serve)
+	router.GET(graphqlPack.Path, handler.Serve)
+	router.GET(graphqlPack.Path+"/schema.graphql", handler.Schema)
+	return router
+}
+
+type graphQLResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []struct {
+		Message    string                 `json:"message"`
+		Path       []interface{}          `json:"path"`
+		Extensions map[string]interface{} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func graphQLRequest(t *testing.T, router *gin.Engine, params graphqlPack.Params, headers ...string) (*httptest.ResponseRecorder, graphQLResponse) {
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest(http.MethodPost, graphqlPack.Path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = proxyAddr
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var resp graphQLResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+	return w, resp
+}
+
+func TestParseGraphQL(t *testing.T) {
+	doc, err := graphql.Parse(`
+		query Users($ids: [ID!]! = ["1"]) {
+			users(ids: $ids) { ...names, mail: email @include(if: true) }
+		}
+		fragment names on User { firstname lastname }`)
+	require.NoError(t, err)
+	require.Len(t, doc.Operations, 1)
+	op := doc.Operations[0]
+	assert.Equal(t, graphql.OperationQuery, op.Type)
+	assert.Equal(t, "Users", op.Name)
+	assert.Equal(t, "[ID!]!", op.Variables[0].Type.String())
+	field := op.SelectionSet[0].(*graphql.Field)
+	assert.Equal(t, "users", field.Name)
+	assert.Equal(t, "mail", field.SelectionSet[1].(*graphql.Field).ResponseKey())
+	assert.Contains(t, doc.Fragments, "names")
+
+	_, err = graphql.Parse(`{ user(id: 1) { email }`)
+	require.Error(t, err)
+	gqlErr := err.(*graphql.Error)
+	assert.Equal(t, graphql.Location{Line: 1, Column: 24}, gqlErr.Locations[0])
+}
+
+func TestGraphQLQueryBatchesLoads(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	mockOrgRepo := new(MockOrgRepository)
+	router := newGraphQLRouter(t, mockRepo, mockOrgRepo)
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	// One query for both users and one for all their organizations, not
+	// one per user.
+	mockRepo.On("GetUsers", mock.Anything, []int{1, 2, 3}).Return([]*userPack.User{
+		{ID: 1, Firstname: "Ada", Lastname: "Lovelace", Email: "ada@example.com", Created: created, Status: userPack.StatusActive},
+		{ID: 2, Firstname: "Alan", Lastname: "Turing", Email: "alan@example.com", Created: created, Status: userPack.StatusSuspended},
+	}, nil).Once()
+	mockOrgRepo.On("BatchListUserMemberships", mock.Anything, []int{1, 2}).Return(map[int][]*orgPack.Membership{
+		1: {{Organization: orgPack.Organization{ID: 10, Name: "Acme", Slug: "acme"}, Role: orgPack.RoleOwner, Joined: created}},
+	}, nil).Once()
+
+	query := graphqlPack.Params{Query: `
+		query($ids: [ID!]!) {
+			users(ids: $ids) {
+				id firstname status created
+				organizations { role organization { slug } }
+			}
+			first: user(id: 1) { email }
+		}`,
+		Variables: map[string]interface{}{"ids": []interface{}{"1", 2, "3"}},
+	}
+	w, resp := graphQLRequest(t, router, query, asUser(1)...)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, resp.Errors)
+	users := resp.Data["users"].([]interface{})
+	require.Len(t, users, 3)
+	assert.Equal(t, map[string]interface{}{
+		"id": "1", "firstname": "Ada", "status": "ACTIVE", "created": "2024-01-02T03:04:05Z",
+		"organizations": []interface{}{map[string]interface{}{"role": "OWNER", "organization": map[string]interface{}{"slug": "acme"}}},
+	}, users[0])
+	assert.Equal(t, "SUSPENDED", users[1].(map[string]interface{})["status"])
+	assert.Equal(t, []interface{}{}, users[1].(map[string]interface{})["organizations"])
+	assert.Nil(t, users[2])
+	assert.Equal(t, "ada@example.com", resp.Data["first"].(map[string]interface{})["email"])
+	// The fields come back in the order they were asked for.
+	assert.True(t, strings.Index(w.Body.String(), `"users"`) < strings.Index(w.Body.String(), `"first"`))
+
+	// Organizations are only shown to authenticated callers.
+	mockRepo.On("GetUsers", mock.Anything, []int{1, 2, 3}).Return([]*userPack.User{{ID: 1, Created: created}}, nil).Once()
+	_, resp = graphQLRequest(t, router, query)
+	require.NotEmpty(t, resp.Errors)
+	assert.Equal(t, graphqlPack.CodeUnauthenticated, resp.Errors[0].Extensions["code"])
+	mockRepo.AssertExpectations(t)
+	mockOrgRepo.AssertExpectations(t)
+}
+
+func TestGraphQLValidation(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	router := newGraphQLRouter(t, mockRepo, new(MockOrgRepository), graphqlPack.WithLimits(4, 50))
+
+	_, resp := graphQLRequest(t, router, graphqlPack.Params{Query: `{ user(id: 1) { password } }`})
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, `Cannot query field "password" on type "User".`, resp.Errors[0].Message)
+	assert.Nil(t, resp.Data)
+
+	_, resp = graphQLRequest(t, router, graphqlPack.Params{Query: `{ user { id } }`})
+	require.Len(t, resp.Errors, 1)
+	assert.Contains(t, resp.Errors[0].Message, `argument "id" of type ID! is required`)
+
+	_, resp = graphQLRequest(t, router, graphqlPack.Params{Query: `{ user(id: 1) { organizations { organization { id slug name created } } } }`})
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, "Query complexity 52 exceeds the maximum of 50.", resp.Errors[0].Message)
+	assert.Equal(t, "QUERY_TOO_COMPLEX", resp.Errors[0].Extensions["code"])
+
+	shallow := newGraphQLRouter(t, mockRepo, new(MockOrgRepository), graphqlPack.WithLimits(3, 0))
+	_, resp = graphQLRequest(t, shallow, graphqlPack.Params{Query: `
+		{ users(ids: [1]) { ...deep } }
+		fragment deep on User { organizations { organization { id } } }`})
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, "Query depth 4 exceeds the maximum of 3.", resp.Errors[0].Message)
+
+	_, resp = graphQLRequest(t, router, graphqlPack.Params{Query: `
+		{ user(id: 1) { ...a } }
+		fragment a on User { ...b }
+		fragment b on User { ...a }`})
+	require.NotEmpty(t, resp.Errors)
+	assert.Contains(t, resp.Errors[0].Message, "within itself")
+
+	_, resp = graphQLRequest(t, router, graphqlPack.Params{Query: `{ user(id: 1) { id`})
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, "GRAPHQL_PARSE_FAILED", resp.Errors[0].Extensions["code"])
+	mockRepo.AssertNotCalled(t, "GetUser", mock.Anything, mock.Anything)
+}
+
+func TestGraphQLPersistedQueries(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	router := newGraphQLRouter(t, mockRepo, new(MockOrgRepository), graphqlPack.WithPersistedQueries(10))
+
+	query := `query($id: ID!) { user(id: $id) { firstname } }`
+	sum := sha256.Sum256([]byte(query))
+	persisted := graphqlPack.Extensions{PersistedQuery: &graphqlPack.PersistedQuery{Version: 1, Sha256Hash: hex.EncodeToString(sum[:])}}
+	variables := map[string]interface{}{"id": "7"}
+
+	_, resp := graphQLRequest(t, router, graphqlPack.Params{Extensions: persisted, Variables: variables})
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, "PersistedQueryNotFound", resp.Errors[0].Message)
+	assert.Equal(t, graphqlPack.CodePersistedQueryMissing, resp.Errors[0].Extensions["code"])
+
+	_, resp = graphQLRequest(t, router, graphqlPack.Params{Query: `{ user(id: 1) { id } }`, Extensions: persisted})
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, "provided sha does not match query", resp.Errors[0].Message)
+
+	mockRepo.On("GetUsers", mock.Anything, []int{7}).Return([]*userPack.User{{ID: 7, Firstname: "Grace"}}, nil).Twice()
+	_, resp = graphQLRequest(t, router, graphqlPack.Params{Query: query, Extensions: persisted, Variables: variables})
+	assert.Empty(t, resp.Errors)
+
+	// Once registered, the hash alone is enough, also with GET.
+	ext, _ := json.Marshal(persisted)
+	vars, _ := json.Marshal(variables)
+	req, _ := http.NewRequest(http.MethodGet, graphqlPack.Path+"?extensions="+string(ext)+"&variables="+string(vars), nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"data":{"user":{"firstname":"Grace"}}}`, w.Body.String())
+	mockRepo.AssertExpectations(t)
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	router := newGraphQLRouter(t, mockRepo, new(MockOrgRepository))
+
+	mockRepo.On("GetUser", mock.Anything, 5).Return(&userPack.User{ID: 5, Firstname: "Ada", Lastname: "Lovelace", Email: "ada@example.com", Age: 36, Status: userPack.StatusActive}, nil)
+	mockRepo.On("UpdateUser", mock.Anything, 5, mock.MatchedBy(func(u *userPack.User) bool {
+		return u.Firstname == "Augusta" && u.Lastname == "Lovelace" && u.Age == 36
+	})).Return(nil).Once()
+	_, resp := graphQLRequest(t, router, graphqlPack.Params{Query: `mutation { updateUser(id: 5, input: {firstname: "Augusta"}) { firstname lastname age } }`})
+	assert.Empty(t, resp.Errors)
+	assert.Equal(t, map[string]interface{}{"firstname": "Augusta", "lastname": "Lovelace", "age": float64(36)}, resp.Data["updateUser"])
+
+	_, resp = graphQLRequest(t, router, graphqlPack.Params{Query: `mutation { updateUser(id: 5, input: {email: "nope"}) { id } }`})
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, "invalid email format", resp.Errors[0].Message)
+	assert.Equal(t, graphqlPack.CodeBadUserInput, resp.Errors[0].Extensions["code"])
+	assert.Nil(t, resp.Data)
+
+	mockRepo.On("DeleteUser", mock.Anything, 9).Return(userPack.ErrUserNotFound).Once()
+	_, resp = graphQLRequest(t, router, graphqlPack.Params{Query: `mutation { deleteUser(id: 9) }`})
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, graphqlPack.CodeNotFound, resp.Errors[0].Extensions["code"])
+	assert.Equal(t, []interface{}{"deleteUser"}, resp.Errors[0].Path)
+
+	_, resp = graphQLRequest(t, router, graphqlPack.Params{Query: `mutation { suspendUser(id: 5, reason: "spam") { status } }`})
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, graphqlPack.CodeForbidden, resp.Errors[0].Extensions["code"])
+
+	mockRepo.On("SetUserStatus", mock.Anything, 5, userPack.StatusActive, userPack.StatusSuspended, "spam").
+		Return(&userPack.User{ID: 5, Status: userPack.StatusSuspended, StatusReason: "spam"}, nil).Once()
+	_, resp = graphQLRequest(t, router, graphqlPack.Params{Query: `mutation { suspendUser(id: 5, reason: "spam") { status statusReason } }`},
+		reqctx.ActorHeader, "alice", reqctx.ActorRolesHeader, "admin")
+	assert.Empty(t, resp.Errors)
+	assert.Equal(t, map[string]interface{}{"status": "SUSPENDED", "statusReason": "spam"}, resp.Data["suspendUser"])
+
+	// Mutations are not allowed over GET.
+	req, _ := http.NewRequest(http.MethodGet, graphqlPack.Path+"?query="+`mutation{deleteUser(id:1)}`, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestGraphQLSchema(t *testing.T) {
+	router := newGraphQLRouter(t, new(MockUserRepository), new(MockOrgRepository))
+
+	req, _ := http.NewRequest(http.MethodGet, graphqlPack.Path+"/schema.graphql", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "type Query {")
+	assert.Contains(t, w.Body.String(), "users(ids: [ID!]!): [User]!")
+	assert.Contains(t, w.Body.String(), "userChanged(resumeToken: String): UserEvent!")
+	assert.Contains(t, w.Body.String(), "scalar DateTime")
+}
+
+func TestGraphQLWebSocket(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	server := httptest.NewServer(newGraphQLRouter(t, mockRepo, new(MockOrgRepository)))
+	defer server.Close()
+
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+graphqlPack.Path, server.URL)
+	require.NoError(t, err)
+	config.Protocol = []string{graphqlPack.Subprotocol}
+	ws, err := websocket.DialConfig(config)
+	require.NoError(t, err)
+	defer ws.Close()
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	type message struct {
+		ID      string          `json:"id,omitempty"`
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload,omitempty"`
+	}
+	receive := func() message {
+		var msg message
+		require.NoError(t, websocket.JSON.Receive(ws, &msg))
+		return msg
+	}
+
+	require.NoError(t, websocket.JSON.Send(ws, message{Type: "connection_init"}))
+	assert.Equal(t, "connection_ack", receive().Type)
+	require.NoError(t, websocket.JSON.Send(ws, message{Type: "ping"}))
+	assert.Equal(t, "pong", receive().Type)
+
+	// Queries work over the socket too.
+	mockRepo.On("GetUsers", mock.Anything, []int{1}).Return([]*userPack.User{{ID: 1, Firstname: "Ada"}}, nil).Once()
+	payload, _ := json.Marshal(graphqlPack.Params{Query: `{ user(id: 1) { firstname } }`})
+	require.NoError(t, websocket.JSON.Send(ws, message{ID: "1", Type: "subscribe", Payload: payload}))
+	msg := receive()
+	assert.Equal(t, "next", msg.Type)
+	assert.Equal(t, "1", msg.ID)
+	assert.JSONEq(t, `{"data":{"user":{"firstname":"Ada"}}}`, string(msg.Payload))
+	assert.Equal(t, message{ID: "1", Type: "complete"}, receive())
+
+	// Without a change feed the subscription fails with an error message.
+	payload, _ = json.Marshal(graphqlPack.Params{Query: `subscription { userChanged { type user { id } } }`})
+	require.NoError(t, websocket.JSON.Send(ws, message{ID: "2", Type: "subscribe", Payload: payload}))
+	msg = receive()
+	assert.Equal(t, "error", msg.Type)
+	assert.Contains(t, string(msg.Payload), `"code":"UNAVAILABLE"`)
+	mockRepo.AssertExpectations(t)
+}
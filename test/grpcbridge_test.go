@@ -0,0 +1,252 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	userpb "user-api/gen/user"
+	userGrpc "user-api/internal/grpc/user"
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/config"
+	"user-api/pkg/grpcbridge"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+// newBridgeHandler serves the user service through grpcbridge in front of
+// a REST stand-in answering "rest".
+func newBridgeHandler(t *testing.T, repo userPack.UserRepository) http.Handler {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(userGrpc.ErrorUnaryInterceptor, reqctx.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(userGrpc.ErrorStreamInterceptor, reqctx.StreamServerInterceptor()),
+	)
+	userpb.RegisterUserServiceServer(server, userGrpc.NewGRPCServer(userPack.NewUserService(repo), nil,
+		config.Config{GRPC: config.GRPCConfig{BatchChunkSize: 10}}))
+	t.Cleanup(server.Stop)
+
+	rest := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "rest")
+	})
+	return grpcbridge.New(server, grpcbridge.WithAllowedOrigins("https://app.example.com")).Handler(rest)
+}
+
+func rpcFrame(flags byte, msg []byte) []byte {
+	out := make([]byte, 5+len(msg))
+	out[0] = flags
+	binary.BigEndian.PutUint32(out[1:5], uint32(len(msg)))
+	copy(out[5:], msg)
+	return out
+}
+
+// readFrames splits a gRPC-Web or Connect body into its flags and messages.
+func readFrames(t *testing.T, body []byte) (flags []byte, msgs [][]byte) {
+	for len(body) > 0 {
+		require.GreaterOrEqual(t, len(body), 5)
+		n := int(binary.BigEndian.Uint32(body[1:5]))
+		require.GreaterOrEqual(t, len(body), 5+n)
+		flags = append(flags, body[0])
+		msgs = append(msgs, body[5:5+n])
+		body = body[5+n:]
+	}
+	return flags, msgs
+}
+
+func mockBridgeUsers(repo *MockUserRepository) {
+	repo.On("GetUser", mock.Anything, 1).Return(&userPack.User{
+		ID: 1, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Status: userPack.StatusActive,
+	}, nil)
+	repo.On("GetUser", mock.Anything, 2).Return(nil, userPack.ErrUserNotFound)
+}
+
+func TestSinglePortServesGRPCAndREST(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	mockBridgeUsers(mockRepo)
+	srv := httptest.NewServer(h2c.NewHandler(newBridgeHandler(t, mockRepo), &http2.Server{}))
+	defer srv.Close()
+
+	// gRPC over h2c...
+	conn, err := grpc.NewClient(srv.Listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	resp, err := userpb.NewUserServiceClient(conn).GetUser(context.Background(), &userpb.GetUserRequest{Id: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "john.doe@example.com", resp.User.Email)
+
+	// ...and HTTP/1.1 on the same port.
+	res, err := http.Get(srv.URL + "/user/1")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, "rest", string(body))
+}
+
+func TestGRPCWeb(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	mockBridgeUsers(mockRepo)
+	h := newBridgeHandler(t, mockRepo)
+
+	msg, _ := proto.Marshal(&userpb.GetUserRequest{Id: 1})
+	req := httptest.NewRequest(http.MethodPost, "/user.UserService/GetUser", bytes.NewReader(rpcFrame(0, msg)))
+	req.Header.Set("Content-Type", "application/grpc-web+proto")
+	req.Header.Set("X-Grpc-Web", "1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/grpc-web+proto", w.Header().Get("Content-Type"))
+	assert.NotEmpty(t, w.Header().Get(reqctx.RequestIDHeader))
+	flags, msgs := readFrames(t, w.Body.Bytes())
+	require.Equal(t, []byte{0, 0x80}, flags)
+	var resp userpb.GetUserResponse
+	require.NoError(t, proto.Unmarshal(msgs[0], &resp))
+	assert.Equal(t, "john.doe@example.com", resp.User.Email)
+	assert.Contains(t, string(msgs[1]), "grpc-status: 0\r\n")
+
+	// The text variant is the same stream in base64, here with an error.
+	msg, _ = proto.Marshal(&userpb.GetUserRequest{Id: 2})
+	req = httptest.NewRequest(http.MethodPost, "/user.UserService/GetUser",
+		strings.NewReader(base64.StdEncoding.EncodeToString(rpcFrame(0, msg))))
+	req.Header.Set("Content-Type", "application/grpc-web-text")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, "application/grpc-web-text+proto", w.Header().Get("Content-Type"))
+	body, err := base64.StdEncoding.DecodeString(w.Body.String())
+	require.NoError(t, err)
+	flags, msgs = readFrames(t, body)
+	require.Equal(t, []byte{0x80}, flags)
+	assert.Contains(t, string(msgs[0]), "grpc-status: 5\r\n")
+	assert.Contains(t, string(msgs[0]), "grpc-message: failed to get user: user not found\r\n")
+}
+
+func TestConnectUnary(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	mockBridgeUsers(mockRepo)
+	h := newBridgeHandler(t, mockRepo)
+
+	call := func(contentType, method string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/user.UserService/"+method, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Connect-Protocol-Version", "1")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := call("application/json", "GetUser", []byte(`{"id": 1}`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var user struct {
+		User struct {
+			Email  string `json:"email"`
+			Status string `json:"status"`
+		} `json:"user"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &user))
+	assert.Equal(t, "john.doe@example.com", user.User.Email)
+	assert.Equal(t, "USER_STATUS_ACTIVE", user.User.Status)
+
+	msg, _ := proto.Marshal(&userpb.GetUserRequest{Id: 1})
+	w = call("application/proto", "GetUser", msg)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp userpb.GetUserResponse
+	require.NoError(t, proto.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, int32(1), resp.User.Id)
+
+	w = call("application/json", "GetUser", []byte(`{"id": 2}`))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"code": "not_found", "message": "failed to get user: user not found"}`, w.Body.String())
+
+	w = call("application/json", "UpdateUser", []byte(`{"id": 1, "user": {"firstname": "John"}}`))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"code": "invalid_argument", "message": "firstname, lastname and email are required"}`, w.Body.String())
+
+	// Plain JSON posts to other paths are REST calls.
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, "rest", w.Body.String())
+}
+
+func TestConnectStreaming(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	h := newBridgeHandler(t, mockRepo)
+
+	mockRepo.On("CreateUsers", mock.Anything, mock.MatchedBy(func(users []*userPack.User) bool {
+		return len(users) == 2
+	})).Return([]error{nil, nil}, nil).Once()
+
+	var body bytes.Buffer
+	body.Write(rpcFrame(0, []byte(`{"firstname": "John", "lastname": "Doe", "email": "john.doe@example.com"}`)))
+	body.Write(rpcFrame(0, []byte(`{"firstname": "Jane", "lastname": "Doe", "email": "invalid-email"}`)))
+	body.Write(rpcFrame(0, []byte(`{"firstname": "Jim", "lastname": "Doe", "email": "jim.doe@example.com"}`)))
+	req := httptest.NewRequest(http.MethodPost, "/user.UserService/BatchCreateUsers", &body)
+	req.Header.Set("Content-Type", "application/connect+json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/connect+json", w.Header().Get("Content-Type"))
+	flags, msgs := readFrames(t, w.Body.Bytes())
+	require.Equal(t, []byte{0, 0x02}, flags)
+	var resp struct {
+		Created int `json:"created"`
+		Failed  int `json:"failed"`
+	}
+	require.NoError(t, json.Unmarshal(msgs[0], &resp))
+	assert.Equal(t, 2, resp.Created)
+	assert.Equal(t, 1, resp.Failed)
+	assert.NotContains(t, string(msgs[1]), `"error"`)
+	mockRepo.AssertExpectations(t)
+
+	// Errors end the stream; the HTTP status stays 200.
+	req = httptest.NewRequest(http.MethodPost, "/user.UserService/WatchUsers", bytes.NewReader(rpcFrame(0, []byte(`{}`))))
+	req.Header.Set("Content-Type", "application/connect+json")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	flags, msgs = readFrames(t, w.Body.Bytes())
+	require.Equal(t, []byte{0x02}, flags)
+	assert.Contains(t, string(msgs[0]), `"code":"unavailable"`)
+}
+
+func TestBridgeCORS(t *testing.T) {
+	h := newBridgeHandler(t, new(MockUserRepository))
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/user.UserService/GetUser", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := preflight("https://app.example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "content-type,x-grpc-web", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Contains(t, w.Header().Get("Access-Control-Expose-Headers"), "Grpc-Status")
+
+	w = preflight("https://evil.example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+}
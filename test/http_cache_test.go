@@ -0,0 +1,104 @@
+package test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/httpcache"
+)
+
+func TestConditionalGetUser(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	r := newGatewayRouter(t, mockRepo)
+
+	updated := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{
+		ID: 1, Firstname: "John", Email: "john.doe@example.com", Status: userPack.StatusActive, Updated: updated,
+	}, nil).Times(6)
+
+	w := serve(r, http.MethodGet, "/user/1", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", w.Header().Get("Last-Modified"))
+	assert.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"))
+	assert.Contains(t, w.Body.String(), `"updated":"2024-05-01T12:00:00Z"`)
+	body := w.Body.String()
+
+	w = serve(r, http.MethodGet, "/user/1", "", "If-None-Match", `"other", `+etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	w = serve(r, http.MethodGet, "/user/1", "", "If-None-Match", `"other"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = serve(r, http.MethodGet, "/user/1", "", "If-Modified-Since", "Wed, 01 May 2024 12:00:00 GMT")
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	w = serve(r, http.MethodGet, "/user/1", "", "If-Modified-Since", "Wed, 01 May 2024 11:59:59 GMT")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = serve(r, http.MethodHead, "/user/1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, len(body), int(w.Result().ContentLength))
+
+	// A change gives a new tag.
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{
+		ID: 1, Firstname: "Johnny", Email: "john.doe@example.com", Status: userPack.StatusActive, Updated: updated.Add(time.Second),
+	}, nil).Once()
+	w = serve(r, http.MethodGet, "/user/1", "", "If-None-Match", etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	// Errors are passed through untouched.
+	mockRepo.On("GetUser", mock.Anything, 2).Return(nil, userPack.ErrUserNotFound).Once()
+	w = serve(r, http.MethodGet, "/user/2", "", "If-None-Match", "*")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("ETag"))
+	mockRepo.AssertExpectations(t)
+}
+
+func TestConditionalListUserVersions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockRepo := new(MockUserRepository)
+	handler := userPack.NewUserHandler(userPack.NewUserService(mockRepo))
+	r := gin.New()
+	r.GET("/user/:id/versions", httpcache.Middleware("private, max-age=60"), handler.ListUserVersions)
+
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	changed := created.Add(time.Hour)
+	user := &userPack.User{ID: 1, Firstname: "John"}
+	mockRepo.On("ListUserVersions", mock.Anything, 1).Return([]*userPack.UserVersion{
+		{Version: 1, User: user, ValidFrom: created},
+	}, nil).Twice()
+
+	w := serve(r, http.MethodGet, "/user/1/versions", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, "Wed, 01 May 2024 12:00:00 GMT", w.Header().Get("Last-Modified"))
+	assert.Equal(t, "private, max-age=60", w.Header().Get("Cache-Control"))
+
+	w = serve(r, http.MethodGet, "/user/1/versions", "", "If-None-Match", "W/"+etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// A new version changes the tag of the collection.
+	mockRepo.On("ListUserVersions", mock.Anything, 1).Return([]*userPack.UserVersion{
+		{Version: 1, User: user, ValidFrom: created, ValidTo: &changed},
+		{Version: 2, User: &userPack.User{ID: 1, Firstname: "Johnny"}, ValidFrom: changed},
+	}, nil).Once()
+	w = serve(r, http.MethodGet, "/user/1/versions", "", "If-None-Match", etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, "Wed, 01 May 2024 13:00:00 GMT", w.Header().Get("Last-Modified"))
+	mockRepo.AssertExpectations(t)
+}
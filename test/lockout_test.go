@@ -0,0 +1,182 @@
+package test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	userpb "user-api/gen/user"
+	authPack "user-api/internal/auth-pack"
+	userGrpc "user-api/internal/grpc/user"
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/config"
+	"user-api/pkg/password"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+var testLockoutConfig = authPack.LockoutConfig{
+	Account: authPack.LockoutPolicy{Threshold: 5, BaseDuration: time.Minute, MaxDuration: time.Hour, ResetAfter: 24 * time.Hour},
+	IP:      authPack.LockoutPolicy{Threshold: 50, BaseDuration: time.Minute, MaxDuration: time.Hour, ResetAfter: 24 * time.Hour},
+}
+
+func TestLoginLockout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	hash, err := password.NewHasher(testParams).Hash("correct horse battery staple")
+	require.NoError(t, err)
+
+	mockRepo := new(MockUserRepository)
+	mockAuthRepo := new(MockAuthRepository)
+	authService := newAuthService(t, mockAuthRepo, mockRepo, authPack.AlgorithmEdDSA, authPack.WithLockout(testLockoutConfig))
+	router.POST("/auth/login", authPack.NewAuthHandler(authService).Login)
+
+	send := func(email, pw string) *httptest.ResponseRecorder {
+		return postJSONFrom(router, "/auth/login", "192.0.2.1:4321", authPack.LoginRequest{Email: email, Password: pw})
+	}
+
+	keys := []string{"account:default:john.doe@example.com", "ip:192.0.2.1"}
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{ID: 1, Email: "john.doe@example.com", Status: userPack.StatusActive}, nil)
+	mockAuthRepo.On("GetCredentials", mock.Anything, "John.Doe@example.com").Return(&authPack.Credentials{UserID: 1, PasswordHash: hash}, nil)
+	mockAuthRepo.On("GetTOTPSecret", mock.Anything, 1).Return(nil, authPack.ErrMFANotEnrolled)
+	mockAuthRepo.On("CreateRefreshToken", mock.Anything, mock.Anything).Return(nil)
+	mockAuthRepo.On("GetRoles", mock.Anything, 1).Return(nil, nil)
+
+	// Test case: A failure counts against the account and the IP
+	mockAuthRepo.On("LockedUntil", mock.Anything, keys).Return(time.Time{}, nil).Twice()
+	mockAuthRepo.On("RecordLoginFailure", mock.Anything, "account:default:john.doe@example.com", 1, "192.0.2.1", testLockoutConfig.Account).Return(&authPack.Lockout{}, false, nil).Once()
+	mockAuthRepo.On("RecordLoginFailure", mock.Anything, "ip:192.0.2.1", 0, "192.0.2.1", testLockoutConfig.IP).Return(&authPack.Lockout{}, false, nil).Once()
+	w := send("John.Doe@example.com", "wrong password")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Test case: A successful login resets the account counter only
+	mockAuthRepo.On("ClearLoginFailures", mock.Anything, "account:default:john.doe@example.com").Return(nil).Once()
+	w = send("John.Doe@example.com", "correct horse battery staple")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Test case: A locked out login is rejected before the password is checked
+	until := time.Now().Add(2 * time.Minute)
+	mockAuthRepo.On("LockedUntil", mock.Anything, keys).Return(until, nil).Once()
+	w = send("John.Doe@example.com", "correct horse battery staple")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 120, retryAfter, 2)
+	mockAuthRepo.AssertNumberOfCalls(t, "GetCredentials", 2)
+
+	// Test case: gRPC logins are locked out the same way
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	userpb.RegisterUserServiceServer(server, userGrpc.NewGRPCServer(userPack.NewUserService(mockRepo), authService, config.Config{}))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	mockAuthRepo.On("LockedUntil", mock.Anything, []string{"account:default:john.doe@example.com", "ip:bufconn"}).Return(until, nil).Once()
+	_, err = userpb.NewUserServiceClient(conn).Login(context.Background(), &userpb.LoginRequest{Email: "John.Doe@example.com", Password: "correct horse battery staple"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "locked until "+until.Format(time.RFC3339))
+
+	// Test case: Accounts are counted per tenant, so the same email in
+	// another tenant has a counter of its own
+	acme := reqctx.WithTenant(context.Background(), "acme")
+	mockAuthRepo.On("LockedUntil", mock.Anything, []string{"account:acme:john.doe@example.com", "ip:192.0.2.1"}).Return(until, nil).Once()
+	_, err = authService.Login(acme, "John.Doe@example.com", "correct horse battery staple", "192.0.2.1")
+	var lockoutErr *authPack.LockoutError
+	require.ErrorAs(t, err, &lockoutErr)
+	mockAuthRepo.AssertNumberOfCalls(t, "GetCredentials", 2)
+	mockAuthRepo.AssertExpectations(t)
+}
+
+func TestUnlock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.Use(reqctx.GinMiddleware(trustedProxy()))
+
+	mockRepo := new(MockUserRepository)
+	mockAuthRepo := new(MockAuthRepository)
+	authService := newAuthService(t, mockAuthRepo, mockRepo, authPack.AlgorithmEdDSA, authPack.WithLockout(testLockoutConfig))
+	handler := authPack.NewAuthHandler(authService)
+	router.GET("/admin/lockouts", handler.ListLockouts)
+	router.DELETE("/admin/users/:id/lockout", handler.UnlockUser)
+	router.DELETE("/admin/lockouts/ip/:ip", handler.UnlockIP)
+
+	send := func(method, path, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.RemoteAddr = proxyAddr
+		req.Header.Set(reqctx.ActorRolesHeader, reqctx.RoleAdmin)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	support := refreshAs(t, authService, mockAuthRepo, mockRepo, 2, "support").AccessToken
+	admin := refreshAs(t, authService, mockAuthRepo, mockRepo, 9, reqctx.RoleAdmin).AccessToken
+	until := time.Now().Add(time.Minute)
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{ID: 1, Email: "John.Doe@example.com"}, nil)
+	mockAuthRepo.On("ListLockouts", mock.Anything).Return([]*authPack.Lockout{{Key: "account:default:john.doe@example.com", Lockouts: 1, LockedUntil: &until}}, nil)
+	mockAuthRepo.On("Unlock", mock.Anything, "account:default:john.doe@example.com", 1).Return(true, nil).Once()
+	mockAuthRepo.On("Unlock", mock.Anything, "ip:2001:db8::1", 0).Return(false, nil).Once()
+
+	// Test case: Only admins can see and lift lockouts, by the role in their
+	// access token; the actor headers send sets do not count
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/admin/lockouts", "").Code)
+	assert.Equal(t, http.StatusForbidden, send(http.MethodDelete, "/admin/users/1/lockout", support).Code)
+	assert.Equal(t, http.StatusForbidden, send(http.MethodDelete, "/admin/lockouts/ip/192.0.2.1", support).Code)
+
+	w := send(http.MethodGet, "/admin/lockouts", admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"key":"account:default:john.doe@example.com"`)
+
+	// Test case: Unlocking a user clears the counter of their email
+	assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/admin/users/1/lockout", admin).Code)
+
+	// Test case: IPs are normalized, and unknown ones are not found
+	assert.Equal(t, http.StatusNotFound, send(http.MethodDelete, "/admin/lockouts/ip/2001:DB8:0::1", admin).Code)
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodDelete, "/admin/lockouts/ip/not-an-ip", admin).Code)
+
+	// Test case: The RPCs check the access token the same way
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(grpc.UnaryInterceptor(userGrpc.ErrorUnaryInterceptor))
+	userpb.RegisterUserServiceServer(server, userGrpc.NewGRPCServer(userPack.NewUserService(mockRepo), authService, config.Config{}))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	client := userpb.NewUserServiceClient(conn)
+
+	_, err = client.ListLockouts(metadata.AppendToOutgoingContext(context.Background(), reqctx.ActorRolesHeader, reqctx.RoleAdmin), &userpb.ListLockoutsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.ListLockouts(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+support), &userpb.ListLockoutsRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	resp, err := client.ListLockouts(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+admin), &userpb.ListLockoutsRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Lockouts, 1)
+	assert.Equal(t, "account:default:john.doe@example.com", resp.Lockouts[0].Key)
+	mockAuthRepo.AssertExpectations(t)
+}
@@ -0,0 +1,223 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	authPack "user-api/internal/auth-pack"
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/encryption"
+	"user-api/pkg/password"
+	"user-api/pkg/totp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, appendix B, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	assert.Equal(t, "287082", totp.Code(secret, totp.Counter(time.Unix(59, 0))))
+	assert.Equal(t, "081804", totp.Code(secret, totp.Counter(time.Unix(1111111109, 0))))
+	assert.Equal(t, "005924", totp.Code(secret, totp.Counter(time.Unix(1234567890, 0))))
+
+	now := time.Unix(1234567890, 0)
+	counter, ok := totp.Validate(secret, totp.Code(secret, totp.Counter(now)-1), now, 1)
+	assert.True(t, ok)
+	assert.Equal(t, totp.Counter(now)-1, counter)
+	_, ok = totp.Validate(secret, totp.Code(secret, totp.Counter(now)-2), now, 1)
+	assert.False(t, ok)
+}
+
+func TestMFA(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.Use(reqctx.GinMiddleware(trustedProxy()))
+
+	key, err := encryption.ParseKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	require.NoError(t, err)
+	cipher, err := encryption.NewCipher(key)
+	require.NoError(t, err)
+
+	mockRepo := new(MockUserRepository)
+	mockAuthRepo := new(MockAuthRepository)
+	authService := newAuthService(t, mockAuthRepo, mockRepo, authPack.AlgorithmEdDSA, authPack.WithMFA(cipher, "user-api"))
+	handler := authPack.NewAuthHandler(authService)
+	router.POST("/auth/login", handler.Login)
+	router.POST("/auth/login/mfa", handler.VerifyMFA)
+	router.POST("/auth/mfa/totp", handler.EnrollTOTP)
+	router.POST("/auth/mfa/totp/confirm", handler.ConfirmTOTP)
+	router.DELETE("/admin/users/:id/mfa", handler.ResetMFA)
+
+	hasher := password.NewHasher(testParams)
+	hash, err := hasher.Hash("correct horse battery staple")
+	require.NoError(t, err)
+	user := &userPack.User{ID: 1, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Age: 30, Status: userPack.StatusActive}
+	mockRepo.On("GetUser", mock.Anything, 1).Return(user, nil)
+	mockAuthRepo.On("GetCredentials", mock.Anything, "john.doe@example.com").Return(&authPack.Credentials{UserID: 1, PasswordHash: hash}, nil)
+	mockAuthRepo.On("CreateRefreshToken", mock.Anything, mock.Anything).Return(nil)
+	mockAuthRepo.On("GetRoles", mock.Anything, 1).Return(nil, nil)
+
+	send := func(method, path, bearer string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(data))
+		req.Header.Set("Content-Type", "application/json")
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Log in without MFA to get an access token for enrollment.
+	mockAuthRepo.On("GetTOTPSecret", mock.Anything, 1).Return(nil, authPack.ErrMFANotEnrolled).Once()
+	w := postJSON(router, "/auth/login", authPack.LoginRequest{Email: "john.doe@example.com", Password: "correct horse battery staple"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var tokens authPack.TokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+
+	// Test case: Enrollment needs an access token
+	w = send(http.MethodPost, "/auth/mfa/totp", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Test case: Enrollment stores the secret encrypted
+	var stored []byte
+	mockAuthRepo.On("SaveTOTPSecret", mock.Anything, 1, mock.Anything).Return(nil).Once().Run(func(args mock.Arguments) {
+		stored = args.Get(2).([]byte)
+	})
+	w = send(http.MethodPost, "/auth/mfa/totp", tokens.AccessToken, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var enrollment authPack.TOTPEnrollment
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &enrollment))
+	assert.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/user-api:john.doe@example.com?"))
+	assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+	_, err = png.Decode(bytes.NewReader(enrollment.QRCode))
+	require.NoError(t, err)
+
+	secret, err := cipher.Decrypt(stored, []byte("mfa_totp:1"))
+	require.NoError(t, err)
+	assert.Equal(t, enrollment.Secret, totp.EncodeSecret(secret))
+	assert.NotContains(t, string(stored), string(secret))
+
+	// Test case: Confirmation with a wrong code, then the right one
+	mockAuthRepo.On("GetTOTPSecret", mock.Anything, 1).Return(&authPack.TOTPSecret{UserID: 1, Secret: stored}, nil).Twice()
+	code := totp.Code(secret, totp.Counter(time.Now()))
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	w = send(http.MethodPost, "/auth/mfa/totp/confirm", tokens.AccessToken, authPack.TOTPCodeRequest{Code: wrong})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var recoveryHashes [][]byte
+	mockAuthRepo.On("ConfirmTOTP", mock.Anything, 1, mock.Anything, mock.Anything).Return(nil).Once().Run(func(args mock.Arguments) {
+		recoveryHashes = args.Get(3).([][]byte)
+	})
+	w = send(http.MethodPost, "/auth/mfa/totp/confirm", tokens.AccessToken, authPack.TOTPCodeRequest{Code: code})
+	require.Equal(t, http.StatusOK, w.Code)
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &confirmed))
+	require.Len(t, confirmed.RecoveryCodes, 10)
+	require.Len(t, recoveryHashes, 10)
+	recoverySum := sha256.Sum256([]byte(strings.ReplaceAll(confirmed.RecoveryCodes[0], "-", "")))
+	assert.Equal(t, recoverySum[:], recoveryHashes[0])
+
+	// Test case: Login now stops at the TOTP step
+	mockAuthRepo.On("GetTOTPSecret", mock.Anything, 1).Return(&authPack.TOTPSecret{UserID: 1, Secret: stored, Confirmed: true}, nil)
+	w = postJSON(router, "/auth/login", authPack.LoginRequest{Email: "john.doe@example.com", Password: "correct horse battery staple"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var step struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		AccessToken string `json:"access_token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &step))
+	assert.True(t, step.MFARequired)
+	assert.Empty(t, step.AccessToken)
+	_, err = authService.VerifyAccessToken(step.MFAToken)
+	assert.Error(t, err, "an MFA token must not pass as an access token")
+
+	// Test case: A valid code completes the login, a replayed one does not
+	mockAuthRepo.On("UseTOTPCounter", mock.Anything, 1, mock.Anything).Return(true, nil).Once()
+	mockAuthRepo.On("UseTOTPCounter", mock.Anything, 1, mock.Anything).Return(false, nil).Once()
+	code = totp.Code(secret, totp.Counter(time.Now()))
+	w = postJSON(router, "/auth/login/mfa", authPack.MFARequest{MFAToken: step.MFAToken, Code: code})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "access_token")
+	w = postJSON(router, "/auth/login/mfa", authPack.MFARequest{MFAToken: step.MFAToken, Code: code})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Test case: Recovery codes are single use and ignore case and dashes
+	mockAuthRepo.On("UseRecoveryCode", mock.Anything, 1, recoveryHashes[0]).Return(true, nil).Once()
+	mockAuthRepo.On("UseRecoveryCode", mock.Anything, 1, recoveryHashes[0]).Return(false, nil).Once()
+	recoveryCode := strings.ToLower(strings.ReplaceAll(confirmed.RecoveryCodes[0], "-", ""))
+	w = postJSON(router, "/auth/login/mfa", authPack.MFARequest{MFAToken: step.MFAToken, RecoveryCode: recoveryCode})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = postJSON(router, "/auth/login/mfa", authPack.MFARequest{MFAToken: step.MFAToken, RecoveryCode: recoveryCode})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Test case: Forged MFA token
+	w = postJSON(router, "/auth/login/mfa", authPack.MFARequest{MFAToken: tokens.AccessToken, Code: code})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Test case: Only admins can reset MFA, as the access token says; the
+	// actor headers of even a trusted proxy do not count
+	w = send(http.MethodDelete, "/admin/users/1/mfa", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = send(http.MethodDelete, "/admin/users/1/mfa", tokens.AccessToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	req, _ := http.NewRequest(http.MethodDelete, "/admin/users/1/mfa", nil)
+	req.RemoteAddr = proxyAddr
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	req.Header.Set(reqctx.ActorRolesHeader, "admin")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	mockAuthRepo.On("DeleteMFA", mock.Anything, 1).Return(true, nil).Once()
+	mockAuthRepo.On("RevokeUserRefreshTokens", mock.Anything, 1).Return(int64(2), nil).Once()
+	adminTokens := refreshAs(t, authService, mockAuthRepo, mockRepo, 9, reqctx.RoleAdmin)
+	w = send(http.MethodDelete, "/admin/users/1/mfa", adminTokens.AccessToken, nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// Test case: Users of another tenant are not found, so their second
+	// factor stays
+	mockRepo.On("GetUser", mock.Anything, 3).Return(nil, userPack.ErrUserNotFound).Once()
+	w = send(http.MethodDelete, "/admin/users/3/mfa", adminTokens.AccessToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	mockAuthRepo.AssertNotCalled(t, "DeleteMFA", mock.Anything, 3)
+	mockAuthRepo.AssertNotCalled(t, "RevokeUserRefreshTokens", mock.Anything, 3)
+	mockAuthRepo.AssertExpectations(t)
+}
+
+func TestEncryption(t *testing.T) {
+	key, err := encryption.ParseKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	require.NoError(t, err)
+	cipher, err := encryption.NewCipher(key)
+	require.NoError(t, err)
+
+	sealed, err := cipher.Encrypt([]byte("secret"), []byte("row 1"))
+	require.NoError(t, err)
+	opened, err := cipher.Decrypt(sealed, []byte("row 1"))
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(opened))
+
+	_, err = cipher.Decrypt(sealed, []byte("row 2"))
+	assert.ErrorIs(t, err, encryption.ErrDecrypt)
+
+	_, err = encryption.ParseKey("c2hvcnQ=")
+	assert.Error(t, err)
+}
@@ -0,0 +1,232 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+
+	userpb "user-api/gen/user"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/httpcache"
+	"user-api/pkg/negotiate"
+)
+
+func serveBody(r http.Handler, method, path, contentType string, body []byte, headers ...string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func newNegotiatingRouter(mockRepo *MockUserRepository) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	handler := userPack.NewUserHandler(userPack.NewUserService(mockRepo))
+	r := gin.New()
+	users := r.Group("", negotiate.Compress([]string{"zstd", "gzip"}, 256), negotiate.Middleware())
+	users.POST("/users", handler.CreateUser)
+	users.GET("/user/:id", httpcache.Middleware(""), handler.GetUser)
+	users.GET("/user/:id/versions", handler.ListUserVersions)
+	return r
+}
+
+func TestNegotiateResponseFormat(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	r := newNegotiatingRouter(mockRepo)
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{
+		ID: 1, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Age: 30,
+		Created: created, Updated: created, Status: userPack.StatusSuspended,
+	}, nil)
+	mockRepo.On("GetUser", mock.Anything, 2).Return(nil, userPack.ErrUserNotFound)
+
+	w := serve(r, http.MethodGet, "/user/1", "")
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Values("Vary"), "Accept")
+
+	w = serve(r, http.MethodGet, "/user/1", "", "Accept", "application/x-protobuf")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-protobuf", w.Header().Get("Content-Type"))
+	var pb userpb.User
+	require.NoError(t, proto.Unmarshal(w.Body.Bytes(), &pb))
+	assert.Equal(t, "john.doe@example.com", pb.Email)
+	assert.Equal(t, userpb.UserStatus_USER_STATUS_SUSPENDED, pb.Status)
+	assert.Equal(t, "2024-05-01T12:00:00Z", pb.Updated)
+
+	w = serve(r, http.MethodGet, "/user/1", "", "Accept", "application/msgpack")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/msgpack", w.Header().Get("Content-Type"))
+	var fromMsgpack struct {
+		Email   string    `codec:"email"`
+		Status  string    `codec:"status"`
+		Created time.Time `codec:"created"`
+	}
+	require.NoError(t, codec.NewDecoderBytes(w.Body.Bytes(), &codec.MsgpackHandle{}).Decode(&fromMsgpack))
+	assert.Equal(t, "john.doe@example.com", fromMsgpack.Email)
+	assert.Equal(t, "suspended", fromMsgpack.Status)
+	assert.True(t, created.Equal(fromMsgpack.Created))
+
+	w = serve(r, http.MethodGet, "/user/1", "", "Accept", "application/cbor")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/cbor", w.Header().Get("Content-Type"))
+	var fromCBOR map[string]interface{}
+	require.NoError(t, cbor.Unmarshal(w.Body.Bytes(), &fromCBOR))
+	assert.Equal(t, "John", fromCBOR["firstname"])
+	assert.Equal(t, "2024-05-01T12:00:00Z", fromCBOR["created"])
+
+	// Quality values decide; ties go to JSON.
+	w = serve(r, http.MethodGet, "/user/1", "", "Accept", "application/json;q=0.5, application/cbor")
+	assert.Equal(t, "application/cbor", w.Header().Get("Content-Type"))
+	w = serve(r, http.MethodGet, "/user/1", "", "Accept", "application/*")
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+
+	// Nothing supported is acceptable.
+	w = serve(r, http.MethodGet, "/user/1", "", "Accept", "text/html")
+	assert.Equal(t, http.StatusNotAcceptable, w.Code)
+	w = serve(r, http.MethodGet, "/user/1", "", "Accept", "application/json;q=0, text/html")
+	assert.Equal(t, http.StatusNotAcceptable, w.Code)
+
+	// Values without a protobuf form fall back to JSON.
+	w = serve(r, http.MethodGet, "/user/2", "", "Accept", "application/x-protobuf")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error": "User not found"}`, w.Body.String())
+}
+
+func TestNegotiateRequestFormat(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	r := newNegotiatingRouter(mockRepo)
+	mockRepo.On("CreateUser", mock.Anything, mock.MatchedBy(func(u *userPack.User) bool {
+		return u.Firstname == "John" && u.Email == "john.doe@example.com" && u.Age == 30
+	})).Run(func(args mock.Arguments) {
+		args.Get(1).(*userPack.User).ID = 7
+	}).Return(nil).Times(3)
+
+	user := map[string]interface{}{"firstname": "John", "lastname": "Doe", "email": "john.doe@example.com", "age": 30}
+	body, err := cbor.Marshal(user)
+	require.NoError(t, err)
+	w := serveBody(r, http.MethodPost, "/users", "application/cbor", body, "Accept", "application/cbor")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created map[string]interface{}
+	require.NoError(t, cbor.Unmarshal(w.Body.Bytes(), &created))
+	assert.EqualValues(t, 7, created["id"])
+
+	var packed []byte
+	require.NoError(t, codec.NewEncoderBytes(&packed, &codec.MsgpackHandle{}).Encode(user))
+	w = serveBody(r, http.MethodPost, "/users", "application/x-msgpack", packed)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+	body, err = proto.Marshal(&userpb.User{Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Age: 30})
+	require.NoError(t, err)
+	w = serveBody(r, http.MethodPost, "/users", "application/x-protobuf", body, "Accept", "application/x-protobuf")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var pb userpb.User
+	require.NoError(t, proto.Unmarshal(w.Body.Bytes(), &pb))
+	assert.EqualValues(t, 7, pb.Id)
+
+	w = serveBody(r, http.MethodPost, "/users", "text/plain", []byte("John"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	w = serveBody(r, http.MethodPost, "/users", "application/cbor", []byte{0xff})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	r := newNegotiatingRouter(mockRepo)
+	user := &userPack.User{ID: 1, Firstname: "John", Lastname: strings.Repeat("Doe", 100), Email: "john.doe@example.com"}
+	versions := []*userPack.UserVersion{{Version: 1, User: user, ValidFrom: time.Now()}}
+	mockRepo.On("ListUserVersions", mock.Anything, 1).Return(versions, nil)
+	mockRepo.On("GetUser", mock.Anything, 1).Return(user, nil)
+
+	plain := serve(r, http.MethodGet, "/user/1/versions", "")
+	assert.Empty(t, plain.Header().Get("Content-Encoding"))
+	assert.Contains(t, plain.Header().Values("Vary"), "Accept-Encoding")
+
+	w := serve(r, http.MethodGet, "/user/1/versions", "", "Accept-Encoding", "gzip, deflate")
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	zr, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, plain.Body.String(), string(body))
+
+	w = serve(r, http.MethodGet, "/user/1/versions", "", "Accept-Encoding", "gzip;q=0.5, zstd")
+	require.Equal(t, "zstd", w.Header().Get("Content-Encoding"))
+	zd, err := zstd.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err = io.ReadAll(zd)
+	zd.Close()
+	require.NoError(t, err)
+	assert.Equal(t, plain.Body.String(), string(body))
+
+	w = serve(r, http.MethodGet, "/user/1/versions", "", "Accept-Encoding", "br")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+
+	// Compressed users carry a weak tag that still revalidates.
+	w = serve(r, http.MethodGet, "/user/1", "", "Accept-Encoding", "gzip")
+	require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	etag := w.Header().Get("ETag")
+	assert.True(t, strings.HasPrefix(etag, `W/"`))
+	w = serve(r, http.MethodGet, "/user/1", "", "Accept-Encoding", "gzip", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Empty(t, w.Body.Bytes())
+
+	// Small bodies are not worth it.
+	mockRepo.On("GetUser", mock.Anything, 2).Return(&userPack.User{ID: 2}, nil)
+	w = serve(r, http.MethodGet, "/user/2", "", "Accept-Encoding", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+}
+
+func TestNegotiateLegacyRoutes(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	r := newGatewayRouter(t, mockRepo)
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{
+		ID: 1, Firstname: "John", Email: "john.doe@example.com", Status: userPack.StatusActive,
+	}, nil)
+	mockRepo.On("CreateUser", mock.Anything, mock.MatchedBy(func(u *userPack.User) bool {
+		return u.Email == "jane.doe@example.com" && u.PasswordHash != ""
+	})).Run(func(args mock.Arguments) {
+		args.Get(1).(*userPack.User).ID = 8
+	}).Return(nil)
+
+	w := serve(r, http.MethodGet, "/user/1", "", "Accept", "application/x-protobuf")
+	require.Equal(t, http.StatusOK, w.Code)
+	var pb userpb.User
+	require.NoError(t, proto.Unmarshal(w.Body.Bytes(), &pb))
+	assert.Equal(t, "john.doe@example.com", pb.Email)
+
+	var packed []byte
+	require.NoError(t, codec.NewEncoderBytes(&packed, &codec.MsgpackHandle{}).Encode(map[string]interface{}{
+		"firstname": "Jane", "lastname": "Doe", "email": "jane.doe@example.com", "age": 28, "password": "correct horse battery",
+	}))
+	w = serveBody(r, http.MethodPost, "/users", "application/msgpack", packed, "Accept", "application/cbor")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created map[string]interface{}
+	require.NoError(t, cbor.Unmarshal(w.Body.Bytes(), &created))
+	assert.EqualValues(t, 8, created["id"])
+	assert.NotContains(t, created, "password")
+
+	w = serveBody(r, http.MethodPatch, "/user/1", "application/xml", []byte("<user/>"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	mockRepo.AssertExpectations(t)
+}
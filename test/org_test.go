@@ -0,0 +1,434 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	orgpb "user-api/gen/org"
+	orgGrpc "user-api/internal/grpc/org"
+	userGrpc "user-api/internal/grpc/user"
+	orgPack "user-api/internal/org-pack"
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type MockOrgRepository struct {
+	mock.Mock
+}
+
+func (m *MockOrgRepository) CreateOrganization(ctx context.Context, org *orgPack.Organization, ownerID int) error {
+	args := m.Called(ctx, org, ownerID)
+	return args.Error(0)
+}
+
+func (m *MockOrgRepository) GetOrganization(ctx context.Context, id int) (*orgPack.Organization, error) {
+	args := m.Called(ctx, id)
+	if org, ok := args.Get(0).(*orgPack.Organization); ok {
+		return org, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockOrgRepository) UpdateOrganization(ctx context.Context, id int, org *orgPack.Organization) error {
+	args := m.Called(ctx, id, org)
+	return args.Error(0)
+}
+
+func (m *MockOrgRepository) DeleteOrganization(ctx context.Context, id int) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *MockOrgRepository) ListMembers(ctx context.Context, orgID int, limit, offset int) ([]*orgPack.Member, error) {
+	args := m.Called(ctx, orgID, limit, offset)
+	if members, ok := args.Get(0).([]*orgPack.Member); ok {
+		return members, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockOrgRepository) ListUserMemberships(ctx context.Context, userID int, limit, offset int) ([]*orgPack.Membership, error) {
+	args := m.Called(ctx, userID, limit, offset)
+	if memberships, ok := args.Get(0).([]*orgPack.Membership); ok {
+		return memberships, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockOrgRepository) BatchListUserMemberships(ctx context.Context, userIDs []int) (map[int][]*orgPack.Membership, error) {
+	args := m.Called(ctx, userIDs)
+	if memberships, ok := args.Get(0).(map[int][]*orgPack.Membership); ok {
+		return memberships, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockOrgRepository) MemberRole(ctx context.Context, orgID, userID int) (string, error) {
+	args := m.Called(ctx, orgID, userID)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockOrgRepository) SetMember(ctx context.Context, orgID, userID int, role string) (*orgPack.Member, error) {
+	args := m.Called(ctx, orgID, userID, role)
+	if member, ok := args.Get(0).(*orgPack.Member); ok {
+		return member, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockOrgRepository) RemoveMember(ctx context.Context, orgID, userID int) error {
+	args := m.Called(ctx, orgID, userID)
+	return args.Error(0)
+}
+
+func (m *MockOrgRepository) CreateTeam(ctx context.Context, team *orgPack.Team) error {
+	args := m.Called(ctx, team)
+	return args.Error(0)
+}
+
+func (m *MockOrgRepository) GetTeam(ctx context.Context, orgID, id int) (*orgPack.Team, error) {
+	args := m.Called(ctx, orgID, id)
+	if team, ok := args.Get(0).(*orgPack.Team); ok {
+		return team, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockOrgRepository) ListTeams(ctx context.Context, orgID int, limit, offset int) ([]*orgPack.Team, error) {
+	args := m.Called(ctx, orgID, limit, offset)
+	if teams, ok := args.Get(0).([]*orgPack.Team); ok {
+		return teams, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockOrgRepository) UpdateTeam(ctx context.Context, orgID, id int, team *orgPack.Team) error {
+	args := m.Called(ctx, orgID, id, team)
+	return args.Error(0)
+}
+
+func (m *MockOrgRepository) DeleteTeam(ctx context.Context, orgID, id int) error {
+	args := m.Called(ctx, orgID, id)
+	return args.Error(0)
+}
+
+func (m *MockOrgRepository) ListTeamMembers(ctx context.Context, orgID, teamID int, limit, offset int) ([]*orgPack.Member, error) {
+	args := m.Called(ctx, orgID, teamID, limit, offset)
+	if members, ok := args.Get(0).([]*orgPack.Member); ok {
+		return members, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockOrgRepository) SetTeamMember(ctx context.Context, orgID, teamID, userID int, role string) (*orgPack.Member, error) {
+	args := m.Called(ctx, orgID, teamID, userID, role)
+	if member, ok := args.Get(0).(*orgPack.Member); ok {
+		return member, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockOrgRepository) RemoveTeamMember(ctx context.Context, orgID, teamID, userID int) error {
+	args := m.Called(ctx, orgID, teamID, userID)
+	return args.Error(0)
+}
+
+// verifiedActor stands in for the access token: it takes the actor of the
+// X-Actor headers as verified.
+func verifiedActor() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if meta := reqctx.FromContext(ctx.Request.Context()); meta.Actor != "" {
+			ctx.Request = ctx.Request.WithContext(reqctx.WithActor(ctx.Request.Context(), meta.Actor, meta.Roles))
+		}
+		ctx.Next()
+	}
+}
+
+// asUser returns the headers of a request by userID with roles.
+func asUser(userID int, roles ...string) []string {
+	return []string{reqctx.ActorHeader, reqctx.UserActorPrefix + strconv.Itoa(userID), reqctx.ActorRolesHeader, strings.Join(roles, ",")}
+}
+
+func newOrgRouter(repo *MockOrgRepository) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.Use(reqctx.GinMiddleware(trustedProxy()), verifiedActor())
+	handler := orgPack.NewOrgHandler(orgPack.NewOrgService(repo))
+	router.GET("/user/:id/orgs", handler.ListUserOrganizations)
+	router.POST("/orgs", handler.CreateOrganization)
+	router.GET("/orgs/:id", handler.GetOrganization)
+	router.PATCH("/orgs/:id", handler.UpdateOrganization)
+	router.DELETE("/orgs/:id", handler.DeleteOrganization)
+	router.GET("/orgs/:id/members", handler.ListMembers)
+	router.PUT("/orgs/:id/members/:userId", handler.SetMember)
+	router.DELETE("/orgs/:id/members/:userId", handler.RemoveMember)
+	router.POST("/orgs/:id/teams", handler.CreateTeam)
+	router.GET("/orgs/:id/teams", handler.ListTeams)
+	router.GET("/orgs/:id/teams/:teamId", handler.GetTeam)
+	router.PATCH("/orgs/:id/teams/:teamId", handler.UpdateTeam)
+	router.DELETE("/orgs/:id/teams/:teamId", handler.DeleteTeam)
+	router.GET("/orgs/:id/teams/:teamId/members", handler.ListTeamMembers)
+	router.PUT("/orgs/:id/teams/:teamId/members/:userId", handler.SetTeamMember)
+	router.DELETE("/orgs/:id/teams/:teamId/members/:userId", handler.RemoveTeamMember)
+	return router
+}
+
+func sendJSON(router *gin.Engine, method, path string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, path, &buf)
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = proxyAddr
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestOrganizationCRUD(t *testing.T) {
+	mockRepo := new(MockOrgRepository)
+	router := newOrgRouter(mockRepo)
+	owner, member := asUser(1), asUser(5)
+
+	// Test case: Name, slug and owner are required
+	w := sendJSON(router, http.MethodPost, "/orgs", orgPack.CreateOrganizationRequest{Name: "Acme", Slug: "Acme Inc", OwnerID: 1}, owner...)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = sendJSON(router, http.MethodPost, "/orgs", orgPack.CreateOrganizationRequest{Name: "Acme", Slug: "acme"}, owner...)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Test case: Anonymous callers and organizations for someone else
+	w = sendJSON(router, http.MethodPost, "/orgs", orgPack.CreateOrganizationRequest{Name: "Acme", Slug: "acme", OwnerID: 1})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = sendJSON(router, http.MethodPost, "/orgs", orgPack.CreateOrganizationRequest{Name: "Acme", Slug: "acme", OwnerID: 1}, member...)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Test case: Successful creation
+	mockRepo.On("CreateOrganization", mock.Anything, mock.MatchedBy(func(org *orgPack.Organization) bool {
+		return org.Name == "Acme" && org.Slug == "acme"
+	}), 1).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(1).(*orgPack.Organization).ID = 10
+	}).Once()
+	w = sendJSON(router, http.MethodPost, "/orgs", orgPack.CreateOrganizationRequest{Name: "Acme", Slug: "acme", OwnerID: 1}, owner...)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var org orgPack.Organization
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &org))
+	assert.Equal(t, 10, org.ID)
+
+	// Test case: Taken slug, and an unknown owner named by a platform admin
+	mockRepo.On("CreateOrganization", mock.Anything, mock.Anything, 1).Return(orgPack.ErrSlugTaken).Once()
+	w = sendJSON(router, http.MethodPost, "/orgs", orgPack.CreateOrganizationRequest{Name: "Acme", Slug: "acme", OwnerID: 1}, owner...)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	mockRepo.On("CreateOrganization", mock.Anything, mock.Anything, 99).Return(userPack.ErrUserNotFound).Once()
+	w = sendJSON(router, http.MethodPost, "/orgs", orgPack.CreateOrganizationRequest{Name: "Acme", Slug: "acme", OwnerID: 99}, asUser(2, reqctx.RolePlatformAdmin)...)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Test case: Reading takes a caller
+	mockRepo.On("GetOrganization", mock.Anything, 10).Return(&orgPack.Organization{ID: 10, Name: "Acme", Slug: "acme"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(router, http.MethodGet, "/orgs/10", nil).Code)
+	assert.Equal(t, http.StatusOK, sendJSON(router, http.MethodGet, "/orgs/10", nil, member...).Code)
+
+	// Test case: Update patches the stored organization, for owners only
+	mockRepo.On("MemberRole", mock.Anything, 10, 1).Return(orgPack.RoleOwner, nil)
+	mockRepo.On("MemberRole", mock.Anything, 10, 5).Return(orgPack.RoleMember, nil)
+	mockRepo.On("UpdateOrganization", mock.Anything, 10, &orgPack.Organization{ID: 10, Name: "Acme Corp", Slug: "acme"}).Return(nil).Once()
+	assert.Equal(t, http.StatusForbidden, sendJSON(router, http.MethodPatch, "/orgs/10", map[string]string{"name": "Acme Corp"}, member...).Code)
+	w = sendJSON(router, http.MethodPatch, "/orgs/10", map[string]string{"name": "Acme Corp"}, owner...)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"Acme Corp"`)
+
+	// Test case: Delete, not found and other organizations
+	mockRepo.On("DeleteOrganization", mock.Anything, 10).Return(nil).Once()
+	mockRepo.On("MemberRole", mock.Anything, 11, 1).Return("", orgPack.ErrOrganizationNotFound).Once()
+	mockRepo.On("MemberRole", mock.Anything, 12, 1).Return("", orgPack.ErrMemberNotFound).Once()
+	assert.Equal(t, http.StatusForbidden, sendJSON(router, http.MethodDelete, "/orgs/10", nil, member...).Code)
+	assert.Equal(t, http.StatusNoContent, sendJSON(router, http.MethodDelete, "/orgs/10", nil, owner...).Code)
+	assert.Equal(t, http.StatusNotFound, sendJSON(router, http.MethodDelete, "/orgs/11", nil, owner...).Code)
+	assert.Equal(t, http.StatusForbidden, sendJSON(router, http.MethodDelete, "/orgs/12", nil, owner...).Code)
+	mockRepo.AssertExpectations(t)
+	mockRepo.AssertNotCalled(t, "DeleteOrganization", mock.Anything, 12)
+}
+
+func TestOrganizationMembers(t *testing.T) {
+	mockRepo := new(MockOrgRepository)
+	router := newOrgRouter(mockRepo)
+	owner, admin, member := asUser(1), asUser(5), asUser(6)
+
+	joined := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mockRepo.On("GetOrganization", mock.Anything, 10).Return(&orgPack.Organization{ID: 10, Name: "Acme", Slug: "acme"}, nil)
+	mockRepo.On("GetOrganization", mock.Anything, 11).Return(nil, orgPack.ErrOrganizationNotFound)
+	mockRepo.On("MemberRole", mock.Anything, 10, 1).Return(orgPack.RoleOwner, nil)
+	mockRepo.On("MemberRole", mock.Anything, 10, 5).Return(orgPack.RoleAdmin, nil)
+	mockRepo.On("MemberRole", mock.Anything, 10, 6).Return(orgPack.RoleMember, nil)
+	mockRepo.On("MemberRole", mock.Anything, 10, 7).Return("", orgPack.ErrMemberNotFound)
+
+	// Test case: Members are paginated
+	mockRepo.On("ListMembers", mock.Anything, 10, 2, 4).Return([]*orgPack.Member{
+		{UserID: 5, Firstname: "John", Role: orgPack.RoleAdmin, Joined: joined},
+	}, nil).Once()
+	w := sendJSON(router, http.MethodGet, "/orgs/10/members?limit=2&offset=4", nil, member...)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"role":"admin"`)
+	assert.Equal(t, http.StatusBadRequest, sendJSON(router, http.MethodGet, "/orgs/10/members?limit=0", nil, member...).Code)
+	assert.Equal(t, http.StatusNotFound, sendJSON(router, http.MethodGet, "/orgs/11/members", nil, member...).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(router, http.MethodGet, "/orgs/10/members", nil).Code)
+
+	// Test case: Organizations of a user
+	mockRepo.On("ListUserMemberships", mock.Anything, 5, 50, 0).Return([]*orgPack.Membership{
+		{Organization: orgPack.Organization{ID: 10, Name: "Acme", Slug: "acme"}, Role: orgPack.RoleAdmin, Joined: joined},
+	}, nil).Once()
+	mockRepo.On("ListUserMemberships", mock.Anything, 6, 50, 0).Return(nil, userPack.ErrUserNotFound).Once()
+	w = sendJSON(router, http.MethodGet, "/user/5/orgs", nil, member...)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"slug":"acme"`)
+	assert.Equal(t, http.StatusNotFound, sendJSON(router, http.MethodGet, "/user/6/orgs", nil, member...).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(router, http.MethodGet, "/user/5/orgs", nil).Code)
+
+	// Test case: Roles are validated
+	assert.Equal(t, http.StatusBadRequest, sendJSON(router, http.MethodPut, "/orgs/10/members/5", orgPack.RoleRequest{Role: "boss"}, owner...).Code)
+
+	// Test case: Adding a member and demoting the last owner
+	mockRepo.On("SetMember", mock.Anything, 10, 7, orgPack.RoleMember).Return(&orgPack.Member{UserID: 7, Role: orgPack.RoleMember}, nil).Twice()
+	mockRepo.On("SetMember", mock.Anything, 10, 1, orgPack.RoleMember).Return(nil, orgPack.ErrLastOwner).Once()
+	assert.Equal(t, http.StatusOK, sendJSON(router, http.MethodPut, "/orgs/10/members/7", orgPack.RoleRequest{Role: orgPack.RoleMember}, owner...).Code)
+	assert.Equal(t, http.StatusConflict, sendJSON(router, http.MethodPut, "/orgs/10/members/1", orgPack.RoleRequest{Role: orgPack.RoleMember}, owner...).Code)
+
+	// Test case: Admins manage members but not owners; members manage nobody
+	assert.Equal(t, http.StatusOK, sendJSON(router, http.MethodPut, "/orgs/10/members/7", orgPack.RoleRequest{Role: orgPack.RoleMember}, admin...).Code)
+	assert.Equal(t, http.StatusForbidden, sendJSON(router, http.MethodPut, "/orgs/10/members/7", orgPack.RoleRequest{Role: orgPack.RoleOwner}, admin...).Code)
+	assert.Equal(t, http.StatusForbidden, sendJSON(router, http.MethodPut, "/orgs/10/members/1", orgPack.RoleRequest{Role: orgPack.RoleAdmin}, admin...).Code)
+	assert.Equal(t, http.StatusForbidden, sendJSON(router, http.MethodDelete, "/orgs/10/members/1", nil, admin...).Code)
+	assert.Equal(t, http.StatusForbidden, sendJSON(router, http.MethodPut, "/orgs/10/members/7", orgPack.RoleRequest{Role: orgPack.RoleMember}, member...).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(router, http.MethodPut, "/orgs/10/members/7", orgPack.RoleRequest{Role: orgPack.RoleMember}).Code)
+
+	// Test case: Platform admins act as owners
+	mockRepo.On("SetMember", mock.Anything, 10, 7, orgPack.RoleOwner).Return(&orgPack.Member{UserID: 7, Role: orgPack.RoleOwner}, nil).Once()
+	w = sendJSON(router, http.MethodPut, "/orgs/10/members/7", orgPack.RoleRequest{Role: orgPack.RoleOwner}, asUser(2, reqctx.RolePlatformAdmin)...)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Test case: The last owner cannot leave
+	mockRepo.On("RemoveMember", mock.Anything, 10, 1).Return(orgPack.ErrLastOwner).Once()
+	mockRepo.On("RemoveMember", mock.Anything, 10, 6).Return(nil).Once()
+	mockRepo.On("RemoveMember", mock.Anything, 10, 7).Return(orgPack.ErrMemberNotFound).Once()
+	assert.Equal(t, http.StatusConflict, sendJSON(router, http.MethodDelete, "/orgs/10/members/1", nil, owner...).Code)
+	assert.Equal(t, http.StatusNoContent, sendJSON(router, http.MethodDelete, "/orgs/10/members/6", nil, admin...).Code)
+	assert.Equal(t, http.StatusNotFound, sendJSON(router, http.MethodDelete, "/orgs/10/members/7", nil, owner...).Code)
+	mockRepo.AssertExpectations(t)
+	mockRepo.AssertNotCalled(t, "SetMember", mock.Anything, 10, 1, orgPack.RoleAdmin)
+}
+
+func TestTeams(t *testing.T) {
+	mockRepo := new(MockOrgRepository)
+	router := newOrgRouter(mockRepo)
+	admin, member := asUser(1), asUser(5)
+	mockRepo.On("MemberRole", mock.Anything, 10, 1).Return(orgPack.RoleAdmin, nil)
+	mockRepo.On("MemberRole", mock.Anything, 10, 5).Return(orgPack.RoleMember, nil)
+
+	// Test case: Teams belong to the organization in the path
+	mockRepo.On("CreateTeam", mock.Anything, mock.MatchedBy(func(team *orgPack.Team) bool {
+		return team.OrgID == 10 && team.Name == "Platform"
+	})).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(1).(*orgPack.Team).ID = 3
+	}).Once()
+	w := sendJSON(router, http.MethodPost, "/orgs/10/teams", orgPack.Team{OrgID: 99, Name: "Platform"}, admin...)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), `"org_id":10`)
+	assert.Equal(t, http.StatusBadRequest, sendJSON(router, http.MethodPost, "/orgs/10/teams", orgPack.Team{}, admin...).Code)
+
+	mockRepo.On("CreateTeam", mock.Anything, mock.Anything).Return(orgPack.ErrTeamNameTaken).Once()
+	assert.Equal(t, http.StatusConflict, sendJSON(router, http.MethodPost, "/orgs/10/teams", orgPack.Team{Name: "Platform"}, admin...).Code)
+
+	// Test case: Members of the organization cannot change its teams
+	assert.Equal(t, http.StatusForbidden, sendJSON(router, http.MethodPost, "/orgs/10/teams", orgPack.Team{Name: "Infra"}, member...).Code)
+	assert.Equal(t, http.StatusForbidden, sendJSON(router, http.MethodPut, "/orgs/10/teams/3/members/5", orgPack.RoleRequest{Role: orgPack.TeamRoleMaintainer}, member...).Code)
+	assert.Equal(t, http.StatusForbidden, sendJSON(router, http.MethodDelete, "/orgs/10/teams/3", nil, member...).Code)
+	assert.Equal(t, http.StatusUnauthorized, sendJSON(router, http.MethodDelete, "/orgs/10/teams/3", nil).Code)
+
+	// Test case: Only organization members can join a team
+	mockRepo.On("SetTeamMember", mock.Anything, 10, 3, 5, orgPack.TeamRoleMaintainer).Return(&orgPack.Member{UserID: 5, Role: orgPack.TeamRoleMaintainer}, nil).Once()
+	mockRepo.On("SetTeamMember", mock.Anything, 10, 3, 8, orgPack.TeamRoleMember).Return(nil, orgPack.ErrNotOrgMember).Once()
+	assert.Equal(t, http.StatusOK, sendJSON(router, http.MethodPut, "/orgs/10/teams/3/members/5", orgPack.RoleRequest{Role: orgPack.TeamRoleMaintainer}, admin...).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, sendJSON(router, http.MethodPut, "/orgs/10/teams/3/members/8", orgPack.RoleRequest{Role: orgPack.TeamRoleMember}, admin...).Code)
+	assert.Equal(t, http.StatusBadRequest, sendJSON(router, http.MethodPut, "/orgs/10/teams/3/members/8", orgPack.RoleRequest{Role: orgPack.RoleOwner}, admin...).Code)
+
+	// Test case: Team members of an unknown team
+	mockRepo.On("GetTeam", mock.Anything, 10, 4).Return(nil, orgPack.ErrTeamNotFound).Once()
+	assert.Equal(t, http.StatusNotFound, sendJSON(router, http.MethodGet, "/orgs/10/teams/4/members", nil, member...).Code)
+
+	mockRepo.On("DeleteTeam", mock.Anything, 10, 3).Return(nil).Once()
+	assert.Equal(t, http.StatusNoContent, sendJSON(router, http.MethodDelete, "/orgs/10/teams/3", nil, admin...).Code)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestOrganizationGRPC(t *testing.T) {
+	mockRepo := new(MockOrgRepository)
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(userGrpc.ErrorUnaryInterceptor, reqctx.UnaryServerInterceptor(reqctx.WithGatewayKey(testGatewayKey))))
+	orgpb.RegisterOrganizationServiceServer(server, orgGrpc.NewGRPCServer(orgPack.NewOrgService(mockRepo)))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	client := orgpb.NewOrganizationServiceClient(conn)
+	// The gateway vouches for the user of the access token.
+	ctx := metadata.AppendToOutgoingContext(context.Background(), reqctx.GatewayKeyHeader, testGatewayKey,
+		reqctx.ActorHeader, reqctx.UserActorPrefix+"1", reqctx.ActorVerifiedHeader, "true")
+
+	// Test case: Anonymous callers
+	_, err = client.GetOrganization(context.Background(), &orgpb.GetOrganizationRequest{Id: 10})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// Test case: Create an organization
+	mockRepo.On("CreateOrganization", mock.Anything, mock.Anything, 1).Return(nil).Run(func(args mock.Arguments) {
+		args.Get(1).(*orgPack.Organization).ID = 10
+	}).Once()
+	resp, err := client.CreateOrganization(ctx, &orgpb.CreateOrganizationRequest{Organization: &orgpb.Organization{Name: "Acme", Slug: "acme"}, OwnerId: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int32(10), resp.Organization.Id)
+	_, err = client.CreateOrganization(ctx, &orgpb.CreateOrganizationRequest{Organization: &orgpb.Organization{Name: "Acme", Slug: "acme"}, OwnerId: 2})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Test case: Unset limits default to a page of 50
+	mockRepo.On("ListUserMemberships", mock.Anything, 1, 50, 0).Return([]*orgPack.Membership{
+		{Organization: orgPack.Organization{ID: 10, Name: "Acme", Slug: "acme"}, Role: orgPack.RoleOwner},
+	}, nil).Once()
+	orgs, err := client.ListUserOrganizations(ctx, &orgpb.ListUserOrganizationsRequest{UserId: 1})
+	require.NoError(t, err)
+	require.Len(t, orgs.Organizations, 1)
+	assert.Equal(t, "owner", orgs.Organizations[0].Role)
+	_, err = client.ListMembers(ctx, &orgpb.ListMembersRequest{OrgId: 10, Limit: 1000})
+	require.Error(t, err)
+
+	// Test case: The last owner cannot be removed
+	mockRepo.On("MemberRole", mock.Anything, 10, 1).Return(orgPack.RoleOwner, nil)
+	mockRepo.On("RemoveMember", mock.Anything, 10, 1).Return(orgPack.ErrLastOwner).Once()
+	_, err = client.RemoveMember(ctx, &orgpb.RemoveMemberRequest{OrgId: 10, UserId: 1})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), orgPack.ErrLastOwner.Error())
+	mockRepo.AssertExpectations(t)
+}
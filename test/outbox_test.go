@@ -0,0 +1,236 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"user-api/internal/outbox"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryOutbox is an outbox table in memory. It claims messages like the
+// Postgres query does: the oldest unpublished message of each key, once it
+// is due and no other relay holds it, and records the results when the
+// batch is done, as the commit would.
+type memoryOutbox struct {
+	mu   sync.Mutex
+	rows []*outboxRow
+}
+
+type outboxRow struct {
+	msg           *outbox.Message
+	attempts      int
+	nextAttemptAt time.Time
+	published     bool
+	lastError     string
+	claimed       bool
+}
+
+func (o *memoryOutbox) add(key, eventType string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.rows = append(o.rows, &outboxRow{msg: &outbox.Message{
+		ID: int64(len(o.rows) + 1), Type: eventType, Key: key, Payload: json.RawMessage(`{}`), Created: time.Now(),
+	}})
+}
+
+func (o *memoryOutbox) ProcessDueMessages(ctx context.Context, limit int, publish func(*outbox.Message, int) outbox.PublishResult) (int, error) {
+	o.mu.Lock()
+	var claimed []*outboxRow
+	pending := map[string]bool{}
+	for _, row := range o.rows {
+		if row.published {
+			continue
+		}
+		oldest := !pending[row.msg.Key]
+		pending[row.msg.Key] = true
+		if oldest && !row.claimed && !row.nextAttemptAt.After(time.Now()) && len(claimed) < limit {
+			row.claimed = true
+			claimed = append(claimed, row)
+		}
+	}
+	o.mu.Unlock()
+
+	results := make([]outbox.PublishResult, len(claimed))
+	for i, row := range claimed {
+		results[i] = publish(row.msg, row.attempts)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, row := range claimed {
+		row.claimed = false
+		row.attempts++
+		row.published = results[i].Published
+		row.lastError = results[i].Error
+		if !row.published {
+			row.nextAttemptAt = results[i].NextAttemptAt
+		}
+	}
+	return len(claimed), nil
+}
+
+func (o *memoryOutbox) PurgePublished(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+func (o *memoryOutbox) row(id int64) outboxRow {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return *o.rows[id-1]
+}
+
+// due makes the messages waiting for a retry due now.
+func (o *memoryOutbox) due() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, row := range o.rows {
+		row.nextAttemptAt = time.Time{}
+	}
+}
+
+func (o *memoryOutbox) unpublished() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for _, row := range o.rows {
+		if !row.published {
+			n++
+		}
+	}
+	return n
+}
+
+// flakyPublisher fails the messages fail picks and hands the others on.
+type flakyPublisher struct {
+	outbox.Publisher
+	mu   sync.Mutex
+	fail func(*outbox.Message) bool
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, msg *outbox.Message) error {
+	p.mu.Lock()
+	fail := p.fail(msg)
+	p.mu.Unlock()
+	if fail {
+		return errors.New("broker unavailable")
+	}
+	return p.Publisher.Publish(ctx, msg)
+}
+
+// published decodes the JSON lines a WriterPublisher wrote.
+func published(t *testing.T, data []byte) []outbox.Message {
+	var messages []outbox.Message
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var msg outbox.Message
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &msg))
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func TestRelayRetry(t *testing.T) {
+	store := new(memoryOutbox)
+	store.add("1", outbox.EventUserCreated)
+	store.add("1", outbox.EventUserUpdated)
+	store.add("2", outbox.EventUserCreated)
+
+	var out bytes.Buffer
+	failures := 2
+	publisher := &flakyPublisher{Publisher: outbox.NewWriterPublisher(&out), fail: func(msg *outbox.Message) bool {
+		if msg.Key == "1" && failures > 0 {
+			failures--
+			return true
+		}
+		return false
+	}}
+	relay := outbox.NewRelay(store, publisher, outbox.RelayConfig{BatchSize: 10, MinBackoff: time.Minute, MaxBackoff: time.Hour})
+
+	// Test case: A failed message stays unpublished and is retried after
+	// the minimum backoff; the later message of its key waits for it, the
+	// messages of other keys do not
+	n, err := relay.RelayOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	first := store.row(1)
+	assert.False(t, first.published)
+	assert.Equal(t, 1, first.attempts)
+	assert.Equal(t, "broker unavailable", first.lastError)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), first.nextAttemptAt, 5*time.Second)
+	assert.Equal(t, 0, store.row(2).attempts)
+	assert.True(t, store.row(3).published)
+
+	// Test case: Nothing is retried before it is due
+	n, err = relay.RelayOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Test case: The backoff doubles with every failed attempt
+	store.due()
+	_, err = relay.RelayOnce(context.Background())
+	require.NoError(t, err)
+	first = store.row(1)
+	assert.False(t, first.published)
+	assert.Equal(t, 2, first.attempts)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), first.nextAttemptAt, 5*time.Second)
+
+	// Test case: Once the broker is back, the messages of the key follow in
+	// order
+	store.due()
+	for i := 0; i < 2; i++ {
+		_, err = relay.RelayOnce(context.Background())
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 0, store.unpublished())
+	var ids []int64
+	for _, msg := range published(t, out.Bytes()) {
+		ids = append(ids, msg.ID)
+	}
+	assert.Equal(t, []int64{3, 1, 2}, ids)
+}
+
+func TestRelayOrderingConcurrent(t *testing.T) {
+	store := new(memoryOutbox)
+	for i := 0; i < 200; i++ {
+		store.add(fmt.Sprint(i%7), outbox.EventUserUpdated)
+	}
+
+	// Every relay drops a third of its messages, which then wait for a
+	// retry while the other relays go on.
+	var out bytes.Buffer
+	writer := outbox.NewWriterPublisher(&out)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		random := rand.New(rand.NewSource(int64(i)))
+		publisher := &flakyPublisher{Publisher: writer, fail: func(*outbox.Message) bool { return random.Intn(3) == 0 }}
+		relay := outbox.NewRelay(store, publisher, outbox.RelayConfig{BatchSize: 5, MinBackoff: 0, MaxBackoff: 0})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for store.unpublished() > 0 {
+				_, err := relay.RelayOnce(context.Background())
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	messages := published(t, out.Bytes())
+	require.Len(t, messages, 200)
+	last := map[string]int64{}
+	for _, msg := range messages {
+		assert.Greater(t, msg.ID, last[msg.Key], "message %d of key %s published out of order", msg.ID, msg.Key)
+		last[msg.Key] = msg.ID
+	}
+}
@@ -0,0 +1,151 @@
+package test
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"testing"
+	"time"
+
+	userpb "user-api/gen/user"
+	authPack "user-api/internal/auth-pack"
+	"user-api/internal/reqctx"
+	"user-api/pkg/config"
+	"user-api/pkg/mailer"
+	"user-api/pkg/password"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPasswordReset(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	smtp := startSMTPStandIn(t)
+	smtpMailer := mailer.NewSMTPMailer(mailer.SMTPConfig{Addr: smtp.addr, From: "user-api <no-reply@example.com>", Timeout: 5 * time.Second})
+
+	authRepo := new(MockAuthRepository)
+	cfg := authPack.PasswordResetConfig{URL: "https://example.com/reset-password", TTL: 30 * time.Minute, EmailLimit: 3, IPLimit: 10, Window: time.Hour}
+	service := newAuthService(t, authRepo, new(MockUserRepository), authPack.AlgorithmEdDSA, authPack.WithPasswordReset(smtpMailer, cfg))
+	handler := authPack.NewAuthHandler(service)
+	router := gin.Default()
+	router.POST("/auth/password-reset", handler.RequestPasswordReset)
+	router.POST("/auth/password-reset/confirm", handler.ResetPassword)
+
+	authRepo.On("Throttle", mock.Anything, "password_reset:ip:192.0.2.1", 10, time.Hour).Return(true, nil)
+	authRepo.On("Throttle", mock.Anything, "password_reset:email:john.doe@example.com", 3, time.Hour).Return(true, nil)
+	authRepo.On("Throttle", mock.Anything, "password_reset:email:nobody@example.com", 3, time.Hour).Return(true, nil)
+	authRepo.On("GetUserIDByEmail", mock.Anything, "john.doe@example.com").Return(1, nil)
+	authRepo.On("GetUserIDByEmail", mock.Anything, "nobody@example.com").Return(0, authPack.ErrCredentialsNotFound)
+	stored := make(chan mock.Arguments, 1)
+	authRepo.On("CreatePasswordResetToken", mock.Anything, 1, mock.Anything, mock.Anything).Return(nil).Once().
+		Run(func(args mock.Arguments) { stored <- args })
+
+	request := func(email string) (int, string) {
+		w := postJSONFrom(router, "/auth/password-reset", "192.0.2.1:4321", authPack.PasswordResetRequest{Email: email})
+		return w.Code, w.Body.String()
+	}
+
+	// Known and unknown emails get the same answer; only the known one gets
+	// a mail.
+	knownCode, knownBody := request("john.doe@example.com")
+	unknownCode, unknownBody := request("nobody@example.com")
+	assert.Equal(t, http.StatusAccepted, knownCode)
+	assert.Equal(t, knownCode, unknownCode)
+	assert.Equal(t, knownBody, unknownBody)
+
+	require.Eventually(t, func() bool { return len(smtp.received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	mail := smtp.received()[0]
+	assert.Equal(t, []string{"john.doe@example.com"}, mail.To)
+	token := mailToken(t, mail)
+
+	// Only the hash of the token is stored.
+	tokenHash := sha256.Sum256([]byte(token))
+	args := <-stored
+	assert.Equal(t, tokenHash[:], args.Get(2))
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), args.Get(3).(time.Time), time.Minute)
+
+	// Confirming checks the password before the token is redeemed.
+	w := postJSON(router, "/auth/password-reset/confirm", authPack.PasswordResetConfirmRequest{Token: token, Password: "short"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	authRepo.AssertNotCalled(t, "ResetPassword", mock.Anything, mock.Anything, mock.Anything)
+
+	var newHash string
+	authRepo.On("ResetPassword", mock.Anything, tokenHash[:], mock.Anything).Return(1, nil).Once().
+		Run(func(args mock.Arguments) { newHash = args.String(2) })
+	w = postJSON(router, "/auth/password-reset/confirm", authPack.PasswordResetConfirmRequest{Token: token, Password: "a brand new password"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	ok, _, err := password.NewHasher(testParams).Verify("a brand new password", newHash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// The token is single use.
+	authRepo.On("ResetPassword", mock.Anything, tokenHash[:], mock.Anything).Return(0, authPack.ErrResetTokenInvalid).Once()
+	w = postJSON(router, "/auth/password-reset/confirm", authPack.PasswordResetConfirmRequest{Token: token, Password: "a brand new password"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPasswordResetRPC(t *testing.T) {
+	client := newGRPCClient(t, new(MockUserRepository), config.Config{})
+
+	// A weak password is the client's mistake, like a missing token.
+	_, err := client.ResetPassword(context.Background(), &userpb.ResetPasswordRequest{Token: "token", Password: "short"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.ResetPassword(context.Background(), &userpb.ResetPasswordRequest{Password: "a brand new password"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestPasswordResetThrottle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	authRepo := new(MockAuthRepository)
+	cfg := authPack.PasswordResetConfig{URL: "https://example.com/reset-password", TTL: 30 * time.Minute, EmailLimit: 3, IPLimit: 10, Window: time.Hour}
+	service := newAuthService(t, authRepo, new(MockUserRepository), authPack.AlgorithmEdDSA, authPack.WithPasswordReset(mailer.LogMailer{}, cfg))
+	router := gin.Default()
+	router.POST("/auth/password-reset", authPack.NewAuthHandler(service).RequestPasswordReset)
+
+	// The per-email limit applies to any spelling of the address, and the
+	// user is not looked up once a limit is hit.
+	authRepo.On("Throttle", mock.Anything, "password_reset:ip:192.0.2.1", 10, time.Hour).Return(true, nil)
+	authRepo.On("Throttle", mock.Anything, "password_reset:email:john.doe@example.com", 3, time.Hour).Return(false, nil)
+	w := postJSONFrom(router, "/auth/password-reset", "192.0.2.1:4321", authPack.PasswordResetRequest{Email: " John.Doe@example.com"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	authRepo.On("Throttle", mock.Anything, "password_reset:ip:192.0.2.2", 10, time.Hour).Return(false, nil)
+	w = postJSONFrom(router, "/auth/password-reset", "192.0.2.2:4321", authPack.PasswordResetRequest{Email: "jane.doe@example.com"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	authRepo.AssertNotCalled(t, "GetUserIDByEmail", mock.Anything, mock.Anything)
+}
+
+func TestPasswordResetTenant(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	authRepo := new(MockAuthRepository)
+	cfg := authPack.PasswordResetConfig{URL: "https://example.com/reset-password", TTL: 30 * time.Minute, EmailLimit: 3, IPLimit: 10, Window: time.Hour}
+	service := newAuthService(t, authRepo, new(MockUserRepository), authPack.AlgorithmEdDSA, authPack.WithPasswordReset(mailer.LogMailer{}, cfg))
+	router := gin.Default()
+	router.Use(reqctx.GinMiddleware())
+	router.POST("/auth/password-reset", authPack.NewAuthHandler(service).RequestPasswordReset)
+
+	// The user is looked up in the tenant of the request, and the token sent
+	// in the background is stored there too.
+	inAcme := mock.MatchedBy(func(ctx context.Context) bool {
+		return reqctx.FromContext(ctx).Tenant() == "acme"
+	})
+	authRepo.On("Throttle", mock.Anything, mock.Anything, mock.Anything, time.Hour).Return(true, nil)
+	authRepo.On("GetUserIDByEmail", inAcme, "john.doe@example.com").Return(4, nil).Once()
+	stored := make(chan struct{})
+	authRepo.On("CreatePasswordResetToken", inAcme, 4, mock.Anything, mock.Anything).Return(nil).Once().
+		Run(func(mock.Arguments) { close(stored) })
+
+	w := serve(router, http.MethodPost, "/auth/password-reset", `{"email": "john.doe@example.com"}`, reqctx.TenantHeader, "acme")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	select {
+	case <-stored:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reset token was not stored in the tenant of the request")
+	}
+	authRepo.AssertExpectations(t)
+}
@@ -0,0 +1,208 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	userpb "user-api/gen/user"
+	"user-api/internal/gateway"
+	userGrpc "user-api/internal/grpc/user"
+	"user-api/internal/reqctx"
+	"user-api/internal/throttle"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/config"
+	"user-api/pkg/ratelimit"
+)
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ratelimit.ParseLimit("100/m")
+	require.NoError(t, err)
+	assert.Equal(t, 100, limit.Burst)
+	assert.InDelta(t, 100.0/60, limit.Rate, 1e-9)
+
+	limit, err = ratelimit.ParseLimit("10/s:20")
+	require.NoError(t, err)
+	assert.Equal(t, ratelimit.Limit{Rate: 10, Burst: 20}, limit)
+
+	for _, s := range []string{"10", "10/w", "0/s", "10/s:0", "x/s"} {
+		_, err := ratelimit.ParseLimit(s)
+		assert.Error(t, err, s)
+	}
+
+	rules, err := throttle.ParseRules("POST /users=10/s:20, /user.UserService/CreateUser=5/m, *=100/s")
+	require.NoError(t, err)
+	assert.Equal(t, ratelimit.Limit{Rate: 10, Burst: 20}, rules["POST /users"])
+	assert.Equal(t, 5, rules["/user.UserService/CreateUser"].Burst)
+	assert.Equal(t, 100, rules[throttle.DefaultRule].Burst)
+
+	_, err = throttle.ParseRules("POST /users")
+	assert.Error(t, err)
+}
+
+func TestMemoryStoreTokenBucket(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	limit := ratelimit.Limit{Rate: 20, Burst: 2}
+
+	res, err := store.Take(context.Background(), "a", limit)
+	require.NoError(t, err)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 1, res.Remaining)
+	res, _ = store.Take(context.Background(), "a", limit)
+	assert.True(t, res.Allowed)
+	assert.Equal(t, 0, res.Remaining)
+
+	res, _ = store.Take(context.Background(), "a", limit)
+	assert.False(t, res.Allowed)
+	assert.Greater(t, res.RetryAfter, time.Duration(0))
+	assert.LessOrEqual(t, res.RetryAfter, 50*time.Millisecond)
+
+	// Other keys have buckets of their own, and buckets refill.
+	res, _ = store.Take(context.Background(), "b", limit)
+	assert.True(t, res.Allowed)
+	time.Sleep(60 * time.Millisecond)
+	res, _ = store.Take(context.Background(), "a", limit)
+	assert.True(t, res.Allowed)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	rules, err := throttle.ParseRules("POST /users=2/m,*=100/s")
+	require.NoError(t, err)
+	limiter := throttle.NewLimiter(ratelimit.NewMemoryStore(), rules)
+
+	r := gin.New()
+	r.Use(reqctx.GinMiddleware(trustedProxy()), limiter.Middleware())
+	r.POST("/users", func(ctx *gin.Context) { ctx.Status(http.StatusCreated) })
+	r.GET("/user/:id", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+
+	for i := 0; i < 2; i++ {
+		w := serve(r, http.MethodPost, "/users", `{}`, throttle.APIKeyHeader, "integration-a")
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, strconv.Itoa(1-i), w.Header().Get("RateLimit-Remaining"))
+	}
+
+	w := serve(r, http.MethodPost, "/users", `{}`, throttle.APIKeyHeader, "integration-a")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.JSONEq(t, `{"error": "rate limit exceeded, try again later"}`, w.Body.String())
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 30, retryAfter, 1)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	// Other clients and other routes are not affected.
+	w = serve(r, http.MethodPost, "/users", `{}`, throttle.APIKeyHeader, "integration-b")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = serve(r, http.MethodPost, "/users", `{}`, reqctx.ActorHeader, "billing")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = serve(r, http.MethodGet, "/user/1", "", throttle.APIKeyHeader, "integration-a")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "100", w.Header().Get("RateLimit-Limit"))
+}
+
+func TestRateLimitGRPC(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	mockBridgeUsers(mockRepo)
+	rules, err := throttle.ParseRules("/user.UserService/GetUser=1/h")
+	require.NoError(t, err)
+	limiter := throttle.NewLimiter(ratelimit.NewMemoryStore(), rules)
+
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(userGrpc.ErrorUnaryInterceptor, reqctx.UnaryServerInterceptor(), limiter.UnaryInterceptor))
+	userpb.RegisterUserServiceServer(server, userGrpc.NewGRPCServer(userPack.NewUserService(mockRepo), nil, config.Config{}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := userpb.NewUserServiceClient(conn)
+
+	var header metadata.MD
+	_, err = client.GetUser(context.Background(), &userpb.GetUserRequest{Id: 1}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, header.Get("ratelimit-limit"))
+	assert.Equal(t, []string{"0"}, header.Get("ratelimit-remaining"))
+
+	_, err = client.GetUser(context.Background(), &userpb.GetUserRequest{Id: 1})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	retryAfter, ok := throttle.RetryAfter(err)
+	require.True(t, ok)
+	assert.InDelta(t, time.Hour.Seconds(), retryAfter.Seconds(), 1)
+
+	// Calls with another API key have a bucket of their own.
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "integration-b")
+	_, err = client.GetUser(ctx, &userpb.GetUserRequest{Id: 1})
+	assert.NoError(t, err)
+}
+
+func TestDailyCreateQuota(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	quota := ratelimit.NewQuota(ratelimit.NewMemoryStore(), "user creation", 1, map[string]int{"acme": 3})
+	service := userPack.NewUserService(mockRepo, userPack.WithCreateQuota(quota))
+	newUser := func() *userPack.User {
+		return &userPack.User{Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com"}
+	}
+
+	mockRepo.On("CreateUser", mock.Anything, mock.Anything).Return(nil).Once()
+	require.NoError(t, service.CreateUser(context.Background(), newUser()))
+	err := service.CreateUser(context.Background(), newUser())
+	var quotaErr *ratelimit.QuotaError
+	require.True(t, errors.As(err, &quotaErr))
+	assert.Equal(t, reqctx.DefaultTenant, quotaErr.Scope)
+	assert.Equal(t, "daily user creation quota of 1 exceeded for default", err.Error())
+	assert.True(t, quotaErr.Reset.After(time.Now()))
+
+	// Tenants with a quota of their own; users that fail to be created do
+	// not count.
+	acme := reqctx.WithTenant(context.Background(), "acme")
+	mockRepo.On("CreateUsers", mock.Anything, mock.Anything).Return([]error{nil, userPack.ErrEmailTaken}, nil).Once()
+	_, err = service.CreateUsers(acme, []*userPack.User{newUser(), newUser()})
+	require.NoError(t, err)
+	mockRepo.On("CreateUser", mock.Anything, mock.Anything).Return(errors.New("connection reset")).Once()
+	assert.Error(t, service.CreateUser(acme, newUser()))
+	mockRepo.On("CreateUsers", mock.Anything, mock.Anything).Return([]error{nil, nil}, nil).Once()
+	_, err = service.CreateUsers(acme, []*userPack.User{newUser(), newUser()})
+	require.NoError(t, err)
+	_, err = service.CreateUsers(acme, []*userPack.User{newUser()})
+	assert.True(t, errors.As(err, &quotaErr))
+	mockRepo.AssertExpectations(t)
+}
+
+func TestDailyCreateQuotaREST(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	quota := ratelimit.NewQuota(ratelimit.NewMemoryStore(), "user creation", 1, nil)
+	r := newGatewayRouter(t, mockRepo, userPack.WithCreateQuota(quota))
+	mockRepo.On("CreateUser", mock.Anything, mock.Anything).Return(nil).Once()
+
+	body := `{"firstname": "John", "lastname": "Doe", "email": "john.doe@example.com"}`
+	w := serve(r, http.MethodPost, "/users", body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = serve(r, http.MethodPost, "/users", body)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.JSONEq(t, `{"error": "failed to create user: daily user creation quota of 1 exceeded for default"}`, w.Body.String())
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err)
+	assert.Greater(t, retryAfter, 0)
+	assert.LessOrEqual(t, retryAfter, 24*60*60)
+
+	w = serve(r, http.MethodPost, gateway.Prefix+"/users", `{"user": `+body+`}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	mockRepo.AssertExpectations(t)
+}
@@ -0,0 +1,436 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"user-api/internal/reqctx"
+	scimPack "user-api/internal/scim-pack"
+	userPack "user-api/internal/user-pack"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type MockScimRepository struct {
+	mock.Mock
+}
+
+func (m *MockScimRepository) ListUserIDs(ctx context.Context, filter scimPack.Filter, offset, limit int) ([]int, int, error) {
+	args := m.Called(ctx, filter, offset, limit)
+	ids, _ := args.Get(0).([]int)
+	return ids, args.Int(1), args.Error(2)
+}
+
+func (m *MockScimRepository) GetExternalIDs(ctx context.Context, userIDs []int) (map[int]string, error) {
+	args := m.Called(ctx, userIDs)
+	if ids, ok := args.Get(0).(map[int]string); ok {
+		return ids, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockScimRepository) SetExternalID(ctx context.Context, userID int, externalID string) error {
+	args := m.Called(ctx, userID, externalID)
+	return args.Error(0)
+}
+
+func (m *MockScimRepository) CreateGroup(ctx context.Context, group *scimPack.Group) error {
+	args := m.Called(ctx, group)
+	return args.Error(0)
+}
+
+func (m *MockScimRepository) GetGroup(ctx context.Context, id int) (*scimPack.Group, error) {
+	args := m.Called(ctx, id)
+	if group, ok := args.Get(0).(*scimPack.Group); ok {
+		return group, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockScimRepository) ListGroups(ctx context.Context, filter scimPack.Filter, offset, limit int) ([]*scimPack.Group, int, error) {
+	args := m.Called(ctx, filter, offset, limit)
+	groups, _ := args.Get(0).([]*scimPack.Group)
+	return groups, args.Int(1), args.Error(2)
+}
+
+func (m *MockScimRepository) ReplaceGroup(ctx context.Context, group *scimPack.Group) error {
+	args := m.Called(ctx, group)
+	return args.Error(0)
+}
+
+func (m *MockScimRepository) DeleteGroup(ctx context.Context, id int) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+const scimToken = "s3cret"
+
+func newScimRouter(mockRepo *MockUserRepository, mockScimRepo *MockScimRepository) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.Use(reqctx.GinMiddleware())
+
+	service := scimPack.NewScimService(userPack.NewUserService(mockRepo), mockScimRepo)
+	handler := scimPack.NewScimHandler(service, map[string]string{scimToken: "acme"})
+	scim := router.Group(scimPack.BasePath, handler.Authenticate())
+	scim.GET("/ServiceProviderConfig", handler.ServiceProviderConfig)
+	scim.GET("/Schemas", handler.ListSchemas)
+	scim.GET("/ResourceTypes/:id", handler.GetResourceType)
+	scim.POST("/Users", handler.CreateUser)
+	scim.GET("/Users", handler.ListUsers)
+	scim.GET("/Users/:id", handler.GetUser)
+	scim.PUT("/Users/:id", handler.ReplaceUser)
+	scim.PATCH("/Users/:id", handler.PatchUser)
+	scim.DELETE("/Users/:id", handler.DeleteUser)
+	scim.POST("/Groups", handler.CreateGroup)
+	scim.PATCH("/Groups/:id", handler.PatchGroup)
+	scim.DELETE("/Groups/:id", handler.DeleteGroup)
+	return router
+}
+
+func scimRequest(router *gin.Engine, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(data))
+	req.Host = "scim.example.com"
+	req.Header.Set("Content-Type", scimPack.ContentType)
+	req.Header.Set("Authorization", "Bearer "+scimToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func inTenant(tenantID string) interface{} {
+	return mock.MatchedBy(func(ctx context.Context) bool {
+		return reqctx.FromContext(ctx).Tenant() == tenantID
+	})
+}
+
+func TestScimAuthentication(t *testing.T) {
+	router := newScimRouter(new(MockUserRepository), new(MockScimRepository))
+
+	for _, auth := range []string{"", "Bearer wrong", "Basic " + scimToken} {
+		req, _ := http.NewRequest(http.MethodGet, "/scim/v2/Users", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code, auth)
+		assert.Contains(t, w.Header().Get("Content-Type"), scimPack.ContentType)
+		assert.Contains(t, w.Body.String(), scimPack.SchemaError)
+		assert.Contains(t, w.Body.String(), `"status":"401"`)
+	}
+}
+
+func TestScimDiscovery(t *testing.T) {
+	router := newScimRouter(new(MockUserRepository), new(MockScimRepository))
+
+	w := scimRequest(router, http.MethodGet, "/scim/v2/ServiceProviderConfig", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var config struct {
+		Patch  struct{ Supported bool }
+		Bulk   struct{ Supported bool }
+		Filter struct {
+			Supported  bool
+			MaxResults int
+		}
+		AuthenticationSchemes []struct{ Type string }
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &config))
+	assert.True(t, config.Patch.Supported)
+	assert.False(t, config.Bulk.Supported)
+	assert.True(t, config.Filter.Supported)
+	assert.Equal(t, 200, config.Filter.MaxResults)
+	assert.Equal(t, "oauthbearertoken", config.AuthenticationSchemes[0].Type)
+
+	w = scimRequest(router, http.MethodGet, "/scim/v2/Schemas", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"totalResults":2`)
+	assert.Contains(t, w.Body.String(), scimPack.SchemaUser)
+	assert.Contains(t, w.Body.String(), scimPack.SchemaGroup)
+
+	w = scimRequest(router, http.MethodGet, "/scim/v2/ResourceTypes/Group", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"endpoint":"/Groups"`)
+
+	w = scimRequest(router, http.MethodGet, "/scim/v2/ResourceTypes/Device", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestParseScimFilter(t *testing.T) {
+	f, err := scimPack.ParseFilter(`userName eq "john@example.com"`)
+	require.NoError(t, err)
+	assert.Equal(t, &scimPack.AttrFilter{Path: "username", Op: "eq", Value: "john@example.com"}, f)
+
+	f, err = scimPack.ParseFilter(`emails[type eq "work" and value co "@example.com"] or not (active eq false)`)
+	require.NoError(t, err)
+	assert.Equal(t, &scimPack.LogicalFilter{
+		Op: "or",
+		Left: &scimPack.LogicalFilter{
+			Op:    "and",
+			Left:  &scimPack.AttrFilter{Path: "emails.type", Op: "eq", Value: "work"},
+			Right: &scimPack.AttrFilter{Path: "emails.value", Op: "co", Value: "@example.com"},
+		},
+		Right: &scimPack.NotFilter{Filter: &scimPack.AttrFilter{Path: "active", Op: "eq", Value: false}},
+	}, f)
+
+	f, err = scimPack.ParseFilter(`urn:ietf:params:scim:schemas:core:2.0:User:name.familyName PR`)
+	require.NoError(t, err)
+	assert.Equal(t, &scimPack.AttrFilter{Path: "name.familyname", Op: "pr"}, f)
+
+	for _, bad := range []string{``, `userName`, `userName eq`, `userName like "x"`, `(userName eq "x"`, `userName eq "x" and`, `userName eq "x`} {
+		_, err := scimPack.ParseFilter(bad)
+		assert.ErrorIs(t, err, scimPack.ErrInvalidFilter, bad)
+	}
+}
+
+func TestScimCreateUser(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	mockScimRepo := new(MockScimRepository)
+	router := newScimRouter(mockRepo, mockScimRepo)
+
+	mockScimRepo.On("ListUserIDs", inTenant("acme"), &scimPack.AttrFilter{Path: "externalid", Op: "eq", Value: "00u1"}, 0, 0).Return(nil, 0, nil).Once()
+	mockRepo.On("CreateUser", inTenant("acme"), mock.MatchedBy(func(u *userPack.User) bool {
+		return u.Email == "john.doe@example.com" && u.Firstname == "John" && u.Lastname == "Doe" && u.TenantID == "acme"
+	})).Run(func(args mock.Arguments) {
+		args.Get(1).(*userPack.User).ID = 7
+	}).Return(nil).Once()
+	mockScimRepo.On("SetExternalID", mock.Anything, 7, "00u1").Return(nil).Once()
+
+	w := scimRequest(router, http.MethodPost, "/scim/v2/Users", map[string]interface{}{
+		"schemas":    []string{scimPack.SchemaUser},
+		"userName":   "john.doe@example.com",
+		"externalId": "00u1",
+		"name":       map[string]string{"givenName": "John", "familyName": "Doe"},
+		"active":     true,
+	})
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), scimPack.ContentType)
+	assert.Equal(t, "http://scim.example.com/scim/v2/Users/7", w.Header().Get("Location"))
+	var res scimPack.UserResource
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, []string{scimPack.SchemaUser}, res.Schemas)
+	assert.Equal(t, "7", res.ID)
+	assert.Equal(t, "00u1", res.ExternalID)
+	assert.Equal(t, "John Doe", res.DisplayName)
+	assert.True(t, *res.Active)
+	assert.Equal(t, "User", res.Meta.ResourceType)
+
+	// Test case: The externalId is taken in the tenant
+	mockScimRepo.On("ListUserIDs", mock.Anything, &scimPack.AttrFilter{Path: "externalid", Op: "eq", Value: "00u2"}, 0, 0).Return(nil, 1, nil).Once()
+	w = scimRequest(router, http.MethodPost, "/scim/v2/Users", map[string]interface{}{
+		"userName":   "jane.doe@example.com",
+		"externalId": "00u2",
+		"name":       map[string]string{"givenName": "Jane", "familyName": "Doe"},
+	})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"scimType":"uniqueness"`)
+
+	// Test case: Missing attributes
+	w = scimRequest(router, http.MethodPost, "/scim/v2/Users", map[string]interface{}{"userName": "jane.doe@example.com"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"scimType":"invalidValue"`)
+
+	mockRepo.AssertExpectations(t)
+	mockScimRepo.AssertExpectations(t)
+}
+
+func TestScimGetUser(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	mockScimRepo := new(MockScimRepository)
+	router := newScimRouter(mockRepo, mockScimRepo)
+
+	mockRepo.On("GetUser", mock.Anything, 7).Return(&userPack.User{ID: 7, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Status: userPack.StatusSuspended}, nil).Once()
+	mockScimRepo.On("GetExternalIDs", mock.Anything, []int{7}).Return(map[int]string{}, nil).Once()
+	mockRepo.On("GetUser", mock.Anything, 8).Return(nil, userPack.ErrUserNotFound).Once()
+
+	w := scimRequest(router, http.MethodGet, "/scim/v2/Users/7", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"userName":"john.doe@example.com"`)
+	assert.Contains(t, w.Body.String(), `"active":false`)
+
+	w = scimRequest(router, http.MethodGet, "/scim/v2/Users/8", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"404"`)
+	assert.Contains(t, w.Body.String(), scimPack.SchemaError)
+
+	mockRepo.AssertExpectations(t)
+	mockScimRepo.AssertExpectations(t)
+}
+
+func TestScimListUsers(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	mockScimRepo := new(MockScimRepository)
+	router := newScimRouter(mockRepo, mockScimRepo)
+
+	filter := &scimPack.AttrFilter{Path: "username", Op: "eq", Value: "john.doe@example.com"}
+	mockScimRepo.On("ListUserIDs", mock.Anything, filter, 0, 200).Return([]int{7}, 1, nil).Once()
+	mockRepo.On("GetUsers", mock.Anything, []int{7}).Return([]*userPack.User{{ID: 7, Email: "john.doe@example.com", Status: userPack.StatusActive}}, nil).Once()
+	mockScimRepo.On("GetExternalIDs", mock.Anything, []int{7}).Return(map[int]string{7: "00u1"}, nil).Once()
+
+	w := scimRequest(router, http.MethodGet, `/scim/v2/Users?filter=userName+eq+%22john.doe%40example.com%22&startIndex=0&count=1000`, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res struct {
+		Schemas      []string
+		TotalResults int
+		StartIndex   int
+		ItemsPerPage int
+		Resources    []scimPack.UserResource
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, []string{scimPack.SchemaListResponse}, res.Schemas)
+	assert.Equal(t, 1, res.TotalResults)
+	assert.Equal(t, 1, res.StartIndex)
+	assert.Equal(t, 1, res.ItemsPerPage)
+	assert.Equal(t, "00u1", res.Resources[0].ExternalID)
+
+	// Test case: Past the last page
+	mockScimRepo.On("ListUserIDs", mock.Anything, nil, 10, 100).Return(nil, 3, nil).Once()
+	w = scimRequest(router, http.MethodGet, "/scim/v2/Users?startIndex=11", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"totalResults":3`)
+	assert.Contains(t, w.Body.String(), `"Resources":[]`)
+
+	w = scimRequest(router, http.MethodGet, "/scim/v2/Users?filter=userName+like+%22x%22", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"scimType":"invalidFilter"`)
+
+	w = scimRequest(router, http.MethodGet, "/scim/v2/Users?count=many", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	mockRepo.AssertExpectations(t)
+	mockScimRepo.AssertExpectations(t)
+}
+
+func TestScimPatchUser(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	mockScimRepo := new(MockScimRepository)
+	router := newScimRouter(mockRepo, mockScimRepo)
+
+	active := &userPack.User{ID: 7, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Status: userPack.StatusActive}
+	suspended := *active
+	suspended.Status = userPack.StatusSuspended
+	mockRepo.On("GetUser", mock.Anything, 7).Return(active, nil).Twice()
+	mockScimRepo.On("GetExternalIDs", mock.Anything, []int{7}).Return(map[int]string{}, nil)
+	mockRepo.On("SetUserStatus", mock.MatchedBy(func(ctx context.Context) bool {
+		return reqctx.FromContext(ctx).Actor == "scim"
+	}), 7, userPack.StatusActive, userPack.StatusSuspended, "deprovisioned by the SCIM client").Return(&suspended, nil).Once()
+	mockRepo.On("GetUser", mock.Anything, 7).Return(&suspended, nil).Once()
+
+	// Test case: Okta sends active as a string
+	w := scimRequest(router, http.MethodPatch, "/scim/v2/Users/7", map[string]interface{}{
+		"schemas":    []string{scimPack.SchemaPatchOp},
+		"Operations": []map[string]interface{}{{"op": "Replace", "path": "active", "value": "False"}},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"active":false`)
+	mockRepo.AssertExpectations(t)
+
+	// Test case: Azure sends operations without a path
+	mockRepo = new(MockUserRepository)
+	router = newScimRouter(mockRepo, mockScimRepo)
+	mockRepo.On("GetUser", mock.Anything, 7).Return(active, nil)
+	mockRepo.On("UpdateUser", mock.Anything, 7, mock.MatchedBy(func(u *userPack.User) bool {
+		return u.Firstname == "Johnny" && u.Lastname == "Doe" && u.Email == "john.doe@example.com"
+	})).Return(nil).Once()
+	w = scimRequest(router, http.MethodPatch, "/scim/v2/Users/7", map[string]interface{}{
+		"schemas":    []string{scimPack.SchemaPatchOp},
+		"Operations": []map[string]interface{}{{"op": "replace", "value": map[string]interface{}{"name.givenName": "Johnny", "displayName": "Johnny Doe"}}},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	mockRepo.AssertExpectations(t)
+
+	// Test case: Unknown and read-only attributes
+	w = scimRequest(router, http.MethodPatch, "/scim/v2/Users/7", map[string]interface{}{
+		"Operations": []map[string]interface{}{{"op": "replace", "path": "nickName", "value": "JD"}},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"scimType":"invalidPath"`)
+	w = scimRequest(router, http.MethodPatch, "/scim/v2/Users/7", map[string]interface{}{
+		"Operations": []map[string]interface{}{{"op": "replace", "path": "id", "value": "8"}},
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"scimType":"mutability"`)
+}
+
+func TestScimReplaceAndDeleteUser(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	mockScimRepo := new(MockScimRepository)
+	router := newScimRouter(mockRepo, mockScimRepo)
+
+	mockRepo.On("GetUser", mock.Anything, 7).Return(&userPack.User{ID: 7, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Status: userPack.StatusActive}, nil)
+	mockScimRepo.On("GetExternalIDs", mock.Anything, []int{7}).Return(map[int]string{7: "00u1"}, nil)
+	mockRepo.On("UpdateUser", mock.Anything, 7, mock.MatchedBy(func(u *userPack.User) bool {
+		return u.Lastname == "Smith"
+	})).Return(nil).Once()
+	mockScimRepo.On("SetExternalID", mock.Anything, 7, "").Return(nil).Once()
+
+	w := scimRequest(router, http.MethodPut, "/scim/v2/Users/7", map[string]interface{}{
+		"schemas":  []string{scimPack.SchemaUser},
+		"userName": "john.doe@example.com",
+		"name":     map[string]string{"givenName": "John", "familyName": "Smith"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	mockRepo.On("DeleteUser", mock.Anything, 7).Return(nil).Once()
+	w = scimRequest(router, http.MethodDelete, "/scim/v2/Users/7", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	mockRepo.AssertExpectations(t)
+	mockScimRepo.AssertExpectations(t)
+}
+
+func TestScimGroups(t *testing.T) {
+	mockScimRepo := new(MockScimRepository)
+	router := newScimRouter(new(MockUserRepository), mockScimRepo)
+
+	mockScimRepo.On("CreateGroup", inTenant("acme"), mock.MatchedBy(func(g *scimPack.Group) bool {
+		return g.DisplayName == "Engineering" && len(g.Members) == 1 && g.Members[0].UserID == 7
+	})).Run(func(args mock.Arguments) {
+		args.Get(1).(*scimPack.Group).ID = 3
+	}).Return(nil).Once()
+
+	w := scimRequest(router, http.MethodPost, "/scim/v2/Groups", map[string]interface{}{
+		"schemas":     []string{scimPack.SchemaGroup},
+		"displayName": "Engineering",
+		"members":     []map[string]string{{"value": "7"}},
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "/scim/v2/Groups/3")
+	assert.Contains(t, w.Body.String(), `"$ref":"http://scim.example.com/scim/v2/Users/7"`)
+
+	mockScimRepo.On("GetGroup", mock.Anything, 3).Return(&scimPack.Group{
+		ID: 3, DisplayName: "Engineering", Members: []scimPack.GroupMember{{UserID: 7}, {UserID: 8}},
+	}, nil).Once()
+	mockScimRepo.On("ReplaceGroup", mock.Anything, mock.MatchedBy(func(g *scimPack.Group) bool {
+		return g.ID == 3 && len(g.Members) == 2 && g.Members[0].UserID == 8 && g.Members[1].UserID == 9
+	})).Return(nil).Once()
+
+	w = scimRequest(router, http.MethodPatch, "/scim/v2/Groups/3", map[string]interface{}{
+		"schemas": []string{scimPack.SchemaPatchOp},
+		"Operations": []map[string]interface{}{
+			{"op": "remove", "path": `members[value eq "7"]`},
+			{"op": "add", "path": "members", "value": []map[string]string{{"value": "9"}}},
+		},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	mockScimRepo.On("DeleteGroup", mock.Anything, 4).Return(scimPack.ErrGroupNotFound).Once()
+	w = scimRequest(router, http.MethodDelete, "/scim/v2/Groups/4", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	mockScimRepo.AssertExpectations(t)
+}
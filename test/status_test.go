@@ -0,0 +1,163 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	userpb "user-api/gen/user"
+	authPack "user-api/internal/auth-pack"
+	userGrpc "user-api/internal/grpc/user"
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/config"
+	"user-api/pkg/password"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestUserStatusTransitions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.Use(reqctx.GinMiddleware(trustedProxy()))
+
+	mockRepo := new(MockUserRepository)
+	handler := userPack.NewUserHandler(userPack.NewUserService(mockRepo))
+	router.POST("/user/:id/suspend", handler.SuspendUser)
+	router.POST("/user/:id/reactivate", handler.ReactivateUser)
+	router.POST("/user/:id/deactivate", handler.DeactivateUser)
+
+	send := func(path, actor, roles, reason string) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(userPack.StatusChangeRequest{Reason: reason})
+		req, _ := http.NewRequest(http.MethodPost, path, bytes.NewBuffer(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = proxyAddr
+		req.Header.Set(reqctx.ActorHeader, actor)
+		req.Header.Set(reqctx.ActorRolesHeader, roles)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{ID: 1, Status: userPack.StatusActive}, nil)
+	mockRepo.On("GetUser", mock.Anything, 2).Return(&userPack.User{ID: 2, Status: userPack.StatusDeactivated}, nil)
+	mockRepo.On("GetUser", mock.Anything, 3).Return(&userPack.User{ID: 3, Status: userPack.StatusPending}, nil)
+	mockRepo.On("GetUser", mock.Anything, 4).Return(nil, userPack.ErrUserNotFound)
+
+	// Test case: Only admins can change the status
+	assert.Equal(t, http.StatusForbidden, send("/user/1/suspend", "alice", "support", "spam").Code)
+
+	// Test case: A reason and an actor are required
+	assert.Equal(t, http.StatusBadRequest, send("/user/1/suspend", "alice", "admin", "  ").Code)
+	assert.Equal(t, http.StatusBadRequest, send("/user/1/suspend", "", "admin", "spam").Code)
+
+	// Test case: Active users can be suspended
+	suspended := &userPack.User{ID: 1, Status: userPack.StatusSuspended, StatusReason: "spam"}
+	mockRepo.On("SetUserStatus", mock.Anything, 1, userPack.StatusActive, userPack.StatusSuspended, "spam").Return(suspended, nil).Once()
+	w := send("/user/1/suspend", "alice", "admin", " spam ")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"suspended"`)
+
+	// Test case: Active users are already active
+	assert.Equal(t, http.StatusConflict, send("/user/1/reactivate", "alice", "admin", "appeal").Code)
+
+	// Test case: Deactivation is final
+	assert.Equal(t, http.StatusConflict, send("/user/2/reactivate", "alice", "admin", "appeal").Code)
+	assert.Equal(t, http.StatusConflict, send("/user/2/deactivate", "alice", "admin", "again").Code)
+
+	// Test case: Pending users can be deactivated
+	mockRepo.On("SetUserStatus", mock.Anything, 3, userPack.StatusPending, userPack.StatusDeactivated, "duplicate").
+		Return(&userPack.User{ID: 3, Status: userPack.StatusDeactivated}, nil).Once()
+	assert.Equal(t, http.StatusOK, send("/user/3/deactivate", "alice", "admin", "duplicate").Code)
+
+	// Test case: A status changed concurrently is a conflict too
+	mockRepo.On("SetUserStatus", mock.Anything, 1, userPack.StatusActive, userPack.StatusDeactivated, "closed").
+		Return(nil, userPack.ErrInvalidStatusTransition).Once()
+	assert.Equal(t, http.StatusConflict, send("/user/1/deactivate", "alice", "admin", "closed").Code)
+
+	// Test case: User not found
+	assert.Equal(t, http.StatusNotFound, send("/user/4/suspend", "alice", "admin", "spam").Code)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestSuspendedUserLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	hash, err := password.NewHasher(testParams).Hash("correct horse battery staple")
+	require.NoError(t, err)
+
+	mockRepo := new(MockUserRepository)
+	mockAuthRepo := new(MockAuthRepository)
+	authService := newAuthService(t, mockAuthRepo, mockRepo, authPack.AlgorithmEdDSA)
+	handler := authPack.NewAuthHandler(authService)
+	router.POST("/auth/login", handler.Login)
+	router.POST("/auth/refresh", handler.Refresh)
+
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{ID: 1, Email: "john.doe@example.com", Status: userPack.StatusSuspended}, nil)
+	mockAuthRepo.On("GetCredentials", mock.Anything, "john.doe@example.com").Return(&authPack.Credentials{UserID: 1, PasswordHash: hash}, nil)
+	mockAuthRepo.On("GetTOTPSecret", mock.Anything, 1).Return(nil, authPack.ErrMFANotEnrolled)
+
+	// Test case: Suspended users cannot log in
+	w := postJSON(router, "/auth/login", authPack.LoginRequest{Email: "john.doe@example.com", Password: "correct horse battery staple"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	mockAuthRepo.AssertNotCalled(t, "CreateRefreshToken", mock.Anything, mock.Anything)
+
+	// Test case: Their existing sessions are revoked on refresh
+	mockAuthRepo.On("RotateRefreshToken", mock.Anything, mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		next := args.Get(2).(*authPack.RefreshToken)
+		next.UserID, next.FamilyID = 1, "family"
+	})
+	mockAuthRepo.On("RevokeRefreshTokenFamily", mock.Anything, mock.Anything).Return(nil).Once()
+	w = postJSON(router, "/auth/refresh", authPack.RefreshRequest{RefreshToken: "refresh"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	mockAuthRepo.AssertExpectations(t)
+}
+
+func TestUserStatusGRPC(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	// The client connects from loopback, which the server trusts to name
+	// the actor.
+	proxies, err := reqctx.ParseTrustedProxies("127.0.0.1")
+	require.NoError(t, err)
+	server := grpc.NewServer(grpc.UnaryInterceptor(reqctx.UnaryServerInterceptor(reqctx.WithTrustedProxies(proxies))))
+	userpb.RegisterUserServiceServer(server, userGrpc.NewGRPCServer(userPack.NewUserService(mockRepo), nil, config.Config{}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	client := userpb.NewUserServiceClient(conn)
+
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{ID: 1, Status: userPack.StatusSuspended}, nil)
+	mockRepo.On("SetUserStatus", mock.Anything, 1, userPack.StatusSuspended, userPack.StatusActive, "appeal granted").
+		Return(&userPack.User{ID: 1, Status: userPack.StatusActive, StatusReason: "appeal granted"}, nil).Once()
+
+	// Test case: Only admins can change the status
+	_, err = client.ReactivateUser(context.Background(), &userpb.ReactivateUserRequest{Id: 1, Reason: "appeal granted"})
+	require.Error(t, err)
+
+	// Test case: Reactivating a suspended user
+	ctx := metadata.AppendToOutgoingContext(context.Background(), reqctx.ActorHeader, "alice", reqctx.ActorRolesHeader, "admin")
+	resp, err := client.ReactivateUser(ctx, &userpb.ReactivateUserRequest{Id: 1, Reason: "appeal granted"})
+	require.NoError(t, err)
+	assert.Equal(t, userpb.UserStatus_USER_STATUS_ACTIVE, resp.User.Status)
+	assert.Equal(t, "appeal granted", resp.User.StatusReason)
+
+	// Test case: Invalid transition
+	_, err = client.SuspendUser(ctx, &userpb.SuspendUserRequest{Id: 1, Reason: "spam"})
+	require.Error(t, err)
+	mockRepo.AssertExpectations(t)
+}
@@ -0,0 +1,147 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authPack "user-api/internal/auth-pack"
+	"user-api/internal/reqctx"
+	"user-api/internal/tenant"
+	userPack "user-api/internal/user-pack"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateUserInTenant(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.Use(reqctx.GinMiddleware())
+
+	mockRepo := new(MockUserRepository)
+	router.POST("/users", userPack.NewUserHandler(userPack.NewUserService(mockRepo)).CreateUser)
+
+	mockRepo.On("CreateUser", mock.Anything, mock.MatchedBy(func(u *userPack.User) bool {
+		return u.Email == "john.doe@example.com" && u.TenantID == "acme"
+	})).Return(nil).Once()
+	mockRepo.On("CreateUser", mock.Anything, mock.MatchedBy(func(u *userPack.User) bool {
+		return u.Email == "jane.doe@example.com" && u.TenantID == reqctx.DefaultTenant
+	})).Return(nil).Once()
+
+	send := func(email, tenantID string) *httptest.ResponseRecorder {
+		body := map[string]interface{}{"firstname": "John", "lastname": "Doe", "email": email, "age": 30, "tenant_id": "other"}
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(http.MethodPost, "/users", bytes.NewBuffer(data))
+		req.Header.Set("Content-Type", "application/json")
+		if tenantID != "" {
+			req.Header.Set(reqctx.TenantHeader, tenantID)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Test case: The tenant comes from the header, not from the body
+	w := send("john.doe@example.com", "acme")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), `"tenant_id":"acme"`)
+
+	// Test case: Requests without a tenant use the default one
+	w = send("jane.doe@example.com", "")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestTenantMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	mockRepo := new(MockUserRepository)
+	mockAuthRepo := new(MockAuthRepository)
+	authService := newAuthService(t, mockAuthRepo, mockRepo, authPack.AlgorithmEdDSA)
+	router.Use(reqctx.GinMiddleware(trustedProxy()), authService.TenantMiddleware())
+	router.POST("/auth/refresh", authPack.NewAuthHandler(authService).Refresh)
+	router.GET("/tenant", func(ctx *gin.Context) {
+		meta := reqctx.FromContext(ctx.Request.Context())
+		ctx.JSON(http.StatusOK, gin.H{"tenant": meta.Tenant(), "visible": tenant.Visible(ctx.Request.Context(), "acme")})
+	})
+
+	// The refresh token was issued in acme; refreshing must look the user up
+	// there whatever the request says.
+	mockRepo.On("GetUser", mock.MatchedBy(func(ctx context.Context) bool {
+		return reqctx.FromContext(ctx).Tenant() == "acme"
+	}), 1).Return(&userPack.User{ID: 1, Status: userPack.StatusActive, TenantID: "acme"}, nil)
+	sum := sha256.Sum256([]byte("current"))
+	mockAuthRepo.On("RotateRefreshToken", mock.Anything, sum[:], mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		next := args.Get(2).(*authPack.RefreshToken)
+		next.UserID, next.FamilyID, next.TenantID = 1, "family", "acme"
+	})
+	mockAuthRepo.On("GetRoles", mock.MatchedBy(func(ctx context.Context) bool {
+		return reqctx.FromContext(ctx).Tenant() == "acme"
+	}), 1).Return(nil, nil)
+
+	w := postJSON(router, "/auth/refresh", authPack.RefreshRequest{RefreshToken: "current"})
+	require.Equal(t, http.StatusOK, w.Code)
+	var tokens authPack.TokenPair
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+	claims, err := authService.VerifyAccessToken(tokens.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "acme", claims.TenantID)
+
+	get := func(token, tenantID, roles string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, "/tenant", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		req.RemoteAddr = proxyAddr
+		req.Header.Set(reqctx.TenantHeader, tenantID)
+		req.Header.Set(reqctx.ActorRolesHeader, roles)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Test case: Without a token the header decides
+	w = get("", "globex", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"tenant":"globex","visible":false}`, w.Body.String())
+
+	// Test case: The token decides when no header is given
+	w = get(tokens.AccessToken, "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"tenant":"acme","visible":true}`, w.Body.String())
+
+	// Test case: A header naming another tenant than the token is refused
+	w = get(tokens.AccessToken, "globex", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Test case: The platform admin role of a header does not count...
+	w = get(tokens.AccessToken, "globex", reqctx.RolePlatformAdmin)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = get("", "globex", reqctx.RolePlatformAdmin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"tenant":"globex","visible":false}`, w.Body.String())
+
+	// ...the one of an access token does: platform admins may act for any
+	// tenant and see them all
+	mockRepo.On("GetUser", mock.Anything, 5).Return(&userPack.User{ID: 5, Status: userPack.StatusActive, TenantID: "acme"}, nil)
+	mockAuthRepo.On("GetRoles", mock.Anything, 5).Return([]string{reqctx.RolePlatformAdmin}, nil)
+	adminSum := sha256.Sum256([]byte("platform"))
+	mockAuthRepo.On("RotateRefreshToken", mock.Anything, adminSum[:], mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		next := args.Get(2).(*authPack.RefreshToken)
+		next.UserID, next.FamilyID, next.TenantID = 5, "admin-family", "acme"
+	})
+	adminTokens, err := authService.Refresh(context.Background(), "platform")
+	require.NoError(t, err)
+	w = get(adminTokens.AccessToken, "globex", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"tenant":"globex","visible":true}`, w.Body.String())
+	mockRepo.AssertExpectations(t)
+}
@@ -0,0 +1,331 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	userpb "user-api/gen/user"
+	authPack "user-api/internal/auth-pack"
+	userGrpc "user-api/internal/grpc/user"
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/certreload"
+	"user-api/pkg/config"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var certSerial int64
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	certSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(certSerial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a leaf certificate for template and returns it in PEM with
+// its key.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	certSerial++
+	template.SerialNumber = big.NewInt(certSerial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) serverCert(t *testing.T) (certPEM, keyPEM []byte) {
+	return ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+func (ca *testCA) clientCert(t *testing.T, principal string) tls.Certificate {
+	template := &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	if u, err := url.Parse(principal); err == nil && u.Scheme != "" {
+		template.URIs = []*url.URL{u}
+	} else {
+		template.Subject.CommonName = principal
+	}
+	certPEM, keyPEM := ca.issue(t, template)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	require.NoError(t, os.WriteFile(name, data, 0o600))
+	// Make sure a rewrite is seen even within the resolution of mtime.
+	future := time.Now().Add(time.Duration(certSerial) * time.Second)
+	require.NoError(t, os.Chtimes(name, future, future))
+}
+
+// tlsFiles writes a server certificate of serverCA and the client CA
+// bundle to a temporary directory.
+func tlsFiles(t *testing.T, serverCA *testCA, clientCAs ...*testCA) (certFile, keyFile, caFile string) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	certPEM, keyPEM := serverCA.serverCert(t)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+	var bundle []byte
+	for _, ca := range clientCAs {
+		bundle = append(bundle, ca.pem...)
+	}
+	writeFile(t, caFile, bundle)
+	return certFile, keyFile, caFile
+}
+
+func serveTLS(t *testing.T, config *tls.Config, handler http.Handler) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(tls.NewListener(listener, config))
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+func tlsClient(serverCA *testCA, certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(serverCA.cert)
+	config := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	if len(certs) > 0 {
+		// Present the certificate even when the server does not list its
+		// CA, so that the server is the one rejecting it.
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &certs[0], nil
+		}
+	}
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: config,
+		// Every request makes a new handshake, so reloads are seen.
+		DisableKeepAlives: true,
+	}}
+}
+
+func TestCertPrincipal(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/ns/prod/sa/billing")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "billing"},
+		URIs:           []*url.URL{spiffe},
+		DNSNames:       []string{"billing.internal"},
+		EmailAddresses: []string{"billing@example.org"},
+	}
+	assert.Equal(t, "spiffe://example.org/ns/prod/sa/billing", authPack.CertPrincipal(cert))
+	cert.URIs = nil
+	assert.Equal(t, "billing.internal", authPack.CertPrincipal(cert))
+	cert.DNSNames = nil
+	assert.Equal(t, "billing@example.org", authPack.CertPrincipal(cert))
+	cert.EmailAddresses = nil
+	assert.Equal(t, "billing", authPack.CertPrincipal(cert))
+}
+
+func TestParseClientCertRoles(t *testing.T) {
+	roles, err := authPack.ParseClientCertRoles("spiffe://example.org/ops=admin|platform-admin, billing=auditor")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"spiffe://example.org/ops": {"admin", "platform-admin"},
+		"billing":                  {"auditor"},
+	}, roles)
+
+	_, err = authPack.ParseClientCertRoles("billing")
+	assert.Error(t, err)
+}
+
+func TestMutualTLSPrincipal(t *testing.T) {
+	serverCA, clientCA, otherCA := newTestCA(t, "server CA"), newTestCA(t, "client CA"), newTestCA(t, "other CA")
+	certFile, keyFile, caFile := tlsFiles(t, serverCA, clientCA)
+	reloader, err := certreload.New(certFile, keyFile, caFile)
+	require.NoError(t, err)
+
+	certAuth := authPack.NewClientCertAuth(map[string][]string{"spiffe://example.org/ops": {reqctx.RoleAdmin}})
+	r := gin.New()
+	r.Use(reqctx.GinMiddleware(), certAuth.Middleware())
+	r.GET("/whoami", func(ctx *gin.Context) {
+		meta := reqctx.FromContext(ctx.Request.Context())
+		ctx.JSON(http.StatusOK, gin.H{"actor": meta.Actor, "roles": meta.Roles})
+	})
+	addr := serveTLS(t, reloader.TLSConfig(tls.VerifyClientCertIfGiven), r)
+
+	whoami := func(client *http.Client) (string, []string, error) {
+		req, _ := http.NewRequest(http.MethodGet, addr+"/whoami", nil)
+		req.Header.Set(reqctx.ActorHeader, "mallory")
+		req.Header.Set(reqctx.ActorRolesHeader, "admin,platform-admin")
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", nil, err
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Actor string   `json:"actor"`
+			Roles []string `json:"roles"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		return body.Actor, body.Roles, err
+	}
+
+	// The certificate wins over the actor headers...
+	actor, roles, err := whoami(tlsClient(serverCA, clientCA.clientCert(t, "spiffe://example.org/ops")))
+	require.NoError(t, err)
+	assert.Equal(t, "spiffe://example.org/ops", actor)
+	assert.Equal(t, []string{reqctx.RoleAdmin}, roles)
+
+	// ...and principals without configured roles get none.
+	actor, roles, err = whoami(tlsClient(serverCA, clientCA.clientCert(t, "billing")))
+	require.NoError(t, err)
+	assert.Equal(t, "billing", actor)
+	assert.Empty(t, roles)
+
+	// Without a certificate the headers of untrusted clients are ignored.
+	actor, roles, err = whoami(tlsClient(serverCA))
+	require.NoError(t, err)
+	assert.Empty(t, actor)
+	assert.Empty(t, roles)
+
+	// Certificates of other CAs fail the handshake.
+	_, _, err = whoami(tlsClient(serverCA, otherCA.clientCert(t, "spiffe://example.org/ops")))
+	assert.Error(t, err)
+}
+
+func TestMutualTLSGRPC(t *testing.T) {
+	serverCA, clientCA := newTestCA(t, "server CA"), newTestCA(t, "client CA")
+	certFile, keyFile, caFile := tlsFiles(t, serverCA, clientCA)
+	reloader, err := certreload.New(certFile, keyFile, caFile)
+	require.NoError(t, err)
+
+	mockRepo := new(MockUserRepository)
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{ID: 1, Status: userPack.StatusActive}, nil)
+	mockRepo.On("SetUserStatus", mock.Anything, 1, userPack.StatusActive, userPack.StatusSuspended, "spam").
+		Return(&userPack.User{ID: 1, Status: userPack.StatusSuspended}, nil).Once()
+
+	certAuth := authPack.NewClientCertAuth(map[string][]string{"ops": {reqctx.RoleAdmin}})
+	server := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(reloader.TLSConfig(tls.RequireAndVerifyClientCert))),
+		grpc.ChainUnaryInterceptor(userGrpc.ErrorUnaryInterceptor, reqctx.UnaryServerInterceptor(), certAuth.UnaryInterceptor),
+	)
+	userpb.RegisterUserServiceServer(server, userGrpc.NewGRPCServer(userPack.NewUserService(mockRepo), nil, config.Config{}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	dial := func(principal string) userpb.UserServiceClient {
+		pool := x509.NewCertPool()
+		pool.AddCert(serverCA.cert)
+		creds := credentials.NewTLS(&tls.Config{
+			RootCAs: pool, ServerName: "localhost", Certificates: []tls.Certificate{clientCA.clientCert(t, principal)},
+		})
+		conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(creds))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return userpb.NewUserServiceClient(conn)
+	}
+
+	// The roles come from the certificate, not from the metadata.
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-actor-roles", "admin")
+	_, err = dial("support").SuspendUser(ctx, &userpb.SuspendUserRequest{Id: 1, Reason: "spam"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	resp, err := dial("ops").SuspendUser(context.Background(), &userpb.SuspendUserRequest{Id: 1, Reason: "spam"})
+	require.NoError(t, err)
+	assert.Equal(t, userpb.UserStatus_USER_STATUS_SUSPENDED, resp.User.Status)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestCertReload(t *testing.T) {
+	serverCA, clientCA, newCA := newTestCA(t, "server CA"), newTestCA(t, "client CA"), newTestCA(t, "new client CA")
+	certFile, keyFile, caFile := tlsFiles(t, serverCA, clientCA)
+	reloader, err := certreload.New(certFile, keyFile, caFile)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Run(ctx, 10*time.Millisecond)
+
+	addr := serveTLS(t, reloader.TLSConfig(tls.RequireAndVerifyClientCert), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	serial := func(client *http.Client) (*big.Int, error) {
+		resp, err := client.Get(addr)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].SerialNumber, nil
+	}
+
+	before, err := serial(tlsClient(serverCA, clientCA.clientCert(t, "ops")))
+	require.NoError(t, err)
+	_, err = serial(tlsClient(serverCA, newCA.clientCert(t, "ops")))
+	require.Error(t, err)
+
+	// Rotate the server certificate and trust the new client CA.
+	certPEM, keyPEM := serverCA.serverCert(t)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+	writeFile(t, caFile, append(append([]byte{}, clientCA.pem...), newCA.pem...))
+
+	client := tlsClient(serverCA, newCA.clientCert(t, "ops"))
+	require.Eventually(t, func() bool {
+		after, err := serial(client)
+		return err == nil && after.Cmp(before) != 0
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// A broken rotation keeps the loaded certificates.
+	writeFile(t, keyFile, []byte("not a key"))
+	assert.Error(t, reloader.Reload())
+	_, err = serial(client)
+	assert.NoError(t, err)
+}
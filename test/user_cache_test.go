@@ -0,0 +1,151 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"user-api/internal/reqctx"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/cache"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	lru := cache.NewLRU(2)
+	lru.Set(ctx, "a", []byte("1"), time.Minute)
+	lru.Set(ctx, "b", []byte("2"), time.Minute)
+	_, ok, _ := lru.Get(ctx, "a")
+	require.True(t, ok)
+
+	// b is the least recently used now.
+	lru.Set(ctx, "c", []byte("3"), time.Minute)
+	_, ok, _ = lru.Get(ctx, "b")
+	assert.False(t, ok)
+	value, ok, _ := lru.Get(ctx, "a")
+	assert.True(t, ok)
+	assert.Equal(t, "1", string(value))
+
+	lru.Set(ctx, "d", []byte("4"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	_, ok, _ = lru.Get(ctx, "d")
+	assert.False(t, ok)
+
+	lru.Delete(ctx, "a")
+	_, ok, _ = lru.Get(ctx, "a")
+	assert.False(t, ok)
+}
+
+func TestCachingUserRepository(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	repo := userPack.NewCachingUserRepository(mockRepo, cache.NewLRU(100), time.Minute)
+	ctx := context.Background()
+
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{
+		ID: 1, Firstname: "John", Email: "john.doe@example.com", TenantID: reqctx.DefaultTenant,
+	}, nil).Once()
+	user, err := repo.GetUser(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "John", user.Firstname)
+
+	// Served from the cache, as a copy of its own.
+	user.Firstname = "Changed"
+	user, err = repo.GetUser(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "John", user.Firstname)
+	mockRepo.AssertNumberOfCalls(t, "GetUser", 1)
+
+	// Other tenants do not get the cached user; the repository decides.
+	mockRepo.On("GetUser", mock.Anything, 1).Return(nil, userPack.ErrUserNotFound).Once()
+	_, err = repo.GetUser(reqctx.WithTenant(ctx, "acme"), 1)
+	assert.ErrorIs(t, err, userPack.ErrUserNotFound)
+
+	// Writes drop the user.
+	mockRepo.On("UpdateUser", mock.Anything, 1, mock.Anything).Return(nil).Once()
+	require.NoError(t, repo.UpdateUser(ctx, 1, &userPack.User{Firstname: "Johnny"}))
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{
+		ID: 1, Firstname: "Johnny", TenantID: reqctx.DefaultTenant,
+	}, nil).Once()
+	user, err = repo.GetUser(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "Johnny", user.Firstname)
+
+	// Misses are not cached.
+	mockRepo.On("GetUser", mock.Anything, 2).Return(nil, userPack.ErrUserNotFound).Twice()
+	_, err = repo.GetUser(ctx, 2)
+	assert.ErrorIs(t, err, userPack.ErrUserNotFound)
+	_, err = repo.GetUser(ctx, 2)
+	assert.ErrorIs(t, err, userPack.ErrUserNotFound)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestCachingUserRepositoryCollapsesMisses(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	repo := userPack.NewCachingUserRepository(mockRepo, cache.NewLRU(100), time.Minute)
+
+	release := make(chan time.Time)
+	mockRepo.On("GetUser", mock.Anything, 1).WaitUntil(release).Return(&userPack.User{
+		ID: 1, TenantID: reqctx.DefaultTenant,
+	}, nil).Once()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := repo.GetUser(context.Background(), 1)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, user.ID)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	mockRepo.AssertNumberOfCalls(t, "GetUser", 1)
+}
+
+func TestCachingUserRepositoryRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	mockRepo := new(MockUserRepository)
+	repo := userPack.NewCachingUserRepository(mockRepo, cache.NewRedis(client, "user-api:"), time.Minute)
+	mockRepo.On("GetUser", mock.Anything, 1).Return(&userPack.User{
+		ID: 1, Email: "john.doe@example.com", TenantID: reqctx.DefaultTenant,
+	}, nil).Twice()
+
+	_, err := repo.GetUser(context.Background(), 1)
+	require.NoError(t, err)
+	assert.True(t, mr.Exists("user-api:user:1"))
+	assert.Equal(t, time.Minute, mr.TTL("user-api:user:1"))
+
+	// Another instance sharing Redis finds it there.
+	other := userPack.NewCachingUserRepository(new(MockUserRepository), cache.NewRedis(client, "user-api:"), time.Minute)
+	user, err := other.GetUser(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, "john.doe@example.com", user.Email)
+
+	// Entries expire, and writes remove them.
+	mr.FastForward(time.Minute)
+	_, err = repo.GetUser(context.Background(), 1)
+	require.NoError(t, err)
+	mockRepo.On("DeleteUser", mock.Anything, 1).Return(nil).Once()
+	require.NoError(t, repo.DeleteUser(context.Background(), 1))
+	assert.False(t, mr.Exists("user-api:user:1"))
+
+	// Without Redis the repository is still read.
+	mr.Close()
+	mockRepo.On("GetUser", mock.Anything, 3).Return(&userPack.User{ID: 3, TenantID: reqctx.DefaultTenant}, nil).Once()
+	user, err = repo.GetUser(context.Background(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, 3, user.ID)
+	mockRepo.AssertExpectations(t)
+}
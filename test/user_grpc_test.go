@@ -0,0 +1,94 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	userpb "user-api/gen/user"
+	userGrpc "user-api/internal/grpc/user"
+	userPack "user-api/internal/user-pack"
+	"user-api/pkg/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newGRPCClient(t *testing.T, repo userPack.UserRepository, cfg config.Config) userpb.UserServiceClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	userpb.RegisterUserServiceServer(server, userGrpc.NewGRPCServer(userPack.NewUserService(repo), nil, cfg))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return userpb.NewUserServiceClient(conn)
+}
+
+func TestBatchGetUsers(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	client := newGRPCClient(t, mockRepo, config.Config{GRPC: config.GRPCConfig{BatchChunkSize: 10}})
+
+	mockRepo.On("GetUsers", mock.Anything, []int{1, 2, 3}).Return([]*userPack.User{
+		{ID: 1, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com"},
+		{ID: 3, Firstname: "Jane", Lastname: "Doe", Email: "jane.doe@example.com"},
+	}, nil)
+
+	resp, err := client.BatchGetUsers(context.Background(), &userpb.BatchGetUsersRequest{Ids: []int32{1, 2, 3}})
+	require.NoError(t, err)
+
+	assert.Len(t, resp.Users, 2)
+	assert.Equal(t, []int32{2}, resp.MissingIds)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestBatchCreateUsers(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	client := newGRPCClient(t, mockRepo, config.Config{GRPC: config.GRPCConfig{BatchChunkSize: 2}})
+
+	// The first chunk commits both users, the second one rejects its only user.
+	mockRepo.On("CreateUsers", mock.Anything, mock.MatchedBy(func(users []*userPack.User) bool {
+		return len(users) == 2
+	})).Return([]error{nil, nil}, nil).Once()
+	mockRepo.On("CreateUsers", mock.Anything, mock.MatchedBy(func(users []*userPack.User) bool {
+		return len(users) == 1
+	})).Return([]error{errors.New("duplicate email")}, nil).Once()
+
+	stream, err := client.BatchCreateUsers(context.Background())
+	require.NoError(t, err)
+
+	users := []*userpb.User{
+		{Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com"},
+		{Firstname: "Jane", Lastname: "Doe", Email: "invalid-email"},
+		{Firstname: "Jane", Lastname: "Doe", Email: "jane.doe@example.com"},
+		{Firstname: "Jim", Lastname: "Doe", Email: "john.doe@example.com"},
+	}
+	for _, user := range users {
+		require.NoError(t, stream.Send(user))
+	}
+
+	resp, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+
+	require.Len(t, resp.Results, 4)
+	assert.EqualValues(t, 2, resp.Created)
+	assert.EqualValues(t, 2, resp.Failed)
+	for i, result := range resp.Results {
+		assert.EqualValues(t, i, result.Index)
+	}
+	assert.True(t, resp.Results[0].Ok)
+	assert.False(t, resp.Results[1].Ok)
+	assert.True(t, resp.Results[2].Ok)
+	assert.False(t, resp.Results[3].Ok)
+	mockRepo.AssertExpectations(t)
+}
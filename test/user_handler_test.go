@@ -1,14 +1,19 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"user-api/internal/reqctx"
 	userPack "user-api/internal/user-pack"
 
 	"github.com/gin-gonic/gin"
@@ -39,6 +44,83 @@ func (m *MockUserRepository) UpdateUser(ctx context.Context, id int, user *userP
 	return args.Error(0)
 }
 
+func (m *MockUserRepository) DeleteUser(ctx context.Context, id int) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *MockUserRepository) GetUsers(ctx context.Context, ids []int) ([]*userPack.User, error) {
+	args := m.Called(ctx, ids)
+	if u, ok := args.Get(0).([]*userPack.User); ok {
+		return u, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockUserRepository) CreateUsers(ctx context.Context, users []*userPack.User) ([]error, error) {
+	args := m.Called(ctx, users)
+	if errs, ok := args.Get(0).([]error); ok {
+		return errs, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockUserRepository) ListAuditEvents(ctx context.Context, userID int, limit, offset int) ([]*userPack.AuditEvent, error) {
+	args := m.Called(ctx, userID, limit, offset)
+	if events, ok := args.Get(0).([]*userPack.AuditEvent); ok {
+		return events, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockUserRepository) GetUserAsOf(ctx context.Context, id int, asOf time.Time) (*userPack.User, error) {
+	args := m.Called(ctx, id, asOf)
+	if u, ok := args.Get(0).(*userPack.User); ok {
+		return u, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockUserRepository) ListUserVersions(ctx context.Context, id int) ([]*userPack.UserVersion, error) {
+	args := m.Called(ctx, id)
+	if v, ok := args.Get(0).([]*userPack.UserVersion); ok {
+		return v, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockUserRepository) GetUserVersion(ctx context.Context, id, version int) (*userPack.UserVersion, error) {
+	args := m.Called(ctx, id, version)
+	if v, ok := args.Get(0).(*userPack.UserVersion); ok {
+		return v, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockUserRepository) VerifyEmail(ctx context.Context, id int, email, tokenID string, expiresAt time.Time) (*userPack.User, error) {
+	args := m.Called(ctx, id, email, tokenID, expiresAt)
+	if u, ok := args.Get(0).(*userPack.User); ok {
+		return u, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockUserRepository) SetUserStatus(ctx context.Context, id int, from, to userPack.UserStatus, reason string) (*userPack.User, error) {
+	args := m.Called(ctx, id, from, to, reason)
+	if u, ok := args.Get(0).(*userPack.User); ok {
+		return u, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockUserRepository) SearchUsers(ctx context.Context, query string, prefix bool, limit int) ([]*userPack.SearchResult, error) {
+	args := m.Called(ctx, query, prefix, limit)
+	if results, ok := args.Get(0).([]*userPack.SearchResult); ok {
+		return results, args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
 func TestCreateUser(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
@@ -203,3 +285,352 @@ func TestEditUser(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, w.Code)
 	mockRepo.AssertExpectations(t)
 }
+
+func TestDeleteUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	mockRepo := new(MockUserRepository)
+	userService := userPack.NewUserService(mockRepo)
+	handler := userPack.NewUserHandler(userService)
+
+	router.DELETE("/user/:id", handler.DeleteUser)
+
+	// Test case: Successful User Deletion
+	mockRepo.On("DeleteUser", mock.Anything, 1).Return(nil)
+
+	req, err := http.NewRequest(http.MethodDelete, "/user/1", nil)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// Test case: User not found
+	mockRepo.On("DeleteUser", mock.Anything, 2).Return(userPack.ErrUserNotFound)
+
+	req, err = http.NewRequest(http.MethodDelete, "/user/2", nil)
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	mockRepo.AssertExpectations(t)
+}
+
+// memoryEventStore holds recorded user events in memory. Events become
+// readable when they are added; notify wakes the listening watcher.
+type memoryEventStore struct {
+	mu     sync.Mutex
+	events []*userPack.UserEvent
+	notify chan struct{}
+}
+
+func newMemoryEventStore() *memoryEventStore {
+	return &memoryEventStore{notify: make(chan struct{}, 1)}
+}
+
+func (s *memoryEventStore) add(txID, id int64, eventType string, user *userPack.User) *userPack.UserEvent {
+	event := &userPack.UserEvent{Position: userPack.EventPosition{TxID: txID, ID: id}, Type: eventType, User: user, Occurred: time.Now()}
+	s.mu.Lock()
+	s.events = append(s.events, event)
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return event
+}
+
+// purge drops the first n events, as the retention would.
+func (s *memoryEventStore) purge(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = s.events[n:]
+}
+
+func (s *memoryEventStore) LastEventPosition(ctx context.Context) (userPack.EventPosition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) == 0 {
+		return userPack.EventPosition{}, nil
+	}
+	return s.events[len(s.events)-1].Position, nil
+}
+
+func (s *memoryEventStore) OldestEventPosition(ctx context.Context) (userPack.EventPosition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.events) == 0 {
+		return userPack.EventPosition{}, nil
+	}
+	return s.events[0].Position, nil
+}
+
+func (s *memoryEventStore) EventsAfter(ctx context.Context, pos userPack.EventPosition) ([]*userPack.UserEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []*userPack.UserEvent
+	for _, event := range s.events {
+		if event.Position.TxID > pos.TxID || (event.Position.TxID == pos.TxID && event.Position.ID > pos.ID) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (s *memoryEventStore) Listen(ctx context.Context, wake func(context.Context) error) error {
+	for {
+		if err := wake(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-s.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *memoryEventStore) PurgeEvents(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+// readEvents reads n Server-Sent Events and returns their ids and types.
+// Heartbeats, which have no id, are skipped.
+func readEvents(t *testing.T, body *bufio.Reader, n int) (ids, types []string) {
+	var id, eventType string
+	for len(ids) < n {
+		line, err := body.ReadString('\n')
+		require.NoError(t, err)
+		switch {
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.TrimSpace(line) == "":
+			if id != "" {
+				ids = append(ids, id)
+				types = append(types, eventType)
+			}
+			id, eventType = "", ""
+		}
+	}
+	return ids, types
+}
+
+func TestWatchUsers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	mockRepo := new(MockUserRepository)
+	userService := userPack.NewUserService(mockRepo)
+	handler := userPack.NewUserHandler(userService)
+
+	router.GET("/users:method", handler.CollectionMethod)
+
+	// Test case: Unknown collection method
+	req, err := http.NewRequest(http.MethodGet, "/users:unknown", nil)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Test case: Change feed not configured
+	req, err = http.NewRequest(http.MethodGet, "/users:watch", nil)
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	store := newMemoryEventStore()
+	john := &userPack.User{ID: 1, Email: "john.doe@example.com", TenantID: reqctx.DefaultTenant}
+	first := store.add(100, 1, userPack.UserEventCreated, john)
+	store.add(100, 2, userPack.UserEventUpdated, john)
+	// A later id in an earlier transaction still comes after the ids of
+	// the transactions before it.
+	store.add(101, 4, userPack.UserEventUpdated, &userPack.User{ID: 2, TenantID: "acme"})
+	third := store.add(102, 3, userPack.UserEventUpdated, john)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watcher := userPack.NewUserWatcher(store, time.Hour)
+	go watcher.Run(ctx)
+	watchRouter := gin.Default()
+	watchRouter.GET("/users:method", userPack.NewUserHandler(userPack.NewUserService(mockRepo, userPack.WithWatcher(watcher))).CollectionMethod)
+	server := httptest.NewServer(watchRouter)
+	t.Cleanup(server.Close)
+
+	watch := func(query string, headers ...string) *http.Response {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/users:watch"+query, nil)
+		require.NoError(t, err)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// Test case: Malformed resume tokens are rejected
+	resp := watch("?resume_token=abc")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Test case: A resume token replays the events after it, in order and
+	// of the tenant of the request only
+	resp = watch("?resume_token=" + first.ResumeToken())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body := bufio.NewReader(resp.Body)
+	ids, types := readEvents(t, body, 2)
+	assert.Equal(t, []string{"100.2", third.ResumeToken()}, ids)
+	assert.Equal(t, []string{userPack.UserEventUpdated, userPack.UserEventUpdated}, types)
+
+	// Test case: Events recorded later are delivered live
+	store.add(103, 5, userPack.UserEventDeleted, john)
+	ids, types = readEvents(t, body, 1)
+	assert.Equal(t, []string{"103.5"}, ids)
+	assert.Equal(t, []string{userPack.UserEventDeleted}, types)
+
+	// Test case: Last-Event-ID resumes the same way
+	resp = watch("", "Last-Event-ID", third.ResumeToken())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	ids, _ = readEvents(t, bufio.NewReader(resp.Body), 1)
+	assert.Equal(t, []string{"103.5"}, ids)
+
+	// Test case: Tokens of events that are no longer retained have expired
+	store.purge(2)
+	resp = watch("?resume_token=" + first.ResumeToken())
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	_, err = userPack.NewUserService(mockRepo, userPack.WithWatcher(watcher)).WatchUsers(ctx, first.ResumeToken())
+	assert.ErrorIs(t, err, userPack.ErrResumeTokenExpired)
+	assert.ErrorIs(t, err, userPack.ErrInvalidResumeToken)
+}
+
+func TestListUserAuditEvents(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	router.Use(reqctx.GinMiddleware(trustedProxy()))
+
+	mockRepo := new(MockUserRepository)
+	userService := userPack.NewUserService(mockRepo)
+	handler := userPack.NewUserHandler(userService)
+
+	router.GET("/user/:id/audit", handler.ListUserAuditEvents)
+
+	newEvents := func() []*userPack.AuditEvent {
+		return []*userPack.AuditEvent{{
+			ID:     1,
+			UserID: 1,
+			Action: userPack.AuditActionUpdate,
+			Actor:  "support-agent",
+			Source: reqctx.SourceREST,
+			Changes: map[string]userPack.FieldChange{
+				"email": {Before: "john.doe@example.com", After: "jane.doe@example.com"},
+				"age":   {Before: 30, After: 31},
+			},
+		}}
+	}
+	mockRepo.On("ListAuditEvents", mock.Anything, 1, 50, 0).Return(newEvents(), nil).Once()
+	mockRepo.On("ListAuditEvents", mock.Anything, 1, 50, 0).Return(newEvents(), nil).Once()
+
+	type response struct {
+		Events []*userPack.AuditEvent `json:"events"`
+	}
+
+	// Test case: Non-admin readers get masked personal data
+	req, err := http.NewRequest(http.MethodGet, "/user/1/audit", nil)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get(reqctx.RequestIDHeader))
+	var masked response
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &masked))
+	require.Len(t, masked.Events, 1)
+	assert.Equal(t, userPack.FieldChange{Before: "j***@example.com", After: "j***@example.com"}, masked.Events[0].Changes["email"])
+	assert.EqualValues(t, 31, masked.Events[0].Changes["age"].After)
+
+	// Test case: Admins see the full diff
+	req, err = http.NewRequest(http.MethodGet, "/user/1/audit", nil)
+	require.NoError(t, err)
+	req.RemoteAddr = proxyAddr
+	req.Header.Set(reqctx.ActorRolesHeader, reqctx.RoleAdmin)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var full response
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &full))
+	assert.Equal(t, "jane.doe@example.com", full.Events[0].Changes["email"].After)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestUserHistory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	mockRepo := new(MockUserRepository)
+	userService := userPack.NewUserService(mockRepo)
+	handler := userPack.NewUserHandler(userService)
+
+	router.GET("/user/:id", handler.GetUser)
+	router.POST("/user/:id/versions/:version/restore", handler.RestoreUserVersion)
+
+	asOf := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	oldUser := &userPack.User{ID: 1, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Age: 30}
+
+	// Test case: Read as of a timestamp
+	mockRepo.On("GetUserAsOf", mock.Anything, 1, asOf).Return(oldUser, nil)
+
+	req, err := http.NewRequest(http.MethodGet, "/user/1?as_of=2024-05-01T12:00:00Z", nil)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Test case: Malformed timestamp
+	req, err = http.NewRequest(http.MethodGet, "/user/1?as_of=yesterday", nil)
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Test case: Restore applies the old version as an update
+	mockRepo.On("GetUserVersion", mock.Anything, 1, 2).Return(&userPack.UserVersion{Version: 2, User: oldUser}, nil)
+	mockRepo.On("UpdateUser", mock.Anything, 1, oldUser).Return(nil)
+	mockRepo.On("GetUser", mock.Anything, 1).Return(oldUser, nil)
+
+	req, err = http.NewRequest(http.MethodPost, "/user/1/versions/2/restore", nil)
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Test case: Unknown version
+	mockRepo.On("GetUserVersion", mock.Anything, 1, 9).Return(nil, userPack.ErrVersionNotFound)
+
+	req, err = http.NewRequest(http.MethodPost, "/user/1/versions/9/restore", nil)
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	mockRepo.AssertExpectations(t)
+}
@@ -0,0 +1,109 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	userPack "user-api/internal/user-pack"
+)
+
+func searchResults(users ...*userPack.User) []*userPack.SearchResult {
+	results := make([]*userPack.SearchResult, len(users))
+	for i, user := range users {
+		results[i] = &userPack.SearchResult{User: user, Rank: 1 / float64(i+1)}
+	}
+	return results
+}
+
+func TestSearchUsers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mockRepo := new(MockUserRepository)
+	handler := userPack.NewUserHandler(userPack.NewUserService(mockRepo))
+	r := gin.New()
+	r.GET("/users:method", handler.CollectionMethod)
+
+	john := &userPack.User{ID: 1, Firstname: "John", Lastname: "O'Doe", Email: "john.doe@example.com"}
+	jon := &userPack.User{ID: 2, Firstname: "Jon", Lastname: "Smith", Email: "jsmith@example.com"}
+	mockRepo.On("SearchUsers", mock.Anything, "jonh doe", false, userPack.DefaultSearchResults).
+		Return(searchResults(john, jon), nil).Once()
+
+	w := serve(r, http.MethodGet, "/users:search?q=+jonh+doe+", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Results []struct {
+			User       userPack.User     `json:"user"`
+			Rank       float64           `json:"rank"`
+			Highlights map[string]string `json:"highlights"`
+		} `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Results, 2)
+	assert.Equal(t, 1, resp.Results[0].User.ID)
+	assert.Greater(t, resp.Results[0].Rank, resp.Results[1].Rank)
+	// "jonh" is a typo of John; doe is a whole word of the name and the email.
+	assert.Equal(t, map[string]string{
+		"firstname": "<mark>John</mark>",
+		"lastname":  "O&#39;<mark>Doe</mark>",
+		"email":     "<mark>john</mark>.<mark>doe</mark>@example.com",
+	}, resp.Results[0].Highlights)
+	assert.Equal(t, map[string]string{"firstname": "<mark>Jon</mark>"}, resp.Results[1].Highlights)
+
+	mockRepo.On("SearchUsers", mock.Anything, "jo sm", true, 5).Return(searchResults(jon), nil).Once()
+	w = serve(r, http.MethodGet, "/users:search?q=jo+sm&prefix=true&limit=5", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	resp.Results = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Results, 1)
+	assert.Equal(t, map[string]string{
+		"firstname": "<mark>Jo</mark>n",
+		"lastname":  "<mark>Sm</mark>ith",
+	}, resp.Results[0].Highlights)
+
+	mockRepo.On("SearchUsers", mock.Anything, "nobody", false, userPack.DefaultSearchResults).Return(nil, nil).Once()
+	w = serve(r, http.MethodGet, "/users:search?q=nobody", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"results": []}`, w.Body.String())
+
+	for _, query := range []string{"", "?q=", "?q=%40.-", "?q=john&limit=0", "?q=john&limit=101", "?q=john&prefix=maybe"} {
+		w = serve(r, http.MethodGet, "/users:search"+query, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+	mockRepo.AssertExpectations(t)
+}
+
+func TestSearchUsersGateway(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	r := newGatewayRouter(t, mockRepo)
+	john := &userPack.User{ID: 1, Firstname: "John", Lastname: "Doe", Email: "john.doe@example.com", Status: userPack.StatusActive}
+	mockRepo.On("SearchUsers", mock.Anything, "doe", true, userPack.MaxSearchResults).Return(searchResults(john), nil)
+
+	w := serve(r, http.MethodGet, "/v1/users:search?query=doe&prefix=true&limit=100", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Results []struct {
+			User       map[string]interface{} `json:"user"`
+			Rank       float64                `json:"rank"`
+			Highlights map[string]string      `json:"highlights"`
+		} `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Results, 1)
+	assert.Equal(t, "john.doe@example.com", resp.Results[0].User["email"])
+	assert.Equal(t, 1.0, resp.Results[0].Rank)
+	assert.Equal(t, map[string]string{
+		"lastname": "<mark>Doe</mark>",
+		"email":    "john.<mark>doe</mark>@example.com",
+	}, resp.Results[0].Highlights)
+
+	w = serve(r, http.MethodGet, "/v1/users:search?query=%20", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(r, http.MethodGet, "/v1/users:search?query=doe&limit=101", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	mockRepo.AssertExpectations(t)
+}
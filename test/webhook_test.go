@@ -0,0 +1,210 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	authPack "user-api/internal/auth-pack"
+	"user-api/internal/outbox"
+	"user-api/internal/reqctx"
+	webhookPack "user-api/internal/webhook-pack"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type MockWebhookRepository struct {
+	mock.Mock
+	webhookPack.WebhookRepository
+
+	sub      *webhookPack.Subscription
+	delivery *webhookPack.Delivery
+	results  []webhookPack.DeliveryResult
+	calls    []string
+	lease    time.Duration
+}
+
+func (m *MockWebhookRepository) CreateSubscription(ctx context.Context, sub *webhookPack.Subscription) error {
+	args := m.Called(ctx, sub)
+	return args.Error(0)
+}
+
+func (m *MockWebhookRepository) ClaimDueDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*webhookPack.ClaimedDelivery, error) {
+	m.calls = append(m.calls, "claim")
+	m.lease = lease
+	return []*webhookPack.ClaimedDelivery{{Subscription: m.sub, Delivery: m.delivery}}, nil
+}
+
+func (m *MockWebhookRepository) RecordDeliveries(ctx context.Context, claimed []*webhookPack.ClaimedDelivery, results []webhookPack.DeliveryResult) error {
+	m.calls = append(m.calls, "record")
+	m.results = append(m.results, results...)
+	m.delivery.Attempts++
+	return nil
+}
+
+func newDispatcher(repo webhookPack.WebhookRepository) *webhookPack.Dispatcher {
+	return webhookPack.NewDispatcher(repo, webhookPack.DispatcherConfig{
+		BatchSize:   10,
+		Timeout:     time.Second,
+		MinBackoff:  time.Minute,
+		MaxBackoff:  time.Hour,
+		MaxAttempts: 2,
+		// The receivers of the tests listen on loopback.
+		AllowPrivateNetworks: true,
+	})
+}
+
+func TestCreateWebhookSubscription(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+
+	mockRepo := new(MockWebhookRepository)
+	handler := webhookPack.NewWebhookHandler(webhookPack.NewWebhookService(mockRepo))
+	mockUserRepo := new(MockUserRepository)
+	mockAuthRepo := new(MockAuthRepository)
+	authService := newAuthService(t, mockAuthRepo, mockUserRepo, authPack.AlgorithmEdDSA)
+
+	router.POST("/webhooks", authPack.NewAuthHandler(authService).RequireAdmin("Only admins can manage webhooks"), handler.CreateSubscription)
+
+	user := refreshAs(t, authService, mockAuthRepo, mockUserRepo, 1).AccessToken
+	admin := refreshAs(t, authService, mockAuthRepo, mockUserRepo, 9, reqctx.RoleAdmin).AccessToken
+	create := func(token string, body gin.H) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, err := http.NewRequest(http.MethodPost, "/webhooks", bytes.NewBuffer(data))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	valid := gin.H{"url": "https://partner.example.com/hook", "event_types": []string{outbox.EventUserCreated}}
+
+	// Test case: Only admins manage subscriptions
+	assert.Equal(t, http.StatusUnauthorized, create("", valid).Code)
+	assert.Equal(t, http.StatusForbidden, create(user, valid).Code)
+
+	// Test case: Unknown event type
+	w := create(admin, gin.H{"url": "https://partner.example.com/hook", "event_types": []string{"user.exploded"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Test case: Receivers inside the network are refused
+	for _, url := range []string{
+		"http://127.0.0.1:8080/hook", "http://localhost/hook", "http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data", "http://10.0.0.5/hook", "https://192.168.1.1/hook", "http://172.16.0.1/hook",
+	} {
+		w := create(admin, gin.H{"url": url, "event_types": []string{outbox.EventUserCreated}})
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+	}
+
+	// Test case: Successful creation returns a generated secret once
+	mockRepo.On("CreateSubscription", mock.Anything, mock.MatchedBy(func(sub *webhookPack.Subscription) bool {
+		return sub.Active && sub.Secret != ""
+	})).Return(nil)
+
+	w = create(admin, valid)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var sub webhookPack.Subscription
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sub))
+	assert.NotEmpty(t, sub.Secret)
+	mockRepo.AssertExpectations(t)
+}
+
+func TestDispatchWebhook(t *testing.T) {
+	const secret = "whsec_test"
+
+	var received []*http.Request
+	var bodies [][]byte
+	status := http.StatusOK
+	var repo *MockWebhookRepository
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo.calls = append(repo.calls, "send")
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	repo = &MockWebhookRepository{
+		sub: &webhookPack.Subscription{ID: 1, URL: receiver.URL, Secret: secret, Active: true},
+		delivery: &webhookPack.Delivery{
+			ID:        7,
+			MessageID: 42,
+			EventType: outbox.EventUserCreated,
+			Payload:   json.RawMessage(`{"id":1,"email":"john.doe@example.com"}`),
+			Status:    webhookPack.DeliveryPending,
+		},
+	}
+	dispatcher := newDispatcher(repo)
+
+	// Test case: Signed delivery accepted by the receiver
+	_, err := dispatcher.DispatchOnce(context.Background())
+	require.NoError(t, err)
+
+	require.Len(t, received, 1)
+	req := received[0]
+	assert.Equal(t, outbox.EventUserCreated, req.Header.Get(webhookPack.EventHeader))
+	assert.Equal(t, "7", req.Header.Get(webhookPack.DeliveryHeader))
+	assert.NoError(t, webhookPack.VerifySignature(secret, req.Header.Get(webhookPack.SignatureHeader),
+		req.Header.Get(webhookPack.TimestampHeader), bodies[0], time.Minute))
+	assert.Error(t, webhookPack.VerifySignature("wrong", req.Header.Get(webhookPack.SignatureHeader),
+		req.Header.Get(webhookPack.TimestampHeader), bodies[0], time.Minute))
+
+	var event webhookPack.Event
+	require.NoError(t, json.Unmarshal(bodies[0], &event))
+	assert.EqualValues(t, 42, event.ID)
+	assert.Equal(t, webhookPack.DeliverySucceeded, repo.results[0].Status)
+
+	// Test case: The delivery is claimed before it is sent, for longer than
+	// sending it may take, and the result recorded afterwards
+	assert.Equal(t, []string{"claim", "send", "record"}, repo.calls)
+	assert.Greater(t, repo.lease, 10*time.Second)
+
+	// Test case: Receiver errors are retried with backoff, then dead-lettered
+	status = http.StatusInternalServerError
+	repo.delivery.Attempts = 0
+
+	_, err = dispatcher.DispatchOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, webhookPack.DeliveryFailed, repo.results[1].Status)
+	assert.Equal(t, http.StatusInternalServerError, repo.results[1].ResponseStatus)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), repo.results[1].NextAttemptAt, 5*time.Second)
+
+	_, err = dispatcher.DispatchOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, webhookPack.DeliveryDead, repo.results[2].Status)
+}
+
+func TestDispatchWebhookPrivateAddress(t *testing.T) {
+	var received int
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer receiver.Close()
+
+	// Whatever got a private address past validation, such as a host name
+	// resolving to one, is refused when the dispatcher dials.
+	repo := &MockWebhookRepository{
+		sub:      &webhookPack.Subscription{ID: 1, URL: receiver.URL, Secret: "whsec_test", Active: true},
+		delivery: &webhookPack.Delivery{ID: 7, MessageID: 42, EventType: outbox.EventUserCreated, Payload: json.RawMessage(`{}`)},
+	}
+	dispatcher := webhookPack.NewDispatcher(repo, webhookPack.DispatcherConfig{BatchSize: 10, Timeout: time.Second, MinBackoff: time.Minute, MaxBackoff: time.Hour, MaxAttempts: 5})
+
+	_, err := dispatcher.DispatchOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, received)
+	require.Len(t, repo.results, 1)
+	assert.Equal(t, webhookPack.DeliveryFailed, repo.results[0].Status)
+	assert.Contains(t, repo.results[0].Error, "private addresses")
+}